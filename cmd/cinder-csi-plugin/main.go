@@ -17,24 +17,73 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+	"k8s.io/cloud-provider-openstack/pkg/version"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog"
 )
 
 var (
-	endpoint    string
-	nodeID      string
-	cloudconfig string
-	cluster     string
+	endpoint      string
+	nodeID        string
+	cloudconfig   string
+	cluster       string
+	clusterID     string
+	probeEnabled  bool
+	probeInterval time.Duration
+	mode          string
+	driverName    string
+
+	operationTimeout time.Duration
+
+	strictOwnership    bool
+	managedVolumesOnly bool
+	protectBootVolumes bool
+	strictParameters   bool
+
+	defaultFsType    string
+	supportedFsTypes []string
+
+	imageMetadataKeys []string
+
+	mountOptionsDenylist []string
+
+	enableCapabilities  []string
+	disableCapabilities []string
+
+	leaderElection bool
+	leaderOpts     cinder.LeaderElectionOpts
+
+	topologyOpts         cinder.TopologyOpts
+	topologySegmentsFile string
+
+	metricsAddress string
+	debugAddress   string
+
+	auditLogPath       string
+	auditLogMaxSize    int64
+	auditLogMaxBackups int
+
+	probeVolumeInterval time.Duration
+	probeVolumeTimeout  time.Duration
+	xfsFormatOptions    []string
+	kernelLogInErrors   bool
+
+	failoverHost      string
+	failoverBackendID string
+	failoverConfirm   bool
 )
 
 func init() {
@@ -46,8 +95,9 @@ func main() {
 	flag.CommandLine.Parse([]string{})
 
 	cmd := &cobra.Command{
-		Use:   "Cinder",
-		Short: "CSI based Cinder driver",
+		Use:     "Cinder",
+		Short:   "CSI based Cinder driver",
+		Version: version.String(),
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
 			// Glog requires this otherwise it complains.
 			flag.CommandLine.Parse(nil)
@@ -73,16 +123,76 @@ func main() {
 
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 
-	cmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "node id")
-	cmd.MarkPersistentFlagRequired("nodeid")
+	cmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "Instance ID of the node, defaults to the NODE_ID environment variable. Looked up from the cloud-init data or the metadata service if empty or not a UUID.")
 
-	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
-	cmd.MarkPersistentFlagRequired("endpoint")
+	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint, required to run the driver")
 
-	cmd.PersistentFlags().StringVar(&cloudconfig, "cloud-config", "", "CSI driver cloud config")
-	cmd.MarkPersistentFlagRequired("cloud-config")
+	cmd.PersistentFlags().StringVar(&cloudconfig, "cloud-config", "", "CSI driver cloud config, required unless running in node mode")
 
 	cmd.PersistentFlags().StringVar(&cluster, "cluster", "", "The identifier of the cluster that the plugin is running in.")
+	cmd.PersistentFlags().StringVar(&clusterID, "cluster-id", "", "ID stamped on the volumes and snapshots created by the plugin, defaults to --cluster.")
+	cmd.PersistentFlags().BoolVar(&strictOwnership, "strict-ownership", false, "Refuse to delete volumes stamped with the ID of another cluster.")
+	cmd.PersistentFlags().BoolVar(&managedVolumesOnly, "delete-managed-volumes-only", false, "Refuse to delete volumes that were not created by the plugin, e.g. statically provisioned ones.")
+	cmd.PersistentFlags().BoolVar(&protectBootVolumes, "protect-boot-volumes", false, "Refuse to delete or detach bootable volumes attached as the root disk of an instance, e.g. /dev/vda.")
+	cmd.PersistentFlags().BoolVar(&strictParameters, "strict-parameters", false, "Refuse to create volumes from storage classes with unknown parameters, instead of ignoring them.")
+
+	cmd.PersistentFlags().StringVar(&defaultFsType, "default-fstype", cinder.DefaultFsType, "Filesystem volumes are formatted with when neither the volume capability nor the storage class sets one.")
+	cmd.PersistentFlags().StringSliceVar(&supportedFsTypes, "supported-fstypes", cinder.DefaultSupportedFsTypes, "Filesystems the plugin formats volumes with, other types are refused by CreateVolume and NodeStageVolume.")
+
+	cmd.PersistentFlags().StringSliceVar(&imageMetadataKeys, "image-metadata-keys", cinder.DefaultImageMetadataKeys, "Image metadata keys storage classes may set on their volumes with imageMetadata/<key> parameters, e.g. hw_disk_bus. None if empty.")
+	cmd.PersistentFlags().StringSliceVar(&mountOptionsDenylist, "mount-options-denylist", nil, "Mount options volumes are never mounted with, dropped from their mount flags with a warning, e.g. discard,_netdev")
+
+	cmd.PersistentFlags().StringSliceVar(&enableCapabilities, "enable-capabilities", nil, "Optional capabilities advertised whether the probe of the cloud at startup finds them supported or not. One of snapshots, expansion, online-expansion or capacity.")
+	cmd.PersistentFlags().StringSliceVar(&disableCapabilities, "disable-capabilities", nil, "Optional capabilities never advertised, e.g. snapshots for a backend that can't take them. One of snapshots, expansion, online-expansion or capacity.")
+
+	cmd.PersistentFlags().BoolVar(&probeEnabled, "probe-connectivity", true, "Check the connectivity to OpenStack, the node ID and the executables formatting the volumes when probed for readiness.")
+	cmd.PersistentFlags().StringVar(&driverName, "driver-name", cinder.DefaultDriverName, "Name under which the CSI driver is registered.")
+
+	cmd.PersistentFlags().StringVar(&topologyOpts.ZoneKey, "topology-zone-key", "", "Topology key of the availability zone, topology.<driver name>/zone if empty. Changing it on an existing cluster makes the existing volumes unschedulable.")
+	cmd.PersistentFlags().StringVar(&topologyOpts.RegionKey, "topology-region-key", "", "Topology key under which nodes report the region of the cloud config, e.g. topology.cinder.csi.openstack.org/region. Not reported if empty.")
+	cmd.PersistentFlags().StringVar(&topologySegmentsFile, "topology-segments-file", "", "File of additional key=value topology segments reported by the nodes.")
+
+	cmd.PersistentFlags().BoolVar(&leaderElection, "leader-election", false, "Only serve the controller service while holding a Lease, so that several controller plugin replicas can run.")
+	cmd.PersistentFlags().StringVar(&leaderOpts.Namespace, "leader-election-namespace", "kube-system", "Namespace of the leader election Lease.")
+	cmd.PersistentFlags().StringVar(&leaderOpts.LeaseName, "leader-election-lease-name", "", "Name of the leader election Lease, derived from the driver name if empty.")
+	cmd.PersistentFlags().DurationVar(&leaderOpts.LeaseDuration, "leader-election-lease-duration", 15*time.Second, "Duration non-leaders wait before trying to acquire the Lease.")
+	cmd.PersistentFlags().DurationVar(&leaderOpts.RenewDeadline, "leader-election-renew-deadline", 10*time.Second, "Duration the leader retries renewing the Lease before giving it up.")
+	cmd.PersistentFlags().DurationVar(&leaderOpts.RetryPeriod, "leader-election-retry-period", 2*time.Second, "Interval between two attempts to acquire or renew the Lease.")
+
+	cmd.PersistentFlags().StringVar(&mode, "mode", cinder.ModeAll, "Services to run: all, controller or node.")
+
+	cmd.PersistentFlags().DurationVar(&probeInterval, "probe-interval", 30*time.Second, "Time during which the result of a readiness check is reused.")
+
+	cmd.PersistentFlags().DurationVar(&operationTimeout, "operation-timeout", 0, "Maximum duration of the controller and node calls, bounding their waits for OpenStack and the devices on the node; the deadline of the call if earlier. Set it below the --timeout of the sidecars. Only bounded by the deadline of the call and the backoffs of the cloud config if 0.")
+
+	cmd.PersistentFlags().DurationVar(&probeVolumeInterval, "probe-volume-interval", time.Second, "Interval between the rescans of the buses while the node waits for the device of a volume.")
+	cmd.PersistentFlags().DurationVar(&probeVolumeTimeout, "probe-volume-timeout", time.Minute, "Time the node rescans the buses for the device of a volume, within the deadline of the NodeStageVolume call.")
+
+	cmd.PersistentFlags().StringSliceVar(&xfsFormatOptions, "xfs-format-options", nil, "Metadata features mkfs.xfs formats new xfs volumes with, e.g. reflink=0 for nodes with kernels that can't mount reflink filesystems. One of crc, finobt, reflink or rmapbt set to 0 or 1, the mkfs.xfs defaults if empty.")
+
+	cmd.PersistentFlags().BoolVar(&kernelLogInErrors, "kernel-log-in-errors", false, "Append the last kernel log lines about the device to the errors of failed mounts and formats. Reading /dev/kmsg needs CAP_SYSLOG, e.g. a privileged node plugin.")
+
+	cmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", "", "Address on which the Prometheus metrics are served under /metrics, e.g. :9808. Not served if empty.")
+	cmd.PersistentFlags().StringVar(&debugAddress, "debug-address", "", "Address on which the pprof profiles and the expvar variables are served under /debug/, e.g. :6060. Only listens on localhost unless a host is given, shares the listener of --metrics-address on the same port. Not served if empty.")
+
+	cmd.PersistentFlags().StringVar(&auditLogPath, "audit-log-path", "", "File the controller appends a JSON line to for every volume it creates, deletes, attaches or detaches. Not written if empty.")
+	cmd.PersistentFlags().Int64Var(&auditLogMaxSize, "audit-log-max-size", 100*1024*1024, "Size in bytes above which the audit log is rotated.")
+	cmd.PersistentFlags().IntVar(&auditLogMaxBackups, "audit-log-max-backups", 5, "Number of rotated audit logs kept, as <audit-log-path>.1 to <audit-log-path>.<n>.")
+
+	failoverCmd := &cobra.Command{
+		Use:   "failover-replication",
+		Short: "Fail the replicated volumes of a Cinder backend over to their replica",
+		Long:  "Fail the replicated volumes of a cinder-volume host over to their replica with the credentials of --cloud-config, which must be those of an admin of Cinder. The volumes are failing-over until Cinder is done, the driver waits for them meanwhile.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			failover()
+		},
+	}
+	failoverCmd.Flags().StringVar(&failoverHost, "host", "", "cinder-volume host whose replicated volumes fail over, e.g. cinder@ceph.")
+	failoverCmd.MarkFlagRequired("host")
+	failoverCmd.Flags().StringVar(&failoverBackendID, "backend-id", "", "Backend the volumes fail over to, among the replication_device of the host. The one picked by Cinder if empty.")
+	failoverCmd.Flags().BoolVar(&failoverConfirm, "confirm", false, "Fail over, the command only prints what it would do otherwise.")
+	cmd.AddCommand(failoverCmd)
 
 	logs.InitLogs()
 	defer logs.FlushLogs()
@@ -96,12 +206,76 @@ func main() {
 }
 
 func handle() {
+	if endpoint == "" {
+		klog.Fatal("--endpoint is required")
+	}
+	if err := cinder.ValidateMode(mode); err != nil {
+		klog.Fatal(err)
+	}
+	if mode != cinder.ModeNode && cloudconfig == "" {
+		klog.Fatalf("--cloud-config is required in %s mode", mode)
+	}
+
+	if nodeID == "" {
+		nodeID = os.Getenv("NODE_ID")
+		if nodeID != "" {
+			klog.V(2).Infof("--nodeid not set, using the NODE_ID environment variable %q", nodeID)
+		}
+	}
+
+	if clusterID != "" {
+		cluster = clusterID
+	}
+
+	openstack.RegisterMetrics()
+	cinder.RegisterMetrics()
+	serveHTTP(metricsAddress, debugAddress)
+
 	d := cinder.NewDriver(nodeID, endpoint, cluster)
+	if err := d.SetDriverName(driverName); err != nil {
+		klog.Fatal(err)
+	}
 
-	//Intiliaze mount
-	mount, err := mount.GetMountProvider()
-	if err != nil {
-		klog.V(3).Infof("Failed to GetMountProvider: %v", err)
+	if topologyOpts.RegionKey != "" {
+		// the cloud config is only optional in node mode
+		if cloudconfig == "" {
+			klog.Fatalf("--topology-region-key needs --cloud-config to read the region from in %s mode", mode)
+		}
+		cfg, _, err := openstack.GetConfigFromFile(cloudconfig)
+		if err != nil {
+			klog.Fatalf("Failed to read the region from the cloud config: %v", err)
+		}
+		topologyOpts.Region = cfg.Global.Region
+	}
+	if topologySegmentsFile != "" {
+		segments, err := cinder.ReadTopologySegments(topologySegmentsFile)
+		if err != nil {
+			klog.Fatalf("Failed to read topology segments: %v", err)
+		}
+		topologyOpts.Segments = segments
+	}
+	if err := d.SetTopologyOpts(topologyOpts); err != nil {
+		klog.Fatal(err)
+	}
+	d.SetProbeOptions(probeEnabled, probeInterval)
+	if err := d.SetOperationTimeout(operationTimeout); err != nil {
+		klog.Fatal(err)
+	}
+	d.SetStrictOwnership(strictOwnership)
+	d.SetManagedVolumesOnly(managedVolumesOnly)
+	d.SetProtectBootVolumes(protectBootVolumes)
+	d.SetStrictParameters(strictParameters)
+	if err := d.SetFsTypes(defaultFsType, supportedFsTypes); err != nil {
+		klog.Fatal(err)
+	}
+	if err := d.SetImageMetadataKeys(imageMetadataKeys); err != nil {
+		klog.Fatal(err)
+	}
+	if err := d.SetMountOptionsDenylist(mountOptionsDenylist); err != nil {
+		klog.Fatal(err)
+	}
+	if err := d.SetCapabilityOverrides(enableCapabilities, disableCapabilities); err != nil {
+		klog.Fatal(err)
 	}
 
 	//Intiliaze Metadatda
@@ -110,15 +284,128 @@ func handle() {
 		klog.V(3).Infof("Failed to GetMetadataProvider: %v", err)
 	}
 
-	// Initiliaze cloud
+	if mode != cinder.ModeNode {
+		// Identify the requests of the driver, with the node when it also runs the node service
+		userAgentNode := ""
+		if mode == cinder.ModeAll {
+			userAgentNode = nodeID
+		}
+		openstack.SetUserAgentInfo(cluster, userAgentNode)
+
+		// Initiliaze cloud
+		openstack.InitOpenStackProvider(cloudconfig)
+		cloud, err := openstack.GetOpenStackProvider()
+		if err != nil {
+			klog.Fatalf("Failed to GetOpenStackProvider: %v", err)
+		}
+
+		d.SetupControllerService(cloud, metadatda)
+		d.ProbeCapabilities(cloud)
+
+		if auditLogPath != "" {
+			if err := d.EnableAuditLog(auditLogPath, auditLogMaxSize, auditLogMaxBackups); err != nil {
+				klog.Fatal(err)
+			}
+		}
+
+		if leaderElection {
+			if err := d.EnableLeaderElection(leaderOpts); err != nil {
+				klog.Fatalf("Failed to enable leader election: %v", err)
+			}
+		}
+	}
+
+	if mode != cinder.ModeController {
+		if cloudconfig != "" {
+			cfg, _, err := openstack.GetConfigFromFile(cloudconfig)
+			if err != nil {
+				klog.Fatalf("Failed to read the cloud config: %v", err)
+			}
+			mount.SetDevicePathBackoff(cfg.BlockStorage.DevicePathBackoff())
+			d.SetTrustDevicePath(cfg.BlockStorage.TrustDevicePath)
+		}
+
+		if err := mount.SetProbeVolumeTimeouts(probeVolumeInterval, probeVolumeTimeout); err != nil {
+			klog.Fatal(err)
+		}
+		if err := mount.SetXFSFormatOptions(xfsFormatOptions); err != nil {
+			klog.Fatal(err)
+		}
+		mount.SetKernelLogInErrors(kernelLogInErrors)
+
+		//Intiliaze mount
+		mount, err := mount.GetMountProvider()
+		if err != nil {
+			klog.Fatalf("Failed to GetMountProvider: %v", err)
+		}
+
+		if err := d.SetupNodeService(mount, metadatda); err != nil {
+			klog.Fatalf("Failed to set up the node service: %v", err)
+		}
+	}
+
+	d.Run()
+}
+
+// failover fails the replicated volumes of --host over to --backend-id, only
+// printing what it would do without --confirm
+func failover() {
+	if cloudconfig == "" {
+		klog.Fatal("--cloud-config is required to fail over")
+	}
+	backend := failoverBackendID
+	if backend == "" {
+		backend = "the one picked by Cinder"
+	}
+	if !failoverConfirm {
+		fmt.Printf("Would fail the replicated volumes of host %s over to backend %s, run again with --confirm to fail over\n", failoverHost, backend)
+		return
+	}
+
+	openstack.SetUserAgentInfo(cluster, "")
 	openstack.InitOpenStackProvider(cloudconfig)
 	cloud, err := openstack.GetOpenStackProvider()
-
 	if err != nil {
-		klog.V(3).Infof("Failed to GetOpenStackProvider: %v", err)
-		return
+		klog.Fatalf("Failed to GetOpenStackProvider: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := cloud.FailoverReplication(ctx, failoverHost, failoverBackendID); err != nil {
+		klog.Fatal(err)
 	}
+	fmt.Printf("Failing the replicated volumes of host %s over to backend %s\n", failoverHost, backend)
+}
 
-	d.SetupDriver(cloud, mount, metadatda)
-	d.Run()
+// serveHTTP serves the Prometheus metrics and the debug handlers until the
+// process exits, on one listener when they share their port
+func serveHTTP(metricsAddress, debugAddress string) {
+	var metricsMux *http.ServeMux
+	if metricsAddress != "" {
+		metricsMux = http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+	}
+
+	if debugAddress != "" {
+		address, err := cinder.DebugListenAddress(debugAddress)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		if metricsMux != nil && cinder.SamePort(metricsAddress, address) {
+			klog.Infof("Serving the debug handlers with the metrics on %s", metricsAddress)
+			cinder.RegisterDebugHandlers(metricsMux)
+		} else {
+			mux := http.NewServeMux()
+			cinder.RegisterDebugHandlers(mux)
+			go serve("debug handlers", address, mux)
+		}
+	}
+
+	if metricsMux != nil {
+		go serve("metrics", metricsAddress, metricsMux)
+	}
+}
+
+func serve(name, address string, handler http.Handler) {
+	klog.Infof("Serving %s on %s", name, address)
+	klog.Fatalf("Failed to serve %s on %s: %v", name, address, http.ListenAndServe(address, handler))
 }
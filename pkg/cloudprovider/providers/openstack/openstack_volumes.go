@@ -42,6 +42,7 @@ import (
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"k8s.io/cloud-provider-openstack/pkg/util/blockdevice"
 	"k8s.io/cloud-provider-openstack/pkg/util/metadata"
 	"k8s.io/klog"
 )
@@ -484,24 +485,17 @@ func (os *OpenStack) CreateVolume(name string, size int, vtype, availability str
 
 // GetDevicePathBySerialID returns the path of an attached block storage volume, specified by its id.
 func (os *OpenStack) GetDevicePathBySerialID(volumeID string) string {
-	// Build a list of candidate device paths.
 	// Certain Nova drivers will set the disk serial ID, including the Cinder volume id.
-	candidateDeviceNodes := []string{
-		// KVM
-		fmt.Sprintf("virtio-%s", volumeID[:20]),
-		// KVM virtio-scsi
-		fmt.Sprintf("scsi-0QEMU_QEMU_HARDDISK_%s", volumeID[:20]),
-		// ESXi
-		fmt.Sprintf("wwn-0x%s", strings.Replace(volumeID, "-", "", -1)),
-	}
+	candidateDevicePaths := blockdevice.SerialIDPaths(volumeID)
 
-	files, _ := ioutil.ReadDir("/dev/disk/by-id/")
+	files, _ := ioutil.ReadDir(blockdevice.ByIDDir)
 
 	for _, f := range files {
-		for _, c := range candidateDeviceNodes {
-			if c == f.Name() {
-				klog.V(4).Infof("Found disk attached as %q; full devicepath: %s\n", f.Name(), path.Join("/dev/disk/by-id/", f.Name()))
-				return path.Join("/dev/disk/by-id/", f.Name())
+		devicePath := path.Join(blockdevice.ByIDDir, f.Name())
+		for _, c := range candidateDevicePaths {
+			if c == devicePath {
+				klog.V(4).Infof("Found disk attached as %q; full devicepath: %s\n", f.Name(), devicePath)
+				return devicePath
 			}
 		}
 	}
@@ -0,0 +1,255 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/klog"
+)
+
+// auditedMethods are the controller calls recorded in the audit log, the
+// ones creating or deleting volumes and their attachments
+var auditedMethods = map[string]bool{
+	"CreateVolume":              true,
+	"DeleteVolume":              true,
+	"ControllerPublishVolume":   true,
+	"ControllerUnpublishVolume": true,
+}
+
+// Outcomes of the audited calls
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// auditRecord is a line of the audit log. The fields not known for the call,
+// e.g. the ID of a volume that failed to be created, are left out.
+type auditRecord struct {
+	Time            string  `json:"time"`
+	RequestID       string  `json:"request_id"`
+	Operation       string  `json:"operation"`
+	Outcome         string  `json:"outcome"`
+	Code            string  `json:"code"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+
+	VolumeID         string `json:"volume_id,omitempty"`
+	VolumeName       string `json:"volume_name,omitempty"`
+	SizeBytes        int64  `json:"size_bytes,omitempty"`
+	VolumeType       string `json:"volume_type,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	NodeID           string `json:"node_id,omitempty"`
+
+	// passed by external-provisioner with --extra-create-metadata
+	PVCName      string `json:"pvc_name,omitempty"`
+	PVCNamespace string `json:"pvc_namespace,omitempty"`
+	PVName       string `json:"pv_name,omitempty"`
+}
+
+// auditLog writes a JSON line to out for every completed audited call
+type auditLog struct {
+	mux     sync.Mutex
+	out     io.Writer
+	now     func() time.Time
+	zoneKey string
+}
+
+// EnableAuditLog records the volumes the controller creates, deletes, attaches
+// and detaches in the file at path, one JSON line per call. The file is
+// rotated once it reaches maxSize bytes, keeping maxBackups of the previous
+// ones.
+func (d *CinderDriver) EnableAuditLog(path string, maxSize int64, maxBackups int) error {
+	if maxSize <= 0 {
+		return fmt.Errorf("invalid --audit-log-max-size %d, must be positive", maxSize)
+	}
+	if maxBackups < 0 {
+		return fmt.Errorf("invalid --audit-log-max-backups %d, must not be negative", maxBackups)
+	}
+	out, err := openRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %v", err)
+	}
+	d.audit = &auditLog{out: out, now: time.Now, zoneKey: d.topologyKey()}
+	return nil
+}
+
+// intercept records the audited calls once they completed. It is called
+// within logGRPC, so that the records carry the request ID of the log lines
+// of the call. Failing to write a record doesn't fail the call, it is logged
+// and counted in the audit write errors metric.
+func (a *auditLog) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := methodName(info.FullMethod)
+	if !auditedMethods[method] {
+		return handler(ctx, req)
+	}
+
+	start := a.now()
+	resp, err := handler(ctx, req)
+	record := a.newRecord(method, req, resp, err)
+	record.Time = start.UTC().Format(time.RFC3339Nano)
+	record.RequestID = logging.RequestIDFrom(ctx)
+	record.DurationSeconds = a.now().Sub(start).Seconds()
+	if werr := a.write(record); werr != nil {
+		klog.Errorf("Failed to write the audit record of %s [%s]: %v", method, record.RequestID, werr)
+		auditWriteErrors.Inc()
+	}
+	return resp, err
+}
+
+// newRecord returns the record of a call, with what the request and its
+// response tell about the volume
+func (a *auditLog) newRecord(method string, req, resp interface{}, err error) *auditRecord {
+	record := &auditRecord{
+		Operation: method,
+		Outcome:   auditSuccess,
+		Code:      status.Code(err).String(),
+	}
+	if err != nil {
+		record.Outcome = auditFailure
+		record.Error = err.Error()
+	}
+
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		params := r.GetParameters()
+		record.VolumeName = r.GetName()
+		record.SizeBytes = r.GetCapacityRange().GetRequiredBytes()
+		record.VolumeType = params["type"]
+		record.AvailabilityZone = params["availability"]
+		record.PVCName = params[pvcNameParam]
+		record.PVCNamespace = params[pvcNamespaceParam]
+		record.PVName = params[pvNameParam]
+		if created, ok := resp.(*csi.CreateVolumeResponse); ok && created.GetVolume() != nil {
+			volume := created.GetVolume()
+			record.VolumeID = volume.GetVolumeId()
+			record.SizeBytes = volume.GetCapacityBytes()
+			if record.AvailabilityZone == "" && len(volume.GetAccessibleTopology()) > 0 {
+				record.AvailabilityZone = volume.GetAccessibleTopology()[0].GetSegments()[a.zoneKey]
+			}
+		}
+	case *csi.DeleteVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+	case *csi.ControllerPublishVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.NodeID = r.GetNodeId()
+	case *csi.ControllerUnpublishVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.NodeID = r.GetNodeId()
+	}
+	return record
+}
+
+func (a *auditLog) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	_, err = a.out.Write(append(line, '\n'))
+	return err
+}
+
+// rotatingFile is a file only appended to, renamed to path.1 once it reaches
+// maxSize, the previous path.1 becoming path.2 and so on up to maxBackups
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would make it exceed
+// its maximum size. Lines are never split across two files.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		// a previous rotation failed to reopen the file
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(f.backup(i), f.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.backup(1)); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+)
+
+// auditSchema maps the fields of the audit records to their JSON type
+var auditSchema = map[string]string{
+	"time":              "string",
+	"request_id":        "string",
+	"operation":         "string",
+	"outcome":           "string",
+	"code":              "string",
+	"error":             "string",
+	"duration_seconds":  "number",
+	"volume_id":         "string",
+	"volume_name":       "string",
+	"size_bytes":        "number",
+	"volume_type":       "string",
+	"availability_zone": "string",
+	"node_id":           "string",
+	"pvc_name":          "string",
+	"pvc_namespace":     "string",
+	"pv_name":           "string",
+}
+
+// the fields every record has
+var auditRequiredFields = []string{"time", "request_id", "operation", "outcome", "code", "duration_seconds"}
+
+// parseAuditRecords checks the lines of the audit log against the schema and
+// returns them
+func parseAuditRecords(t *testing.T, data []byte) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid audit record %q: %v", line, err)
+		}
+		for field, value := range record {
+			var kind string
+			switch value.(type) {
+			case string:
+				kind = "string"
+			case float64:
+				kind = "number"
+			}
+			expected, ok := auditSchema[field]
+			assert.True(t, ok, "unexpected field %s in %s", field, line)
+			if ok {
+				assert.Equal(t, expected, kind, "type of %s in %s", field, line)
+			}
+		}
+		for _, field := range auditRequiredFields {
+			assert.Contains(t, record, field)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+			t.Errorf("invalid time in %s: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func auditCall(a *auditLog, method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx := logging.WithRequestID(FakeCtx, "42")
+	return a.intercept(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + method}, handler)
+}
+
+func TestAuditLogRecords(t *testing.T) {
+	out := &bytes.Buffer{}
+	a := &auditLog{out: out, now: time.Now, zoneKey: "topology.cinder.csi.openstack.org/zone"}
+
+	created := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      FakeVolID,
+			CapacityBytes: 2 * 1024 * 1024 * 1024,
+			AccessibleTopology: []*csi.Topology{
+				{Segments: map[string]string{"topology.cinder.csi.openstack.org/zone": "nova"}},
+			},
+		},
+	}
+	_, err := auditCall(a, "CreateVolume", &csi.CreateVolumeRequest{
+		Name:          FakeVolName,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1},
+		Parameters: map[string]string{
+			"type":                             "fast",
+			"csi.storage.k8s.io/pvc/name":      "fake-pvc",
+			"csi.storage.k8s.io/pvc/namespace": "fake-namespace",
+			"csi.storage.k8s.io/pv/name":       "pvc-fake-pv",
+		},
+	}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return created, nil
+	})
+	assert.NoError(t, err)
+
+	_, err = auditCall(a, "ControllerPublishVolume", &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "fake error")
+	})
+	assert.Error(t, err)
+
+	// calls not changing volumes are not recorded
+	_, err = auditCall(a, "ListVolumes", &csi.ListVolumesRequest{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.ListVolumesResponse{}, nil
+	})
+	assert.NoError(t, err)
+
+	records := parseAuditRecords(t, out.Bytes())
+	if !assert.Len(t, records, 2) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"operation":         "CreateVolume",
+		"outcome":           "success",
+		"code":              "OK",
+		"request_id":        "42",
+		"volume_id":         FakeVolID,
+		"volume_name":       FakeVolName,
+		"size_bytes":        float64(2 * 1024 * 1024 * 1024),
+		"volume_type":       "fast",
+		"availability_zone": "nova",
+		"pvc_name":          "fake-pvc",
+		"pvc_namespace":     "fake-namespace",
+		"pv_name":           "pvc-fake-pv",
+	}, withoutTiming(records[0]))
+	assert.Equal(t, map[string]interface{}{
+		"operation":  "ControllerPublishVolume",
+		"outcome":    "failure",
+		"code":       "NotFound",
+		"error":      "rpc error: code = NotFound desc = fake error",
+		"request_id": "42",
+		"volume_id":  FakeVolID,
+		"node_id":    FakeNodeID,
+	}, withoutTiming(records[1]))
+}
+
+// withoutTiming returns the record without the fields changing every run
+func withoutTiming(record map[string]interface{}) map[string]interface{} {
+	delete(record, "time")
+	delete(record, "duration_seconds")
+	return record
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("fake write error")
+}
+
+// Test failing to write a record doesn't fail the call
+func TestAuditLogWriteError(t *testing.T) {
+	a := &auditLog{out: failingWriter{}, now: time.Now}
+	before := metricValue(t, auditWriteErrors)
+
+	resp, err := auditCall(a, "DeleteVolume", &csi.DeleteVolumeRequest{VolumeId: FakeVolID}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.DeleteVolumeResponse{}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &csi.DeleteVolumeResponse{}, resp)
+	assert.Equal(t, before+1, metricValue(t, auditWriteErrors))
+}
+
+func TestEnableAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	assert.Error(t, d.EnableAuditLog(path, 0, 1))
+	// room for a couple of records per file
+	assert.NoError(t, d.EnableAuditLog(path, 400, 2))
+
+	for i := 0; i < 10; i++ {
+		auditCall(d.audit, "DeleteVolume", &csi.DeleteVolumeRequest{VolumeId: FakeVolID}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &csi.DeleteVolumeResponse{}, nil
+		})
+	}
+
+	files, err := filepath.Glob(path + "*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path, path + ".1", path + ".2"}, files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		assert.True(t, len(data) <= 400, "%s is larger than its maximum size", file)
+		// records are never split across files
+		for _, record := range parseAuditRecords(t, data) {
+			assert.Equal(t, "DeleteVolume", record["operation"])
+		}
+	}
+}
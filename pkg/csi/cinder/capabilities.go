@@ -0,0 +1,207 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+	"k8s.io/klog"
+)
+
+// Optional capabilities of the driver, advertised when the cloud supports
+// them unless forced on or off with --enable-capabilities and
+// --disable-capabilities
+const (
+	// CREATE_DELETE_SNAPSHOT and LIST_SNAPSHOTS
+	snapshotsCapability = "snapshots"
+	// EXPAND_VOLUME of the controller and node services
+	expansionCapability = "expansion"
+	// ONLINE volume expansion rather than OFFLINE, only with expansion
+	onlineExpansionCapability = "online-expansion"
+	// GET_CAPACITY
+	capacityCapability = "capacity"
+)
+
+var optionalCapabilities = []string{capacityCapability, expansionCapability, onlineExpansionCapability, snapshotsCapability}
+
+// Time the probe of the features of the cloud may take at startup
+const capabilityProbeTimeout = 30 * time.Second
+
+// SetCapabilityOverrides forces the optional capabilities to enable, or to
+// disable, whatever the cloud supports, for clouds the probe gets wrong
+func (d *CinderDriver) SetCapabilityOverrides(enable, disable []string) error {
+	forced := map[string]bool{}
+	for _, names := range []struct {
+		list    []string
+		enabled bool
+	}{{enable, true}, {disable, false}} {
+		for _, name := range names.list {
+			if !isOptionalCapability(name) {
+				return fmt.Errorf("unknown capability %q, must be one of %s", name, strings.Join(optionalCapabilities, ", "))
+			}
+			if enabled, ok := forced[name]; ok && enabled != names.enabled {
+				return fmt.Errorf("capability %s is both enabled and disabled", name)
+			}
+			forced[name] = names.enabled
+		}
+	}
+	d.forcedCapabilities = forced
+	d.updateCapabilities()
+	return nil
+}
+
+// ProbeCapabilities advertises the optional capabilities the cloud supports,
+// probing its Block Storage API. A failed probe leaves only the capabilities
+// every cloud supports: no snapshots and offline expansion.
+func (d *CinderDriver) ProbeCapabilities(cloud openstack.IOpenStack) {
+	ctx, cancel := context.WithTimeout(context.Background(), capabilityProbeTimeout)
+	defer cancel()
+
+	features, err := cloud.ProbeFeatures(ctx)
+	if err != nil {
+		klog.Warningf("Failed to probe the features of the cloud, not advertising snapshots and online expansion: %v", err)
+		features = &openstack.BackendFeatures{}
+	} else {
+		klog.V(2).Infof("Block Storage API %s supports snapshots: %t, online extend: %t", features.APIVersion, features.Snapshots, features.OnlineExtend)
+	}
+	d.supportedCapabilities = map[string]bool{
+		snapshotsCapability:       features.Snapshots,
+		expansionCapability:       true,
+		onlineExpansionCapability: features.OnlineExtend,
+		capacityCapability:        true,
+	}
+	d.updateCapabilities()
+}
+
+// capabilityEnabled returns whether the optional capability is advertised:
+// forced on or off, else supported by the cloud, all of them being assumed
+// supported until the cloud is probed
+func (d *CinderDriver) capabilityEnabled(name string) bool {
+	if enabled, ok := d.forcedCapabilities[name]; ok {
+		return enabled
+	}
+	if d.supportedCapabilities == nil {
+		return true
+	}
+	return d.supportedCapabilities[name]
+}
+
+// updateCapabilities sets the controller and node service capabilities from
+// the optional ones enabled, so that every capability call agrees
+func (d *CinderDriver) updateCapabilities() {
+	controller := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	}
+	node := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	}
+	if d.capabilityEnabled(snapshotsCapability) {
+		controller = append(controller, csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT, csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS)
+	}
+	if d.capabilityEnabled(expansionCapability) {
+		controller = append(controller, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+		node = append(node, csi.NodeServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	if d.capabilityEnabled(capacityCapability) {
+		controller = append(controller, csi.ControllerServiceCapability_RPC_GET_CAPACITY)
+	}
+
+	d.cscap = nil
+	for _, c := range controller {
+		d.cscap = append(d.cscap, NewControllerServiceCapability(c))
+	}
+	d.nscap = nil
+	for _, n := range node {
+		d.nscap = append(d.nscap, NewNodeServiceCapability(n))
+	}
+}
+
+// pluginCapabilities returns the capabilities of GetPluginCapabilities: the
+// controller service and the volume expansion only when the controller
+// service is served
+func (d *CinderDriver) pluginCapabilities() []*csi.PluginCapability {
+	var caps []*csi.PluginCapability
+	if d.cs != nil {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+	caps = append(caps, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	})
+	if d.cs != nil && d.capabilityEnabled(expansionCapability) {
+		expansion := csi.PluginCapability_VolumeExpansion_OFFLINE
+		if d.capabilityEnabled(onlineExpansionCapability) {
+			expansion = csi.PluginCapability_VolumeExpansion_ONLINE
+		}
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: expansion},
+			},
+		})
+	}
+	return caps
+}
+
+// logCapabilities logs the capabilities the driver advertises
+func (d *CinderDriver) logCapabilities() {
+	var names []string
+	for _, c := range d.pluginCapabilities() {
+		if service := c.GetService(); service != nil {
+			names = append(names, service.GetType().String())
+		} else {
+			names = append(names, "VOLUME_EXPANSION_"+c.GetVolumeExpansion().GetType().String())
+		}
+	}
+	if d.cs != nil {
+		for _, c := range d.cscap {
+			names = append(names, "CONTROLLER_"+c.GetRpc().GetType().String())
+		}
+	}
+	if d.ns != nil {
+		for _, c := range d.nscap {
+			names = append(names, "NODE_"+c.GetRpc().GetType().String())
+		}
+	}
+	sort.Strings(names)
+	klog.Infof("Advertising the capabilities %s", strings.Join(names, ", "))
+}
+
+func isOptionalCapability(name string) bool {
+	for _, c := range optionalCapabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
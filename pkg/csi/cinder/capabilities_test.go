@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+)
+
+// advertisedCapabilities returns the capabilities of the three capability
+// calls of a driver serving the controller and node services
+func advertisedCapabilities(t *testing.T, d *CinderDriver) []string {
+	var names []string
+	plugin, err := d.ids.GetPluginCapabilities(FakeCtx, &csi.GetPluginCapabilitiesRequest{})
+	assert.NoError(t, err)
+	for _, c := range plugin.GetCapabilities() {
+		if expansion := c.GetVolumeExpansion(); expansion != nil {
+			names = append(names, "VOLUME_EXPANSION_"+expansion.GetType().String())
+		}
+	}
+	controller, err := d.cs.ControllerGetCapabilities(FakeCtx, &csi.ControllerGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	for _, c := range controller.GetCapabilities() {
+		names = append(names, "CONTROLLER_"+c.GetRpc().GetType().String())
+	}
+	node, err := NewNodeServer(d, nil, nil).NodeGetCapabilities(FakeCtx, &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	for _, c := range node.GetCapabilities() {
+		names = append(names, "NODE_"+c.GetRpc().GetType().String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	all := []string{
+		"CONTROLLER_CREATE_DELETE_SNAPSHOT",
+		"CONTROLLER_CREATE_DELETE_VOLUME",
+		"CONTROLLER_EXPAND_VOLUME",
+		"CONTROLLER_GET_CAPACITY",
+		"CONTROLLER_LIST_SNAPSHOTS",
+		"CONTROLLER_LIST_VOLUMES",
+		"CONTROLLER_PUBLISH_UNPUBLISH_VOLUME",
+		"NODE_EXPAND_VOLUME",
+		"NODE_STAGE_UNSTAGE_VOLUME",
+		"VOLUME_EXPANSION_ONLINE",
+	}
+	// what every cloud supports
+	conservative := []string{
+		"CONTROLLER_CREATE_DELETE_VOLUME",
+		"CONTROLLER_EXPAND_VOLUME",
+		"CONTROLLER_GET_CAPACITY",
+		"CONTROLLER_LIST_VOLUMES",
+		"CONTROLLER_PUBLISH_UNPUBLISH_VOLUME",
+		"NODE_EXPAND_VOLUME",
+		"NODE_STAGE_UNSTAGE_VOLUME",
+		"VOLUME_EXPANSION_OFFLINE",
+	}
+
+	tests := []struct {
+		name     string
+		features *openstack.BackendFeatures
+		probeErr error
+		enable   []string
+		disable  []string
+		expected []string
+	}{
+		{
+			name:     "all supported",
+			features: &openstack.BackendFeatures{APIVersion: "v3", Snapshots: true, OnlineExtend: true},
+			expected: all,
+		},
+		{
+			name:     "v2",
+			features: &openstack.BackendFeatures{APIVersion: "v2"},
+			expected: conservative,
+		},
+		{
+			name:     "probe failure",
+			probeErr: errors.New("fake error"),
+			expected: conservative,
+		},
+		{
+			name:     "forced on",
+			probeErr: errors.New("fake error"),
+			enable:   []string{"snapshots", "online-expansion"},
+			expected: all,
+		},
+		{
+			name:     "forced off",
+			features: &openstack.BackendFeatures{APIVersion: "v3", Snapshots: true, OnlineExtend: true},
+			disable:  []string{"snapshots", "expansion", "capacity"},
+			expected: []string{
+				"CONTROLLER_CREATE_DELETE_VOLUME",
+				"CONTROLLER_LIST_VOLUMES",
+				"CONTROLLER_PUBLISH_UNPUBLISH_VOLUME",
+				"NODE_STAGE_UNSTAGE_VOLUME",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			if tt.features != nil {
+				cloud.SetFeatures(*tt.features)
+			}
+			if tt.probeErr != nil {
+				cloud.InjectFailures("ProbeFeatures", tt.probeErr)
+			}
+			d := NewFakeDriver()
+			assert.NoError(t, d.SetCapabilityOverrides(tt.enable, tt.disable))
+			d.SetupControllerService(cloud, nil)
+			d.ProbeCapabilities(cloud)
+
+			assert.Equal(t, tt.expected, advertisedCapabilities(t, d))
+		})
+	}
+}
+
+// Test the driver advertises every capability until the cloud is probed, as
+// the node service does
+func TestCapabilitiesNotProbed(t *testing.T) {
+	d := NewFakeDriver()
+	d.SetupControllerService(openstack.NewFakeOpenStack(), nil)
+	assert.Contains(t, advertisedCapabilities(t, d), "CONTROLLER_CREATE_DELETE_SNAPSHOT")
+	assert.Contains(t, advertisedCapabilities(t, d), "VOLUME_EXPANSION_ONLINE")
+
+	assert.NoError(t, d.SetCapabilityOverrides(nil, []string{"expansion"}))
+	assert.NotContains(t, advertisedCapabilities(t, d), "NODE_EXPAND_VOLUME")
+}
+
+func TestSetCapabilityOverrides(t *testing.T) {
+	d := NewFakeDriver()
+	err := d.SetCapabilityOverrides([]string{"snapshot"}, nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, `unknown capability "snapshot", must be one of capacity, expansion, online-expansion, snapshots`, err.Error())
+	}
+	err = d.SetCapabilityOverrides([]string{"snapshots"}, []string{"expansion", "snapshots"})
+	if assert.Error(t, err) {
+		assert.Equal(t, "capability snapshots is both enabled and disabled", err.Error())
+	}
+	assert.NoError(t, d.SetCapabilityOverrides([]string{"snapshots"}, []string{"expansion"}))
+	assert.True(t, d.capabilityEnabled("snapshots"))
+	assert.False(t, d.capabilityEnabled("expansion"))
+}
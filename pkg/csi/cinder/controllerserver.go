@@ -17,8 +17,14 @@ limitations under the License.
 package cinder
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/golang/protobuf/ptypes"
 
@@ -28,13 +34,143 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+	"k8s.io/cloud-provider-openstack/pkg/util/blockdevice"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
 	"k8s.io/cloud-provider-openstack/pkg/volume/util"
 	"k8s.io/klog"
 )
 
+const (
+	// Parameters passed by external-provisioner with --extra-create-metadata
+	pvcNameParam      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceParam = "csi.storage.k8s.io/pvc/namespace"
+	pvNameParam       = "csi.storage.k8s.io/pv/name"
+
+	// Storage class parameter protecting the new volumes from deletion
+	protectedParam = "protected"
+	// Storage class parameter retaining the volumes DeleteVolume is called
+	// for, instead of deleting them
+	onDeleteParam  = "onDelete"
+	onDeleteRetain = "retain"
+	onDeleteDelete = "delete"
+
+	// Cinder volume metadata keys
+	clusterMetadataKey      = DefaultDriverName + "/cluster"
+	pvcNameMetadataKey      = DefaultDriverName + "/pvc-name"
+	pvcNamespaceMetadataKey = DefaultDriverName + "/pvc-namespace"
+	pvNameMetadataKey       = DefaultDriverName + "/pv-name"
+	accessTypeMetadataKey   = DefaultDriverName + "/access-type"
+	csiNameMetadataKey      = DefaultDriverName + "/csi-name"
+	// Set to "true" on a volume not created by the driver to let it be deleted
+	// with --delete-managed-volumes-only
+	allowDeleteMetadataKey = DefaultDriverName + "/allow-delete"
+	// Set to "true" on a volume to refuse its deletion, whoever created it
+	protectedMetadataKey = DefaultDriverName + "/protected"
+	// Set to "retain" on the volumes of a storage class with onDelete: retain
+	onDeleteMetadataKey = DefaultDriverName + "/on-delete"
+	// Set on the retained volumes, for the external cleanup
+	deletedAtMetadataKey     = DefaultDriverName + "/deleted-at"
+	deletedPVNameMetadataKey = DefaultDriverName + "/deleted-pv-name"
+
+	// Prefix of the name of the retained volumes
+	retainedVolumePrefix = "deleted-"
+
+	// Image metadata key choosing the bus Nova attaches the disk on, e.g. scsi
+	diskBusImageMetadataKey = "hw_disk_bus"
+
+	// Values of the access type metadata
+	accessTypeBlock = "block"
+	accessTypeMount = "mount"
+
+	// Publish context key set to "true" when the volume was attached to a
+	// stopped instance, the device shows up in the guest once it boots
+	instanceStoppedPublishKey = "InstanceStopped"
+	// Publish context key of the /dev/disk/by-id paths the device of the
+	// volume may have, comma separated. Unlike the DevicePath reported by Nova
+	// they are stable, the node stages the volume on the first that exists.
+	devicePathsByIDPublishKey = "DevicePathsByID"
+	// Publish context key of the device name the volume was attached as, set
+	// with explicit-device-names unless the cloud refused it
+	requestedDevicePublishKey = "RequestedDevice"
+	// Publish context key of the ID of the Cinder attachment of the volume to
+	// the instance, when Cinder reports it
+	attachmentIDPublishKey = "AttachmentID"
+	// Publish context key set to "true" when the volume is published readonly
+	readonlyPublishKey = "Readonly"
+
+	// Cinder limits metadata keys and values to 255 characters
+	maxMetadataLength = 255
+	// Cinder limits volume names to 255 characters
+	maxVolumeNameLength = 255
+	// Length of the hash appended to truncated volume names
+	volumeNameHashLength = 8
+)
+
 type controllerServer struct {
-	Driver *CinderDriver
-	Cloud  openstack.IOpenStack
+	Driver   *CinderDriver
+	Cloud    openstack.IOpenStack
+	Metadata openstack.IMetadata
+	inFlight *inFlight
+	detached *detachedVolumes
+}
+
+// operationPendingError is returned when a request is retried while the
+// original one is still being processed
+func operationPendingError(key string) error {
+	return status.Errorf(codes.Aborted, "operation pending for %s", key)
+}
+
+// waitError maps a wait that ended because the request context was cancelled
+// or ran out of time to the matching gRPC code, so the sidecar retries the
+// request instead of reporting an internal error. A volume stuck attaching or
+// detaching is a FailedPrecondition telling how to get it unstuck, as is a
+// locked or shelved instance. A new volume deleted because it failed is Aborted, the
+// retry creates it again.
+func waitError(err error) error {
+	if failed, ok := err.(*openstack.FailedVolumeError); ok && failed.Deleted {
+		return status.Error(codes.Aborted, err.Error())
+	}
+	if stuck, ok := err.(*openstack.StuckVolumeError); ok {
+		return status.Error(codes.FailedPrecondition, stuckVolumeMessage(stuck))
+	}
+	if deleted, ok := err.(*openstack.VolumeDeletedError); ok {
+		return status.Error(codes.NotFound, deleted.Error())
+	}
+	if shelved, ok := err.(*openstack.InstanceShelvedError); ok {
+		return status.Errorf(codes.FailedPrecondition, "%v, volumes can be attached to it once it is unshelved with `openstack server unshelve %s`", shelved, shelved.InstanceID)
+	}
+	if locked, ok := err.(*openstack.InstanceLockedError); ok {
+		return status.Errorf(codes.FailedPrecondition, "%v, volumes can be attached to it once it is unlocked with `openstack server unlock %s`", locked, locked.InstanceID)
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return err
+}
+
+func stuckVolumeMessage(stuck *openstack.StuckVolumeError) string {
+	if stuck.Recovered {
+		return stuck.Error() + ", the operation will succeed when retried"
+	}
+	msg := stuck.Error() + ", e.g. after a restart of Nova compute. "
+	if stuck.Status == openstack.VolumeAttachingStatus {
+		msg += fmt.Sprintf("Reset it with `cinder reset-state --state available --attach-status detached %s`", stuck.VolumeID)
+	} else {
+		msg += fmt.Sprintf("Detach it with `cinder force-detach %s`", stuck.VolumeID)
+	}
+	return msg + ", or set recover-stuck-volumes in the [BlockStorage] section of the cloud config to let the plugin do it with admin credentials"
+}
+
+// createError maps a creation refused because the project is over its quota
+// to ResourceExhausted, so that it is reported as such on the PVC
+func createError(err error) error {
+	if cpoerrors.IsOverQuota(err) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return err
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -46,6 +182,39 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "")
 	}
 
+	// volumes and snapshots may share names
+	key := "volume/" + volName
+	if ok := cs.inFlight.Insert(key); !ok {
+		return nil, operationPendingError(key)
+	}
+	defer cs.inFlight.Delete(key)
+
+	params, err := parseVolumeParams(req.GetParameters(), cs.Driver)
+	if err != nil {
+		return nil, err
+	}
+	// fail before the node tries to format and mount the volume
+	for _, c := range req.GetVolumeCapabilities() {
+		mnt := c.GetMount()
+		if fsType := mnt.GetFsType(); fsType != "" {
+			if err := cs.Driver.checkFsType(fsType); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+			}
+		}
+		if _, err := cs.Driver.normalizeMountOptions(mnt.GetMountFlags()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+		}
+	}
+
+	// Prefer the PV name as the Cinder display name when the provisioner passes it
+	if params.PVName != "" {
+		volName = params.PVName
+	}
+	opts := cs.Cloud.GetBlockStorageOpts()
+	fullName := opts.VolumeNamePrefix + volName
+	unprefixedName := cinderVolumeName(volName)
+	volName = cinderVolumeName(fullName)
+
 	// Volume Size - Default is 1 GiB
 	volSizeBytes := int64(1 * 1024 * 1024 * 1024)
 	if req.GetCapacityRange() != nil {
@@ -53,77 +222,110 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 	volSizeGB := int(util.RoundUpSize(volSizeBytes, 1024*1024*1024))
 
-	// Volume Type
-	volType := req.GetParameters()["type"]
-
-	var volAvailability string
-	if req.GetAccessibilityRequirements() != nil {
-		volAvailability = getAZFromTopology(req.GetAccessibilityRequirements())
+	// Volume Type, the storage class overrides the default of the cloud config
+	volType := params.Type
+	if volType == "" {
+		volType = opts.DefaultVolumeType
 	}
 
-	if len(volAvailability) == 0 {
-		// Volume Availability - Default is nova
-		volAvailability = req.GetParameters()["availability"]
+	// Volume Availability
+	volAvailability, err := cs.getVolumeAZ(ctx, req, params)
+	if err != nil {
+		return nil, err
 	}
 
 	cloud := cs.Cloud
 
 	// Verify a volume with the provided name doesn't already exist for this tenant
-	volumes, err := cloud.GetVolumesByName(volName)
+	volumes, err := cloud.GetVolumesByName(ctx, volName)
 	if err != nil {
 		klog.V(3).Infof("Failed to query for existing Volume during CreateVolume: %v", err)
 	}
+	// Volumes created before volume-name-prefix was set don't carry the prefix
+	if len(volumes) == 0 && opts.VolumeNamePrefix != "" {
+		volumes, err = cloud.GetVolumesByName(ctx, unprefixedName)
+		if err != nil {
+			klog.V(3).Infof("Failed to query for existing Volume during CreateVolume: %v", err)
+		}
+	}
 
-	resID := ""
-	resAvailability := ""
-	resSize := 0
-	snapshotID := ""
+	var vol openstack.Volume
 
 	if len(volumes) == 1 {
-		resID = volumes[0].ID
-		resAvailability = volumes[0].AZ
-		resSize = volumes[0].Size
+		vol = volumes[0]
 
-		klog.V(4).Infof("Volume %s already exists in Availability Zone: %s of size %d GiB", resID, resAvailability, resSize)
+		klog.V(4).Infof("Volume %s already exists in Availability Zone: %s of size %d GiB", vol.ID, vol.AZ, vol.Size)
+
+		// A previous attempt gave up waiting for the volume
+		if vol.Status == openstack.VolumeCreatingStatus || strings.HasPrefix(vol.Status, openstack.VolumeErrorStatus) {
+			if err := cloud.WaitVolumeCreated(ctx, vol.ID); err != nil {
+				klog.V(3).Infof("Failed to WaitVolumeCreated: %v", err)
+				return nil, waitError(err)
+			}
+		}
 	} else if len(volumes) > 1 {
 		klog.V(3).Infof("found multiple existing volumes with selected name (%s) during create", volName)
 		return nil, errors.New("multiple volumes reported by Cinder with same name")
 	} else {
 		// Volume Create
-		properties := map[string]string{"cinder.csi.openstack.org/cluster": cs.Driver.cluster}
+		properties := cs.volumeMetadata(params, req.GetVolumeCapabilities())
+		if volName != fullName {
+			properties[csiNameMetadataKey] = truncateMetadata(fullName)
+		}
 		content := req.GetVolumeContentSource()
 
+		snapshotID := ""
 		if content != nil && content.GetSnapshot() != nil {
 			snapshotID = content.GetSnapshot().GetSnapshotId()
+			volSizeGB, err = snapshotVolumeSize(ctx, cloud, snapshotID, volSizeGB, req.GetCapacityRange().GetRequiredBytes() > 0)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		resID, resAvailability, resSize, err = cloud.CreateVolume(volName, volSizeGB, volType, volAvailability, snapshotID, &properties)
+		klog.V(4).Infof("Creating volume %s with volume type %q", volName, volType)
+		created, err := cloud.CreateVolume(ctx, volName, volSizeGB, volType, volAvailability, snapshotID, cs.volumeDescription(), &properties)
 		if err != nil {
 			klog.V(3).Infof("Failed to CreateVolume: %v", err)
-			return nil, err
+			return nil, createError(err)
 		}
+		vol = *created
+
+		klog.V(4).Infof("Create volume %s in Availability Zone: %s of size %d GiB", vol.ID, vol.AZ, vol.Size)
 
-		klog.V(4).Infof("Create volume %s in Availability Zone: %s of size %d GiB", resID, resAvailability, resSize)
+		if err := cloud.WaitVolumeCreated(ctx, vol.ID); err != nil {
+			klog.V(3).Infof("Failed to WaitVolumeCreated: %v", err)
+			return nil, waitError(err)
+		}
+	}
 
+	if err := cs.setImageMetadata(ctx, vol, params.ImageMetadata); err != nil {
+		return nil, err
 	}
 
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      resID,
-			CapacityBytes: int64(resSize * 1024 * 1024 * 1024),
-			AccessibleTopology: []*csi.Topology{
-				{
-					Segments: map[string]string{topologyKey: resAvailability},
-				},
-			},
+			VolumeId:      vol.ID,
+			CapacityBytes: int64(vol.Size * 1024 * 1024 * 1024),
 		},
 	}
 
-	if snapshotID != "" {
+	// Pin the volume to the Nova zones of the zone it was created in, unless
+	// the Cinder zones don't match the Nova ones and volumes can be attached
+	// anywhere
+	if !opts.IgnoreVolumeAZ && vol.AZ != "" {
+		for _, zone := range opts.AZMapping.NovaAZs(vol.AZ) {
+			resp.Volume.AccessibleTopology = append(resp.Volume.AccessibleTopology, &csi.Topology{
+				Segments: map[string]string{cs.Driver.topologyKey(): zone},
+			})
+		}
+	}
+
+	if vol.SnapshotID != "" {
 		src := &csi.VolumeContentSource{
 			Type: &csi.VolumeContentSource_Snapshot{
 				Snapshot: &csi.VolumeContentSource_SnapshotSource{
-					SnapshotId: snapshotID,
+					SnapshotId: vol.SnapshotID,
 				},
 			},
 		}
@@ -132,13 +334,52 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	return resp, nil
 }
 
+// snapshotVolumeSize returns the size of a new volume restored from the
+// snapshot. Cinder creates the volume at the requested size, the node grows
+// the filesystem of the snapshot to fill it when staging the volume. A
+// requested size smaller than the snapshot is refused, without one the volume
+// gets the size of the snapshot.
+func snapshotVolumeSize(ctx context.Context, cloud openstack.IOpenStack, snapshotID string, sizeGB int, sizeRequested bool) (int, error) {
+	snap, err := cloud.GetSnapshotByID(ctx, snapshotID)
+	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			return 0, status.Errorf(codes.NotFound, "Snapshot %s not found", snapshotID)
+		}
+		return 0, status.Errorf(codes.Internal, "failed to get snapshot %s: %v", snapshotID, err)
+	}
+	if sizeGB >= snap.Size {
+		return sizeGB, nil
+	}
+	if sizeRequested {
+		return 0, status.Errorf(codes.InvalidArgument, "requested size %d GiB is smaller than the size %d GiB of snapshot %s", sizeGB, snap.Size, snapshotID)
+	}
+	return snap.Size, nil
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 
 	// Volume Delete
 	volID := req.GetVolumeId()
-	err := cs.Cloud.DeleteVolume(volID)
+
+	volume, err := cs.checkVolumeDeletion(ctx, volID)
+	if err != nil {
+		return nil, err
+	}
+	knownDetached := cs.detached.Take(volID)
+
+	if volume != nil && volume.Metadata[onDeleteMetadataKey] == onDeleteRetain {
+		if err := cs.retainVolume(ctx, *volume); err != nil {
+			return nil, err
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	err = cs.Cloud.DeleteVolume(ctx, volID, knownDetached)
 	if err != nil {
 		klog.V(3).Infof("Failed to DeleteVolume: %v", err)
+		if inUse, ok := err.(*openstack.VolumeInUseError); ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v, it can be deleted once detached", inUse)
+		}
 		return nil, err
 	}
 
@@ -153,22 +394,55 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	instanceID := req.GetNodeId()
 	volumeID := req.GetVolumeId()
 
-	_, err := cs.Cloud.AttachVolume(instanceID, volumeID)
+	key := "attachment/" + volumeID + "/" + instanceID
+	if ok := cs.inFlight.Insert(key); !ok {
+		return nil, operationPendingError(key)
+	}
+	defer cs.inFlight.Delete(key)
+
+	// fetched once for the checks and the attach
+	volume, err := cs.Cloud.GetVolume(ctx, volumeID)
 	if err != nil {
-		klog.V(3).Infof("Failed to AttachVolume: %v", err)
+		if cpoerrors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume %s not found", volumeID)
+		}
+		klog.V(3).Infof("Failed to GetVolume: %v", err)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("GetVolume failed with error %v", err))
+	}
+
+	if !cs.Cloud.GetBlockStorageOpts().IgnoreVolumeAZ {
+		if err := cs.validateVolumeAZ(ctx, instanceID, volume); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cs.checkAttachmentLimit(ctx, instanceID, volume); err != nil {
 		return nil, err
 	}
 
-	err = cs.Cloud.WaitDiskAttached(instanceID, volumeID)
+	cs.detached.Forget(volumeID)
+	devicePath, err := cs.Cloud.AttachFetchedVolume(ctx, instanceID, &volume)
 	if err != nil {
-		klog.V(3).Infof("Failed to WaitDiskAttached: %v", err)
-		return nil, err
+		klog.V(3).Infof("Failed to AttachVolume: %v", err)
+		return nil, waitError(err)
 	}
 
-	devicePath, err := cs.Cloud.GetAttachmentDiskPath(instanceID, volumeID)
+	attached, err := cs.Cloud.WaitDiskAttached(ctx, instanceID, volumeID)
 	if err != nil {
-		klog.V(3).Infof("Failed to GetAttachmentDiskPath: %v", err)
-		return nil, err
+		klog.V(3).Infof("Failed to WaitDiskAttached: %v", err)
+		return nil, waitError(err)
+	}
+
+	// the attachment gives the device, unless Nova didn't report one. With no
+	// device known at all, the node finds the disk by its serial.
+	if devicePath == "" {
+		devicePath, err = cs.Cloud.GetAttachmentDiskPath(ctx, instanceID, volumeID)
+		if _, ok := err.(*openstack.NoDevicePathError); ok {
+			klog.V(4).Infof("%v, leaving the node to find it by serial", err)
+		} else if err != nil {
+			klog.V(3).Infof("Failed to GetAttachmentDiskPath: %v", err)
+			return nil, err
+		}
 	}
 
 	klog.V(4).Infof("ControllerPublishVolume %s on %s", volumeID, instanceID)
@@ -176,29 +450,120 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	// Publish Volume Info
 	pvInfo := map[string]string{}
 	pvInfo["DevicePath"] = devicePath
+	if volume.RequestedDevice != "" {
+		pvInfo[requestedDevicePublishKey] = volume.RequestedDevice
+	}
+	// the volume of the last poll has the attachment, new or not
+	if attachment, ok := attached.AttachedTo(instanceID); ok && attachment.AttachmentID != "" {
+		pvInfo[attachmentIDPublishKey] = attachment.AttachmentID
+	}
+	if req.GetReadonly() {
+		pvInfo[readonlyPublishKey] = "true"
+	}
+	// the node looks for the disk on the bus of the image metadata first
+	pvInfo[devicePathsByIDPublishKey] = strings.Join(blockdevice.BusSerialIDPaths(volumeID, volume.ImageMetadata[diskBusImageMetadataKey]), ",")
+	// the state is cached since the attach
+	if state, err := cs.Cloud.GetInstanceState(ctx, instanceID); err != nil {
+		klog.V(4).Infof("Failed to GetInstanceState: %v", err)
+	} else if state == openstack.InstanceStoppedState {
+		pvInfo[instanceStoppedPublishKey] = "true"
+	}
 
 	return &csi.ControllerPublishVolumeResponse{
 		PublishContext: pvInfo,
 	}, nil
 }
 
+// validateVolumeAZ checks the volume is in the same availability zone as the
+// instance it is about to be attached to, so a cross-zone attach fails early
+// with both zones named instead of with an opaque error from Nova
+func (cs *controllerServer) validateVolumeAZ(ctx context.Context, instanceID string, volume openstack.Volume) error {
+	// volumes of backends without zones can be attached anywhere
+	if volume.AZ == "" {
+		return nil
+	}
+
+	instanceAZ, err := cs.Cloud.GetInstanceAZ(ctx, instanceID)
+	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			return status.Errorf(codes.NotFound, "Instance %s not found", instanceID)
+		}
+		klog.V(3).Infof("Failed to GetInstanceAZ: %v", err)
+		return status.Error(codes.Internal, fmt.Sprintf("GetInstanceAZ failed with error %v", err))
+	}
+
+	// the zones are compared as named by Cinder
+	if instanceAZ != "" && volume.AZ != cs.Cloud.GetBlockStorageOpts().AZMapping.CinderAZ(instanceAZ) {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s is in availability zone %s but instance %s is in availability zone %s, "+
+			"set az-mapping or ignore-volume-az in the [BlockStorage] section if Cinder zones don't match the Nova ones", volume.ID, volume.AZ, instanceID, instanceAZ)
+	}
+	return nil
+}
+
+// checkAttachmentLimit fails with ResourceExhausted when the instance already
+// has as many volumes attached as the configured limit allows, rather than
+// letting the attach hang until it times out
+func (cs *controllerServer) checkAttachmentLimit(ctx context.Context, instanceID string, volume openstack.Volume) error {
+	limit := cs.Cloud.GetBlockStorageOpts().NodeVolumeAttachLimit
+	if limit <= 0 {
+		return nil
+	}
+
+	count, err := cs.Cloud.GetAttachmentCount(ctx, instanceID)
+	if err != nil {
+		klog.V(3).Infof("Failed to GetAttachmentCount: %v", err)
+		return status.Error(codes.Internal, fmt.Sprintf("GetAttachmentCount failed with error %v", err))
+	}
+	if count < limit {
+		return nil
+	}
+
+	// a retried publish of a volume already attached to the instance is fine,
+	// whichever of the attachments of a multiattach volume is the instance's
+	if _, ok := volume.AttachedTo(instanceID); ok {
+		return nil
+	}
+	return status.Errorf(codes.ResourceExhausted, "Instance %s already has %d volumes attached, the limit is %d", instanceID, count, limit)
+}
+
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 
 	// Volume Detach
 	instanceID := req.GetNodeId()
 	volumeID := req.GetVolumeId()
 
-	err := cs.Cloud.DetachVolume(instanceID, volumeID)
+	key := "attachment/" + volumeID + "/" + instanceID
+	if ok := cs.inFlight.Insert(key); !ok {
+		return nil, operationPendingError(key)
+	}
+	defer cs.inFlight.Delete(key)
+
+	if cs.Driver.protectBootVolumes {
+		volume, err := cs.Cloud.GetVolume(ctx, volumeID)
+		if err != nil && !cpoerrors.IsNotFound(err) {
+			klog.V(3).Infof("Failed to GetVolume: %v", err)
+			return nil, err
+		}
+		// a volume that doesn't exist is left to DetachVolume
+		if err == nil {
+			if err := cs.checkBootVolume(volume, instanceID, "detached"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err := cs.Cloud.DetachVolume(ctx, instanceID, volumeID)
 	if err != nil {
 		klog.V(3).Infof("Failed to DetachVolume: %v", err)
-		return nil, err
+		return nil, waitError(err)
 	}
 
-	err = cs.Cloud.WaitDiskDetached(instanceID, volumeID)
+	err = cs.Cloud.WaitDiskDetached(ctx, instanceID, volumeID)
 	if err != nil {
 		klog.V(3).Infof("Failed to WaitDiskDetached: %v", err)
-		return nil, err
+		return nil, waitError(err)
 	}
+	cs.detached.Add(volumeID)
 
 	klog.V(4).Infof("ControllerUnpublishVolume %s on %s", volumeID, instanceID)
 
@@ -207,7 +572,7 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 
 func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 
-	vlist, err := cs.Cloud.ListVolumes()
+	vlist, err := cs.Cloud.ListVolumes(ctx)
 	if err != nil {
 		klog.V(3).Infof("Failed to ListVolumes: %v", err)
 		return nil, err
@@ -215,6 +580,9 @@ func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolume
 
 	var ventries []*csi.ListVolumesResponse_Entry
 	for _, v := range vlist {
+		if !cs.ownsVolume(v.Metadata) {
+			continue
+		}
 		ventry := csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
 				VolumeId:      v.ID,
@@ -235,29 +603,56 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	// No description from csi.CreateSnapshotRequest now
 	description := ""
 
+	key := "snapshot/" + name
+	if ok := cs.inFlight.Insert(key); !ok {
+		return nil, operationPendingError(key)
+	}
+	defer cs.inFlight.Delete(key)
+
 	// Verify a snapshot with the provided name doesn't already exist for this tenant
-	snapshots, err := cs.Cloud.GetSnapshotByNameAndVolumeID(name, volumeId)
+	snapshots, err := cs.Cloud.GetSnapshotsByName(ctx, name)
 	if err != nil {
 		klog.V(3).Infof("Failed to query for existing Snapshot during CreateSnapshot: %v", err)
+		return nil, status.Error(codes.Internal, "Failed to get snapshots")
 	}
 	var snap *ossnapshots.Snapshot
+	var ready bool
 
 	if len(snapshots) == 1 {
 		snap = &snapshots[0]
 
-		klog.V(3).Infof("Found existing snapshot %s on %s", name, volumeId)
+		if snap.VolumeID != volumeId {
+			klog.V(3).Infof("Snapshot %s already exists on a different source volume %s", name, snap.VolumeID)
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for source volume %s", name, snap.VolumeID)
+		}
+		if snap.Status == openstack.SnapshotErrorStatus {
+			return nil, status.Errorf(codes.Internal, "Snapshot %s is in %s state", snap.ID, snap.Status)
+		}
+		ready = snap.Status == openstack.SnapshotReadyStatus
+
+		klog.V(3).Infof("Found existing snapshot %s on %s with status %s", name, volumeId, snap.Status)
 	} else if len(snapshots) > 1 {
 		klog.V(3).Infof("found multiple existing snapshots with selected name (%s) during create", name)
 		return nil, errors.New("multiple snapshots reported by Cinder with same name")
 	} else {
-		// TODO: Delegate the check to openstack itself and ignore the conflict
-		snap, err = cs.Cloud.CreateSnapshot(name, volumeId, description, &req.Parameters)
+		tags := map[string]string{clusterMetadataKey: cs.Driver.cluster}
+		for k, v := range req.Parameters {
+			tags[k] = v
+		}
+		snap, err = cs.Cloud.CreateSnapshot(ctx, name, volumeId, description, &tags)
 		if err != nil {
 			klog.V(3).Infof("Failed to Create snapshot: %v", err)
-			return nil, err
+			return nil, createError(err)
 		}
 
 		klog.V(3).Infof("CreateSnapshot %s on %s", name, volumeId)
+
+		err = cs.Cloud.WaitSnapshotReady(ctx, snap.ID)
+		if err != nil {
+			klog.V(3).Infof("Failed to WaitSnapshotReady: %v", err)
+			return nil, waitError(err)
+		}
+		ready = true
 	}
 
 	ctime, err := ptypes.TimestampProto(snap.CreatedAt)
@@ -265,19 +660,13 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		klog.Errorf("Error to convert time to timestamp: %v", err)
 	}
 
-	err = cs.Cloud.WaitSnapshotReady(snap.ID)
-	if err != nil {
-		klog.V(3).Infof("Failed to WaitSnapshotReady: %v", err)
-		return nil, err
-	}
-
 	return &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
 			SnapshotId:     snap.ID,
 			SizeBytes:      int64(snap.Size * 1024 * 1024 * 1024),
 			SourceVolumeId: snap.VolumeID,
 			CreationTime:   ctime,
-			ReadyToUse:     true,
+			ReadyToUse:     ready,
 		},
 	}, nil
 }
@@ -287,8 +676,16 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	id := req.SnapshotId
 
 	// Delegate the check to openstack itself
-	err := cs.Cloud.DeleteSnapshot(id)
+	err := cs.Cloud.DeleteSnapshot(ctx, id)
 	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			klog.V(3).Infof("Snapshot %s is already deleted", id)
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		if inUse, ok := err.(*openstack.SnapshotInUseError); ok {
+			klog.V(3).Infof("Failed to Delete snapshot: %v", inUse)
+			return nil, status.Error(codes.FailedPrecondition, inUse.Error())
+		}
 		klog.V(3).Infof("Failed to Delete snapshot: %v", err)
 		return nil, err
 	}
@@ -296,36 +693,69 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 }
 
 func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max_entries %d", req.GetMaxEntries())
+	}
+
+	// external-snapshotter looks its snapshots up by ID after restarts
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		snap, err := cs.Cloud.GetSnapshotByID(ctx, snapshotID)
+		if cpoerrors.IsNotFound(err) {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if err != nil {
+			klog.V(3).Infof("Failed to get snapshot %s: %v", snapshotID, err)
+			return nil, status.Errorf(codes.Internal, "failed to get snapshot %s: %v", snapshotID, err)
+		}
+		if sourceID := req.GetSourceVolumeId(); sourceID != "" && snap.VolumeID != sourceID {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		return &csi.ListSnapshotsResponse{
+			Entries: []*csi.ListSnapshotsResponse_Entry{{Snapshot: csiSnapshot(snap)}},
+		}, nil
+	}
 
 	filters := map[string]string{}
-	// FIXME: honor the limit, offset and filters later
-	vlist, err := cs.Cloud.ListSnapshots(int(req.MaxEntries), 0, filters)
+	if sourceID := req.GetSourceVolumeId(); sourceID != "" {
+		filters[openstack.SnapshotVolumeIDFilter] = sourceID
+	}
+	slist, next, err := cs.Cloud.ListSnapshots(ctx, int(req.GetMaxEntries()), req.GetStartingToken(), filters)
+	if _, ok := err.(*openstack.InvalidMarkerError); ok {
+		return nil, status.Errorf(codes.Aborted, "invalid starting_token %q: %v", req.GetStartingToken(), err)
+	}
 	if err != nil {
 		klog.V(3).Infof("Failed to ListSnapshots: %v", err)
-		return nil, err
+		return nil, status.Errorf(codes.Internal, "failed to list snapshots: %v", err)
 	}
 
 	var ventries []*csi.ListSnapshotsResponse_Entry
-	for _, v := range vlist {
-		ctime, err := ptypes.TimestampProto(v.CreatedAt)
-		if err != nil {
-			klog.Errorf("Error to convert time to timestamp: %v", err)
-		}
-		ventry := csi.ListSnapshotsResponse_Entry{
-			Snapshot: &csi.Snapshot{
-				SizeBytes:      int64(v.Size * 1024 * 1024 * 1024),
-				SnapshotId:     v.ID,
-				SourceVolumeId: v.VolumeID,
-				CreationTime:   ctime,
-				ReadyToUse:     true,
-			},
+	for i := range slist {
+		// failed snapshots would never become ready
+		if slist[i].Status == openstack.SnapshotErrorStatus {
+			continue
 		}
-		ventries = append(ventries, &ventry)
+		ventries = append(ventries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(&slist[i])})
 	}
 	return &csi.ListSnapshotsResponse{
-		Entries: ventries,
+		Entries:   ventries,
+		NextToken: next,
 	}, nil
+}
 
+// csiSnapshot returns the CSI snapshot of a Cinder snapshot, ready to use once
+// available
+func csiSnapshot(snap *ossnapshots.Snapshot) *csi.Snapshot {
+	ctime, err := ptypes.TimestampProto(snap.CreatedAt)
+	if err != nil {
+		klog.Errorf("Error to convert time to timestamp: %v", err)
+	}
+	return &csi.Snapshot{
+		SizeBytes:      int64(snap.Size * 1024 * 1024 * 1024),
+		SnapshotId:     snap.ID,
+		SourceVolumeId: snap.VolumeID,
+		CreationTime:   ctime,
+		ReadyToUse:     snap.Status == openstack.SnapshotReadyStatus,
+	}
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
@@ -339,18 +769,435 @@ func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, fmt.Sprintf("ValidateVolumeCapabilities is not yet implemented"))
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	caps := req.GetVolumeCapabilities()
+	if len(caps) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+
+	if _, err := cs.Cloud.GetVolume(ctx, volumeID); err != nil {
+		if cpoerrors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume %s not found", volumeID)
+		}
+		klog.V(3).Infof("Failed to GetVolume: %v", err)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("GetVolume failed with error %v", err))
+	}
+
+	for _, c := range caps {
+		// contradicting mount options are invalid whatever the volume
+		mnt := c.GetMount()
+		if _, err := cs.Driver.normalizeMountOptions(mnt.GetMountFlags()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume capability: %v", err)
+		}
+		if fsType := mnt.GetFsType(); fsType != "" {
+			if err := cs.Driver.checkFsType(fsType); err != nil {
+				return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+			}
+		}
+		if !cs.Driver.supportsAccessMode(c.GetAccessMode().GetMode()) {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: fmt.Sprintf("access mode %s is not supported", c.GetAccessMode().GetMode())}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: caps,
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
 }
 
 func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, fmt.Sprintf("GetCapacity is not yet implemented"))
+	// the same volume type as CreateVolume would use
+	params, err := parseVolumeParams(req.GetParameters(), cs.Driver)
+	if err != nil {
+		return nil, err
+	}
+	volType := params.Type
+	if volType == "" {
+		volType = cs.Cloud.GetBlockStorageOpts().DefaultVolumeType
+	}
+
+	capacityGB, err := cs.Cloud.GetAvailableCapacity(ctx, volType)
+	if err == openstack.ErrCapacityUnknown {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("GetCapacity: the capacity available to volume type %q is unknown", volType))
+	}
+	if err != nil {
+		klog.V(3).Infof("Failed to GetCapacity of volume type %q: %v", volType, err)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("GetCapacity failed with error %v", err))
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacityGB * 1024 * 1024 * 1024,
+	}, nil
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, fmt.Sprintf("ControllerExpandVolume is not yet implemented"))
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	capRange := req.GetCapacityRange()
+	if capRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range not provided")
+	}
+
+	volSizeBytes := int64(capRange.GetRequiredBytes())
+	volSizeGB := int(util.RoundUpSize(volSizeBytes, 1024*1024*1024))
+	maxVolSize := capRange.GetLimitBytes()
+	if maxVolSize > 0 && maxVolSize < int64(volSizeGB)*1024*1024*1024 {
+		return nil, status.Error(codes.OutOfRange, "After round-up, volume size exceeds the limit specified")
+	}
+
+	volume, err := cs.Cloud.GetVolume(ctx, volumeID)
+	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume %s not found", volumeID)
+		}
+		klog.V(3).Infof("Failed to GetVolume: %v", err)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("GetVolume failed with error %v", err))
+	}
+
+	nodeExpansionRequired := nodeExpansionRequired(volume)
+
+	if volume.Size >= volSizeGB {
+		// a previous request already expanded the volume
+		klog.V(4).Infof("Volume %s is already of size %d GiB", volumeID, volume.Size)
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         int64(volume.Size * 1024 * 1024 * 1024),
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
+	err = cs.Cloud.ExpandVolume(ctx, volumeID, volSizeGB)
+	if err != nil {
+		klog.V(3).Infof("Failed to ExpandVolume: %v", err)
+		if _, ok := err.(*openstack.OnlineExtendUnsupportedError); ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v, detach it first by stopping the pods using it, the expansion is retried", err)
+		}
+		if werr := waitError(err); werr != err {
+			return nil, werr
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.V(4).Infof("ControllerExpandVolume resized volume %s to %d GiB", volumeID, volSizeGB)
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(volSizeGB * 1024 * 1024 * 1024),
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+// nodeExpansionRequired tells whether the node has to grow the filesystem after
+// the volume itself has been expanded. Raw block volumes, known from the access
+// type recorded in the volume metadata at creation, need nothing from the node.
+func nodeExpansionRequired(volume openstack.Volume) bool {
+	if volume.Metadata[accessTypeMetadataKey] == accessTypeBlock {
+		return false
+	}
+
+	if volume.Status == openstack.VolumeAvailableStatus {
+		// the filesystem is grown when the volume is next staged on a node
+		klog.V(4).Infof("Volume %s is not attached, node expansion is deferred until it is staged", volume.ID)
+	}
+	return true
+}
+
+// ownsVolume returns whether the volume with the given metadata belongs to
+// the cluster. Volumes created before the cluster ID was stamped, and all the
+// volumes when the cluster ID is not set, are treated as owned.
+func (cs *controllerServer) ownsVolume(metadata map[string]string) bool {
+	owner := metadata[clusterMetadataKey]
+	return cs.Driver.cluster == "" || owner == "" || owner == cs.Driver.cluster
+}
+
+// createdByDriver returns whether the volume carries the description or the
+// cluster metadata the driver sets on the volumes it creates, or the metadata
+// the in-tree plugin set on the volumes it created
+func (cs *controllerServer) createdByDriver(volume openstack.Volume) bool {
+	if _, ok := volume.Metadata[clusterMetadataKey]; ok {
+		return true
+	}
+	// created by the in-tree plugin before the migration to the driver
+	if _, ok := volume.Metadata[inTreePVNameMetadataKey]; ok {
+		return true
+	}
+	return volume.Description == openstack.DefaultVolumeDescription || volume.Description == cs.volumeDescription()
+}
+
+// checkVolumeDeletion refuses the deletion of a protected volume, of a volume
+// stamped with the ID of another cluster with --strict-ownership, or not
+// created by the driver with --delete-managed-volumes-only, and returns the
+// volume otherwise. Volumes that don't exist are left to DeleteVolume, nil is
+// returned for them.
+func (cs *controllerServer) checkVolumeDeletion(ctx context.Context, volumeID string) (*openstack.Volume, error) {
+	volume, err := cs.Cloud.GetVolume(ctx, volumeID)
+	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		klog.V(3).Infof("Failed to GetVolume: %v", err)
+		return nil, err
+	}
+	if cs.Driver.strictOwnership && !cs.ownsVolume(volume.Metadata) {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s belongs to cluster %q, not to cluster %q", volumeID, volume.Metadata[clusterMetadataKey], cs.Driver.cluster)
+	}
+	if cs.Driver.managedVolumesOnly && !cs.createdByDriver(volume) && volume.Metadata[allowDeleteMetadataKey] != "true" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s was not created by the driver, set its %s metadata to \"true\" or turn off --delete-managed-volumes-only to delete it", volumeID, allowDeleteMetadataKey)
+	}
+	if err := cs.checkBootVolume(volume, "", "deleted"); err != nil {
+		return nil, err
+	}
+	if err := checkVolumeProtection(volume); err != nil {
+		return nil, err
+	}
+	return &volume, nil
+}
+
+// setImageMetadata sets the image metadata of the storage class on a new
+// volume, the keys already set by a previous attempt are skipped. A failure
+// leaves the volume for the retry of CreateVolume to find.
+func (cs *controllerServer) setImageMetadata(ctx context.Context, vol openstack.Volume, metadata map[string]string) error {
+	missing := map[string]string{}
+	for k, v := range metadata {
+		if vol.ImageMetadata[k] != v {
+			missing[k] = v
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := cs.Cloud.SetVolumeImageMetadata(ctx, vol.ID, missing); err != nil {
+		klog.V(3).Infof("Failed to SetVolumeImageMetadata: %v", err)
+		return err
+	}
+	klog.V(4).Infof("Set the image metadata %v on volume %s", missing, vol.ID)
+	return nil
+}
+
+// retainVolume keeps a volume of a storage class with onDelete: retain for
+// an external cleanup instead of deleting it: the volume is renamed to
+// deleted-<name> and stamped with the time of the deletion and its PV. Both
+// steps are skipped when already done, so that retries and later deletions
+// of the volume leave it as is.
+func (cs *controllerServer) retainVolume(ctx context.Context, volume openstack.Volume) error {
+	if !strings.HasPrefix(volume.Name, retainedVolumePrefix) {
+		if err := cs.Cloud.RenameVolume(ctx, volume.ID, retainedVolumeName(volume.Name)); err != nil {
+			klog.V(3).Infof("Failed to RenameVolume: %v", err)
+			return err
+		}
+	}
+	if _, ok := volume.Metadata[deletedAtMetadataKey]; ok {
+		klog.V(4).Infof("Volume %s is already retained", volume.ID)
+		return nil
+	}
+
+	metadata := map[string]string{deletedAtMetadataKey: time.Now().UTC().Format(time.RFC3339)}
+	pvName := volume.Metadata[pvNameMetadataKey]
+	if pvName == "" {
+		// the name of the CreateVolume call is the one of the PV
+		pvName = volume.Metadata[csiNameMetadataKey]
+	}
+	if pvName != "" {
+		metadata[deletedPVNameMetadataKey] = pvName
+	}
+	if err := cs.Cloud.SetVolumeMetadata(ctx, volume.ID, metadata); err != nil {
+		klog.V(3).Infof("Failed to SetVolumeMetadata: %v", err)
+		return err
+	}
+	retainedVolumes.Inc()
+	klog.Infof("Retained volume %s as %s instead of deleting it, its storage class has %s: %s", volume.ID, retainedVolumeName(volume.Name), onDeleteParam, onDeleteRetain)
+	return nil
+}
+
+// retainedVolumeName returns the name of a retained volume, within the
+// length Cinder accepts
+func retainedVolumeName(name string) string {
+	if strings.HasPrefix(name, retainedVolumePrefix) {
+		return name
+	}
+	return truncate(retainedVolumePrefix+name, maxVolumeNameLength)
+}
+
+// checkBootVolume refuses, with --protect-boot-volumes, to act on a bootable
+// volume attached as the root disk of the instance, or of any instance if
+// instanceID is empty: deleting or detaching it takes the instance down
+func (cs *controllerServer) checkBootVolume(volume openstack.Volume, instanceID, action string) error {
+	if !cs.Driver.protectBootVolumes {
+		return nil
+	}
+	if root, ok := volume.RootAttachment(instanceID); ok {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s is the root disk %s of instance %s and is not %s with --protect-boot-volumes", volume.ID, root.Device, root.ServerID, action)
+	}
+	return nil
+}
+
+// checkVolumeProtection refuses the deletion of a volume whose protected
+// metadata is set to true. A value that is not a boolean protects the volume
+// as well, rather than guessing what was meant.
+func checkVolumeProtection(volume openstack.Volume) error {
+	value, ok := volume.Metadata[protectedMetadataKey]
+	if !ok {
+		return nil
+	}
+	protected, err := strconv.ParseBool(value)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s has an invalid %s metadata %q and is kept, set it to \"false\" with `openstack volume set --property %s=false %s` to delete it", volume.ID, protectedMetadataKey, value, protectedMetadataKey, volume.ID)
+	}
+	if protected {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s is protected from deletion, set its %s metadata to \"false\" with `openstack volume set --property %s=false %s` to delete it", volume.ID, protectedMetadataKey, protectedMetadataKey, volume.ID)
+	}
+	return nil
+}
+
+// volumeMetadata returns the metadata of a new volume, tracing it back to
+// the cluster and, when provided, to its PVC and PV. The access type is kept
+// as a hint for requests that don't carry the volume capability.
+func (cs *controllerServer) volumeMetadata(params *volumeParams, caps []*csi.VolumeCapability) map[string]string {
+	properties := map[string]string{clusterMetadataKey: cs.Driver.cluster}
+	extraCreateMetadata := map[string]string{
+		pvcNameMetadataKey:      params.PVCName,
+		pvcNamespaceMetadataKey: params.PVCNamespace,
+		pvNameMetadataKey:       params.PVName,
+	}
+	for key, v := range extraCreateMetadata {
+		if v != "" {
+			properties[truncateMetadata(key)] = truncateMetadata(v)
+		}
+	}
+	if params.Protected {
+		properties[protectedMetadataKey] = "true"
+	}
+	if params.OnDelete == onDeleteRetain {
+		properties[onDeleteMetadataKey] = onDeleteRetain
+	}
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			properties[accessTypeMetadataKey] = accessTypeBlock
+			break
+		}
+		if c.GetMount() != nil {
+			properties[accessTypeMetadataKey] = accessTypeMount
+		}
+	}
+	return properties
+}
+
+// truncateMetadata cuts s to the Cinder metadata length limit without
+// splitting a multi-byte character
+func truncateMetadata(s string) string {
+	return truncate(s, maxMetadataLength)
+}
+
+// cinderVolumeName returns the Cinder display name of a volume. Names over
+// the Cinder limit are truncated and suffixed with a hash of the full name,
+// so that looking the volume up by name keeps working.
+// The format must not change, or existing volumes would no longer be found.
+func cinderVolumeName(name string) string {
+	if len(name) <= maxVolumeNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:volumeNameHashLength]
+	return truncate(name, maxVolumeNameLength-len(suffix)) + suffix
+}
+
+// volumeDescription returns the description of new volumes, with the
+// {cluster} placeholder of volume-description replaced by the cluster name
+func (cs *controllerServer) volumeDescription() string {
+	description := cs.Cloud.GetBlockStorageOpts().VolumeDescription
+	if description == "" {
+		return openstack.DefaultVolumeDescription
+	}
+	return strings.Replace(description, "{cluster}", cs.Driver.cluster, -1)
+}
+
+// truncate cuts s to at most max bytes without splitting a multi-byte character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	i := max
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i]
+}
+
+// getVolumeAZ picks the availability zone of a new volume, trying in order the
+// storage class parameter, the topology requirement, the configured default and
+// the zone the controller runs in. An empty zone leaves the choice to Cinder.
+// The zones typed by users, the parameter and the default, must be Cinder
+// zones, when they can be listed.
+func (cs *controllerServer) getVolumeAZ(ctx context.Context, req *csi.CreateVolumeRequest, params *volumeParams) (string, error) {
+	if az := params.Availability; az != "" {
+		klog.V(4).Infof("Using availability zone %s from the storage class parameters", az)
+		if err := cs.validateAvailabilityZone(ctx, az, "the storage class parameters"); err != nil {
+			return "", err
+		}
+		return az, nil
+	}
+
+	// the topology and the metadata service give Nova zones
+	opts := cs.Cloud.GetBlockStorageOpts()
+	if req.GetAccessibilityRequirements() != nil {
+		if zone := getAZFromTopology(req.GetAccessibilityRequirements(), cs.Driver.topologyKey()); zone != "" {
+			az := opts.AZMapping.CinderAZ(zone)
+			klog.V(4).Infof("Using availability zone %s from the topology requirement %s", az, zone)
+			return az, nil
+		}
+	}
+
+	if az := opts.DefaultAvailabilityZone; az != "" {
+		klog.V(4).Infof("Using availability zone %s from the cloud config", az)
+		if err := cs.validateAvailabilityZone(ctx, az, "the cloud config"); err != nil {
+			return "", err
+		}
+		return az, nil
+	}
+
+	if cs.Metadata != nil {
+		zone, err := cs.Metadata.GetAvailabilityZone()
+		if err != nil {
+			klog.V(3).Infof("Failed to get availability zone from metadata service: %v", err)
+		} else if zone != "" {
+			az := opts.AZMapping.CinderAZ(zone)
+			klog.V(4).Infof("Using availability zone %s of the controller in %s from the metadata service", az, zone)
+			return az, nil
+		}
+	}
+
+	klog.V(4).Infof("No availability zone found, using the cloud default")
+	return "", nil
+}
+
+// validateAvailabilityZone returns InvalidArgument if az, taken from source, is
+// not one of the Cinder availability zones. Zones are not validated when they
+// cannot be listed.
+func (cs *controllerServer) validateAvailabilityZone(ctx context.Context, az, source string) error {
+	zones, err := cs.Cloud.GetAvailabilityZones(ctx)
+	if err != nil {
+		klog.V(3).Infof("Failed to list the availability zones, not validating %s: %v", az, err)
+		return nil
+	}
+	if len(zones) == 0 {
+		return nil
+	}
+	for _, zone := range zones {
+		if zone == az {
+			return nil
+		}
+	}
+	return status.Errorf(codes.InvalidArgument, "availability zone %q of %s is not one of the Cinder zones %s", az, source, strings.Join(zones, ", "))
 }
 
-func getAZFromTopology(requirement *csi.TopologyRequirement) string {
+func getAZFromTopology(requirement *csi.TopologyRequirement, topologyKey string) string {
 	for _, topology := range requirement.GetPreferred() {
 		zone, exists := topology.GetSegments()[topologyKey]
 		if exists {
@@ -17,12 +17,21 @@ limitations under the License.
 package cinder
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
 )
 
@@ -36,11 +45,13 @@ func init() {
 		flag.Parse()
 
 		osmock = new(openstack.OpenStackMock)
+		osmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{})
+		osmock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
 		openstack.OsInstance = osmock
 
 		d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
 
-		fakeCs = NewControllerServer(d, openstack.OsInstance)
+		fakeCs = NewControllerServer(d, openstack.OsInstance, nil)
 	}
 }
 
@@ -49,8 +60,8 @@ func TestCreateVolume(t *testing.T) {
 
 	// mock OpenStack
 	properties := map[string]string{"cinder.csi.openstack.org/cluster": FakeCluster}
-	// CreateVolume(name string, size int, vtype, availability string, snapshotID string, tags *map[string]string) (string, string, int, error)
-	osmock.On("CreateVolume", FakeVolName, mock.AnythingOfType("int"), FakeVolType, FakeAvailability, "", &properties).Return(FakeVolID, FakeAvailability, FakeCapacityGiB, nil)
+	// CreateVolume(ctx context.Context, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error)
+	osmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, FakeAvailability, "", openstack.DefaultVolumeDescription, &properties).Return(FakeCreatedVol, nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -79,15 +90,15 @@ func TestCreateVolume(t *testing.T) {
 	assert.NotNil(actualRes.Volume.CapacityBytes)
 	assert.NotEqual(0, len(actualRes.Volume.VolumeId), "Volume Id is nil")
 	assert.NotNil(actualRes.Volume.AccessibleTopology)
-	assert.Equal(FakeAvailability, actualRes.Volume.AccessibleTopology[0].GetSegments()[topologyKey])
+	assert.Equal(FakeAvailability, actualRes.Volume.AccessibleTopology[0].GetSegments()[defaultTopologyKey])
 
 }
 
 func TestCreateVolumeFromSnapshot(t *testing.T) {
 
 	properties := map[string]string{"cinder.csi.openstack.org/cluster": FakeCluster}
-	// CreateVolume(name string, size int, vtype, availability string, snapshotID string, tags *map[string]string) (string, string, int, error)
-	osmock.On("CreateVolume", FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", FakeSnapshotID, &properties).Return(FakeVolID, FakeAvailability, FakeCapacityGiB, nil)
+	// CreateVolume(ctx context.Context, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error)
+	osmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", FakeSnapshotID, openstack.DefaultVolumeDescription, &properties).Return(&openstack.Volume{ID: FakeVolID, AZ: FakeAvailability, Size: FakeCapacityGiB, SnapshotID: FakeSnapshotID}, nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -124,6 +135,133 @@ func TestCreateVolumeFromSnapshot(t *testing.T) {
 
 }
 
+// Test the size of a volume restored from a snapshot of 2 GiB
+func TestCreateVolumeFromSnapshotSize(t *testing.T) {
+	tests := []struct {
+		name         string
+		capacity     *csi.CapacityRange
+		expectedCode codes.Code
+		expectedSize int64
+	}{
+		{"unspecified", nil, codes.OK, 2},
+		{"equal", &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024}, codes.OK, 2},
+		{"larger", &csi.CapacityRange{RequiredBytes: 5 * 1024 * 1024 * 1024}, codes.OK, 5},
+		{"smaller", &csi.CapacityRange{RequiredBytes: 1 * 1024 * 1024 * 1024}, codes.InvalidArgument, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			source, err := cloud.CreateVolume(FakeCtx, "source", 2, "", "", "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create the source volume: %v", err)
+			}
+			snap, err := cloud.CreateSnapshot(FakeCtx, FakeSnapshotName, source.ID, "", nil)
+			if err != nil {
+				t.Fatalf("failed to create the snapshot: %v", err)
+			}
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+			res, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+				Name:          FakeVolName,
+				CapacityRange: tt.capacity,
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.ID},
+					},
+				},
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode != codes.OK {
+				assert.Contains(t, err.Error(), "smaller than the size 2 GiB of snapshot "+snap.ID)
+				vols, _ := cloud.ListVolumes(FakeCtx)
+				assert.Len(t, vols, 1)
+				return
+			}
+			assert.Equal(t, tt.expectedSize*1024*1024*1024, res.GetVolume().GetCapacityBytes())
+			assert.Equal(t, snap.ID, res.GetVolume().GetContentSource().GetSnapshot().GetSnapshotId())
+		})
+	}
+}
+
+// Test a volume cannot be restored from a missing snapshot
+func TestCreateVolumeFromMissingSnapshot(t *testing.T) {
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), openstack.NewFakeOpenStack(), nil)
+
+	_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: FakeSnapshotID},
+			},
+		},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// Test CreateVolume refuses the filesystem types the driver doesn't format
+// volumes with, in the storage class or the volume capability
+func TestCreateVolumeFsTypes(t *testing.T) {
+	mountCap := func(fsType string) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType},
+			},
+		}}
+	}
+	tests := []struct {
+		name         string
+		params       map[string]string
+		caps         []*csi.VolumeCapability
+		expectedCode codes.Code
+		expectedMsg  string
+	}{
+		{name: "default", caps: mountCap("")},
+		{name: "allowed capability", caps: mountCap("xfs")},
+		{name: "allowed parameter", params: map[string]string{"fstype": "ext4"}},
+		{name: "rejected capability", caps: mountCap("btrfs"), expectedCode: codes.InvalidArgument, expectedMsg: `"btrfs" is not supported, the supported types are ext4, xfs`},
+		{name: "rejected parameter", params: map[string]string{"fstype": "ext5"}, expectedCode: codes.InvalidArgument, expectedMsg: `"ext5" is not supported, the supported types are ext4, xfs`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			if err := d.SetFsTypes("ext4", []string{"ext4", "xfs"}); err != nil {
+				t.Fatalf("failed to set the filesystem types: %v", err)
+			}
+			cs := NewControllerServer(d, cloud, nil)
+
+			_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+				Name:               FakeVolName,
+				Parameters:         tt.params,
+				VolumeCapabilities: tt.caps,
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode != codes.OK {
+				assert.Contains(t, err.Error(), tt.expectedMsg)
+				assert.Equal(t, 0, cloud.Calls("CreateVolume"))
+			}
+		})
+	}
+}
+
+// Test CreateVolume refuses contradicting mount options before creating the volume
+func TestCreateVolumeMountOptions(t *testing.T) {
+	cloud := openstack.NewFakeOpenStack()
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"noatime", "ro", "rw"}},
+			},
+		}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "conflicting mount options ro and rw")
+	assert.Equal(t, 0, cloud.Calls("CreateVolume"))
+}
+
 // Test CreateVolumeDuplicate
 func TestCreateVolumeDuplicate(t *testing.T) {
 
@@ -145,15 +283,569 @@ func TestCreateVolumeDuplicate(t *testing.T) {
 	// Assert
 	assert.NotNil(actualRes.Volume)
 	assert.NotEqual(0, len(actualRes.Volume.VolumeId), "Volume Id is nil")
-	assert.Equal("nova", actualRes.Volume.AccessibleTopology[0].GetSegments()[topologyKey])
+	assert.Equal("nova", actualRes.Volume.AccessibleTopology[0].GetSegments()[defaultTopologyKey])
 	assert.Equal("261a8b81-3660-43e5-bab8-6470b65ee4e9", actualRes.Volume.VolumeId)
 }
 
+// Test CreateVolume reports the zone the volume was actually created in
+func TestCreateVolumeTopology(t *testing.T) {
+
+	tests := []struct {
+		name             string
+		opts             openstack.BlockStorageOpts
+		createdAZ        string
+		expectedTopology []*csi.Topology
+	}{
+		{
+			name:      "zone of the created volume",
+			createdAZ: "zone-2",
+			expectedTopology: []*csi.Topology{
+				{Segments: map[string]string{defaultTopologyKey: "zone-2"}},
+			},
+		},
+		{
+			name:             "no zone reported",
+			createdAZ:        "",
+			expectedTopology: nil,
+		},
+		{
+			name:             "ignore-volume-az",
+			opts:             openstack.BlockStorageOpts{IgnoreVolumeAZ: true},
+			createdAZ:        "zone-2",
+			expectedTopology: nil,
+		},
+		{
+			name:      "Nova zones of the Cinder zone",
+			opts:      openstack.BlockStorageOpts{AZMapping: openstack.NewAZMapping(map[string]string{"zone-1": "storage-1", "zone-2": "storage-1"})},
+			createdAZ: "storage-1",
+			expectedTopology: []*csi.Topology{
+				{Segments: map[string]string{defaultTopologyKey: "zone-1"}},
+				{Segments: map[string]string{defaultTopologyKey: "zone-2"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			azmock := new(openstack.OpenStackMock)
+			azmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, mock.Anything).Return(&openstack.Volume{ID: FakeVolID, AZ: tt.createdAZ, Size: FakeCapacityGiB}, nil)
+			azmock.On("GetBlockStorageOpts").Return(tt.opts)
+			azmock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), azmock, nil)
+
+			// Fake request
+			fakeReq := &csi.CreateVolumeRequest{
+				Name: FakeVolName,
+			}
+
+			// Invoke CreateVolume
+			actualRes, err := cs.CreateVolume(FakeCtx, fakeReq)
+			if err != nil {
+				t.Errorf("failed to CreateVolume: %v", err)
+			}
+
+			// Assert
+			assert.Equal(t, tt.expectedTopology, actualRes.Volume.AccessibleTopology)
+		})
+	}
+}
+
+// Test the availability zone fallback chain of CreateVolume
+func TestGetVolumeAZ(t *testing.T) {
+
+	topology := &csi.TopologyRequirement{
+		Preferred: []*csi.Topology{
+			{
+				Segments: map[string]string{defaultTopologyKey: "topology-zone"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		params      map[string]string
+		topology    *csi.TopologyRequirement
+		defaultAZ   string
+		metadataAZ  string
+		metadataErr error
+		noMetadata  bool
+		mapping     map[string]string
+		// Cinder zones, validation is unavailable if empty
+		zones        []string
+		zonesErr     error
+		expectedAZ   string
+		expectedCode codes.Code
+	}{
+		{
+			name:       "storage class parameter",
+			params:     map[string]string{"availability": "param-zone"},
+			topology:   topology,
+			defaultAZ:  "config-zone",
+			metadataAZ: "metadata-zone",
+			expectedAZ: "param-zone",
+		},
+		{
+			name:       "topology",
+			topology:   topology,
+			defaultAZ:  "config-zone",
+			metadataAZ: "metadata-zone",
+			expectedAZ: "topology-zone",
+		},
+		{
+			name:       "cloud config default",
+			defaultAZ:  "config-zone",
+			metadataAZ: "metadata-zone",
+			expectedAZ: "config-zone",
+		},
+		{
+			name:       "controller zone from metadata",
+			metadataAZ: "metadata-zone",
+			expectedAZ: "metadata-zone",
+		},
+		{
+			name:        "metadata service failure",
+			metadataErr: errors.New("metadata service unavailable"),
+			expectedAZ:  "",
+		},
+		{
+			name:       "no metadata service",
+			noMetadata: true,
+			expectedAZ: "",
+		},
+		{
+			name:       "mapped topology zone",
+			topology:   topology,
+			mapping:    map[string]string{"topology-zone": "storage-zone"},
+			expectedAZ: "storage-zone",
+		},
+		{
+			name:       "mapped controller zone",
+			metadataAZ: "metadata-zone",
+			mapping:    map[string]string{"metadata-zone": "storage-zone"},
+			expectedAZ: "storage-zone",
+		},
+		{
+			name:       "storage class parameter not mapped",
+			params:     map[string]string{"availability": "param-zone"},
+			mapping:    map[string]string{"param-zone": "storage-zone"},
+			expectedAZ: "param-zone",
+		},
+		{
+			name:       "valid storage class parameter",
+			params:     map[string]string{"availability": "param-zone"},
+			zones:      []string{"config-zone", "param-zone"},
+			expectedAZ: "param-zone",
+		},
+		{
+			name:         "storage class parameter typo",
+			params:       map[string]string{"availability": "parm-zone"},
+			zones:        []string{"config-zone", "param-zone"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:       "valid cloud config default",
+			defaultAZ:  "config-zone",
+			zones:      []string{"config-zone", "param-zone"},
+			expectedAZ: "config-zone",
+		},
+		{
+			name:         "cloud config default typo",
+			defaultAZ:    "confg-zone",
+			zones:        []string{"config-zone", "param-zone"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:       "zones not listed",
+			params:     map[string]string{"availability": "parm-zone"},
+			zonesErr:   errors.New("service unavailable"),
+			expectedAZ: "parm-zone",
+		},
+		{
+			name:       "topology zone not validated",
+			topology:   topology,
+			zones:      []string{"config-zone", "param-zone"},
+			expectedAZ: "topology-zone",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloudmock := new(openstack.OpenStackMock)
+			cloudmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{DefaultAvailabilityZone: tt.defaultAZ, AZMapping: openstack.NewAZMapping(tt.mapping)})
+			cloudmock.On("GetAvailabilityZones", mock.Anything).Return(tt.zones, tt.zonesErr)
+
+			var metadata openstack.IMetadata
+			if !tt.noMetadata {
+				metadatamock := new(openstack.OpenStackMock)
+				metadatamock.On("GetAvailabilityZone").Return(tt.metadataAZ, tt.metadataErr)
+				metadata = metadatamock
+			}
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloudmock, metadata)
+
+			// Fake request
+			fakeReq := &csi.CreateVolumeRequest{
+				Name:                      FakeVolName,
+				Parameters:                tt.params,
+				AccessibilityRequirements: tt.topology,
+			}
+
+			params, err := parseVolumeParams(fakeReq.GetParameters(), cs.Driver)
+			if err != nil {
+				t.Fatalf("failed to parse the parameters: %v", err)
+			}
+
+			// Assert
+			az, err := cs.getVolumeAZ(FakeCtx, fakeReq, params)
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			assert.Equal(t, tt.expectedAZ, az)
+		})
+	}
+}
+
+// Test CreateVolume records the PVC and PV passed by the provisioner
+func TestCreateVolumeExtraMetadata(t *testing.T) {
+
+	properties := map[string]string{
+		"cinder.csi.openstack.org/cluster":       FakeCluster,
+		"cinder.csi.openstack.org/pvc-name":      "fake-pvc",
+		"cinder.csi.openstack.org/pvc-namespace": "fake-namespace",
+		"cinder.csi.openstack.org/pv-name":       "pvc-fake-pv",
+	}
+
+	metamock := new(openstack.OpenStackMock)
+	metamock.On("CreateVolume", mock.Anything, "pvc-fake-pv", mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, &properties).Return(FakeCreatedVol, nil)
+	metamock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{})
+	metamock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), metamock, nil)
+
+	// Fake request
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+		Parameters: map[string]string{
+			"csi.storage.k8s.io/pvc/name":      "fake-pvc",
+			"csi.storage.k8s.io/pvc/namespace": "fake-namespace",
+			"csi.storage.k8s.io/pv/name":       "pvc-fake-pv",
+		},
+	}
+
+	// Invoke CreateVolume
+	_, err := cs.CreateVolume(FakeCtx, fakeReq)
+	if err != nil {
+		t.Errorf("failed to CreateVolume: %v", err)
+	}
+
+	// Assert
+	metamock.AssertCalled(t, "CreateVolume", mock.Anything, "pvc-fake-pv", mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, &properties)
+}
+
+// Test the volume type of the storage class takes precedence over the
+// default-volume-type of the cloud config
+func TestCreateVolumeDefaultVolumeType(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      map[string]string
+		defaultType string
+		expected    string
+	}{
+		{"no type", nil, "", ""},
+		{"default type", nil, "ssd", "ssd"},
+		{"storage class type", map[string]string{"type": "hdd"}, "", "hdd"},
+		{"storage class overrides default", map[string]string{"type": "hdd"}, "ssd", "hdd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typemock := new(openstack.OpenStackMock)
+			typemock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), tt.expected, "", "", openstack.DefaultVolumeDescription, mock.Anything).Return(FakeCreatedVol, nil)
+			typemock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{DefaultVolumeType: tt.defaultType})
+			typemock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), typemock, nil)
+
+			_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+				Name:       FakeVolName,
+				Parameters: tt.params,
+			})
+			assert.NoError(t, err)
+			typemock.AssertCalled(t, "CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), tt.expected, "", "", openstack.DefaultVolumeDescription, mock.Anything)
+		})
+	}
+}
+
+func TestTruncateMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("short", truncateMetadata("short"))
+	assert.Equal(strings.Repeat("a", 255), truncateMetadata(strings.Repeat("a", 300)))
+
+	// a two byte character straddling the limit is dropped entirely
+	assert.Equal(strings.Repeat("a", 254), truncateMetadata(strings.Repeat("a", 254)+"é"))
+}
+
+func TestCinderVolumeName(t *testing.T) {
+	assert := assert.New(t)
+
+	// names within the limit are kept
+	assert.Equal(FakeVolName, cinderVolumeName(FakeVolName))
+	assert.Equal(strings.Repeat("a", 255), cinderVolumeName(strings.Repeat("a", 255)))
+
+	// longer names are truncated and suffixed with a hash of the full name
+	assert.Equal(strings.Repeat("a", 246)+"-9835fa6b", cinderVolumeName(strings.Repeat("a", 300)))
+	assert.Equal("pvc-"+strings.Repeat("x", 242)+"-9fd4fdec", cinderVolumeName("pvc-"+strings.Repeat("x", 260)))
+}
+
+// Test CreateVolume with a name over the Cinder limit
+func TestCreateVolumeLongName(t *testing.T) {
+
+	longName := "pvc-" + strings.Repeat("x", 260)
+	cinderName := "pvc-" + strings.Repeat("x", 242) + "-9fd4fdec"
+	properties := map[string]string{
+		"cinder.csi.openstack.org/cluster":  FakeCluster,
+		"cinder.csi.openstack.org/csi-name": longName,
+	}
+
+	namemock := new(openstack.OpenStackMock)
+	namemock.On("CreateVolume", mock.Anything, cinderName, mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, &properties).Return(FakeCreatedVol, nil)
+	namemock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{})
+	namemock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), namemock, nil)
+
+	// Fake request
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: longName,
+	}
+
+	// Invoke CreateVolume
+	_, err := cs.CreateVolume(FakeCtx, fakeReq)
+	if err != nil {
+		t.Errorf("failed to CreateVolume: %v", err)
+	}
+
+	// Assert
+	namemock.AssertCalled(t, "CreateVolume", mock.Anything, cinderName, mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, &properties)
+}
+
+// Test CreateVolume is idempotent against the in-memory cloud
+func TestCreateVolumeFakeCloud(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+	}
+
+	first, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(err)
+
+	// Retried request returns the same volume
+	second, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(err)
+	assert.Equal(first.GetVolume().GetVolumeId(), second.GetVolume().GetVolumeId())
+
+	vols, err := cloud.ListVolumes(FakeCtx)
+	assert.NoError(err)
+	assert.Len(vols, 1)
+
+	// Cloud failures are returned
+	cloud.InjectFailure("CreateVolume", errors.New("fake error"))
+	_, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: "other-volume"})
+	assert.Error(err)
+}
+
+// Test a volume found in error status by a retried CreateVolume is deleted,
+// and created again by the next retry
+func TestCreateVolumeFailedVolume(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+	}
+
+	first, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(err)
+	assert.NoError(cloud.SetVolumeStatus(first.GetVolume().GetVolumeId(), openstack.VolumeErrorStatus))
+
+	_, err = cs.CreateVolume(FakeCtx, fakeReq)
+	assert.Equal(codes.Aborted, status.Code(err))
+	vols, err := cloud.ListVolumes(FakeCtx)
+	assert.NoError(err)
+	assert.Empty(vols)
+
+	second, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(err)
+	assert.NotEqual(first.GetVolume().GetVolumeId(), second.GetVolume().GetVolumeId())
+}
+
+// Test CreateVolume prefixes the display name and still finds the volumes
+// created before volume-name-prefix was set
+func TestCreateVolumeNamePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	// volume created without a prefix
+	legacy, err := cloud.CreateVolume(FakeCtx, "legacy-volume", 1, "", "", "", "", nil)
+	assert.NoError(err)
+
+	cloud.SetBlockStorageOpts(openstack.BlockStorageOpts{VolumeNamePrefix: "k8s-"})
+
+	resp, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+	assert.NoError(err)
+	vol, err := cloud.GetVolume(FakeCtx, resp.GetVolume().GetVolumeId())
+	assert.NoError(err)
+	assert.Equal("k8s-"+FakeVolName, vol.Name)
+
+	// retried requests find the prefixed volume
+	resp, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+	assert.NoError(err)
+	assert.Equal(vol.ID, resp.GetVolume().GetVolumeId())
+
+	// and the unprefixed one
+	resp, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: "legacy-volume"})
+	assert.NoError(err)
+	assert.Equal(legacy.ID, resp.GetVolume().GetVolumeId())
+
+	vols, err := cloud.ListVolumes(FakeCtx)
+	assert.NoError(err)
+	assert.Len(vols, 2)
+}
+
+// Test the {cluster} placeholder of volume-description
+func TestCreateVolumeDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		expected    string
+	}{
+		{"default", "", openstack.DefaultVolumeDescription},
+		{"fixed", "Created by the CSI driver", "Created by the CSI driver"},
+		{"cluster placeholder", "Created by {cluster}", "Created by " + FakeCluster},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			descmock := new(openstack.OpenStackMock)
+			descmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", "", tt.expected, mock.Anything).Return(FakeCreatedVol, nil)
+			descmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{VolumeDescription: tt.description})
+			descmock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), descmock, nil)
+
+			_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+			assert.NoError(t, err)
+			descmock.AssertCalled(t, "CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", "", tt.expected, mock.Anything)
+		})
+	}
+}
+
+// Test a creation refused because of the project quota is reported as
+// ResourceExhausted, and the retry succeeds once the quota allows it
+func TestCreateVolumeOverQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	cloud.InjectFailures("CreateVolume", gophercloud.ErrUnexpectedResponseCode{
+		Actual: 413,
+		Body:   []byte("VolumeSizeExceedsAvailableQuota"),
+	})
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+
+	_, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+	assert.NoError(err)
+	assert.Equal(2, cloud.Calls("CreateVolume"))
+}
+
+// Test CreateVolume rejects a duplicate request while the first one is in flight
+func TestCreateVolumeInFlight(t *testing.T) {
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// slow backend blocking until released
+	slowmock := new(openstack.OpenStackMock)
+	slowmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, mock.Anything).Run(func(args mock.Arguments) {
+		started <- struct{}{}
+		<-release
+	}).Return(FakeCreatedVol, nil)
+	slowmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{})
+	slowmock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), slowmock, nil)
+
+	// Init assert
+	assert := assert.New(t)
+
+	// Fake request
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := cs.CreateVolume(FakeCtx, fakeReq)
+		errs <- err
+	}()
+	<-started
+
+	// Duplicate request while the first one is still running
+	_, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.Equal(codes.Aborted, status.Code(err))
+
+	close(release)
+	assert.NoError(<-errs)
+
+	// Once the first request completes, a retry goes through
+	_, err = cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(err)
+	slowmock.AssertNumberOfCalls(t, "CreateVolume", 2)
+}
+
+// Test the in-flight entry is released when the backend panics
+func TestCreateVolumeInFlightPanic(t *testing.T) {
+
+	panicmock := new(openstack.OpenStackMock)
+	panicmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, mock.Anything).Run(func(args mock.Arguments) {
+		panic("fake backend failure")
+	}).Return(FakeCreatedVol, nil).Once()
+	panicmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), FakeVolType, "", "", openstack.DefaultVolumeDescription, mock.Anything).Return(FakeCreatedVol, nil)
+	panicmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{})
+	panicmock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), panicmock, nil)
+
+	// Fake request
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+	}
+
+	assert.Panics(t, func() {
+		cs.CreateVolume(FakeCtx, fakeReq)
+	})
+
+	_, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(t, err)
+}
+
 // Test DeleteVolume
 func TestDeleteVolume(t *testing.T) {
 
-	// DeleteVolume(volumeID string) error
-	osmock.On("DeleteVolume", FakeVolID).Return(nil)
+	// GetVolume(ctx context.Context, volumeID string) (Volume, error)
+	osmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID, AZ: FakeAvailability}, nil)
+	// DeleteVolume(ctx context.Context, volumeID string, knownDetached bool) error
+	osmock.On("DeleteVolume", mock.Anything, FakeVolID, false).Return(nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -176,15 +868,358 @@ func TestDeleteVolume(t *testing.T) {
 	assert.Equal(expectedRes, actualRes)
 }
 
+// Test deleting an attached volume is a FailedPrecondition naming the node
+// holding it
+func TestDeleteVolumeInUse(t *testing.T) {
+	inusemock := new(openstack.OpenStackMock)
+	inusemock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	inusemock.On("DeleteVolume", mock.Anything, FakeVolID, false).Return(&openstack.VolumeInUseError{
+		VolumeID:    FakeVolID,
+		ServerIDs:   []string{FakeNodeID},
+		ServerNames: map[string]string{FakeNodeID: "node-1"},
+	})
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), inusemock, nil)
+
+	_, err := cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: FakeVolID})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, fmt.Sprintf("volume %s is still attached to node-1 (instance %s), it can be deleted once detached", FakeVolID, FakeNodeID), status.Convert(err).Message())
+}
+
+// Test the DeleteVolume following a detach tells the volume is known to be
+// detached, once
+func TestDeleteVolumeAfterUnpublish(t *testing.T) {
+	detachmock := new(openstack.OpenStackMock)
+	detachmock.On("DetachVolume", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+	detachmock.On("WaitDiskDetached", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+	detachmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	detachmock.On("DeleteVolume", mock.Anything, FakeVolID, true).Return(errors.New("fake error")).Once()
+	detachmock.On("DeleteVolume", mock.Anything, FakeVolID, false).Return(nil).Once()
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), detachmock, nil)
+
+	_, err := cs.ControllerUnpublishVolume(FakeCtx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+	assert.NoError(t, err)
+
+	_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: FakeVolID})
+	assert.Error(t, err)
+	// the retry checks again
+	_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: FakeVolID})
+	assert.NoError(t, err)
+	detachmock.AssertExpectations(t)
+}
+
+// Test --strict-ownership refuses to delete the volumes of another cluster
+func TestDeleteVolumeStrictOwnership(t *testing.T) {
+	tests := []struct {
+		name         string
+		owner        *map[string]string
+		strict       bool
+		expectedCode codes.Code
+	}{
+		{"same cluster", &map[string]string{"cinder.csi.openstack.org/cluster": FakeCluster}, true, codes.OK},
+		{"not stamped", nil, true, codes.OK},
+		{"other cluster", &map[string]string{"cinder.csi.openstack.org/cluster": "other-cluster"}, true, codes.FailedPrecondition},
+		{"other cluster without strict ownership", &map[string]string{"cinder.csi.openstack.org/cluster": "other-cluster"}, false, codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			vol, err := cloud.CreateVolume(FakeCtx, FakeVolName, 1, "", "", "", "", tt.owner)
+			assert.NoError(t, err)
+
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			d.SetStrictOwnership(tt.strict)
+			cs := NewControllerServer(d, cloud, nil)
+
+			_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+
+			_, getErr := cloud.GetVolume(FakeCtx, vol.ID)
+			if tt.expectedCode == codes.OK {
+				assert.Error(t, getErr, "volume should be deleted")
+				return
+			}
+			// the refusal names both clusters and keeps the volume
+			assert.Contains(t, err.Error(), "other-cluster")
+			assert.Contains(t, err.Error(), FakeCluster)
+			assert.NoError(t, getErr)
+		})
+	}
+}
+
+// Test --delete-managed-volumes-only keeps the volumes not created by the driver
+func TestDeleteVolumeManagedVolumesOnly(t *testing.T) {
+	tests := []struct {
+		name         string
+		description  string
+		metadata     *map[string]string
+		expectedCode codes.Code
+	}{
+		{"description stamp", openstack.DefaultVolumeDescription, nil, codes.OK},
+		{"cluster stamp", "", &map[string]string{"cinder.csi.openstack.org/cluster": FakeCluster}, codes.OK},
+		{"in-tree stamp", "", &map[string]string{"kubernetes.io/created-for/pv/name": "pvc-1"}, codes.OK},
+		{"not stamped", "precious", nil, codes.FailedPrecondition},
+		{"override", "precious", &map[string]string{"cinder.csi.openstack.org/allow-delete": "true"}, codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			vol, err := cloud.CreateVolume(FakeCtx, FakeVolName, 1, "", "", "", tt.description, tt.metadata)
+			assert.NoError(t, err)
+
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			d.SetManagedVolumesOnly(true)
+			cs := NewControllerServer(d, cloud, nil)
+
+			_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+
+			_, getErr := cloud.GetVolume(FakeCtx, vol.ID)
+			if tt.expectedCode == codes.OK {
+				assert.Error(t, getErr, "volume should be deleted")
+				return
+			}
+			// the refusal explains how to override it
+			assert.Contains(t, err.Error(), "cinder.csi.openstack.org/allow-delete")
+			assert.Contains(t, err.Error(), "--delete-managed-volumes-only")
+			assert.NoError(t, getErr)
+		})
+	}
+}
+
+// Test the volumes with the protected metadata set are kept
+func TestDeleteVolumeProtected(t *testing.T) {
+	tests := []struct {
+		name         string
+		metadata     *map[string]string
+		expectedCode codes.Code
+		expectedMsg  string
+	}{
+		{"absent", nil, codes.OK, ""},
+		{"protected", &map[string]string{"cinder.csi.openstack.org/protected": "true"}, codes.FailedPrecondition, "is protected from deletion"},
+		{"unprotected", &map[string]string{"cinder.csi.openstack.org/protected": "false"}, codes.OK, ""},
+		{"malformed", &map[string]string{"cinder.csi.openstack.org/protected": "yes"}, codes.FailedPrecondition, `invalid cinder.csi.openstack.org/protected metadata "yes"`},
+		{"empty", &map[string]string{"cinder.csi.openstack.org/protected": ""}, codes.FailedPrecondition, `invalid cinder.csi.openstack.org/protected metadata ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			vol, err := cloud.CreateVolume(FakeCtx, FakeVolName, 1, "", "", "", "", tt.metadata)
+			assert.NoError(t, err)
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+			_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+
+			_, getErr := cloud.GetVolume(FakeCtx, vol.ID)
+			if tt.expectedCode == codes.OK {
+				assert.Error(t, getErr, "volume should be deleted")
+				return
+			}
+			assert.NoError(t, getErr)
+			// the refusal explains how to clear the flag
+			assert.Contains(t, err.Error(), tt.expectedMsg)
+			assert.Contains(t, err.Error(), "openstack volume set --property cinder.csi.openstack.org/protected=false "+vol.ID)
+
+			// clearing it out-of-band lets the retry delete the volume
+			assert.NoError(t, cloud.SetVolumeMetadata(FakeCtx, vol.ID, map[string]string{"cinder.csi.openstack.org/protected": "false"}))
+			_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: vol.ID})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// Test the protected parameter of the storage class is recorded in the
+// volume metadata, and must be a boolean
+func TestCreateVolumeProtected(t *testing.T) {
+	tests := []struct {
+		value        string
+		expectedCode codes.Code
+		protected    bool
+	}{
+		{"true", codes.OK, true},
+		{"false", codes.OK, false},
+		{"on", codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+			resp, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+				Name:       FakeVolName,
+				Parameters: map[string]string{"protected": tt.value},
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if err != nil {
+				return
+			}
+			vol, err := cloud.GetVolume(FakeCtx, resp.GetVolume().GetVolumeId())
+			assert.NoError(t, err)
+			_, protected := vol.Metadata["cinder.csi.openstack.org/protected"]
+			assert.Equal(t, tt.protected, protected)
+		})
+	}
+}
+
+// Test the image metadata of the storage class is set on the new volumes,
+// the node looking for their disk on the bus it chooses first
+func TestCreateVolumeImageMetadata(t *testing.T) {
+	cloud := openstack.NewFakeOpenStack()
+	cloud.AddInstance(FakeNodeID, "nova")
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+	req := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+		Parameters: map[string]string{
+			"imageMetadata/hw_disk_bus":   "scsi",
+			"imageMetadata/hw_scsi_model": "virtio-scsi",
+		},
+	}
+
+	// the retry sets the metadata on the volume created by the failed call
+	cloud.InjectFailures("SetVolumeImageMetadata", errors.New("fake error"))
+	_, err := cs.CreateVolume(FakeCtx, req)
+	assert.Error(t, err)
+	resp, err := cs.CreateVolume(FakeCtx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cloud.Calls("CreateVolume"))
+	volID := resp.GetVolume().GetVolumeId()
+	vol, err := cloud.GetVolume(FakeCtx, volID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"hw_disk_bus": "scsi", "hw_scsi_model": "virtio-scsi"}, vol.ImageMetadata)
+
+	// set once
+	_, err = cs.CreateVolume(FakeCtx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cloud.Calls("SetVolumeImageMetadata"))
+
+	pub, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: volID,
+		NodeId:   FakeNodeID,
+	})
+	assert.NoError(t, err)
+	byID := strings.Split(pub.GetPublishContext()[devicePathsByIDPublishKey], ",")
+	if assert.Len(t, byID, 3) {
+		assert.True(t, strings.HasPrefix(byID[0], "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_"), byID[0])
+	}
+
+	// keys not allowed are refused before creating anything
+	_, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name:       "other",
+		Parameters: map[string]string{"imageMetadata/os_type": "windows"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 1, cloud.Calls("CreateVolume"))
+}
+
+// Test the volumes of a storage class with onDelete: retain are renamed and
+// stamped instead of deleted, once
+func TestDeleteVolumeRetain(t *testing.T) {
+	cloud := openstack.NewFakeOpenStack()
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	resp, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+		Parameters: map[string]string{
+			"onDelete":                   "retain",
+			"csi.storage.k8s.io/pv/name": "pvc-fake-pv",
+		},
+	})
+	assert.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+	vol, err := cloud.GetVolume(FakeCtx, volID)
+	assert.NoError(t, err)
+	assert.Equal(t, "retain", vol.Metadata["cinder.csi.openstack.org/on-delete"])
+	before := metricValue(t, retainedVolumes)
+
+	// a failure half way is completed by the retry
+	cloud.InjectFailures("SetVolumeMetadata", errors.New("fake error"))
+	_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	assert.Error(t, err)
+	_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cloud.Calls("DeleteVolume"))
+
+	retained, err := cloud.GetVolume(FakeCtx, volID)
+	assert.NoError(t, err)
+	assert.Equal(t, "deleted-"+vol.Name, retained.Name)
+	assert.Equal(t, "pvc-fake-pv", retained.Metadata["cinder.csi.openstack.org/deleted-pv-name"])
+	deletedAt, err := time.Parse(time.RFC3339, retained.Metadata["cinder.csi.openstack.org/deleted-at"])
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), deletedAt, time.Minute)
+	assert.Equal(t, before+1, metricValue(t, retainedVolumes))
+
+	// deleting it again leaves it as is
+	_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	assert.NoError(t, err)
+	again, err := cloud.GetVolume(FakeCtx, volID)
+	assert.NoError(t, err)
+	assert.Equal(t, retained.Name, again.Name)
+	assert.Equal(t, retained.Metadata, again.Metadata)
+	assert.Equal(t, 1, cloud.Calls("RenameVolume"))
+	assert.Equal(t, before+1, metricValue(t, retainedVolumes))
+
+	// onDelete: delete is the default
+	resp, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name:       "other",
+		Parameters: map[string]string{"onDelete": "delete"},
+	})
+	assert.NoError(t, err)
+	_, err = cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+	assert.NoError(t, err)
+	_, err = cloud.GetVolume(FakeCtx, resp.GetVolume().GetVolumeId())
+	assert.Error(t, err, "volume should be deleted")
+}
+
+func TestRetainedVolumeName(t *testing.T) {
+	assert.Equal(t, "deleted-pvc-1", retainedVolumeName("pvc-1"))
+	assert.Equal(t, "deleted-pvc-1", retainedVolumeName("deleted-pvc-1"))
+	long := retainedVolumeName(strings.Repeat("a", 255))
+	assert.Len(t, long, 255)
+	assert.True(t, strings.HasPrefix(long, "deleted-aaa"))
+}
+
+// Test ListVolumes leaves out the volumes of other clusters
+func TestListVolumesClusterFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	owned, _ := cloud.CreateVolume(FakeCtx, "owned", 1, "", "", "", "", &map[string]string{"cinder.csi.openstack.org/cluster": FakeCluster})
+	unstamped, _ := cloud.CreateVolume(FakeCtx, "unstamped", 1, "", "", "", "", nil)
+	cloud.CreateVolume(FakeCtx, "foreign", 1, "", "", "", "", &map[string]string{"cinder.csi.openstack.org/cluster": "other-cluster"})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	resp, err := cs.ListVolumes(FakeCtx, &csi.ListVolumesRequest{})
+	assert.NoError(err)
+
+	var ids []string
+	for _, e := range resp.GetEntries() {
+		ids = append(ids, e.GetVolume().GetVolumeId())
+	}
+	assert.ElementsMatch([]string{owned.ID, unstamped.ID}, ids)
+}
+
 // Test ControllerPublishVolume
 func TestControllerPublishVolume(t *testing.T) {
 
-	// AttachVolume(instanceID, volumeID string) (string, error)
-	osmock.On("AttachVolume", FakeNodeID, FakeVolID).Return(FakeVolID, nil)
-	// WaitDiskAttached(instanceID string, volumeID string) error
-	osmock.On("WaitDiskAttached", FakeNodeID, FakeVolID).Return(nil)
-	// GetAttachmentDiskPath(instanceID, volumeID string) (string, error)
-	osmock.On("GetAttachmentDiskPath", FakeNodeID, FakeVolID).Return(FakeDevicePath, nil)
+	// GetVolume(ctx context.Context, volumeID string) (Volume, error)
+	osmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID, AZ: FakeAvailability}, nil)
+	// GetInstanceAZ(ctx context.Context, instanceID string) (string, error)
+	osmock.On("GetInstanceAZ", mock.Anything, FakeNodeID).Return(FakeAvailability, nil)
+	// AttachFetchedVolume(ctx context.Context, instanceID string, volume *Volume) (string, error)
+	osmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return(FakeDevicePath, nil)
+	// WaitDiskAttached(ctx context.Context, instanceID string, volumeID string) (Volume, error)
+	osmock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	// GetInstanceState(ctx context.Context, instanceID string) (string, error)
+	osmock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -214,13 +1249,415 @@ func TestControllerPublishVolume(t *testing.T) {
 	assert.Equal(expectedRes, actualRes)
 }
 
+// Test ControllerPublishVolume rejects a duplicate request for the same volume and node
+func TestControllerPublishVolumeInFlight(t *testing.T) {
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// slow backend blocking until released
+	slowmock := new(openstack.OpenStackMock)
+	slowmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Run(func(args mock.Arguments) {
+		started <- struct{}{}
+		<-release
+	}).Return(FakeDevicePath, nil)
+	slowmock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	slowmock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
+	slowmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	slowmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), slowmock, nil)
+
+	// Init assert
+	assert := assert.New(t)
+
+	// Fake request
+	fakeReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := cs.ControllerPublishVolume(FakeCtx, fakeReq)
+		errs <- err
+	}()
+	<-started
+
+	// Duplicate request while the first one is still running
+	_, err := cs.ControllerPublishVolume(FakeCtx, fakeReq)
+	assert.Equal(codes.Aborted, status.Code(err))
+
+	// Unpublish of the same volume on the same node waits for the publish too
+	_, err = cs.ControllerUnpublishVolume(FakeCtx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+	assert.Equal(codes.Aborted, status.Code(err))
+
+	close(release)
+	assert.NoError(<-errs)
+	slowmock.AssertNumberOfCalls(t, "AttachFetchedVolume", 1)
+}
+
+// Test ControllerPublishVolume checks the zones of the volume and the instance
+func TestControllerPublishVolumeAZ(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		opts         openstack.BlockStorageOpts
+		volumeAZ     string
+		instanceAZ   string
+		expectedCode codes.Code
+	}{
+		{"same zone", openstack.BlockStorageOpts{}, "zone-1", "zone-1", codes.OK},
+		{"different zones", openstack.BlockStorageOpts{}, "nova", "zone-1", codes.FailedPrecondition},
+		{"unknown volume zone", openstack.BlockStorageOpts{}, "", "zone-1", codes.OK},
+		{"unknown instance zone", openstack.BlockStorageOpts{}, "nova", "", codes.OK},
+		{"different zones ignored", openstack.BlockStorageOpts{IgnoreVolumeAZ: true}, "nova", "zone-1", codes.OK},
+		{"mapped zones", openstack.BlockStorageOpts{AZMapping: openstack.NewAZMapping(map[string]string{"zone-1": "storage-1"})}, "storage-1", "zone-1", codes.OK},
+		{"different mapped zones", openstack.BlockStorageOpts{AZMapping: openstack.NewAZMapping(map[string]string{"zone-1": "storage-1"})}, "zone-1", "zone-1", codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			azmock := new(openstack.OpenStackMock)
+			azmock.On("GetBlockStorageOpts").Return(tt.opts)
+			azmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID, AZ: tt.volumeAZ}, nil)
+			azmock.On("GetInstanceAZ", mock.Anything, FakeNodeID).Return(tt.instanceAZ, nil)
+			azmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return(FakeDevicePath, nil)
+			azmock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+			azmock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), azmock, nil)
+
+			// Fake request
+			fakeReq := &csi.ControllerPublishVolumeRequest{
+				VolumeId: FakeVolID,
+				NodeId:   FakeNodeID,
+			}
+
+			// Invoke ControllerPublishVolume
+			_, err := cs.ControllerPublishVolume(FakeCtx, fakeReq)
+
+			// Assert
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode == codes.FailedPrecondition {
+				assert.Contains(t, err.Error(), tt.volumeAZ)
+				assert.Contains(t, err.Error(), tt.instanceAZ)
+				assert.Contains(t, err.Error(), "ignore-volume-az")
+				azmock.AssertNotCalled(t, "AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything)
+			}
+			if tt.opts.IgnoreVolumeAZ || tt.volumeAZ == "" {
+				azmock.AssertNotCalled(t, "GetInstanceAZ", mock.Anything, FakeNodeID)
+			}
+		})
+	}
+}
+
+// Test a volume stuck attaching or detaching is reported as FailedPrecondition
+// with the way to get it unstuck
+func TestControllerPublishVolumeStuck(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		stuck    *openstack.StuckVolumeError
+		expected string
+	}{
+		{"attaching", &openstack.StuckVolumeError{VolumeID: FakeVolID, Status: openstack.VolumeAttachingStatus, For: time.Hour}, "cinder reset-state"},
+		{"detaching", &openstack.StuckVolumeError{VolumeID: FakeVolID, Status: openstack.VolumeDetachingStatus, For: time.Hour}, "cinder force-detach"},
+		{"recovered", &openstack.StuckVolumeError{VolumeID: FakeVolID, Status: openstack.VolumeAttachingStatus, For: time.Hour, Recovered: true}, "will succeed when retried"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stuckmock := new(openstack.OpenStackMock)
+			stuckmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+			stuckmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true})
+			stuckmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return(FakeDevicePath, nil)
+			stuckmock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{}, tt.stuck)
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), stuckmock, nil)
+
+			_, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+				VolumeId: FakeVolID,
+				NodeId:   FakeNodeID,
+			})
+
+			assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+// Test a volume deleted while being attached is reported as NotFound
+func TestControllerPublishVolumeDeleted(t *testing.T) {
+	deletedmock := new(openstack.OpenStackMock)
+	deletedmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	deletedmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true})
+	deletedmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return(FakeDevicePath, nil)
+	deletedmock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{}, &openstack.VolumeDeletedError{VolumeID: FakeVolID})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), deletedmock, nil)
+
+	_, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Contains(t, err.Error(), "deleted while waiting for attach")
+}
+
+// Test an attach refused by a locked instance is a FailedPrecondition with
+// the lock reason
+func TestControllerPublishVolumeInstanceLocked(t *testing.T) {
+	lockedmock := new(openstack.OpenStackMock)
+	lockedmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	lockedmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true})
+	lockedmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return("", &openstack.InstanceLockedError{InstanceID: FakeNodeID, Reason: "hypervisor maintenance"})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), lockedmock, nil)
+
+	_, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "hypervisor maintenance")
+	lockedmock.AssertNotCalled(t, "WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID)
+}
+
+// Test ControllerPublishVolume gets the volume once, and the device path from
+// the attachment
+func TestControllerPublishVolumeFakeCloud(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	cloud.SetBlockStorageOpts(openstack.BlockStorageOpts{NodeVolumeAttachLimit: 3})
+	cloud.AddInstance(FakeNodeID, "nova")
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	created, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+	assert.NoError(err)
+	volumeID := created.GetVolume().GetVolumeId()
+	gets := cloud.Calls("GetVolume")
+
+	res, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   FakeNodeID,
+	})
+	assert.NoError(err)
+	assert.Equal("/dev/vdb", res.GetPublishContext()["DevicePath"])
+
+	assert.Equal(gets+1, cloud.Calls("GetVolume"))
+	assert.Equal(1, cloud.Calls("AttachFetchedVolume"))
+	assert.Equal(0, cloud.Calls("AttachVolume"))
+	assert.Equal(0, cloud.Calls("GetAttachmentDiskPath"))
+
+	_, err = cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "missing-volume",
+		NodeId:   FakeNodeID,
+	})
+	assert.Equal(codes.NotFound, status.Code(err))
+}
+
+// Test a publish retried after a restart of the controller, the volume being
+// already attached, gets the publish context of the first attach
+func TestControllerPublishVolumeRetryAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := openstack.NewFakeOpenStack()
+	cloud.AddInstance(FakeNodeID, "nova")
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+	created, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+	assert.NoError(err)
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId: created.GetVolume().GetVolumeId(),
+		NodeId:   FakeNodeID,
+		Readonly: true,
+	}
+
+	first, err := cs.ControllerPublishVolume(FakeCtx, req)
+	assert.NoError(err)
+	assert.Equal("/dev/vdb", first.GetPublishContext()["DevicePath"])
+	assert.Equal("fake-attachment-"+req.VolumeId, first.GetPublishContext()[attachmentIDPublishKey])
+	assert.Equal("true", first.GetPublishContext()[readonlyPublishKey])
+
+	restarted := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+	gets := cloud.Calls("GetVolume")
+	retried, err := restarted.ControllerPublishVolume(FakeCtx, req)
+	assert.NoError(err)
+	assert.Equal(first.GetPublishContext(), retried.GetPublishContext())
+	assert.Equal(gets+1, cloud.Calls("GetVolume"))
+	assert.Equal(0, cloud.Calls("GetAttachmentDiskPath"))
+}
+
+// Test volumes are attached to active and stopped instances, the node being
+// told about the stopped ones, and not to shelved ones
+func TestControllerPublishVolumeInstanceState(t *testing.T) {
+	tests := []struct {
+		vmState string
+		code    codes.Code
+		stopped bool
+	}{
+		{vmState: "active", code: codes.OK},
+		{vmState: "stopped", code: codes.OK, stopped: true},
+		{vmState: "shelved_offloaded", code: codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.vmState, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			cloud.AddInstance(FakeNodeID, "nova")
+			cloud.SetInstanceState(FakeNodeID, tt.vmState)
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+			created, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeVolName})
+			assert.NoError(t, err)
+
+			res, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+				VolumeId: created.GetVolume().GetVolumeId(),
+				NodeId:   FakeNodeID,
+			})
+			assert.Equal(t, tt.code, status.Code(err))
+			if err != nil {
+				assert.Contains(t, err.Error(), "openstack server unshelve "+FakeNodeID)
+				return
+			}
+			_, stopped := res.GetPublishContext()[instanceStoppedPublishKey]
+			assert.Equal(t, tt.stopped, stopped)
+		})
+	}
+}
+
+// Test the device path is asked to Cinder when Nova didn't report one
+func TestControllerPublishVolumeNoDevice(t *testing.T) {
+	devicemock := new(openstack.OpenStackMock)
+	devicemock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	devicemock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true})
+	devicemock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return("", nil)
+	devicemock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	devicemock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
+	devicemock.On("GetAttachmentDiskPath", mock.Anything, FakeNodeID, FakeVolID).Return(FakeDevicePath, nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), devicemock, nil)
+
+	res, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, FakeDevicePath, res.GetPublishContext()["DevicePath"])
+}
+
+// Test the device name the volume was attached as is published
+func TestControllerPublishVolumeRequestedDevice(t *testing.T) {
+	devicemock := new(openstack.OpenStackMock)
+	devicemock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	devicemock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true, ExplicitDeviceNames: true})
+	devicemock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return("/dev/vdc", nil).Run(func(args mock.Arguments) {
+		args.Get(2).(*openstack.Volume).RequestedDevice = "/dev/vdc"
+	})
+	devicemock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	devicemock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), devicemock, nil)
+
+	res, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdc", res.GetPublishContext()["DevicePath"])
+	assert.Equal(t, "/dev/vdc", res.GetPublishContext()[requestedDevicePublishKey])
+}
+
+// Test the volume is published without a device path when neither Nova nor
+// Cinder know it, for the node to find it by serial
+func TestControllerPublishVolumeNoDevicePath(t *testing.T) {
+	devicemock := new(openstack.OpenStackMock)
+	devicemock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	devicemock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true})
+	devicemock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return("", nil)
+	devicemock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+	devicemock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
+	devicemock.On("GetAttachmentDiskPath", mock.Anything, FakeNodeID, FakeVolID).Return("", &openstack.NoDevicePathError{VolumeID: FakeVolID, InstanceID: FakeNodeID})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), devicemock, nil)
+
+	res, err := cs.ControllerPublishVolume(FakeCtx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "", res.GetPublishContext()["DevicePath"])
+	// the node finds the device under one of its stable paths
+	assert.Equal(t, "/dev/disk/by-id/virtio-CSIVolumeID,/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_CSIVolumeID,/dev/disk/by-id/wwn-0xCSIVolumeID", res.GetPublishContext()[devicePathsByIDPublishKey])
+}
+
+// Test ControllerPublishVolume against the per-node attachment limit
+func TestControllerPublishVolumeAttachLimit(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		count        int
+		attachedTo   []string
+		expectedCode codes.Code
+	}{
+		{"under the limit", 2, nil, codes.OK},
+		{"at the limit", 3, nil, codes.ResourceExhausted},
+		{"at the limit already attached", 3, []string{FakeNodeID}, codes.OK},
+		{"at the limit already attached after another node", 3, []string{"other-node", FakeNodeID}, codes.OK},
+		{"at the limit attached to another node", 3, []string{"other-node"}, codes.ResourceExhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume := openstack.Volume{ID: FakeVolID}
+			for _, instanceID := range tt.attachedTo {
+				volume.Attachments = append(volume.Attachments, openstack.Attachment{ServerID: instanceID})
+			}
+			if len(tt.attachedTo) > 0 {
+				volume.AttachedServerId = tt.attachedTo[0]
+			}
+
+			limitmock := new(openstack.OpenStackMock)
+			limitmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{IgnoreVolumeAZ: true, NodeVolumeAttachLimit: 3})
+			limitmock.On("GetAttachmentCount", mock.Anything, FakeNodeID).Return(tt.count, nil)
+			limitmock.On("GetVolume", mock.Anything, FakeVolID).Return(volume, nil)
+			limitmock.On("AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything).Return(FakeDevicePath, nil)
+			limitmock.On("WaitDiskAttached", mock.Anything, FakeNodeID, FakeVolID).Return(openstack.Volume{ID: FakeVolID}, nil)
+			limitmock.On("GetInstanceState", mock.Anything, FakeNodeID).Return("active", nil)
+
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), limitmock, nil)
+
+			// Fake request
+			fakeReq := &csi.ControllerPublishVolumeRequest{
+				VolumeId: FakeVolID,
+				NodeId:   FakeNodeID,
+			}
+
+			// Invoke ControllerPublishVolume
+			_, err := cs.ControllerPublishVolume(FakeCtx, fakeReq)
+
+			// Assert
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode == codes.ResourceExhausted {
+				limitmock.AssertNotCalled(t, "AttachFetchedVolume", mock.Anything, FakeNodeID, mock.Anything)
+			}
+		})
+	}
+}
+
 // Test ControllerUnpublishVolume
 func TestControllerUnpublishVolume(t *testing.T) {
 
-	// DetachVolume(instanceID, volumeID string) error
-	osmock.On("DetachVolume", FakeNodeID, FakeVolID).Return(nil)
-	// WaitDiskDetached(instanceID string, volumeID string) error
-	osmock.On("WaitDiskDetached", FakeNodeID, FakeVolID).Return(nil)
+	// DetachVolume(ctx context.Context, instanceID, volumeID string) error
+	osmock.On("DetachVolume", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+	// WaitDiskDetached(ctx context.Context, instanceID string, volumeID string) error
+	osmock.On("WaitDiskDetached", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -246,7 +1683,7 @@ func TestControllerUnpublishVolume(t *testing.T) {
 
 func TestListVolumes(t *testing.T) {
 
-	osmock.On("ListVolumes").Return(nil)
+	osmock.On("ListVolumes", mock.Anything).Return(nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -269,8 +1706,9 @@ func TestListVolumes(t *testing.T) {
 // Test CreateSnapshot
 func TestCreateSnapshot(t *testing.T) {
 
-	osmock.On("CreateSnapshot", FakeSnapshotName, FakeVolID, "", &map[string]string{"tag": "tag1"}).Return(&FakeSnapshotRes, nil)
-	osmock.On("WaitSnapshotReady", FakeSnapshotID).Return(nil)
+	osmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return(nil, nil)
+	osmock.On("CreateSnapshot", mock.Anything, FakeSnapshotName, FakeVolID, "", &map[string]string{"tag": "tag1", "cinder.csi.openstack.org/cluster": FakeCluster}).Return(&FakeSnapshotRes, nil)
+	osmock.On("WaitSnapshotReady", mock.Anything, FakeSnapshotID).Return(nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -292,13 +1730,174 @@ func TestCreateSnapshot(t *testing.T) {
 	assert.Equal(FakeVolID, actualRes.Snapshot.SourceVolumeId)
 
 	assert.NotNil(FakeSnapshotID, actualRes.Snapshot.SnapshotId)
+
+	assert.True(actualRes.Snapshot.ReadyToUse)
+}
+
+// Test CreateSnapshot with a name already used for a different source volume
+func TestCreateSnapshotAlreadyExists(t *testing.T) {
+
+	existing := FakeSnapshotRes
+	existing.Name = FakeSnapshotName
+	existing.VolumeID = "another-volume"
+
+	snapmock := new(openstack.OpenStackMock)
+	snapmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return([]snapshots.Snapshot{existing}, nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), snapmock, nil)
+
+	// Fake request
+	fakeReq := &csi.CreateSnapshotRequest{
+		Name:           FakeSnapshotName,
+		SourceVolumeId: FakeVolID,
+	}
+
+	// Invoke CreateSnapshot
+	_, err := cs.CreateSnapshot(FakeCtx, fakeReq)
+
+	// Assert
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	snapmock.AssertNotCalled(t, "CreateSnapshot", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+// Test CreateSnapshot retried after the first request timed out waiting for the snapshot
+func TestCreateSnapshotRetryAfterTimeout(t *testing.T) {
+
+	creating := FakeSnapshotRes
+	creating.Name = FakeSnapshotName
+	creating.Status = "creating"
+
+	available := creating
+	available.Status = "available"
+
+	snapmock := new(openstack.OpenStackMock)
+	snapmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return(nil, nil).Once()
+	snapmock.On("CreateSnapshot", mock.Anything, FakeSnapshotName, FakeVolID, "", mock.Anything).Return(&creating, nil).Once()
+	snapmock.On("WaitSnapshotReady", mock.Anything, FakeSnapshotID).Return(errors.New("Timeout, Snapshot is still not Ready")).Once()
+	snapmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return([]snapshots.Snapshot{creating}, nil).Once()
+	snapmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return([]snapshots.Snapshot{available}, nil).Once()
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), snapmock, nil)
+
+	// Init assert
+	assert := assert.New(t)
+
+	// Fake request
+	fakeReq := &csi.CreateSnapshotRequest{
+		Name:           FakeSnapshotName,
+		SourceVolumeId: FakeVolID,
+	}
+
+	// First request creates the snapshot but times out waiting for it
+	_, err := cs.CreateSnapshot(FakeCtx, fakeReq)
+	assert.Error(err)
+
+	// Retry returns the existing snapshot, not ready yet
+	actualRes, err := cs.CreateSnapshot(FakeCtx, fakeReq)
+	assert.NoError(err)
+	assert.Equal(FakeSnapshotID, actualRes.Snapshot.SnapshotId)
+	assert.False(actualRes.Snapshot.ReadyToUse)
+
+	// Next retry sees the snapshot available
+	actualRes, err = cs.CreateSnapshot(FakeCtx, fakeReq)
+	assert.NoError(err)
+	assert.Equal(FakeSnapshotID, actualRes.Snapshot.SnapshotId)
+	assert.True(actualRes.Snapshot.ReadyToUse)
+
+	snapmock.AssertNumberOfCalls(t, "CreateSnapshot", 1)
+}
+
+// Test CreateSnapshot rejects a duplicate request while the first one is in flight
+func TestCreateSnapshotInFlight(t *testing.T) {
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// slow backend blocking until released
+	slowmock := new(openstack.OpenStackMock)
+	slowmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return(nil, nil)
+	slowmock.On("CreateSnapshot", mock.Anything, FakeSnapshotName, FakeVolID, "", mock.Anything).Return(&FakeSnapshotRes, nil)
+	slowmock.On("WaitSnapshotReady", mock.Anything, FakeSnapshotID).Run(func(args mock.Arguments) {
+		started <- struct{}{}
+		<-release
+	}).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), slowmock, nil)
+
+	// Init assert
+	assert := assert.New(t)
+
+	// Fake request
+	fakeReq := &csi.CreateSnapshotRequest{
+		Name:           FakeSnapshotName,
+		SourceVolumeId: FakeVolID,
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := cs.CreateSnapshot(FakeCtx, fakeReq)
+		errs <- err
+	}()
+	<-started
+
+	// Duplicate request while the first one is still running
+	_, err := cs.CreateSnapshot(FakeCtx, fakeReq)
+	assert.Equal(codes.Aborted, status.Code(err))
+
+	close(release)
+	assert.NoError(<-errs)
+	slowmock.AssertNumberOfCalls(t, "WaitSnapshotReady", 1)
+}
+
+// Test a snapshot is not blocked by a volume of the same name in flight
+func TestCreateSnapshotInFlightVolumeName(t *testing.T) {
+
+	snapmock := new(openstack.OpenStackMock)
+	snapmock.On("GetSnapshotsByName", mock.Anything, FakeSnapshotName).Return(nil, nil)
+	snapmock.On("CreateSnapshot", mock.Anything, FakeSnapshotName, FakeVolID, "", mock.Anything).Return(&FakeSnapshotRes, nil)
+	snapmock.On("WaitSnapshotReady", mock.Anything, FakeSnapshotID).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), snapmock, nil)
+
+	// a volume of the same name is being created
+	cs.inFlight.Insert("volume/" + FakeSnapshotName)
+
+	_, err := cs.CreateSnapshot(FakeCtx, &csi.CreateSnapshotRequest{
+		Name:           FakeSnapshotName,
+		SourceVolumeId: FakeVolID,
+	})
+	assert.NoError(t, err)
+
+	// while a volume request of that name is still pending
+	_, err = cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{Name: FakeSnapshotName})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+// Test a cancelled request context is reported as Canceled instead of as
+// an internal error
+func TestControllerUnpublishVolumeCanceled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cancelmock := new(openstack.OpenStackMock)
+	cancelmock.On("DetachVolume", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+	cancelmock.On("WaitDiskDetached", mock.Anything, FakeNodeID, FakeVolID).Return(ctx.Err())
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cancelmock, nil)
+
+	_, err := cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+	})
+	assert.Equal(t, codes.Canceled, status.Code(err))
 }
 
 // Test DeleteSnapshot
 func TestDeleteSnapshot(t *testing.T) {
 
-	// DeleteSnapshot(volumeID string) error
-	osmock.On("DeleteSnapshot", FakeSnapshotID).Return(nil)
+	// DeleteSnapshot(ctx context.Context, volumeID string) error
+	osmock.On("DeleteSnapshot", mock.Anything, FakeSnapshotID).Return(nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -321,9 +1920,54 @@ func TestDeleteSnapshot(t *testing.T) {
 	assert.Equal(expectedRes, actualRes)
 }
 
+// Test DeleteSnapshot of a snapshot already removed from Cinder
+func TestDeleteSnapshotNotFound(t *testing.T) {
+
+	snapmock := new(openstack.OpenStackMock)
+	snapmock.On("DeleteSnapshot", mock.Anything, FakeSnapshotID).Return(gophercloud.ErrDefault404{})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), snapmock, nil)
+
+	// Fake request
+	fakeReq := &csi.DeleteSnapshotRequest{
+		SnapshotId: FakeSnapshotID,
+	}
+
+	// Invoke DeleteSnapshot
+	actualRes, err := cs.DeleteSnapshot(FakeCtx, fakeReq)
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Equal(t, &csi.DeleteSnapshotResponse{}, actualRes)
+}
+
+// Test DeleteSnapshot of a snapshot still backing a volume
+func TestDeleteSnapshotInUse(t *testing.T) {
+
+	snapmock := new(openstack.OpenStackMock)
+	snapmock.On("DeleteSnapshot", mock.Anything, FakeSnapshotID).Return(&openstack.SnapshotInUseError{
+		SnapshotID: FakeSnapshotID,
+		Volumes:    []string{FakeVolID},
+	})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), snapmock, nil)
+
+	// Fake request
+	fakeReq := &csi.DeleteSnapshotRequest{
+		SnapshotId: FakeSnapshotID,
+	}
+
+	// Invoke DeleteSnapshot
+	_, err := cs.DeleteSnapshot(FakeCtx, fakeReq)
+
+	// Assert
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), FakeVolID)
+}
+
 func TestListSnapshots(t *testing.T) {
 
-	osmock.On("ListSnapshots", 0, 0, map[string]string{}).Return(FakeSnapshotsRes, nil)
+	osmock.On("ListSnapshots", mock.Anything, 0, "", map[string]string{}).Return(FakeSnapshotsRes, "", nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -341,3 +1985,405 @@ func TestListSnapshots(t *testing.T) {
 
 	assert.NotNil(FakeSnapshotID, actualRes.Entries[0].Snapshot.SnapshotId)
 }
+
+// Test the snapshots are paged through with the tokens, and filtered by
+// source volume
+func TestListSnapshotsPages(t *testing.T) {
+	cloud := openstack.NewFakeOpenStack()
+	vol, _ := cloud.CreateVolume(FakeCtx, "vol", 1, "", "", "", "", nil)
+	other, _ := cloud.CreateVolume(FakeCtx, "other", 1, "", "", "", "", nil)
+	for i := 0; i < 5; i++ {
+		source := vol
+		if i%2 == 1 {
+			source = other
+		}
+		if _, err := cloud.CreateSnapshot(FakeCtx, fmt.Sprintf("snap%d", i), source.ID, "", nil); err != nil {
+			t.Fatalf("failed to create snapshot: %v", err)
+		}
+	}
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	tests := []struct {
+		name     string
+		sourceID string
+		expected int
+	}{
+		{"all", "", 5},
+		{"source volume", other.ID, 2},
+		{"source volume without snapshots", "missing-volume", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed := make(map[string]bool)
+			req := &csi.ListSnapshotsRequest{MaxEntries: 2, SourceVolumeId: tt.sourceID}
+			for pages := 0; pages < 5; pages++ {
+				res, err := cs.ListSnapshots(FakeCtx, req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, len(res.GetEntries()) <= 2, "page of %d snapshots", len(res.GetEntries()))
+				for _, e := range res.GetEntries() {
+					assert.False(t, listed[e.GetSnapshot().GetSnapshotId()], "snapshot listed twice")
+					listed[e.GetSnapshot().GetSnapshotId()] = true
+					if tt.sourceID != "" {
+						assert.Equal(t, tt.sourceID, e.GetSnapshot().GetSourceVolumeId())
+					}
+					assert.True(t, e.GetSnapshot().GetReadyToUse())
+					assert.Equal(t, int64(1024*1024*1024), e.GetSnapshot().GetSizeBytes())
+				}
+				if res.GetNextToken() == "" {
+					break
+				}
+				req.StartingToken = res.GetNextToken()
+			}
+			assert.Len(t, listed, tt.expected)
+		})
+	}
+}
+
+// Test an unknown starting token aborts the listing
+func TestListSnapshotsInvalidToken(t *testing.T) {
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), openstack.NewFakeOpenStack(), nil)
+
+	_, err := cs.ListSnapshots(FakeCtx, &csi.ListSnapshotsRequest{StartingToken: "fake-snapshot-404"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+// Test the lookup of a snapshot by ID, as external-snapshotter does after a
+// restart, among thousands of snapshots
+func TestListSnapshotsByID(t *testing.T) {
+	cloud := openstack.NewFakeOpenStack()
+	vol, _ := cloud.CreateVolume(FakeCtx, "vol", 1, "", "", "", "", nil)
+	var last string
+	for i := 0; i < 3000; i++ {
+		snap, err := cloud.CreateSnapshot(FakeCtx, fmt.Sprintf("snap%d", i), vol.ID, "", nil)
+		if err != nil {
+			t.Fatalf("failed to create snapshot: %v", err)
+		}
+		last = snap.ID
+	}
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+	res, err := cs.ListSnapshots(FakeCtx, &csi.ListSnapshotsRequest{SnapshotId: last})
+	assert.NoError(t, err)
+	if assert.Len(t, res.GetEntries(), 1) {
+		assert.Equal(t, last, res.GetEntries()[0].GetSnapshot().GetSnapshotId())
+		assert.Equal(t, vol.ID, res.GetEntries()[0].GetSnapshot().GetSourceVolumeId())
+	}
+	assert.Equal(t, "", res.GetNextToken())
+	// found without listing
+	assert.Equal(t, 0, cloud.Calls("ListSnapshots"))
+
+	// a filter matching nothing is an empty list
+	for _, req := range []*csi.ListSnapshotsRequest{
+		{SnapshotId: "fake-snapshot-missing"},
+		{SnapshotId: last, SourceVolumeId: "other-volume"},
+	} {
+		res, err := cs.ListSnapshots(FakeCtx, req)
+		assert.NoError(t, err)
+		assert.Empty(t, res.GetEntries())
+	}
+
+	// paging through all of them lists each once
+	listed := make(map[string]bool)
+	req := &csi.ListSnapshotsRequest{MaxEntries: 500}
+	for {
+		res, err := cs.ListSnapshots(FakeCtx, req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, e := range res.GetEntries() {
+			listed[e.GetSnapshot().GetSnapshotId()] = true
+		}
+		if res.GetNextToken() == "" {
+			break
+		}
+		req.StartingToken = res.GetNextToken()
+	}
+	assert.Len(t, listed, 3000)
+	assert.Equal(t, 6, cloud.Calls("ListSnapshots"))
+}
+
+// Test ControllerExpandVolume
+func TestControllerExpandVolume(t *testing.T) {
+
+	expandmock := new(openstack.OpenStackMock)
+	expandmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID, Status: "available", Size: 1}, nil)
+	expandmock.On("ExpandVolume", mock.Anything, FakeVolID, 5).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), expandmock, nil)
+
+	// Fake request
+	fakeReq := &csi.ControllerExpandVolumeRequest{
+		VolumeId: FakeVolID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 5 * 1024 * 1024 * 1024,
+		},
+	}
+
+	// Expected Result
+	expectedRes := &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         5 * 1024 * 1024 * 1024,
+		NodeExpansionRequired: true,
+	}
+
+	// Invoke ControllerExpandVolume
+	actualRes, err := cs.ControllerExpandVolume(FakeCtx, fakeReq)
+	if err != nil {
+		t.Errorf("failed to ControllerExpandVolume: %v", err)
+	}
+
+	// Assert
+	assert.Equal(t, expectedRes, actualRes)
+}
+
+// Test ControllerExpandVolume on a volume that is already large enough
+func TestControllerExpandVolumeAlreadyExpanded(t *testing.T) {
+
+	expandmock := new(openstack.OpenStackMock)
+	expandmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID, Status: "in-use", Size: 5}, nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), expandmock, nil)
+
+	// Fake request
+	fakeReq := &csi.ControllerExpandVolumeRequest{
+		VolumeId: FakeVolID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 5 * 1024 * 1024 * 1024,
+		},
+	}
+
+	// Invoke ControllerExpandVolume
+	actualRes, err := cs.ControllerExpandVolume(FakeCtx, fakeReq)
+	if err != nil {
+		t.Errorf("failed to ControllerExpandVolume: %v", err)
+	}
+
+	// Assert
+	assert.Equal(t, int64(5*1024*1024*1024), actualRes.CapacityBytes)
+	expandmock.AssertNotCalled(t, "ExpandVolume", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// Test ControllerExpandVolume checks the limit against the rounded up size
+func TestControllerExpandVolumeLimit(t *testing.T) {
+
+	expandmock := new(openstack.OpenStackMock)
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), expandmock, nil)
+
+	// 4.5 GiB rounds up to 5 GiB, above the limit
+	fakeReq := &csi.ControllerExpandVolumeRequest{
+		VolumeId: FakeVolID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 4*1024*1024*1024 + 512*1024*1024,
+			LimitBytes:    4*1024*1024*1024 + 768*1024*1024,
+		},
+	}
+
+	_, err := cs.ControllerExpandVolume(FakeCtx, fakeReq)
+
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	expandmock.AssertNotCalled(t, "GetVolume", mock.Anything, mock.Anything)
+	expandmock.AssertNotCalled(t, "ExpandVolume", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// Test ControllerExpandVolume tells to detach a volume the cloud cannot
+// extend online
+func TestControllerExpandVolumeInUse(t *testing.T) {
+
+	expandmock := new(openstack.OpenStackMock)
+	expandmock.On("GetVolume", mock.Anything, FakeVolID).Return(openstack.Volume{ID: FakeVolID, Status: "in-use", Size: 1}, nil)
+	expandmock.On("ExpandVolume", mock.Anything, FakeVolID, 5).Return(&openstack.OnlineExtendUnsupportedError{VolumeID: FakeVolID, Reason: "fake error"})
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), expandmock, nil)
+
+	// Fake request
+	fakeReq := &csi.ControllerExpandVolumeRequest{
+		VolumeId: FakeVolID,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 5 * 1024 * 1024 * 1024,
+		},
+	}
+
+	// Invoke ControllerExpandVolume
+	_, err := cs.ControllerExpandVolume(FakeCtx, fakeReq)
+
+	// Assert
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "detach it first")
+}
+
+func TestGetCapacity(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      map[string]string
+		defaultType string
+		wantType    string
+		capacityGB  int64
+		err         error
+		code        codes.Code
+	}{
+		{name: "storage class type", params: map[string]string{"type": "ssd"}, defaultType: "hdd", wantType: "ssd", capacityGB: 200},
+		{name: "default type", defaultType: "hdd", wantType: "hdd", capacityGB: 100},
+		{name: "no type", capacityGB: 300},
+		{name: "unknown", err: openstack.ErrCapacityUnknown, code: codes.Unavailable},
+		{name: "failure", err: errors.New("fake error"), code: codes.Internal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capmock := new(openstack.OpenStackMock)
+			capmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{DefaultVolumeType: tt.defaultType})
+			capmock.On("GetAvailableCapacity", mock.Anything, tt.wantType).Return(tt.capacityGB, tt.err)
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), capmock, nil)
+
+			res, err := cs.GetCapacity(FakeCtx, &csi.GetCapacityRequest{Parameters: tt.params})
+			if tt.err != nil {
+				assert.Equal(t, tt.code, status.Code(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.capacityGB*1024*1024*1024, res.AvailableCapacity)
+			capmock.AssertExpectations(t)
+		})
+	}
+}
+
+func TestNodeExpansionRequired(t *testing.T) {
+
+	blockHint := map[string]string{"cinder.csi.openstack.org/access-type": "block"}
+	mountHint := map[string]string{"cinder.csi.openstack.org/access-type": "mount"}
+
+	tests := []struct {
+		name     string
+		volume   openstack.Volume
+		expected bool
+	}{
+		{"block hint attached", openstack.Volume{Status: "in-use", Metadata: blockHint}, false},
+		{"block hint detached", openstack.Volume{Status: "available", Metadata: blockHint}, false},
+		{"mount hint attached", openstack.Volume{Status: "in-use", Metadata: mountHint}, true},
+		{"mount hint detached", openstack.Volume{Status: "available", Metadata: mountHint}, true},
+		{"no hint", openstack.Volume{Status: "in-use"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, nodeExpansionRequired(tt.volume))
+		})
+	}
+}
+
+// Test --protect-boot-volumes refuses to delete or detach bootable volumes
+// attached as a root disk only
+func TestProtectBootVolumes(t *testing.T) {
+	tests := []struct {
+		name     string
+		bootable bool
+		device   string
+		refused  bool
+	}{
+		{"bootable root disk", true, "/dev/vda", true},
+		{"bootable data disk", true, "/dev/vdb", false},
+		{"root disk", false, "/dev/vda", false},
+		{"data disk", false, "/dev/vdb", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume := openstack.Volume{
+				ID:          FakeVolID,
+				Status:      "in-use",
+				Bootable:    tt.bootable,
+				Attachments: []openstack.Attachment{{ServerID: FakeNodeID, Device: tt.device}},
+			}
+			osmock := new(openstack.OpenStackMock)
+			osmock.On("GetVolume", mock.Anything, FakeVolID).Return(volume, nil)
+			osmock.On("DeleteVolume", mock.Anything, FakeVolID, false).Return(nil)
+			osmock.On("DetachVolume", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+			osmock.On("WaitDiskDetached", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			d.SetProtectBootVolumes(true)
+			cs := NewControllerServer(d, osmock, nil)
+
+			_, deleteErr := cs.DeleteVolume(FakeCtx, &csi.DeleteVolumeRequest{VolumeId: FakeVolID})
+			_, detachErr := cs.ControllerUnpublishVolume(FakeCtx, &csi.ControllerUnpublishVolumeRequest{VolumeId: FakeVolID, NodeId: FakeNodeID})
+			if !tt.refused {
+				assert.NoError(t, deleteErr)
+				assert.NoError(t, detachErr)
+				return
+			}
+			assert.Equal(t, codes.FailedPrecondition, status.Code(deleteErr))
+			assert.Equal(t, fmt.Sprintf("Volume %s is the root disk /dev/vda of instance %s and is not deleted with --protect-boot-volumes", FakeVolID, FakeNodeID), status.Convert(deleteErr).Message())
+			assert.Equal(t, codes.FailedPrecondition, status.Code(detachErr))
+			assert.Contains(t, detachErr.Error(), "is not detached with --protect-boot-volumes")
+			osmock.AssertNotCalled(t, "DeleteVolume", mock.Anything, FakeVolID, false)
+			osmock.AssertNotCalled(t, "DetachVolume", mock.Anything, FakeNodeID, FakeVolID)
+		})
+	}
+
+	// without the flag the root disks are left to Cinder and Nova
+	osmock := new(openstack.OpenStackMock)
+	osmock.On("DetachVolume", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+	osmock.On("WaitDiskDetached", mock.Anything, FakeNodeID, FakeVolID).Return(nil)
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), osmock, nil)
+	_, err := cs.ControllerUnpublishVolume(FakeCtx, &csi.ControllerUnpublishVolumeRequest{VolumeId: FakeVolID, NodeId: FakeNodeID})
+	assert.NoError(t, err)
+	osmock.AssertNotCalled(t, "GetVolume", mock.Anything, FakeVolID)
+}
+
+// Test ValidateVolumeCapabilities confirms the supported capabilities only
+func TestValidateVolumeCapabilities(t *testing.T) {
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode, fsType string, flags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: flags},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	writer := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	tests := []struct {
+		name         string
+		volumeID     string
+		caps         []*csi.VolumeCapability
+		expectedCode codes.Code
+		confirmed    bool
+		expectedMsg  string
+	}{
+		{name: "supported", caps: []*csi.VolumeCapability{mountCap(writer, "ext4", "noatime")}, confirmed: true},
+		{name: "duplicated mount options", caps: []*csi.VolumeCapability{mountCap(writer, "", "ro", "ro")}, confirmed: true},
+		{name: "unsupported access mode", caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "")}, expectedMsg: "access mode MULTI_NODE_MULTI_WRITER is not supported"},
+		{name: "unsupported filesystem", caps: []*csi.VolumeCapability{mountCap(writer, "vfat")}, expectedMsg: `filesystem type "vfat" is not supported`},
+		{name: "conflicting mount options", caps: []*csi.VolumeCapability{mountCap(writer, "", "sync,async")}, expectedCode: codes.InvalidArgument, expectedMsg: "conflicting mount options sync and async"},
+		{name: "no capabilities", expectedCode: codes.InvalidArgument, expectedMsg: "Volume capabilities missing in request"},
+		{name: "missing volume", volumeID: "missing-volume", caps: []*csi.VolumeCapability{mountCap(writer, "")}, expectedCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := openstack.NewFakeOpenStack()
+			vol, err := cloud.CreateVolume(FakeCtx, FakeVolName, 1, "", "", "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create the volume: %v", err)
+			}
+			cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloud, nil)
+
+			volumeID := tt.volumeID
+			if volumeID == "" {
+				volumeID = vol.ID
+			}
+			res, err := cs.ValidateVolumeCapabilities(FakeCtx, &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volumeID,
+				VolumeCapabilities: tt.caps,
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode != codes.OK {
+				assert.Contains(t, err.Error(), tt.expectedMsg)
+				return
+			}
+			if tt.confirmed {
+				assert.Equal(t, tt.caps, res.GetConfirmed().GetVolumeCapabilities())
+				return
+			}
+			assert.Nil(t, res.GetConfirmed())
+			assert.Contains(t, res.GetMessage(), tt.expectedMsg)
+		})
+	}
+}
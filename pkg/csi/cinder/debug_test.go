@@ -0,0 +1,89 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterDebugHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterDebugHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		contains string
+	}{
+		{"/debug/pprof/", "goroutine"},
+		{"/debug/pprof/goroutine?debug=1", "goroutine profile"},
+		{"/debug/vars", "memstats"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Contains(t, string(body), tt.contains)
+		})
+	}
+}
+
+func TestDebugListenAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+		errMsg   string
+	}{
+		{":6060", "localhost:6060", ""},
+		{"127.0.0.1:6060", "127.0.0.1:6060", ""},
+		{"0.0.0.0:6060", "0.0.0.0:6060", ""},
+		{"[::1]:6060", "[::1]:6060", ""},
+		{"6060", "", "invalid --debug-address"},
+		{"localhost:", "", "missing port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			address, err := DebugListenAddress(tt.address)
+			if tt.errMsg != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.errMsg)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, address)
+		})
+	}
+}
+
+func TestSamePort(t *testing.T) {
+	assert.True(t, SamePort(":9808", "localhost:9808"))
+	assert.False(t, SamePort(":9808", "localhost:6060"))
+	assert.False(t, SamePort("", "localhost:9808"))
+}
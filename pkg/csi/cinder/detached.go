@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"sync"
+	"time"
+)
+
+// a DeleteVolume following the detach by longer is checked again
+const detachedVolumeTTL = 1 * time.Minute
+
+// detachedVolumes remembers the volumes ControllerUnpublishVolume waited for
+// the detach of, so that the DeleteVolume following it doesn't fetch the
+// volume again to check it is not attached.
+type detachedVolumes struct {
+	mux     sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	volumes map[string]time.Time
+}
+
+// newDetachedVolumes returns an empty detachedVolumes
+func newDetachedVolumes() *detachedVolumes {
+	return &detachedVolumes{
+		ttl:     detachedVolumeTTL,
+		now:     time.Now,
+		volumes: make(map[string]time.Time),
+	}
+}
+
+// Add records that the volume was detached, dropping the expired records
+func (d *detachedVolumes) Add(volumeID string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	now := d.now()
+	for id, expires := range d.volumes {
+		if now.After(expires) {
+			delete(d.volumes, id)
+		}
+	}
+	d.volumes[volumeID] = now.Add(d.ttl)
+}
+
+// Forget drops the record of the volume, after it was attached again
+func (d *detachedVolumes) Forget(volumeID string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	delete(d.volumes, volumeID)
+}
+
+// Take returns whether the volume was detached recently, and drops its record
+func (d *detachedVolumes) Take(volumeID string) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	expires, ok := d.volumes[volumeID]
+	delete(d.volumes, volumeID)
+	return ok && !d.now().After(expires)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetachedVolumes(t *testing.T) {
+	d := newDetachedVolumes()
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	// taken once
+	d.Add("vol1")
+	assert.True(t, d.Take("vol1"))
+	assert.False(t, d.Take("vol1"))
+
+	// attached again
+	d.Add("vol1")
+	d.Forget("vol1")
+	assert.False(t, d.Take("vol1"))
+
+	// expired
+	d.Add("vol1")
+	now = now.Add(detachedVolumeTTL + time.Second)
+	assert.False(t, d.Take("vol1"))
+
+	// expired records are dropped by the next Add
+	d.Add("vol1")
+	now = now.Add(detachedVolumeTTL + time.Second)
+	d.Add("vol2")
+	assert.Len(t, d.volumes, 1)
+	assert.True(t, d.Take("vol2"))
+}
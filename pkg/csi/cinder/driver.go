@@ -17,24 +17,53 @@ limitations under the License.
 package cinder
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+	"k8s.io/cloud-provider-openstack/pkg/version"
 	"k8s.io/klog"
 )
 
+// DefaultDriverName is the name of the driver unless configured otherwise
+const DefaultDriverName = "cinder.csi.openstack.org"
+
+// Maximum length of a CSI driver name
+const maxDriverNameLength = 63
+
+// Run modes of the driver, selecting the CSI services it serves.
+// The identity service is always served.
 const (
-	driverName  = "cinder.csi.openstack.org"
-	topologyKey = "topology." + driverName + "/zone"
+	ModeAll        = "all"
+	ModeController = "controller"
+	ModeNode       = "node"
 )
 
-var (
-	version = "1.0.0"
-)
+// Default time during which the result of a readiness check is reused
+const defaultProbeInterval = 30 * time.Second
+
+// DefaultFsType is the filesystem volumes are formatted with when neither
+// their capability nor their volume context names one
+const DefaultFsType = "ext4"
+
+// DefaultSupportedFsTypes are the filesystems the driver formats volumes with
+// unless configured otherwise
+var DefaultSupportedFsTypes = []string{"ext2", "ext3", "ext4", "xfs"}
+
+// DefaultImageMetadataKeys are the image metadata keys storage classes may
+// set on their volumes unless configured otherwise, those choosing the bus
+// Nova attaches the disks on
+var DefaultImageMetadataKeys = []string{"hw_disk_bus", "hw_scsi_model"}
 
 type CinderDriver struct {
 	name        string
@@ -44,40 +73,67 @@ type CinderDriver struct {
 	cloudconfig string
 	cluster     string
 
+	probeEnabled  bool
+	probeInterval time.Duration
+
+	operationTimeout time.Duration
+
+	trustDevicePath    bool
+	strictOwnership    bool
+	managedVolumesOnly bool
+	protectBootVolumes bool
+	strictParameters   bool
+
+	defaultFsType    string
+	supportedFsTypes []string
+
+	imageMetadataKeys []string
+
+	mountOptionsDenylist []string
+
+	zoneTopologyKey   string
+	regionTopologyKey string
+	region            string
+	topologySegments  map[string]string
+
+	leader               *leaderGate
+	leaderElectionConfig *leaderelection.LeaderElectionConfig
+
+	audit *auditLog
+
 	ids *identityServer
 	cs  *controllerServer
 	ns  *nodeServer
 
+	// optional capabilities supported by the cloud, nil until probed, and
+	// forced on or off
+	supportedCapabilities map[string]bool
+	forcedCapabilities    map[string]bool
+
 	vcap  []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 	nscap []*csi.NodeServiceCapability
 }
 
 func NewDriver(nodeID, endpoint, cluster string) *CinderDriver {
-	klog.Infof("Driver: %v version: %v", driverName, version)
+	klog.Infof("Driver: %v version: %v", DefaultDriverName, version.String())
 
 	d := &CinderDriver{}
-	d.name = driverName
+	d.name = DefaultDriverName
 	d.nodeID = nodeID
-	d.version = version
+	d.version = version.Version
 	d.endpoint = endpoint
 	d.cluster = cluster
+	d.probeEnabled = true
+	d.probeInterval = defaultProbeInterval
+	d.defaultFsType = DefaultFsType
+	d.supportedFsTypes = DefaultSupportedFsTypes
+	d.imageMetadataKeys = DefaultImageMetadataKeys
 
-	d.AddControllerServiceCapabilities(
-		[]csi.ControllerServiceCapability_RPC_Type{
-			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
-		})
+	// all the optional capabilities until the cloud is probed
+	d.updateCapabilities()
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
-	d.AddNodeServiceCapabilities(
-		[]csi.NodeServiceCapability_RPC_Type{
-			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-		})
-
 	return d
 }
 
@@ -131,15 +187,236 @@ func (d *CinderDriver) GetVolumeCapabilityAccessModes() []*csi.VolumeCapability_
 	return d.vcap
 }
 
+// supportsAccessMode returns whether volumes may be published with mode
+func (d *CinderDriver) supportsAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, c := range d.vcap {
+		if c.GetMode() == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDriverName changes the name under which the driver registers, so that
+// several instances of it can run in the same cluster. The name must be a
+// DNS subdomain of at most 63 characters.
+func (d *CinderDriver) SetDriverName(name string) error {
+	if len(name) > maxDriverNameLength {
+		return fmt.Errorf("invalid driver name %q: must be no more than %d characters", name, maxDriverNameLength)
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid driver name %q: %s", name, strings.Join(errs, ", "))
+	}
+	klog.Infof("Using driver name: %v", name)
+	d.name = name
+	return nil
+}
+
+// topologyKey returns the key of the availability zone in topology segments
+func (d *CinderDriver) topologyKey() string {
+	if d.zoneTopologyKey != "" {
+		return d.zoneTopologyKey
+	}
+	return zoneTopologyKeyFor(d.name)
+}
+
+// SetProbeOptions configures whether Probe checks the connectivity of the
+// plugin, and how long the result of a check is reused
+func (d *CinderDriver) SetProbeOptions(enabled bool, interval time.Duration) {
+	d.probeEnabled = enabled
+	d.probeInterval = interval
+}
+
+// SetTrustDevicePath configures whether the node stages volumes on the device
+// path reported by Nova instead of looking the device up itself
+func (d *CinderDriver) SetTrustDevicePath(trust bool) {
+	d.trustDevicePath = trust
+}
+
+// SetStrictOwnership configures whether DeleteVolume refuses to delete the
+// volumes stamped with the ID of another cluster
+func (d *CinderDriver) SetStrictOwnership(strict bool) {
+	d.strictOwnership = strict
+}
+
+// SetManagedVolumesOnly configures whether DeleteVolume refuses to delete the
+// volumes that were not created by the driver
+func (d *CinderDriver) SetManagedVolumesOnly(managedOnly bool) {
+	d.managedVolumesOnly = managedOnly
+}
+
+// SetProtectBootVolumes configures whether DeleteVolume and
+// ControllerUnpublishVolume refuse to act on the volumes instances boot from
+func (d *CinderDriver) SetProtectBootVolumes(protect bool) {
+	d.protectBootVolumes = protect
+}
+
+// SetStrictParameters configures whether CreateVolume refuses the storage
+// class parameters it doesn't know instead of ignoring them
+func (d *CinderDriver) SetStrictParameters(strict bool) {
+	d.strictParameters = strict
+}
+
+// SetFsTypes configures the filesystem volumes are formatted with by
+// default, and the filesystems the driver formats volumes with at all. The
+// default must be one of them.
+func (d *CinderDriver) SetFsTypes(defaultFsType string, supported []string) error {
+	if len(supported) == 0 {
+		return fmt.Errorf("no supported filesystem type")
+	}
+	for _, fsType := range supported {
+		if fsType == "" {
+			return fmt.Errorf("invalid supported filesystem types %q: empty type", strings.Join(supported, ","))
+		}
+	}
+	d.supportedFsTypes = supported
+	if err := d.checkFsType(defaultFsType); err != nil {
+		d.supportedFsTypes = DefaultSupportedFsTypes
+		return fmt.Errorf("invalid default filesystem type: %v", err)
+	}
+	d.defaultFsType = defaultFsType
+	klog.Infof("Formatting volumes with %s by default, supporting %s", defaultFsType, strings.Join(supported, ", "))
+	return nil
+}
+
+// SetImageMetadataKeys configures the image metadata keys storage classes may
+// set on their volumes with imageMetadata/<key> parameters, none if empty
+func (d *CinderDriver) SetImageMetadataKeys(keys []string) error {
+	for _, key := range keys {
+		if key == "" || strings.Contains(key, "/") {
+			return fmt.Errorf("invalid image metadata key %q", key)
+		}
+	}
+	d.imageMetadataKeys = keys
+	return nil
+}
+
+// checkImageMetadataKey returns an error naming the allowed image metadata
+// keys if key is not one of them
+func (d *CinderDriver) checkImageMetadataKey(key string) error {
+	for _, allowed := range d.imageMetadataKeys {
+		if key == allowed {
+			return nil
+		}
+	}
+	if len(d.imageMetadataKeys) == 0 {
+		return fmt.Errorf("no image metadata key is allowed by --image-metadata-keys")
+	}
+	return fmt.Errorf("image metadata key %q is not allowed, the keys allowed by --image-metadata-keys are %s", key, strings.Join(d.imageMetadataKeys, ", "))
+}
+
+// checkFsType returns an error naming the supported filesystem types if
+// fsType is not one of them
+func (d *CinderDriver) checkFsType(fsType string) error {
+	for _, supported := range d.supportedFsTypes {
+		if fsType == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("filesystem type %q is not supported, the supported types are %s", fsType, strings.Join(d.supportedFsTypes, ", "))
+}
+
+// ValidateMode checks that mode is one of the supported run modes
+func ValidateMode(mode string) error {
+	switch mode {
+	case ModeAll, ModeController, ModeNode:
+		return nil
+	}
+	return fmt.Errorf("invalid mode %q, must be one of %s, %s or %s", mode, ModeAll, ModeController, ModeNode)
+}
+
+// SetupDriver configures the driver to serve both the controller and the node service
 func (d *CinderDriver) SetupDriver(cloud openstack.IOpenStack, mount mount.IMount, metadata openstack.IMetadata) {
+	d.cs = NewControllerServer(d, cloud, metadata)
+	d.ns = NewNodeServer(d, mount, metadata)
+	d.setupIdentityService()
+}
 
-	d.ids = NewIdentityServer(d)
-	d.cs = NewControllerServer(d, cloud)
+// SetupControllerService configures the driver to serve the controller service
+func (d *CinderDriver) SetupControllerService(cloud openstack.IOpenStack, metadata openstack.IMetadata) {
+	d.cs = NewControllerServer(d, cloud, metadata)
+	d.setupIdentityService()
+}
+
+// SetupNodeService configures the driver to serve the node service. It fails
+// if the ID of the node cannot be determined.
+func (d *CinderDriver) SetupNodeService(mount mount.IMount, metadata openstack.IMetadata) error {
+	if d.nodeID != "" && !isInstanceID(d.nodeID) {
+		klog.Warningf("Ignoring the node ID %q, which is not an instance UUID, and looking up the instance ID", d.nodeID)
+	}
+	nodeID, source, err := getNodeID(d.nodeID, mount, metadata)
+	if err != nil {
+		return fmt.Errorf("failed to determine the node ID: %v", err)
+	}
+	klog.Infof("Using instance ID %s from %s as the node ID", nodeID, source)
 	d.ns = NewNodeServer(d, mount, metadata)
+	setNodeHypervisor(d.ns.hypervisor())
+	d.setupIdentityService()
+	return nil
+}
+
+// setupIdentityService creates the identity server, whose readiness check
+// covers the services configured so far
+func (d *CinderDriver) setupIdentityService() {
+	d.ids = NewIdentityServer(d)
+	if !d.probeEnabled {
+		return
+	}
 
+	var checks []func() error
+	if d.cs != nil {
+		// the controller must be able to reach the Cinder API
+		cloud := d.cs.Cloud
+		checks = append(checks, func() error {
+			return cloud.CheckBlockStorageAPI(context.Background())
+		})
+	}
+	if d.ns != nil {
+		// the node must be able to determine its instance ID, and to format
+		// the volumes
+		override, mount, metadata := d.nodeID, d.ns.Mount, d.ns.Metadata
+		checks = append(checks, func() error {
+			_, _, err := getNodeID(override, mount, metadata)
+			return err
+		})
+		fsTypes := d.supportedFsTypes
+		checks = append(checks, func() error {
+			return checkExecutables(fsTypes)
+		})
+	}
+	d.ids.readiness = newReadinessCheck(d.probeInterval, checks...)
 }
 
 func (d *CinderDriver) Run() {
+	// only register the services that were set up
+	var cs csi.ControllerServer
+	if d.cs != nil {
+		cs = d.cs
+	}
+	var ns csi.NodeServer
+	if d.ns != nil {
+		ns = d.ns
+	}
+
+	// probes only read the result of the checks from then on
+	if d.ids.readiness != nil {
+		go d.ids.readiness.run(wait.NeverStop)
+	}
+
+	d.logCapabilities()
+
+	var interceptors []grpc.UnaryServerInterceptor
+	if d.operationTimeout > 0 {
+		interceptors = append(interceptors, d.boundOperation)
+	}
+	if d.leader != nil {
+		go d.runLeaderElection(wait.NeverStop)
+		interceptors = append(interceptors, d.leader.intercept)
+	}
+	// calls refused by the leader gate are not audited, they changed nothing
+	if d.audit != nil {
+		interceptors = append(interceptors, d.audit.intercept)
+	}
 
-	RunControllerandNodePublishServer(d.endpoint, d.ids, d.cs, d.ns)
+	RunControllerandNodePublishServer(d.endpoint, d.ids, cs, ns, interceptors...)
 }
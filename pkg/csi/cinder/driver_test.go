@@ -17,10 +17,15 @@ limitations under the License.
 package cinder
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
 )
 
 const (
@@ -28,7 +33,8 @@ const (
 )
 
 var (
-	vendorVersion = "1.0.0"
+	vendorVersion      = "dev"
+	defaultTopologyKey = "topology." + DefaultDriverName + "/zone"
 )
 
 func NewFakeDriver() *CinderDriver {
@@ -63,4 +69,130 @@ func TestValidateControllerServiceRequest(t *testing.T) {
 	// Test controller service list snapshot is supported
 	err = d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS)
 	assert.NoError(t, err)
+
+	// Test controller service expand volume is supported
+	err = d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+	assert.NoError(t, err)
+
+	// Test controller service get capacity is supported
+	err = d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY)
+	assert.NoError(t, err)
+}
+
+func TestValidateMode(t *testing.T) {
+	assert.NoError(t, ValidateMode(ModeAll))
+	assert.NoError(t, ValidateMode(ModeController))
+	assert.NoError(t, ValidateMode(ModeNode))
+	assert.Error(t, ValidateMode(""))
+	assert.Error(t, ValidateMode("fake"))
+}
+
+func TestSetupControllerService(t *testing.T) {
+	d := NewFakeDriver()
+	d.SetupControllerService(new(openstack.OpenStackMock), nil)
+
+	assert.NotNil(t, d.cs)
+	assert.Nil(t, d.ns)
+
+	resp, err := d.ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, csi.PluginCapability_Service_CONTROLLER_SERVICE, resp.GetCapabilities()[0].GetService().GetType())
+}
+
+func TestSetupNodeService(t *testing.T) {
+	d := NewFakeDriver()
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetInstanceID").Return(FakeNodeID, nil)
+
+	err := d.SetupNodeService(mountmock, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, d.cs)
+	assert.NotNil(t, d.ns)
+	// the mock detects no hypervisor
+	assert.Equal(t, 1.0, metricValue(t, nodeHypervisor.WithLabelValues(mount.HypervisorUnknown)))
+
+	// Controller service is not advertised
+	resp, err := d.ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.NoError(t, err)
+	for _, c := range resp.GetCapabilities() {
+		assert.NotEqual(t, csi.PluginCapability_Service_CONTROLLER_SERVICE, c.GetService().GetType())
+	}
+}
+
+func TestSetupNodeServiceNoNodeID(t *testing.T) {
+	d := NewFakeDriver()
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetInstanceID").Return("", errors.New("fake error"))
+	metadatamock := new(openstack.OpenStackMock)
+
+	err := d.SetupNodeService(mountmock, metadatamock)
+	assert.Error(t, err)
+	assert.Nil(t, d.ns)
+}
+
+func TestSetupNodeServiceNodeIDOverride(t *testing.T) {
+	d := NewDriver("1b2d3c4e-5f60-4a7b-8c9d-0e1f2a3b4c5d", FakeEndpoint, FakeCluster)
+	mountmock := new(mount.MountMock)
+
+	// the metadata is not looked up when the instance ID is given
+	err := d.SetupNodeService(mountmock, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, d.ns)
+	mountmock.AssertNotCalled(t, "GetInstanceID")
+}
+
+func TestSetDriverName(t *testing.T) {
+	d := NewFakeDriver()
+	assert.Equal(t, DefaultDriverName, d.name)
+	assert.Equal(t, defaultTopologyKey, d.topologyKey())
+
+	err := d.SetDriverName("cinder-a.csi.openstack.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "cinder-a.csi.openstack.org", d.name)
+	assert.Equal(t, "topology.cinder-a.csi.openstack.org/zone", d.topologyKey())
+
+	// Invalid names are rejected and the name is kept
+	for _, name := range []string{"", "Cinder.csi", "-cinder.csi", "cinder_a.csi", strings.Repeat("a", 64)} {
+		assert.Error(t, d.SetDriverName(name), name)
+	}
+	assert.Equal(t, "cinder-a.csi.openstack.org", d.name)
+}
+
+func TestSetFsTypes(t *testing.T) {
+	d := NewFakeDriver()
+	assert.Equal(t, DefaultFsType, d.defaultFsType)
+	assert.NoError(t, d.checkFsType("xfs"))
+
+	assert.NoError(t, d.SetFsTypes("xfs", []string{"ext4", "xfs"}))
+	assert.Equal(t, "xfs", d.defaultFsType)
+	err := d.checkFsType("btrfs")
+	if assert.Error(t, err) {
+		assert.Equal(t, `filesystem type "btrfs" is not supported, the supported types are ext4, xfs`, err.Error())
+	}
+
+	// Invalid types are rejected and the types are kept
+	assert.Error(t, d.SetFsTypes("ext3", []string{"ext4", "xfs"}))
+	assert.Error(t, d.SetFsTypes("ext4", nil))
+	assert.Error(t, d.SetFsTypes("ext4", []string{"ext4", ""}))
+	assert.Equal(t, "xfs", d.defaultFsType)
+}
+
+func TestSetImageMetadataKeys(t *testing.T) {
+	d := NewFakeDriver()
+	assert.NoError(t, d.checkImageMetadataKey("hw_disk_bus"))
+
+	assert.NoError(t, d.SetImageMetadataKeys([]string{"hw_disk_bus"}))
+	assert.Error(t, d.checkImageMetadataKey("hw_scsi_model"))
+
+	// none allowed
+	assert.NoError(t, d.SetImageMetadataKeys(nil))
+	err := d.checkImageMetadataKey("hw_disk_bus")
+	if assert.Error(t, err) {
+		assert.Equal(t, "no image metadata key is allowed by --image-metadata-keys", err.Error())
+	}
+
+	// Invalid keys are rejected and the keys are kept
+	assert.Error(t, d.SetImageMetadataKeys([]string{"hw_disk_bus", ""}))
+	assert.Error(t, d.SetImageMetadataKeys([]string{"imageMetadata/hw_disk_bus"}))
+	assert.Error(t, d.checkImageMetadataKey("hw_disk_bus"))
 }
@@ -55,9 +55,17 @@ var FakeVol3 = openstack.Volume{
 	Status: "available",
 	AZ:     "",
 }
+var FakeCreatedVol = &openstack.Volume{
+	ID:     FakeVolID,
+	Name:   FakeVolName,
+	Status: "creating",
+	Size:   FakeCapacityGiB,
+	AZ:     FakeAvailability,
+}
 var FakeSnapshotRes = snapshots.Snapshot{
 	ID:       FakeSnapshotID,
 	Name:     "fake-snapshot",
+	Status:   "available",
 	VolumeID: FakeVolID,
 }
 
@@ -17,16 +17,123 @@ limitations under the License.
 package cinder
 
 import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
 
 type identityServer struct {
-	Driver *CinderDriver
+	Driver    *CinderDriver
+	readiness *readinessCheck
+}
+
+// readinessCheck runs the checks deciding whether the plugin is ready, and
+// caches their result for interval so that frequent probes stay cheap. Once
+// run in the background, the checks are refreshed every interval and probes
+// only read their last result.
+type readinessCheck struct {
+	mux        sync.Mutex
+	checks     []func() error
+	interval   time.Duration
+	lastCheck  time.Time
+	lastErr    error
+	background bool
+}
+
+// errNotChecked is reported until the background checks ran once
+var errNotChecked = errors.New("the readiness checks did not run yet")
+
+// newReadinessCheck returns a readinessCheck running checks at most once per interval
+func newReadinessCheck(interval time.Duration, checks ...func() error) *readinessCheck {
+	return &readinessCheck{
+		checks:   checks,
+		interval: interval,
+	}
+}
+
+// Check returns the error of the first failing check, or nil if the plugin is ready
+func (r *readinessCheck) Check() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.background {
+		if r.lastCheck.IsZero() {
+			return errNotChecked
+		}
+		return r.lastErr
+	}
+	if !r.lastCheck.IsZero() && time.Since(r.lastCheck) < r.interval {
+		return r.lastErr
+	}
+
+	r.lastErr = r.runChecks()
+	r.lastCheck = time.Now()
+	return r.lastErr
+}
+
+// run refreshes the result of the checks every interval until stop is
+// closed, without blocking the probes while the checks run
+func (r *readinessCheck) run(stop <-chan struct{}) {
+	r.mux.Lock()
+	r.background = true
+	interval := r.interval
+	r.mux.Unlock()
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	wait.Until(func() {
+		err := r.runChecks()
+		if err != nil {
+			klog.Warningf("Plugin is not ready: %v", err)
+		}
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		r.lastErr, r.lastCheck = err, time.Now()
+	}, interval, stop)
+}
+
+func (r *readinessCheck) runChecks() error {
+	for _, check := range r.checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookPath finds an executable in the PATH, replaced in tests
+var lookPath = exec.LookPath
+
+// checkExecutables returns an error naming the executables the node needs to
+// stage volumes that are missing: blkid and the mkfs of every supported
+// filesystem
+func checkExecutables(fsTypes []string) error {
+	executables := []string{"blkid"}
+	for _, fsType := range fsTypes {
+		executables = append(executables, "mkfs."+fsType)
+	}
+	var missing []string
+	for _, executable := range executables {
+		if _, err := lookPath(executable); err != nil {
+			missing = append(missing, executable)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing the executables %s, needed to format the volumes", strings.Join(missing, ", "))
+	}
+	return nil
 }
 
 func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
@@ -47,32 +154,18 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	_, err := openstack.CreateOpenStackProvider()
-	if err != nil {
-		klog.V(3).Infof("Failed to CreateOpenStackProvider: %v", err)
-		return nil, status.Error(codes.FailedPrecondition, "Failed to communicate with openstack")
+	if ids.readiness != nil {
+		if err := ids.readiness.Check(); err != nil {
+			klog.Warningf("Plugin is not ready: %v", err)
+			return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+		}
 	}
-	return &csi.ProbeResponse{}, nil
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	klog.V(5).Infof("Using default capabilities")
 	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
-				},
-			},
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
-					},
-				},
-			},
-		},
+		Capabilities: ids.Driver.pluginCapabilities(),
 	}, nil
 }
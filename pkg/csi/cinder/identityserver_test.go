@@ -18,10 +18,18 @@ package cinder
 
 import (
 	"context"
+	"errors"
+	"os/exec"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
 )
 
 func TestGetPluginInfo(t *testing.T) {
@@ -32,6 +40,130 @@ func TestGetPluginInfo(t *testing.T) {
 	req := csi.GetPluginInfoRequest{}
 	resp, err := ids.GetPluginInfo(context.Background(), &req)
 	assert.NoError(t, err)
-	assert.Equal(t, resp.GetName(), driverName)
+	assert.Equal(t, resp.GetName(), DefaultDriverName)
 	assert.Equal(t, resp.GetVendorVersion(), vendorVersion)
 }
+
+// fakeLookPath finds the executables but the missing ones until restore is
+// called
+func fakeLookPath(missing ...string) (restore func()) {
+	old := lookPath
+	lookPath = func(file string) (string, error) {
+		for _, m := range missing {
+			if file == m {
+				return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+			}
+		}
+		return "/usr/sbin/" + file, nil
+	}
+	return func() {
+		lookPath = old
+	}
+}
+
+func TestProbe(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeLookPath()()
+
+	probemock := new(openstack.OpenStackMock)
+	probemock.On("CheckBlockStorageAPI", mock.Anything).Return(errors.New("fake error")).Once()
+	probemock.On("CheckBlockStorageAPI", mock.Anything).Return(nil)
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetInstanceID").Return(FakeNodeID, nil)
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	d.SetProbeOptions(true, time.Hour)
+	d.SetupDriver(probemock, mountmock, nil)
+
+	// Failing check reports not ready
+	resp, err := d.ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(err)
+	assert.False(resp.GetReady().GetValue())
+
+	// Result is reused within the interval
+	resp, err = d.ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(err)
+	assert.False(resp.GetReady().GetValue())
+	probemock.AssertNumberOfCalls(t, "CheckBlockStorageAPI", 1)
+
+	// Check runs again once the interval has passed
+	d.ids.readiness.interval = 0
+	resp, err = d.ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(err)
+	assert.True(resp.GetReady().GetValue())
+	probemock.AssertNumberOfCalls(t, "CheckBlockStorageAPI", 2)
+}
+
+func TestProbeNodeID(t *testing.T) {
+	probemock := new(openstack.OpenStackMock)
+	probemock.On("CheckBlockStorageAPI", mock.Anything).Return(nil)
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetInstanceID").Return("", errors.New("fake error"))
+	probemeta := new(openstack.OpenStackMock)
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	d.SetupDriver(probemock, mountmock, probemeta)
+
+	// Node ID cannot be determined
+	resp, err := d.ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.False(t, resp.GetReady().GetValue())
+}
+
+func TestProbeDisabled(t *testing.T) {
+	probemock := new(openstack.OpenStackMock)
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	d.SetProbeOptions(false, defaultProbeInterval)
+	d.SetupDriver(probemock, nil, nil)
+
+	resp, err := d.ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.GetReady().GetValue())
+	probemock.AssertNotCalled(t, "CheckBlockStorageAPI", mock.Anything)
+}
+
+// Test the node is not ready while the executables formatting the volumes are
+// missing
+func TestProbeExecutables(t *testing.T) {
+	defer fakeLookPath("mkfs.xfs", "mkfs.btrfs")()
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetInstanceID").Return(FakeNodeID, nil)
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	assert.NoError(t, d.SetFsTypes("ext4", []string{"ext4", "xfs", "btrfs"}))
+	assert.NoError(t, d.SetupNodeService(mountmock, nil))
+
+	err := d.ids.readiness.Check()
+	if assert.Error(t, err) {
+		assert.Equal(t, "missing the executables mkfs.xfs, mkfs.btrfs, needed to format the volumes", err.Error())
+	}
+
+	assert.NoError(t, checkExecutables([]string{"ext4"}))
+}
+
+// Test the checks run in the background refresh the result the probes read
+func TestReadinessCheckBackground(t *testing.T) {
+	var checks int32
+	r := newReadinessCheck(10*time.Millisecond, func() error {
+		if atomic.AddInt32(&checks, 1) == 1 {
+			return errors.New("fake error")
+		}
+		return nil
+	})
+	r.mux.Lock()
+	r.background = true
+	r.mux.Unlock()
+	// not ready until the checks ran once
+	assert.Equal(t, errNotChecked, r.Check())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.run(stop)
+
+	err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return r.Check() == nil, nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, atomic.LoadInt32(&checks) >= 2)
+}
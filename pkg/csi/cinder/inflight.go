@@ -0,0 +1,59 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// inFlight keeps track of the requests currently being processed, so that a
+// retry from a sidecar does not start the same operation a second time.
+type inFlight struct {
+	mux sync.Mutex
+	ops map[string]struct{}
+}
+
+// newInFlight returns an empty inFlight tracker
+func newInFlight() *inFlight {
+	return &inFlight{
+		ops: make(map[string]struct{}),
+	}
+}
+
+// Insert marks the operation identified by key as in flight. It returns
+// false if an operation with the same key is already being processed.
+func (f *inFlight) Insert(key string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if _, ok := f.ops[key]; ok {
+		klog.V(4).Infof("Operation %s is already in flight", key)
+		return false
+	}
+	f.ops[key] = struct{}{}
+	return true
+}
+
+// Delete removes the operation identified by key from the tracker
+func (f *inFlight) Delete(key string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	delete(f.ops, key)
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlight(t *testing.T) {
+	f := newInFlight()
+
+	// First insert succeeds, duplicate is rejected
+	assert.True(t, f.Insert("key1"))
+	assert.False(t, f.Insert("key1"))
+
+	// Other keys are independent
+	assert.True(t, f.Insert("key2"))
+
+	// Released keys can be inserted again
+	f.Delete("key1")
+	assert.True(t, f.Insert("key1"))
+
+	// Deleting an unknown key is a no-op
+	f.Delete("unknown")
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+// Prefix of the full method names of the controller service RPCs
+const controllerServicePrefix = "/csi.v1.Controller/"
+
+// LeaderElectionOpts configures the election of the controller plugin
+// instance serving the controller service
+type LeaderElectionOpts struct {
+	// Namespace of the Lease object
+	Namespace string
+	// Name of the Lease object, derived from the driver name if empty
+	LeaseName string
+	// Duration non-leaders wait before trying to acquire the lease
+	LeaseDuration time.Duration
+	// Duration the leader retries renewing the lease before giving it up
+	RenewDeadline time.Duration
+	// Interval between two attempts to acquire or renew the lease
+	RetryPeriod time.Duration
+}
+
+// leaderGate tracks whether this instance holds the controller lease
+type leaderGate struct {
+	leading int32
+}
+
+func (g *leaderGate) setLeading(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	atomic.StoreInt32(&g.leading, v)
+}
+
+func (g *leaderGate) isLeading() bool {
+	return atomic.LoadInt32(&g.leading) == 1
+}
+
+// intercept rejects controller service calls while this instance is not the
+// leader. Identity and node service calls are always served.
+func (g *leaderGate) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, controllerServicePrefix) && !g.isLeading() {
+		return nil, status.Error(codes.Unavailable, "this controller plugin instance is not the leader")
+	}
+	return handler(ctx, req)
+}
+
+// EnableLeaderElection makes the driver serve the controller service only
+// while it holds a Lease in the cluster it runs in
+func (d *CinderDriver) EnableLeaderElection(opts LeaderElectionOpts) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get in-cluster config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %v", err)
+	}
+
+	if opts.LeaseName == "" {
+		opts.LeaseName = leaseName(d.name)
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock,
+		opts.Namespace,
+		opts.LeaseName,
+		client.CoreV1(),
+		client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity: hostname + "_" + string(uuid.NewUUID()),
+		})
+	if err != nil {
+		return fmt.Errorf("failed to create lease lock: %v", err)
+	}
+
+	d.leader = &leaderGate{}
+	d.leaderElectionConfig = &leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: opts.LeaseDuration,
+		RenewDeadline: opts.RenewDeadline,
+		RetryPeriod:   opts.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Became leader, serving the controller service")
+				d.leader.setLeading(true)
+			},
+			OnStoppedLeading: func() {
+				klog.Warningf("Lost leadership, no longer serving the controller service")
+				d.leader.setLeading(false)
+			},
+			OnNewLeader: func(identity string) {
+				klog.V(3).Infof("Current leader of the controller plugin: %s", identity)
+			},
+		},
+	}
+	return nil
+}
+
+// runLeaderElection takes part in the election until stop is closed. When
+// leadership is lost, the instance stands for election again.
+func (d *CinderDriver) runLeaderElection(stop <-chan struct{}) {
+	wait.Until(func() {
+		leaderelection.RunOrDie(context.Background(), *d.leaderElectionConfig)
+	}, d.leaderElectionConfig.RetryPeriod, stop)
+}
+
+// leaseName returns the default name of the Lease of the driver
+func leaseName(driverName string) string {
+	return strings.Replace(driverName, ".", "-", -1) + "-controller"
+}
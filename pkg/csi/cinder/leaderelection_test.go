@@ -0,0 +1,68 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeaderGate(t *testing.T) {
+	assert := assert.New(t)
+	g := &leaderGate{}
+
+	called := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called++
+		return nil, nil
+	}
+	controllerInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	nodeInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	identityInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Identity/Probe"}
+
+	// Followers reject controller calls
+	_, err := g.intercept(FakeCtx, &csi.CreateVolumeRequest{}, controllerInfo, handler)
+	assert.Equal(codes.Unavailable, status.Code(err))
+	assert.Equal(0, called)
+
+	// but serve node and identity calls
+	_, err = g.intercept(FakeCtx, &csi.NodeStageVolumeRequest{}, nodeInfo, handler)
+	assert.NoError(err)
+	_, err = g.intercept(FakeCtx, &csi.ProbeRequest{}, identityInfo, handler)
+	assert.NoError(err)
+	assert.Equal(2, called)
+
+	// The leader serves controller calls
+	g.setLeading(true)
+	_, err = g.intercept(FakeCtx, &csi.CreateVolumeRequest{}, controllerInfo, handler)
+	assert.NoError(err)
+	assert.Equal(3, called)
+
+	g.setLeading(false)
+	_, err = g.intercept(FakeCtx, &csi.CreateVolumeRequest{}, controllerInfo, handler)
+	assert.Equal(codes.Unavailable, status.Code(err))
+}
+
+func TestLeaseName(t *testing.T) {
+	assert.Equal(t, "cinder-csi-openstack-org-controller", leaseName(DefaultDriverName))
+}
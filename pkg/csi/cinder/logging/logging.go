@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging decorates the klog output of the driver with key=value
+// fields identifying the operation and the objects it acts on, e.g.
+//
+//	op=AttachVolume request_id=42 volume_id=... instance_id=...: message
+//
+// Keys are written in the order they were added, values containing spaces,
+// quotes or '=' are quoted and empty values are left out, so that log based
+// alerts can rely on the format.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// Keys of the fields used across the driver
+const (
+	Op         = "op"
+	RequestID  = "request_id"
+	VolumeID   = "volume_id"
+	InstanceID = "instance_id"
+	SnapshotID = "snapshot_id"
+	DevicePath = "device_path"
+
+	// OpenStackRequestID is the ID set by OpenStack in the X-Openstack-Request-Id header
+	OpenStackRequestID = "openstack_request_id"
+)
+
+// requestIDKey is the context key under which the request ID is stored
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the gRPC request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the request ID stored in ctx, or an empty string
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Logger writes klog lines prefixed with its fields
+type Logger struct {
+	fields []string
+}
+
+// FromContext returns a Logger with the request ID stored in ctx, if any
+func FromContext(ctx context.Context) Logger {
+	return With(RequestID, RequestIDFrom(ctx))
+}
+
+// With returns a Logger with the given key/value pairs
+func With(keysAndValues ...string) Logger {
+	return Logger{}.With(keysAndValues...)
+}
+
+// With returns a copy of l with the given key/value pairs added
+func (l Logger) With(keysAndValues ...string) Logger {
+	fields := make([]string, len(l.fields), len(l.fields)+len(keysAndValues)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i+1] == "" {
+			continue
+		}
+		fields = append(fields, keysAndValues[i]+"="+quote(keysAndValues[i+1]))
+	}
+	return Logger{fields: fields}
+}
+
+// quote quotes the values that would otherwise break the key=value format
+func quote(value string) string {
+	if strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// format prefixes the message with the fields of l
+func (l Logger) format(format string, args ...interface{}) string {
+	msg := fmt.Sprintf(format, args...)
+	if len(l.fields) == 0 {
+		return msg
+	}
+	return strings.Join(l.fields, " ") + ": " + msg
+}
+
+// Verbose logs at a klog verbosity level
+type Verbose struct {
+	l       Logger
+	enabled klog.Verbose
+}
+
+// V returns a Verbose logging only if the klog verbosity is at least level
+func (l Logger) V(level klog.Level) Verbose {
+	return Verbose{l: l, enabled: klog.V(level)}
+}
+
+// Infof logs if the verbosity level is enabled
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v.enabled {
+		klog.InfoDepth(1, v.l.format(format, args...))
+	}
+}
+
+// Infof logs at the info level
+func (l Logger) Infof(format string, args ...interface{}) {
+	klog.InfoDepth(1, l.format(format, args...))
+}
+
+// Warningf logs at the warning level
+func (l Logger) Warningf(format string, args ...interface{}) {
+	klog.WarningDepth(1, l.format(format, args...))
+}
+
+// Errorf logs at the error level
+func (l Logger) Errorf(format string, args ...interface{}) {
+	klog.ErrorDepth(1, l.format(format, args...))
+}
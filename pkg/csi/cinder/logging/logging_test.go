@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		logger   Logger
+		expected string
+	}{
+		{
+			name:     "no fields",
+			logger:   Logger{},
+			expected: "attached",
+		},
+		{
+			name:     "fields in order",
+			logger:   With(Op, "AttachVolume", VolumeID, "vol-1", InstanceID, "inst-1"),
+			expected: "op=AttachVolume volume_id=vol-1 instance_id=inst-1: attached",
+		},
+		{
+			name:     "empty values left out",
+			logger:   With(Op, "AttachVolume", VolumeID, "", InstanceID, "inst-1"),
+			expected: "op=AttachVolume instance_id=inst-1: attached",
+		},
+		{
+			name:     "values quoted when needed",
+			logger:   With(DevicePath, "/dev/disk by-id", "name", `a="b"`),
+			expected: `device_path="/dev/disk by-id" name="a=\"b\"": attached`,
+		},
+		{
+			name:     "odd key left out",
+			logger:   With(Op, "DetachVolume", VolumeID),
+			expected: "op=DetachVolume: attached",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.logger.format("%s", "attached"))
+		})
+	}
+}
+
+func TestWithDoesNotModifyParent(t *testing.T) {
+	parent := With(Op, "AttachVolume")
+	child1 := parent.With(VolumeID, "vol-1")
+	child2 := parent.With(VolumeID, "vol-2")
+
+	assert.Equal(t, "op=AttachVolume: x", parent.format("x"))
+	assert.Equal(t, "op=AttachVolume volume_id=vol-1: x", child1.format("x"))
+	assert.Equal(t, "op=AttachVolume volume_id=vol-2: x", child2.format("x"))
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Equal(t, "x", FromContext(context.Background()).format("x"))
+
+	ctx := WithRequestID(context.Background(), "42")
+	assert.Equal(t, "42", RequestIDFrom(ctx))
+	assert.Equal(t, "request_id=42 op=CreateVolume: x", FromContext(ctx).With(Op, "CreateVolume").format("x"))
+}
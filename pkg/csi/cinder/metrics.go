@@ -0,0 +1,111 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+const (
+	metricsNamespace = "cinder_csi"
+	metricsSubsystem = "operations"
+)
+
+var (
+	operationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "duration_seconds",
+			Help:      "Duration of the CSI calls, by method and resulting gRPC code",
+			// from 10ms to about 20 minutes, attaches and creates from
+			// snapshots take minutes
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 18),
+		},
+		[]string{"method", "grpc_code"},
+	)
+
+	operationsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "in_flight",
+			Help:      "Number of CSI calls being served, by method",
+		},
+		[]string{"method"},
+	)
+
+	retainedVolumes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retained_volumes_total",
+			Help:      "Number of volumes retained instead of deleted, their storage class having onDelete: retain",
+		},
+	)
+
+	nodeHypervisor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "node_hypervisor_info",
+			Help:      "Hypervisor the node plugin detected, which decides how it looks for the devices of the volumes",
+		},
+		[]string{"hypervisor"},
+	)
+
+	auditWriteErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "audit_write_errors_total",
+			Help:      "Number of records the audit log failed to write",
+		},
+	)
+)
+
+// RegisterMetrics registers the metrics of the CSI calls
+func RegisterMetrics() {
+	if err := prometheus.Register(operationDuration); err != nil {
+		klog.V(5).Infof("unable to register for operation duration metrics")
+	}
+	if err := prometheus.Register(operationsInFlight); err != nil {
+		klog.V(5).Infof("unable to register for operations in flight metrics")
+	}
+	if err := prometheus.Register(retainedVolumes); err != nil {
+		klog.V(5).Infof("unable to register for retained volumes metrics")
+	}
+	if err := prometheus.Register(auditWriteErrors); err != nil {
+		klog.V(5).Infof("unable to register for audit write errors metrics")
+	}
+	if err := prometheus.Register(nodeHypervisor); err != nil {
+		klog.V(5).Infof("unable to register for node hypervisor metrics")
+	}
+}
+
+// setNodeHypervisor sets the hypervisor info metric to the hypervisor of the
+// node
+func setNodeHypervisor(hypervisor string) {
+	nodeHypervisor.Reset()
+	nodeHypervisor.WithLabelValues(hypervisor).Set(1)
+}
+
+// methodName returns the name of the RPC of a full gRPC method name, e.g.
+// CreateVolume for /csi.v1.Controller/CreateVolume
+func methodName(fullMethod string) string {
+	return path.Base(fullMethod)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metricValue returns the value of a gauge or a counter, or the number of
+// observations of a histogram
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		t.Fatalf("failed to read the metric: %v", err)
+	}
+	if h := metric.GetHistogram(); h != nil {
+		return float64(h.GetSampleCount())
+	}
+	if c := metric.GetCounter(); c != nil {
+		return c.GetValue()
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func observations(t *testing.T, method, code string) float64 {
+	return metricValue(t, operationDuration.WithLabelValues(method, code).(prometheus.Metric))
+}
+
+func TestMethodName(t *testing.T) {
+	assert.Equal(t, "CreateVolume", methodName("/csi.v1.Controller/CreateVolume"))
+	assert.Equal(t, "NodeStageVolume", methodName("/csi.v1.Node/NodeStageVolume"))
+}
+
+func TestLogGRPCMetrics(t *testing.T) {
+	assert := assert.New(t)
+	// a method of its own, the metrics being global
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/FakeMetricsMethod"}
+	inFlight := operationsInFlight.WithLabelValues("FakeMetricsMethod")
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.Equal(float64(1), metricValue(t, inFlight), "in flight while handled")
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	_, err := logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, handler)
+	assert.NoError(err)
+	assert.Equal(float64(0), metricValue(t, inFlight))
+	assert.Equal(float64(1), observations(t, "FakeMetricsMethod", "OK"))
+
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "fake error")
+	}
+	logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, failing)
+	logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, failing)
+	assert.Equal(float64(2), observations(t, "FakeMetricsMethod", "NotFound"))
+
+	// errors without a status are Unknown to the caller
+	plain := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, errors.New("fake error")
+	}
+	logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, plain)
+	assert.Equal(float64(1), observations(t, "FakeMetricsMethod", "Unknown"))
+	assert.Equal(float64(1), observations(t, "FakeMetricsMethod", "OK"))
+	assert.Equal(float64(0), metricValue(t, inFlight))
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog"
+)
+
+// Once the kubernetes.io/cinder volumes are migrated, the CSI translation
+// library hands their PVs and storage classes to the driver in the shape the
+// in-tree plugin accepted. The volume handle is the plain Cinder volume ID,
+// but the parameters and attributes need normalizing.
+
+const (
+	// fsTypeParam is the filesystem type parameter of the in-tree plugin
+	fsTypeParam = "fstype"
+
+	// Cinder volume metadata key the in-tree plugin sets on the volumes it
+	// creates, with the name of their PV
+	inTreePVNameMetadataKey = "kubernetes.io/created-for/pv/name"
+)
+
+// inTreeParams are the storage class parameters of the in-tree plugin, which
+// matched their keys case-insensitively
+var inTreeParams = []string{"type", "availability", fsTypeParam}
+
+// normalizeParameters returns the storage class parameters with the keys of
+// the in-tree parameters in lower case, e.g. type for Type. The parameters
+// are returned as is when they need no change.
+func normalizeParameters(params map[string]string) map[string]string {
+	var normalized map[string]string
+	for k, v := range params {
+		lower := strings.ToLower(k)
+		if lower == k || !isInTreeParam(lower) {
+			continue
+		}
+		if normalized == nil {
+			normalized = make(map[string]string, len(params))
+			for key, value := range params {
+				normalized[key] = value
+			}
+		}
+		if _, ok := params[lower]; ok {
+			klog.Warningf("Ignoring the storage class parameter %s, %s is set", k, lower)
+		} else {
+			normalized[lower] = v
+		}
+		delete(normalized, k)
+	}
+	if normalized == nil {
+		return params
+	}
+	return normalized
+}
+
+func isInTreeParam(key string) bool {
+	for _, p := range inTreeParams {
+		if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeFsType returns the filesystem type of a volume, from its capability or
+// else from its volume context, where migrated volumes may carry it as fsType
+// or fstype. An empty string means the default.
+func volumeFsType(volCap *csi.VolumeCapability, volumeContext map[string]string) string {
+	if fsType := volCap.GetMount().GetFsType(); fsType != "" {
+		return fsType
+	}
+	for k, v := range volumeContext {
+		if strings.ToLower(k) == fsTypeParam && v != "" {
+			return v
+		}
+	}
+	return ""
+}
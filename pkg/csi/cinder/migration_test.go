@@ -0,0 +1,144 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/api/core/v1"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+	"k8s.io/csi-translation-lib/plugins"
+)
+
+func TestNormalizeParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected map[string]string
+	}{
+		{"nil", nil, nil},
+		{"csi", map[string]string{"type": "ssd", "availability": "nova"}, map[string]string{"type": "ssd", "availability": "nova"}},
+		{"in-tree", map[string]string{"Type": "ssd", "Availability": "nova", "fsType": "xfs"}, map[string]string{"type": "ssd", "availability": "nova", "fstype": "xfs"}},
+		{"both spellings", map[string]string{"Type": "hdd", "type": "ssd"}, map[string]string{"type": "ssd"}},
+		{"other parameters", map[string]string{"csi.storage.k8s.io/pv/name": "pv-1", "Custom": "x"}, map[string]string{"csi.storage.k8s.io/pv/name": "pv-1", "Custom": "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, normalizeParameters(tt.params))
+		})
+	}
+}
+
+func TestVolumeFsType(t *testing.T) {
+	mountCap := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType},
+			},
+		}
+	}
+	tests := []struct {
+		name          string
+		volCap        *csi.VolumeCapability
+		volumeContext map[string]string
+		expected      string
+	}{
+		{"capability", mountCap("xfs"), map[string]string{"fsType": "ext3"}, "xfs"},
+		{"fsType attribute", mountCap(""), map[string]string{"fsType": "xfs"}, "xfs"},
+		{"fstype attribute", mountCap(""), map[string]string{"fstype": "xfs"}, "xfs"},
+		{"default", mountCap(""), nil, ""},
+		{"no capability", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, volumeFsType(tt.volCap, tt.volumeContext))
+		})
+	}
+}
+
+// Test a storage class of the in-tree plugin creates the volume it did
+func TestCreateVolumeInTreeParameters(t *testing.T) {
+	properties := map[string]string{"cinder.csi.openstack.org/cluster": FakeCluster}
+
+	cloudmock := new(openstack.OpenStackMock)
+	cloudmock.On("CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), "ssd", "az-2", "", openstack.DefaultVolumeDescription, &properties).Return(FakeCreatedVol, nil)
+	cloudmock.On("GetBlockStorageOpts").Return(openstack.BlockStorageOpts{})
+	cloudmock.On("WaitVolumeCreated", mock.Anything, FakeVolID).Return(nil)
+
+	cs := NewControllerServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), cloudmock, nil)
+
+	_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name:       FakeVolName,
+		Parameters: map[string]string{"Type": "ssd", "Availability": "az-2"},
+	})
+	assert.NoError(t, err)
+	cloudmock.AssertCalled(t, "CreateVolume", mock.Anything, FakeVolName, mock.AnythingOfType("int"), "ssd", "az-2", "", openstack.DefaultVolumeDescription, &properties)
+}
+
+// Test a PV of the in-tree plugin, translated by the CSI translation library,
+// stages the volume it names with the filesystem it was formatted with
+func TestNodeStageVolumeMigratedPV(t *testing.T) {
+	inTree := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				Cinder: &v1.CinderPersistentVolumeSource{
+					VolumeID: FakeVolID,
+					FSType:   "xfs",
+				},
+			},
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		},
+	}
+	translated, err := plugins.NewOpenStackCinderCSITranslator().TranslateInTreePVToCSI(inTree)
+	if err != nil {
+		t.Fatalf("failed to translate the in-tree PV: %v", err)
+	}
+	source := translated.Spec.CSI
+	assert.Equal(t, DefaultDriverName, source.Driver)
+	// the handle is the plain volume ID
+	assert.Equal(t, FakeVolID, source.VolumeHandle)
+
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+	mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
+	mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+	mountmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "xfs", []string(nil)).Return(nil)
+	mountmock.On("ResizeFS", FakeDevicePath, FakeStagingTargetPath).Return(nil)
+	ns := NewNodeServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), mountmock, nil)
+
+	// the request kubelet builds from the CSI source
+	_, err = ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+		VolumeId:          source.VolumeHandle,
+		PublishContext:    map[string]string{"DevicePath": FakeDevicePath},
+		StagingTargetPath: FakeStagingTargetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: source.FSType},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+		VolumeContext: source.VolumeAttributes,
+	})
+	assert.NoError(t, err)
+	mountmock.AssertCalled(t, "FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "xfs", []string(nil))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+)
+
+// DevicePathResolver finds the device of an attached volume on the node
+type DevicePathResolver struct {
+	Mount IMount
+	// TrustDevicePath makes Resolve use the device path reported by Nova as is
+	TrustDevicePath bool
+	// MetadataDevicePath looks the device up in the metadata service, it may be nil
+	MetadataDevicePath func(volumeID string) string
+	// Strategy orders the serial ID and metadata service lookups for the
+	// hypervisor of the node, nil tries the serial ID first
+	Strategy *DiscoveryStrategy
+}
+
+// deviceExists returns whether the device file exists, replaced in tests
+var deviceExists = func(devicePath string) bool {
+	_, err := os.Stat(devicePath)
+	return err == nil
+}
+
+// Resolve returns the device of the volume. The first of the stable by-id
+// paths passed by the controller that exists is used. Otherwise the device
+// path reported by Nova is used if trusted, else the device is looked up by
+// its serial ID and then in the metadata service, the other way around on
+// hypervisors not setting the serial of the disks.
+func (r *DevicePathResolver) Resolve(volumeID string, byIDPaths []string, novaPath string) (string, error) {
+	log := logging.With(logging.Op, "ResolveDevicePath", logging.VolumeID, volumeID, "nova_device_path", novaPath)
+
+	for _, byIDPath := range byIDPaths {
+		if deviceExists(byIDPath) {
+			log.With(logging.DevicePath, byIDPath).V(4).Infof("Using the by-id path passed by the controller")
+			return byIDPath, nil
+		}
+	}
+
+	if r.TrustDevicePath && novaPath != "" {
+		log.V(4).Infof("Using the device path reported by Nova")
+		return novaPath, nil
+	}
+
+	var devicePath string
+	var err error
+	if r.Strategy.MetadataFirst() && r.MetadataDevicePath != nil {
+		devicePath = r.MetadataDevicePath(volumeID)
+	}
+	if devicePath == "" {
+		devicePath, err = r.Mount.GetDevicePath(volumeID)
+	}
+	if devicePath == "" && !r.Strategy.MetadataFirst() && r.MetadataDevicePath != nil {
+		devicePath = r.MetadataDevicePath(volumeID)
+	}
+	if devicePath == "" {
+		if novaPath != "" {
+			return "", fmt.Errorf("unable to find the device of volume %s: %v, the device path %s reported by Nova is only used with trust-device-path", volumeID, err, novaPath)
+		}
+		return "", fmt.Errorf("unable to find the device of volume %s: %v", volumeID, err)
+	}
+
+	if novaPath != "" && !sameDevice(devicePath, novaPath) {
+		log.With(logging.DevicePath, devicePath).Warningf("Device path reported by Nova does not match the device found on the node, using the latter")
+	}
+	return devicePath, nil
+}
+
+// sameDevice returns whether both paths lead to the same device file, the
+// paths found by serial ID are symlinks to the /dev/vdX paths Nova reports
+func sameDevice(a, b string) bool {
+	if a == b {
+		return true
+	}
+	resolvedA, err := filepath.EvalSymlinks(a)
+	if err != nil {
+		return false
+	}
+	resolvedB, err := filepath.EvalSymlinks(b)
+	if err != nil {
+		return false
+	}
+	return resolvedA == resolvedB
+}
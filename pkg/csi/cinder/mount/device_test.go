@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	fakeVolumeID   = "261a8b81-3660-43e5-bab8-6470b65ee4e8"
+	fakeNovaPath   = "/dev/vdb"
+	fakeSerialPath = "/dev/disk/by-id/virtio-261a8b81-3660-43e5-b"
+)
+
+const fakeByIDPath = "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_261a8b81-3660-43e5-b"
+
+func TestResolve(t *testing.T) {
+	byIDPaths := []string{fakeSerialPath, fakeByIDPath}
+	tests := []struct {
+		name         string
+		trust        bool
+		byIDPaths    []string
+		existing     string
+		novaPath     string
+		serialPath   string
+		metadataPath string
+		expected     string
+		expectErr    bool
+	}{
+		{name: "by-id path", byIDPaths: byIDPaths, existing: fakeByIDPath, novaPath: fakeNovaPath, expected: fakeByIDPath},
+		{name: "by-id path preferred when trusted", trust: true, byIDPaths: byIDPaths, existing: fakeByIDPath, novaPath: fakeNovaPath, expected: fakeByIDPath},
+		{name: "trusted nova path", trust: true, byIDPaths: byIDPaths, novaPath: fakeNovaPath, serialPath: fakeSerialPath, expected: fakeNovaPath},
+		{name: "trusted without nova path", trust: true, serialPath: fakeSerialPath, expected: fakeSerialPath},
+		{name: "serial ID", byIDPaths: byIDPaths, novaPath: fakeNovaPath, serialPath: fakeSerialPath, expected: fakeSerialPath},
+		{name: "metadata service", novaPath: fakeNovaPath, metadataPath: "/dev/vdc", expected: "/dev/vdc"},
+		{name: "untrusted nova path", novaPath: fakeNovaPath, expectErr: true},
+		{name: "not found", expectErr: true},
+	}
+
+	oldDeviceExists := deviceExists
+	defer func() { deviceExists = oldDeviceExists }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviceExists = func(devicePath string) bool { return devicePath == tt.existing }
+			mountmock := new(MountMock)
+			if tt.serialPath != "" {
+				mountmock.On("GetDevicePath", fakeVolumeID).Return(tt.serialPath, nil)
+			} else {
+				mountmock.On("GetDevicePath", fakeVolumeID).Return("", errors.New("fake error"))
+			}
+			r := &DevicePathResolver{
+				Mount:              mountmock,
+				TrustDevicePath:    tt.trust,
+				MetadataDevicePath: func(string) string { return tt.metadataPath },
+			}
+
+			devicePath, err := r.Resolve(fakeVolumeID, tt.byIDPaths, tt.novaPath)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, devicePath)
+			if tt.existing != "" || (tt.trust && tt.novaPath != "") {
+				mountmock.AssertNotCalled(t, "GetDevicePath", fakeVolumeID)
+			}
+		})
+	}
+}
+
+// Test an untrusted Nova path is named when the device is not found
+func TestResolveUntrustedNovaPath(t *testing.T) {
+	mountmock := new(MountMock)
+	mountmock.On("GetDevicePath", fakeVolumeID).Return("", errors.New("fake error"))
+	r := &DevicePathResolver{Mount: mountmock}
+
+	_, err := r.Resolve(fakeVolumeID, nil, fakeNovaPath)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the device path /dev/vdb reported by Nova is only used with trust-device-path")
+	}
+}
+
+// Test the paths compared to detect a mismatch with the Nova path follow symlinks
+func TestSameDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vdb := filepath.Join(dir, "vdb")
+	vdc := filepath.Join(dir, "vdc")
+	serial := filepath.Join(dir, "virtio-261a8b81-3660-43e5-b")
+	for _, f := range []string{vdb, vdc} {
+		if err := ioutil.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(vdb, serial); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, sameDevice(vdb, vdb))
+	assert.True(t, sameDevice(serial, vdb))
+	// mismatch, a warning is logged by Resolve
+	assert.False(t, sameDevice(serial, vdc))
+	assert.False(t, sameDevice(serial, filepath.Join(dir, "missing")))
+}
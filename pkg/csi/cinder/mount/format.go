@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// xfsMetadataFeatures are the mkfs.xfs -m features --xfs-format-options may
+// toggle, all of them but crc need crc=1
+var xfsMetadataFeatures = []string{"crc", "finobt", "reflink", "rmapbt"}
+
+// xfsFormatArgs are the arguments passed to mkfs.xfs before the device, set
+// by SetXFSFormatOptions
+var xfsFormatArgs []string
+
+// newDiskMounter returns the mounter formatting and mounting the volumes,
+// replaced in tests
+var newDiskMounter = func() *mount.SafeFormatAndMount {
+	return &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()}
+}
+
+// SetXFSFormatOptions sets the metadata features, e.g. reflink=0, mkfs.xfs
+// formats new volumes with. Recent mkfs.xfs enable features, like reflink,
+// that older kernels refuse to mount, so clusters mixing kernels need to turn
+// them off.
+func SetXFSFormatOptions(options []string) error {
+	if len(options) == 0 {
+		xfsFormatArgs = nil
+		return nil
+	}
+	values := map[string]string{}
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || !isXFSMetadataFeature(kv[0]) || (kv[1] != "0" && kv[1] != "1") {
+			return fmt.Errorf("invalid xfs format option %q, must be one of %s set to 0 or 1", option, strings.Join(xfsMetadataFeatures, ", "))
+		}
+		if _, ok := values[kv[0]]; ok {
+			return fmt.Errorf("invalid xfs format options, %s is set twice", kv[0])
+		}
+		values[kv[0]] = kv[1]
+	}
+	if values["crc"] == "0" {
+		for _, feature := range xfsMetadataFeatures {
+			if values[feature] == "1" && feature != "crc" {
+				return fmt.Errorf("invalid xfs format options, %s=1 needs crc=1", feature)
+			}
+		}
+	}
+	xfsFormatArgs = []string{"-m", strings.Join(options, ",")}
+	return nil
+}
+
+func isXFSMetadataFeature(feature string) bool {
+	for _, f := range xfsMetadataFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// formatAndMount formats the device unless it has a filesystem and mounts it.
+// Devices formatted with xfs get the options of SetXFSFormatOptions, the
+// other ones are formatted by the mounter with its defaults. Failures carry
+// the kernel log about the device with SetKernelLogInErrors.
+func formatAndMount(diskMounter *mount.SafeFormatAndMount, source string, target string, fstype string, options []string) error {
+	log := logging.With(logging.Op, "formatAndMount")
+	if fstype == "xfs" && len(xfsFormatArgs) > 0 {
+		format, err := diskMounter.GetDiskFormat(source)
+		if err != nil {
+			return fmt.Errorf("failed to get the format of %s: %v", source, err)
+		}
+		if format == "" {
+			args := append(append([]string{}, xfsFormatArgs...), source)
+			log.V(4).Infof("Formatting %s with mkfs.xfs %s", source, strings.Join(args, " "))
+			if out, err := diskMounter.Exec.Run("mkfs.xfs", args...); err != nil {
+				return withKernelLog(fmt.Errorf("failed to format %s with mkfs.xfs %s: %v, output: %s", source, strings.Join(args, " "), err, string(out)), source)
+			}
+		}
+	}
+	// the device is only mounted once it has a filesystem. The kernel logs
+	// why a mount failed, e.g. the features of the filesystem it refuses.
+	err := withKernelLog(diskMounter.FormatAndMount(source, target, fstype, options), source)
+	if err != nil && fstype == "xfs" && isUnsupportedFeaturesError(err) {
+		return fmt.Errorf("%v, the xfs filesystem of %s may have been formatted with features the kernel of the node doesn't support, e.g. by a more recent mkfs.xfs enabling reflink; format the volumes with --xfs-format-options=reflink=0 for older kernels", err, source)
+	}
+	return err
+}
+
+// unsupportedFeaturesPattern matches the kernel messages about the features of
+// a filesystem the kernel doesn't support, e.g. "XFS (vdb): Superblock has
+// unknown read-only compatible features (0x4) enabled."
+var unsupportedFeaturesPattern = regexp.MustCompile(`(?i)unsupported features|superblock has unknown [a-z -]*features`)
+
+// isUnsupportedFeaturesError returns whether a mount failed because the kernel
+// doesn't support the features of the filesystem. Mount reports a bad
+// superblock whatever the reason, e.g. a bad mount option, only the kernel log
+// of the error names the features.
+func isUnsupportedFeaturesError(err error) bool {
+	return unsupportedFeaturesPattern.MatchString(err.Error())
+}
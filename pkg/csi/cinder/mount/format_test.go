@@ -0,0 +1,238 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// fakeExitError is the exit status of a failed command
+type fakeExitError int
+
+func (e fakeExitError) String() string  { return e.Error() }
+func (e fakeExitError) Error() string   { return fmt.Sprintf("exit status %d", int(e)) }
+func (e fakeExitError) Exited() bool    { return true }
+func (e fakeExitError) ExitStatus() int { return int(e) }
+
+// fakeDisk is a device formatted by the mkfs commands run by its exec, and
+// mounted by its mounter once it has a filesystem. Its filesystem is grown to
+// the size of the device by the resize commands.
+type fakeDisk struct {
+	*mount.FakeMounter
+	format   string
+	mountErr error
+	// sizes of the device and of its filesystem, in bytes
+	deviceSize int64
+	fsSize     int64
+	// the commands run, with their arguments
+	commands []string
+}
+
+func (d *fakeDisk) Run(cmd string, args ...string) ([]byte, error) {
+	d.commands = append(d.commands, strings.Join(append([]string{cmd}, args...), " "))
+	switch {
+	case cmd == "blkid":
+		if d.format == "" {
+			// blkid finds no filesystem on the device
+			return nil, fakeExitError(2)
+		}
+		return []byte("DEVNAME=/dev/vdb\nTYPE=" + d.format + "\n"), nil
+	case strings.HasPrefix(cmd, "mkfs."):
+		d.format = strings.TrimPrefix(cmd, "mkfs.")
+	case cmd == "blockdev":
+		return []byte(fmt.Sprintf("%d\n", d.deviceSize)), nil
+	case cmd == "dumpe2fs":
+		return []byte(fmt.Sprintf("Filesystem volume name:   <none>\nBlock count:              %d\nBlock size:               4096\n", d.fsSize/4096)), nil
+	case cmd == "xfs_io":
+		return []byte(fmt.Sprintf("fd.path = \"/mnt\"\ngeom.bsize = 4096\ngeom.agcount = 4\ngeom.datablocks = %d\n", d.fsSize/4096)), nil
+	case cmd == "btrfs" && args[0] == "inspect-internal":
+		return []byte(fmt.Sprintf("superblock: bytenr=65536, device=/dev/vdb\ndev_item.total_bytes\t%d\ndev_item.bytes_used\t1048576\n", d.fsSize)), nil
+	case cmd == "resize2fs" || cmd == "xfs_growfs" || cmd == "btrfs":
+		d.fsSize = d.deviceSize
+	}
+	return nil, nil
+}
+
+func (d *fakeDisk) Mount(source string, target string, fstype string, options []string) error {
+	if d.format == "" {
+		return errors.New("mount: wrong fs type, bad option, bad superblock on " + source)
+	}
+	if d.mountErr != nil {
+		return d.mountErr
+	}
+	return d.FakeMounter.Mount(source, target, fstype, options)
+}
+
+// mkfs returns the mkfs command the disk was formatted with
+func (d *fakeDisk) mkfs() string {
+	for _, cmd := range d.commands {
+		if strings.HasPrefix(cmd, "mkfs.") {
+			return cmd
+		}
+	}
+	return ""
+}
+
+// fakeDiskMounter formats and mounts the disk until restore is called
+func fakeDiskMounter(disk *fakeDisk) (restore func()) {
+	disk.FakeMounter = &mount.FakeMounter{}
+	old := newDiskMounter
+	newDiskMounter = func() *mount.SafeFormatAndMount {
+		return &mount.SafeFormatAndMount{Interface: disk, Exec: disk}
+	}
+	return func() {
+		newDiskMounter = old
+	}
+}
+
+func TestSetXFSFormatOptions(t *testing.T) {
+	defer SetXFSFormatOptions(nil)
+
+	tests := []struct {
+		name     string
+		options  []string
+		expected []string
+		errMsg   string
+	}{
+		{"none", nil, nil, ""},
+		{"reflink", []string{"reflink=0"}, []string{"-m", "reflink=0"}, ""},
+		{"several", []string{"crc=1", "finobt=0", "reflink=0"}, []string{"-m", "crc=1,finobt=0,reflink=0"}, ""},
+		{"no crc", []string{"crc=0", "finobt=0", "reflink=0"}, []string{"-m", "crc=0,finobt=0,reflink=0"}, ""},
+		{"unknown feature", []string{"sparse=1"}, nil, `invalid xfs format option "sparse=1", must be one of crc, finobt, reflink, rmapbt set to 0 or 1`},
+		{"bad value", []string{"reflink=false"}, nil, `invalid xfs format option "reflink=false"`},
+		{"no value", []string{"reflink"}, nil, `invalid xfs format option "reflink"`},
+		{"twice", []string{"reflink=0", "reflink=1"}, nil, "reflink is set twice"},
+		{"needs crc", []string{"crc=0", "reflink=1"}, nil, "reflink=1 needs crc=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xfsFormatArgs = nil
+			err := SetXFSFormatOptions(tt.options)
+			if tt.errMsg != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.errMsg)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, xfsFormatArgs)
+		})
+	}
+}
+
+// Test mkfs.xfs gets the format options, and only for a fresh device
+func TestFormatAndMountXFSOptions(t *testing.T) {
+	defer SetXFSFormatOptions(nil)
+
+	tests := []struct {
+		name     string
+		options  []string
+		fstype   string
+		format   string
+		expected string
+	}{
+		{"xfs options", []string{"reflink=0", "finobt=0"}, "xfs", "", "mkfs.xfs -m reflink=0,finobt=0 /dev/vdb"},
+		{"xfs defaults", nil, "xfs", "", "mkfs.xfs /dev/vdb"},
+		{"formatted", []string{"reflink=0"}, "xfs", "xfs", ""},
+		{"ext4", []string{"reflink=0"}, "ext4", "", "mkfs.ext4 -F -m0 /dev/vdb"},
+		{"btrfs", []string{"reflink=0"}, "btrfs", "", "mkfs.btrfs /dev/vdb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, SetXFSFormatOptions(tt.options))
+			disk := &fakeDisk{format: tt.format}
+			defer fakeDiskMounter(disk)()
+
+			m := &Mount{}
+			assert.NoError(t, m.FormatAndMount("/dev/vdb", "/staging", tt.fstype, nil))
+			assert.Equal(t, tt.expected, disk.mkfs())
+			assert.Equal(t, tt.fstype, disk.format)
+			mounts, _ := disk.List()
+			if assert.Len(t, mounts, 1) {
+				assert.Equal(t, "/dev/vdb", mounts[0].Device)
+			}
+		})
+	}
+}
+
+// Test a kernel refusing the features of an xfs filesystem gets a hint about
+// reflink
+func TestFormatAndMountXFSUnsupportedFeatures(t *testing.T) {
+	mountErr := errors.New("mount failed: exit status 32, output: mount: wrong fs type, bad option, bad superblock on /dev/vdb")
+	defer fakeKernelLog(nil, "XFS (vdb): Superblock has unknown read-only compatible features (0x4) enabled.")()
+	disk := &fakeDisk{format: "xfs", mountErr: mountErr}
+	defer fakeDiskMounter(disk)()
+
+	m := &Mount{}
+	err := m.FormatAndMount("/dev/vdb", "/staging", "xfs", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad superblock on /dev/vdb")
+		assert.Contains(t, err.Error(), "--xfs-format-options=reflink=0")
+	}
+
+	// an ext4 volume gets no xfs hint
+	disk = &fakeDisk{format: "ext4", mountErr: mountErr}
+	defer fakeDiskMounter(disk)()
+	err = m.FormatAndMount("/dev/vdb", "/staging", "ext4", nil)
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "reflink")
+	}
+}
+
+// Test an xfs mount failing for another reason, mount reporting the same bad
+// superblock, gets no hint about reflink
+func TestFormatAndMountXFSOtherFailure(t *testing.T) {
+	mountErr := errors.New("mount failed: exit status 32, output: mount: wrong fs type, bad option, bad superblock on /dev/vdb, missing codepage or helper program, or other error")
+
+	tests := []struct {
+		name     string
+		messages []string
+	}{
+		{"no kernel log", nil},
+		{"bad option", []string{"XFS (vdb): unknown mount option [nobarrier]."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer fakeKernelLog(nil, tt.messages...)()
+			disk := &fakeDisk{format: "xfs", mountErr: mountErr}
+			defer fakeDiskMounter(disk)()
+
+			m := &Mount{}
+			err := m.FormatAndMount("/dev/vdb", "/staging", "xfs", []string{"nobarrier"})
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "bad superblock on /dev/vdb")
+				assert.NotContains(t, err.Error(), "reflink")
+			}
+		})
+	}
+}
+
+// Test btrfs is grown through its mount point
+func TestResizeFSBtrfs(t *testing.T) {
+	disk := &fakeDisk{format: "btrfs"}
+	defer fakeDiskMounter(disk)()
+
+	m := &Mount{}
+	assert.NoError(t, m.ResizeFS("/dev/vdb", "/staging"))
+	assert.Contains(t, disk.commands, "btrfs filesystem resize max /staging")
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/cloud-provider-openstack/pkg/util/blockdevice"
+)
+
+// Hypervisors the node may run on, detected from its DMI
+const (
+	HypervisorKVM     = "kvm"
+	HypervisorVMware  = "vmware"
+	HypervisorHyperV  = "hyperv"
+	HypervisorUnknown = "unknown"
+)
+
+// dmiPath is where the kernel exposes the DMI of the machine
+const dmiPath = "/sys/class/dmi/id"
+
+// readDMI returns a DMI field of the node, replaced in tests
+var readDMI = func(field string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dmiPath, field))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// DiscoveryStrategy is how the device of an attached volume is looked for on
+// the hypervisor of the node. The zero value, for unknown hypervisors, tries
+// every by-id path and then the metadata service.
+type DiscoveryStrategy struct {
+	hypervisor string
+}
+
+// DetectDiscoveryStrategy returns the strategy of the hypervisor named by the
+// DMI vendor and product of the node
+func DetectDiscoveryStrategy() *DiscoveryStrategy {
+	log := logging.With(logging.Op, "DetectHypervisor")
+	vendor, err := readDMI("sys_vendor")
+	if err != nil {
+		log.Warningf("Failed to read the DMI of the node, trying every device discovery source: %v", err)
+		return &DiscoveryStrategy{}
+	}
+	product, err := readDMI("product_name")
+	if err != nil {
+		log.V(4).Infof("Failed to read the DMI product name: %v", err)
+	}
+	s := &DiscoveryStrategy{hypervisor: hypervisorOf(vendor, product)}
+	log.Infof("Detected the %s hypervisor from the DMI vendor %q and product %q", s.Hypervisor(), vendor, product)
+	return s
+}
+
+// hypervisorOf returns the hypervisor of a DMI vendor and product
+func hypervisorOf(vendor, product string) string {
+	switch {
+	case strings.Contains(vendor, "VMware") || strings.HasPrefix(product, "VMware"):
+		return HypervisorVMware
+	case vendor == "Microsoft Corporation" && product == "Virtual Machine":
+		return HypervisorHyperV
+	// Nova sets the product of libvirt guests to "OpenStack Nova", or
+	// "OpenStack Compute" on some distributions
+	case vendor == "QEMU" || strings.Contains(product, "KVM") || strings.HasPrefix(product, "OpenStack"):
+		return HypervisorKVM
+	}
+	return HypervisorUnknown
+}
+
+// Hypervisor returns the name of the hypervisor of the strategy
+func (s *DiscoveryStrategy) Hypervisor() string {
+	if s == nil || s.hypervisor == "" {
+		return HypervisorUnknown
+	}
+	return s.hypervisor
+}
+
+// SerialIDPaths returns the by-id paths the disk of the volume may be linked
+// under on the hypervisor: the virtio and virtio-scsi ones on KVM, the WWN
+// on VMware and none on Hyper-V, which doesn't set the serial of the disks.
+func (s *DiscoveryStrategy) SerialIDPaths(volumeID string) []string {
+	paths := blockdevice.SerialIDPaths(volumeID)
+	switch s.Hypervisor() {
+	case HypervisorKVM:
+		return paths[:2]
+	case HypervisorVMware:
+		return paths[2:]
+	case HypervisorHyperV:
+		return nil
+	}
+	return paths
+}
+
+// MetadataFirst returns whether the metadata service is asked for the device
+// before the by-id paths are looked for
+func (s *DiscoveryStrategy) MetadataFirst() bool {
+	return s.Hypervisor() == HypervisorHyperV
+}
+
+// DiscoveryStrategyOf returns the strategy the mount provider detected, nil
+// for providers not detecting the hypervisor
+func DiscoveryStrategyOf(m IMount) *DiscoveryStrategy {
+	if provider, ok := m.(*Mount); ok {
+		return provider.strategy
+	}
+	return nil
+}
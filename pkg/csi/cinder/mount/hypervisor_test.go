@@ -0,0 +1,154 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDMI makes readDMI return the fields, or err, until restore is called
+func fakeDMI(fields map[string]string, err error) (restore func()) {
+	old := readDMI
+	readDMI = func(field string) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		value, ok := fields[field]
+		if !ok {
+			return "", errors.New("no such file or directory")
+		}
+		return value, nil
+	}
+	return func() {
+		readDMI = old
+	}
+}
+
+func TestDetectDiscoveryStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		vendor   string
+		product  string
+		expected string
+	}{
+		{"nova libvirt", "OpenStack Foundation", "OpenStack Nova", HypervisorKVM},
+		{"rhosp libvirt", "Red Hat", "OpenStack Compute", HypervisorKVM},
+		{"plain qemu", "QEMU", "Standard PC (i440FX + PIIX, 1996)", HypervisorKVM},
+		{"kvm", "Red Hat", "KVM", HypervisorKVM},
+		{"vmware", "VMware, Inc.", "VMware Virtual Platform", HypervisorVMware},
+		{"vmware7", "VMware, Inc.", "VMware7,1", HypervisorVMware},
+		{"hyper-v", "Microsoft Corporation", "Virtual Machine", HypervisorHyperV},
+		{"surface", "Microsoft Corporation", "Surface Pro", HypervisorUnknown},
+		{"bare metal", "Dell Inc.", "PowerEdge R640", HypervisorUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer fakeDMI(map[string]string{"sys_vendor": tt.vendor, "product_name": tt.product}, nil)()
+			assert.Equal(t, tt.expected, DetectDiscoveryStrategy().Hypervisor())
+		})
+	}
+}
+
+// Test nodes without DMI keep trying every source
+func TestDetectDiscoveryStrategyNoDMI(t *testing.T) {
+	defer fakeDMI(nil, errors.New("permission denied"))()
+
+	s := DetectDiscoveryStrategy()
+	assert.Equal(t, HypervisorUnknown, s.Hypervisor())
+	assert.Len(t, s.SerialIDPaths(fakeVolumeID), 3)
+	assert.False(t, s.MetadataFirst())
+}
+
+func TestDiscoveryStrategySerialIDPaths(t *testing.T) {
+	virtio := "/dev/disk/by-id/virtio-261a8b81-3660-43e5-b"
+	scsi := "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_261a8b81-3660-43e5-b"
+	wwn := "/dev/disk/by-id/wwn-0x261a8b81366043e5bab86470b65ee4e8"
+
+	tests := []struct {
+		hypervisor    string
+		expected      []string
+		metadataFirst bool
+	}{
+		{HypervisorKVM, []string{virtio, scsi}, false},
+		{HypervisorVMware, []string{wwn}, false},
+		{HypervisorHyperV, nil, true},
+		{HypervisorUnknown, []string{virtio, scsi, wwn}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hypervisor, func(t *testing.T) {
+			s := &DiscoveryStrategy{hypervisor: tt.hypervisor}
+			assert.Equal(t, tt.expected, s.SerialIDPaths(fakeVolumeID))
+			assert.Equal(t, tt.metadataFirst, s.MetadataFirst())
+		})
+	}
+
+	// providers not detecting the hypervisor try everything
+	var s *DiscoveryStrategy
+	assert.Equal(t, HypervisorUnknown, s.Hypervisor())
+	assert.Equal(t, []string{virtio, scsi, wwn}, s.SerialIDPaths(fakeVolumeID))
+	assert.Nil(t, DiscoveryStrategyOf(new(MountMock)))
+}
+
+// Test the disks of Hyper-V nodes are not waited for by serial ID
+func TestGetDevicePathHyperV(t *testing.T) {
+	m := &Mount{strategy: &DiscoveryStrategy{hypervisor: HypervisorHyperV}}
+	_, err := m.GetDevicePath(fakeVolumeID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not linked by serial ID on the hyperv hypervisor")
+	}
+}
+
+// Test the metadata service is asked first on Hyper-V, and last elsewhere
+func TestResolveStrategy(t *testing.T) {
+	tests := []struct {
+		hypervisor   string
+		serialPath   string
+		metadataPath string
+		expected     string
+		serialCalled bool
+	}{
+		{HypervisorHyperV, fakeSerialPath, "/dev/sdb", "/dev/sdb", false},
+		{HypervisorHyperV, fakeSerialPath, "", fakeSerialPath, true},
+		{HypervisorKVM, fakeSerialPath, "/dev/sdb", fakeSerialPath, true},
+		{HypervisorUnknown, "", "/dev/sdb", "/dev/sdb", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hypervisor, func(t *testing.T) {
+			mountmock := new(MountMock)
+			if tt.serialPath != "" {
+				mountmock.On("GetDevicePath", fakeVolumeID).Return(tt.serialPath, nil)
+			} else {
+				mountmock.On("GetDevicePath", fakeVolumeID).Return("", errors.New("fake error"))
+			}
+			r := &DevicePathResolver{
+				Mount:              mountmock,
+				MetadataDevicePath: func(string) string { return tt.metadataPath },
+				Strategy:           &DiscoveryStrategy{hypervisor: tt.hypervisor},
+			}
+
+			devicePath, err := r.Resolve(fakeVolumeID, nil, "")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, devicePath)
+			if !tt.serialCalled {
+				mountmock.AssertNotCalled(t, "GetDevicePath", fakeVolumeID)
+			}
+		})
+	}
+}
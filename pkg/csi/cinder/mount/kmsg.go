@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+)
+
+const (
+	// number of the last kernel log lines about a device appended to errors
+	maxKernelLogLines = 20
+	// kernel log lines are trimmed to this length in errors
+	maxKernelLogLineLength = 200
+)
+
+// kernelLogInErrors is whether the failed mounts and formats report the
+// kernel log lines about the device, set by SetKernelLogInErrors
+var kernelLogInErrors bool
+
+// readKernelLog returns the messages of the kernel log, replaced in tests
+var readKernelLog = readKmsg
+
+// SetKernelLogInErrors sets whether the errors of failed mounts and formats
+// carry the last kernel log lines mentioning the device. The cause of the
+// failure, e.g. an I/O error or an unsupported filesystem feature, is often
+// only logged by the kernel, but reading its log needs privileges.
+func SetKernelLogInErrors(enabled bool) {
+	kernelLogInErrors = enabled
+}
+
+// withKernelLog returns err with the last kernel log lines mentioning the
+// device appended, when enabled. Failing to read the log only loses them,
+// err is returned as is.
+func withKernelLog(err error, device string) error {
+	if err == nil || !kernelLogInErrors {
+		return err
+	}
+	excerpt := kernelLogExcerpt(device)
+	if excerpt == "" {
+		return err
+	}
+	return fmt.Errorf("%v, kernel log: %s", err, excerpt)
+}
+
+// kernelLogExcerpt returns the last kernel log lines mentioning the device,
+// trimmed and joined, e.g. "XFS (vdb): Superblock has unknown read-only
+// compatible features (0x4) enabled."
+func kernelLogExcerpt(device string) string {
+	log := logging.With(logging.Op, "kernelLog", logging.DevicePath, device)
+	// the kernel names the device, not its by-id link
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	name := filepath.Base(device)
+
+	messages, err := readKernelLog()
+	if err != nil {
+		log.V(4).Infof("Failed to read the kernel log: %v", err)
+	}
+	var lines []string
+	for _, message := range messages {
+		if mentionsDevice(message, name) {
+			lines = append(lines, trimKernelLogLine(message))
+		}
+	}
+	if len(lines) > maxKernelLogLines {
+		lines = lines[len(lines)-maxKernelLogLines:]
+	}
+	return strings.Join(lines, "; ")
+}
+
+// mentionsDevice returns whether a kernel log message is about the device,
+// e.g. vdb, or one of its partitions, but not about vdbb
+func mentionsDevice(message, name string) bool {
+	for i := 0; ; {
+		j := strings.Index(message[i:], name)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(name)
+		if (start == 0 || !isNameChar(message[start-1])) && (end == len(message) || !isLetter(message[end])) {
+			return true
+		}
+		i = end
+	}
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isLetter(c) || c >= '0' && c <= '9'
+}
+
+func trimKernelLogLine(line string) string {
+	line = strings.TrimSpace(line)
+	if len(line) > maxKernelLogLineLength {
+		line = line[:maxKernelLogLineLength] + "..."
+	}
+	return line
+}
+
+// kmsgMessage returns the message of a /dev/kmsg record, e.g. "XFS (vdb):
+// Mounting V5 Filesystem" for "6,1234,5678901,-;XFS (vdb): Mounting V5
+// Filesystem\n", without the dictionary lines that may follow it
+func kmsgMessage(record []byte) string {
+	if i := bytes.IndexByte(record, ';'); i >= 0 {
+		record = record[i+1:]
+	}
+	if i := bytes.IndexByte(record, '\n'); i >= 0 {
+		record = record[:i]
+	}
+	return string(record)
+}
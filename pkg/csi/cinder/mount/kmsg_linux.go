@@ -0,0 +1,58 @@
+// +build linux
+
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"syscall"
+)
+
+// kmsgPath is the device the kernel log is read from
+const kmsgPath = "/dev/kmsg"
+
+// readKmsg returns the messages of the kernel log. /dev/kmsg is read without
+// blocking, and without the runtime poller that would wait for new messages,
+// until it has nothing left. Reading it needs CAP_SYSLOG.
+func readKmsg() ([]string, error) {
+	fd, err := syscall.Open(kmsgPath, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	var messages []string
+	// a read returns one record, at most about 8KiB long
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(fd, buf)
+		switch {
+		case err == syscall.EAGAIN:
+			return messages, nil
+		case err == syscall.EPIPE:
+			// the record was overwritten while being read, the next one follows
+			continue
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			return messages, err
+		case n <= 0:
+			return messages, nil
+		}
+		messages = append(messages, kmsgMessage(buf[:n]))
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKernelLog makes the kernel log hold messages, or fail with err after
+// them, until restore is called
+func fakeKernelLog(err error, messages ...string) (restore func()) {
+	oldRead, oldEnabled := readKernelLog, kernelLogInErrors
+	readKernelLog = func() ([]string, error) {
+		return messages, err
+	}
+	SetKernelLogInErrors(true)
+	return func() {
+		readKernelLog, kernelLogInErrors = oldRead, oldEnabled
+	}
+}
+
+func TestKmsgMessage(t *testing.T) {
+	assert.Equal(t, "XFS (vdb): Mounting V5 Filesystem", kmsgMessage([]byte("6,1234,5678901,-;XFS (vdb): Mounting V5 Filesystem\n")))
+	assert.Equal(t, "blk_update_request: I/O error, dev vdb, sector 0", kmsgMessage([]byte("3,1235,5678902,-;blk_update_request: I/O error, dev vdb, sector 0\n SUBSYSTEM=block\n DEVICE=b252:16\n")))
+}
+
+func TestMentionsDevice(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected bool
+	}{
+		{"XFS (vdb): Mounting V5 Filesystem", true},
+		{"EXT4-fs (vdb1): mounted filesystem with ordered data mode", true},
+		{"blk_update_request: I/O error, dev vdb, sector 0", true},
+		{"XFS (vdbb): Mounting V5 Filesystem", false},
+		{"XFS (xvdb): Mounting V5 Filesystem", false},
+		{"XFS (vdc): Mounting V5 Filesystem", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, mentionsDevice(tt.message, "vdb"), tt.message)
+	}
+}
+
+func TestKernelLogExcerpt(t *testing.T) {
+	var messages []string
+	for i := 0; i < 30; i++ {
+		messages = append(messages, fmt.Sprintf("blk_update_request: I/O error, dev vdb, sector %d", i))
+		messages = append(messages, fmt.Sprintf("blk_update_request: I/O error, dev vdc, sector %d", i))
+	}
+	messages = append(messages, "XFS (vdb): "+strings.Repeat("x", 300))
+	defer fakeKernelLog(nil, messages...)()
+
+	lines := strings.Split(kernelLogExcerpt("/dev/vdb"), "; ")
+	if assert.Len(t, lines, maxKernelLogLines) {
+		assert.Equal(t, "blk_update_request: I/O error, dev vdb, sector 11", lines[0])
+		assert.Equal(t, maxKernelLogLineLength+len("..."), len(lines[maxKernelLogLines-1]))
+	}
+	for _, line := range lines {
+		assert.NotContains(t, line, "vdc")
+	}
+}
+
+// Test the errors of failed mounts carry the kernel log about the device,
+// only when enabled, and are left as is when the log cannot be read
+func TestFormatAndMountKernelLog(t *testing.T) {
+	mountErr := errors.New("mount failed: exit status 32, output: mount: wrong fs type, bad option, bad superblock on /dev/vdb")
+	messages := []string{
+		"XFS (vdb): Superblock has unknown read-only compatible features (0x4) enabled.",
+		"XFS (vdc): Mounting V5 Filesystem",
+		"XFS (vdb): Attempted to mount read-only compatible filesystem read-write.",
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		readErr  error
+		messages []string
+		expected string
+	}{
+		{"enabled", true, nil, messages, mountErr.Error() + ", kernel log: " + messages[0] + "; " + messages[2]},
+		{"disabled", false, nil, messages, mountErr.Error()},
+		{"unreadable", true, errors.New("open /dev/kmsg: operation not permitted"), nil, mountErr.Error()},
+		{"partly read", true, errors.New("read /dev/kmsg: invalid argument"), messages[:1], mountErr.Error() + ", kernel log: " + messages[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer fakeKernelLog(tt.readErr, tt.messages...)()
+			SetKernelLogInErrors(tt.enabled)
+			disk := &fakeDisk{format: "ext4", mountErr: mountErr}
+			defer fakeDiskMounter(disk)()
+
+			m := &Mount{}
+			err := m.FormatAndMount("/dev/vdb", "/staging", "ext4", nil)
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, err.Error())
+			}
+		})
+	}
+}
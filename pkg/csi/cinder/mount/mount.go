@@ -17,31 +17,34 @@ limitations under the License.
 package mount
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/cloud-provider-openstack/pkg/util/blockdevice"
 	"k8s.io/kubernetes/pkg/util/mount"
-	utilexec "k8s.io/utils/exec"
-
-	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/resizefs"
 )
 
 const (
-	probeVolumeDuration      = 1 * time.Second
-	probeVolumeTimeout       = 60 * time.Second
-	operationFinishInitDelay = 1 * time.Second
-	operationFinishFactor    = 1.1
-	operationFinishSteps     = 15
-	instanceIDFile           = "/var/lib/cloud/data/instance-id"
+	defaultProbeVolumeDuration = 1 * time.Second
+	defaultProbeVolumeTimeout  = 60 * time.Second
+	operationFinishInitDelay   = 1 * time.Second
+	operationFinishFactor      = 1.1
+	operationFinishSteps       = 15
+	operationFinishJitter      = 0.1
+	instanceIDFile             = "/var/lib/cloud/data/instance-id"
 )
 
 type IMount interface {
-	ScanForAttach(devicePath string) error
+	ScanForAttach(ctx context.Context, devicePath string) error
 	GetDevicePath(volumeID string) (string, error)
 	IsLikelyNotMountPointAttach(targetpath string) (bool, error)
 	FormatAndMount(source string, target string, fstype string, options []string) error
@@ -49,54 +52,71 @@ type IMount interface {
 	Mount(source string, target string, fstype string, options []string) error
 	UnmountPath(mountPath string) error
 	GetInstanceID() (string, error)
+	RescanDevice(devicePath string) error
+	ResizeFS(devicePath string, deviceMountPath string) error
+	NeedsResize(devicePath string, deviceMountPath string) (bool, error)
 }
 
 type Mount struct {
+	// strategy is how GetDevicePath looks for devices, detected once by
+	// GetMountProvider
+	strategy *DiscoveryStrategy
 }
 
 var MInstance IMount = nil
 
-func GetMountProvider() (IMount, error) {
+// devicePathBackoff is the backoff of GetDevicePath
+var devicePathBackoff = wait.Backoff{
+	Duration: operationFinishInitDelay,
+	Factor:   operationFinishFactor,
+	Steps:    operationFinishSteps,
+	Jitter:   operationFinishJitter,
+}
 
-	if MInstance == nil {
-		MInstance = &Mount{}
-	}
-	return MInstance, nil
+// SetDevicePathBackoff sets the backoff used by GetDevicePath while waiting
+// for the device of an attached volume to show up
+func SetDevicePathBackoff(backoff wait.Backoff) {
+	devicePathBackoff = backoff
 }
 
-// probeVolume probes volume in compute
-func probeVolume() error {
-	// rescan scsi bus
-	scsi_path := "/sys/class/scsi_host/"
-	if dirs, err := ioutil.ReadDir(scsi_path); err == nil {
-		for _, f := range dirs {
-			name := scsi_path + f.Name() + "/scan"
-			data := []byte("- - -")
-			ioutil.WriteFile(name, data, 0666)
-		}
-	}
+// sysBlockPath is where the kernel lists the block devices, replaced in tests
+var sysBlockPath = "/sys/block"
 
-	executor := utilexec.New()
-	args := []string{"trigger"}
-	cmd := executor.Command("udevadm", args...)
-	_, err := cmd.CombinedOutput()
-	if err != nil {
-		klog.V(3).Infof("error running udevadm trigger %v\n", err)
-		return err
+// probeVolumeDuration and probeVolumeTimeout are the interval between the
+// rescans of ScanForAttach and how long it rescans for
+var (
+	probeVolumeDuration = defaultProbeVolumeDuration
+	probeVolumeTimeout  = defaultProbeVolumeTimeout
+)
+
+// probe rescans the buses for new devices, replaced in tests
+var probe = probeVolume
+
+// SetProbeVolumeTimeouts sets the interval between the rescans of
+// ScanForAttach and how long it rescans for
+func SetProbeVolumeTimeouts(duration, timeout time.Duration) error {
+	if duration <= 0 || timeout <= 0 {
+		return fmt.Errorf("invalid volume probe interval %v and timeout %v, both must be positive", duration, timeout)
 	}
+	probeVolumeDuration, probeVolumeTimeout = duration, timeout
 	return nil
 }
 
+func GetMountProvider() (IMount, error) {
+
+	if MInstance == nil {
+		MInstance = &Mount{strategy: DetectDiscoveryStrategy()}
+	}
+	return MInstance, nil
+}
+
 // GetDevicePath returns the path of an attached block storage volume, specified by its id.
 func (m *Mount) GetDevicePath(volumeID string) (string, error) {
-	backoff := wait.Backoff{
-		Duration: operationFinishInitDelay,
-		Factor:   operationFinishFactor,
-		Steps:    operationFinishSteps,
+	if len(m.strategy.SerialIDPaths(volumeID)) == 0 {
+		return "", fmt.Errorf("the disks are not linked by serial ID on the %s hypervisor", m.strategy.Hypervisor())
 	}
-
 	var devicePath string
-	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+	err := wait.ExponentialBackoff(devicePathBackoff, func() (bool, error) {
 		devicePath = m.getDevicePathBySerialID(volumeID)
 		if devicePath != "" {
 			return true, nil
@@ -114,65 +134,103 @@ func (m *Mount) GetDevicePath(volumeID string) (string, error) {
 
 // GetDevicePathBySerialID returns the path of an attached block storage volume, specified by its id.
 func (m *Mount) getDevicePathBySerialID(volumeID string) string {
-	// Build a list of candidate device paths.
+	log := logging.With(logging.Op, "GetDevicePath", logging.VolumeID, volumeID)
+
 	// Certain Nova drivers will set the disk serial ID, including the Cinder volume id.
-	candidateDeviceNodes := []string{
-		// KVM
-		fmt.Sprintf("virtio-%s", volumeID[:20]),
-		// KVM virtio-scsi
-		fmt.Sprintf("scsi-0QEMU_QEMU_HARDDISK_%s", volumeID[:20]),
-		// ESXi
-		fmt.Sprintf("wwn-0x%s", strings.Replace(volumeID, "-", "", -1)),
-	}
+	candidateDevicePaths := m.strategy.SerialIDPaths(volumeID)
 
-	files, err := ioutil.ReadDir("/dev/disk/by-id/")
+	files, err := ioutil.ReadDir(blockdevice.ByIDDir)
 	if err != nil {
-		klog.V(4).Infof("ReadDir failed with error %v", err)
+		log.V(4).Infof("ReadDir failed with error %v", err)
 	}
 
 	for _, f := range files {
-		for _, c := range candidateDeviceNodes {
-			if c == f.Name() {
-				klog.V(4).Infof("Found disk attached as %q; full devicepath: %s\n",
-					f.Name(), path.Join("/dev/disk/by-id/", f.Name()))
-				return path.Join("/dev/disk/by-id/", f.Name())
+		devicePath := path.Join(blockdevice.ByIDDir, f.Name())
+		for _, c := range candidateDevicePaths {
+			if c == devicePath {
+				log.With(logging.DevicePath, devicePath).V(4).Infof("Found disk attached as %q", f.Name())
+				return devicePath
 			}
 		}
 	}
 
-	klog.V(4).Infof("Failed to find device for the volumeID: %q by serial ID", volumeID)
+	log.V(4).Infof("Failed to find device by serial ID")
 	return ""
 }
 
-// ScanForAttach
-func (m *Mount) ScanForAttach(devicePath string) error {
+// ScanForAttach rescans the buses until the device shows up, the timeout
+// expires or ctx is done. No rescan is done once the device exists.
+func (m *Mount) ScanForAttach(ctx context.Context, devicePath string) error {
+	log := logging.With(logging.Op, "ScanForAttach", logging.DevicePath, devicePath)
 	ticker := time.NewTicker(probeVolumeDuration)
 	defer ticker.Stop()
 	timer := time.NewTimer(probeVolumeTimeout)
 	defer timer.Stop()
 
 	for {
+		log.V(5).Infof("Checking Cinder disk is attached")
+		exists, err := mount.PathExists(devicePath)
+		if exists && err == nil {
+			return nil
+		}
+		log.V(3).Infof("Could not find attached Cinder disk, rescanning")
+		probe()
+
 		select {
 		case <-ticker.C:
-			klog.V(5).Infof("Checking Cinder disk %q is attached.", devicePath)
-			probeVolume()
-
-			exists, err := mount.PathExists(devicePath)
-			if exists && err == nil {
-				return nil
-			} else {
-				klog.V(3).Infof("Could not find attached Cinder disk %s", devicePath)
-			}
 		case <-timer.C:
 			return fmt.Errorf("Could not find attached Cinder disk %s. Timeout waiting for mount paths to be created.", devicePath)
+		case <-ctx.Done():
+			return fmt.Errorf("Could not find attached Cinder disk %s: %v", devicePath, ctx.Err())
+		}
+	}
+}
+
+// RescanDevice makes the kernel read the size of the device again, so that it
+// sees a disk extended while attached. virtio-blk disks have no rescan file,
+// the hypervisor tells the kernel their new size.
+func (m *Mount) RescanDevice(devicePath string) error {
+	log := logging.With(logging.Op, "RescanDevice", logging.DevicePath, devicePath)
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device %s: %v", devicePath, err)
+	}
+	rescan := filepath.Join(sysBlockPath, filepath.Base(device), "device", "rescan")
+	if _, err := os.Stat(rescan); os.IsNotExist(err) {
+		log.V(4).Infof("%s has no rescan file, not rescanning", device)
+		return nil
+	}
+	if err := ioutil.WriteFile(rescan, []byte("1"), 0666); err != nil {
+		return fmt.Errorf("failed to rescan device %s: %v", device, err)
+	}
+	log.V(4).Infof("Rescanned %s", device)
+	return nil
+}
+
+// ResizeFS grows the filesystem of the device mounted at deviceMountPath to
+// the size of the device
+func (m *Mount) ResizeFS(devicePath string, deviceMountPath string) error {
+	diskMounter := newDiskMounter()
+	format, err := diskMounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to get the format of %s: %v", devicePath, err)
+	}
+	// btrfs is grown through its mount point, resizefs only knows ext and xfs
+	if format == "btrfs" {
+		if out, err := diskMounter.Exec.Run("btrfs", "filesystem", "resize", "max", deviceMountPath); err != nil {
+			return fmt.Errorf("failed to resize the btrfs filesystem of %s mounted at %s: %v, output: %s", devicePath, deviceMountPath, err, string(out))
 		}
+		return nil
+	}
+	if _, err := resizefs.NewResizeFs(diskMounter).Resize(devicePath, deviceMountPath); err != nil {
+		return fmt.Errorf("failed to resize the filesystem of %s mounted at %s: %v", devicePath, deviceMountPath, err)
 	}
+	return nil
 }
 
-// FormatAndMount
+// FormatAndMount formats the device unless it has a filesystem and mounts it
 func (m *Mount) FormatAndMount(source string, target string, fstype string, options []string) error {
-	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()}
-	return diskMounter.FormatAndMount(source, target, fstype, options)
+	return formatAndMount(newDiskMounter(), source, target, fstype, options)
 }
 
 func (m *Mount) Mount(source string, target string, fstype string, options []string) error {
@@ -216,13 +274,13 @@ func (m *Mount) UnmountPath(mountPath string) error {
 func (m *Mount) GetInstanceID() (string, error) {
 	// Try to find instance ID on the local filesystem (created by cloud-init)
 	idBytes, err := ioutil.ReadFile(instanceIDFile)
-	if err == nil {
-		instanceID := string(idBytes)
-		instanceID = strings.TrimSpace(instanceID)
-		klog.V(3).Infof("Got instance id from %s: %s", instanceIDFile, instanceID)
-		if instanceID != "" {
-			return instanceID, nil
-		}
+	if err != nil {
+		return "", err
+	}
+	instanceID := strings.TrimSpace(string(idBytes))
+	if instanceID == "" {
+		return "", fmt.Errorf("%s is empty", instanceIDFile)
 	}
-	return "", err
+	logging.With(logging.Op, "GetInstanceID", logging.InstanceID, instanceID).V(3).Infof("Got instance id from %s", instanceIDFile)
+	return instanceID, nil
 }
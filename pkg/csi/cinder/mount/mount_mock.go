@@ -16,7 +16,11 @@ limitations under the License.
 
 package mount
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	"context"
+
+	mock "github.com/stretchr/testify/mock"
+)
 
 // MountMock is an autogenerated mock type for the IMount type
 // ORIGINALLY GENERATED BY mockery with hand edits
@@ -115,13 +119,13 @@ func (_m *MountMock) IsLikelyNotMountPointDetach(targetpath string) (bool, error
 	return r0, r1
 }
 
-// ScanForAttach provides a mock function with given fields: devicePath
-func (_m *MountMock) ScanForAttach(devicePath string) error {
-	ret := _m.Called(devicePath)
+// ScanForAttach provides a mock function with given fields: ctx, devicePath
+func (_m *MountMock) ScanForAttach(ctx context.Context, devicePath string) error {
+	ret := _m.Called(ctx, devicePath)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(devicePath)
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, devicePath)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -163,3 +167,52 @@ func (_m *MountMock) UnmountPath(mountPath string) error {
 
 	return r0
 }
+
+// RescanDevice provides a mock function with given fields: devicePath
+func (_m *MountMock) RescanDevice(devicePath string) error {
+	ret := _m.Called(devicePath)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(devicePath)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ResizeFS provides a mock function with given fields: devicePath, deviceMountPath
+func (_m *MountMock) ResizeFS(devicePath string, deviceMountPath string) error {
+	ret := _m.Called(devicePath, deviceMountPath)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string) error); ok {
+		r0 = rf(devicePath, deviceMountPath)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// NeedsResize provides a mock function with given fields: devicePath, deviceMountPath
+func (_m *MountMock) NeedsResize(devicePath string, deviceMountPath string) (bool, error) {
+	ret := _m.Called(devicePath, deviceMountPath)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, string) bool); ok {
+		r0 = rf(devicePath, deviceMountPath)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(devicePath, deviceMountPath)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
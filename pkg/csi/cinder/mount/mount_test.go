@@ -0,0 +1,175 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProbe replaces the rescans of the buses with a counter until restore
+// is called
+func fakeProbe(t *testing.T, duration, timeout time.Duration) (probes *int32, restore func()) {
+	probes = new(int32)
+	oldProbe, oldDuration, oldTimeout := probe, probeVolumeDuration, probeVolumeTimeout
+	probe = func() error {
+		atomic.AddInt32(probes, 1)
+		return nil
+	}
+	assert.NoError(t, SetProbeVolumeTimeouts(duration, timeout))
+	return probes, func() {
+		probe, probeVolumeDuration, probeVolumeTimeout = oldProbe, oldDuration, oldTimeout
+	}
+}
+
+func TestScanForAttachDeviceExists(t *testing.T) {
+	probes, restore := fakeProbe(t, time.Millisecond, time.Minute)
+	defer restore()
+	dir, err := ioutil.TempDir("", "dev")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	devicePath := filepath.Join(dir, "vdb")
+	assert.NoError(t, ioutil.WriteFile(devicePath, nil, 0644))
+
+	m := &Mount{}
+	assert.NoError(t, m.ScanForAttach(context.Background(), devicePath))
+	assert.Equal(t, int32(0), atomic.LoadInt32(probes))
+}
+
+// Test the rescans stop once the device shows up
+func TestScanForAttachDeviceAppears(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dev")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	devicePath := filepath.Join(dir, "vdb")
+
+	probes, restore := fakeProbe(t, time.Millisecond, time.Minute)
+	defer restore()
+	probe = func() error {
+		if atomic.AddInt32(probes, 1) == 3 {
+			return ioutil.WriteFile(devicePath, nil, 0644)
+		}
+		return nil
+	}
+
+	m := &Mount{}
+	assert.NoError(t, m.ScanForAttach(context.Background(), devicePath))
+	assert.Equal(t, int32(3), atomic.LoadInt32(probes))
+}
+
+func TestScanForAttachTimeout(t *testing.T) {
+	_, restore := fakeProbe(t, time.Millisecond, 20*time.Millisecond)
+	defer restore()
+
+	m := &Mount{}
+	err := m.ScanForAttach(context.Background(), "/nonexistent/vdb")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Timeout")
+	}
+}
+
+// Test the scan gives up as soon as the caller is gone rather than at the
+// timeout
+func TestScanForAttachCancel(t *testing.T) {
+	probes, restore := fakeProbe(t, time.Hour, time.Hour)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+
+	start := time.Now()
+	m := &Mount{}
+	err := m.ScanForAttach(ctx, "/nonexistent/vdb")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), context.Canceled.Error())
+	}
+	assert.True(t, time.Since(start) < time.Minute)
+	assert.Equal(t, int32(1), atomic.LoadInt32(probes))
+}
+
+func TestSetProbeVolumeTimeouts(t *testing.T) {
+	_, restore := fakeProbe(t, time.Second, time.Minute)
+	defer restore()
+	assert.Error(t, SetProbeVolumeTimeouts(0, time.Minute))
+	assert.Error(t, SetProbeVolumeTimeouts(time.Second, -time.Minute))
+	assert.Equal(t, time.Second, probeVolumeDuration)
+	assert.Equal(t, time.Minute, probeVolumeTimeout)
+}
+
+// fakeSysBlock creates a device linked from /dev/disk/by-id and its sysfs
+// directory, with a rescan file if rescannable, in dir until restore is called
+func fakeSysBlock(t *testing.T, dir, device string, rescannable bool) (devicePath string, restore func()) {
+	oldSysBlockPath := sysBlockPath
+	sysBlockPath = filepath.Join(dir, "sys", "block")
+	sysDevice := filepath.Join(sysBlockPath, device, "device")
+	assert.NoError(t, os.MkdirAll(sysDevice, 0755))
+	if rescannable {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(sysDevice, "rescan"), nil, 0644))
+	}
+
+	byID := filepath.Join(dir, "dev", "disk", "by-id")
+	assert.NoError(t, os.MkdirAll(byID, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dev", device), nil, 0644))
+	devicePath = filepath.Join(byID, "scsi-0QEMU_QEMU_HARDDISK_"+device)
+	assert.NoError(t, os.Symlink(filepath.Join("..", "..", device), devicePath))
+	return devicePath, func() {
+		sysBlockPath = oldSysBlockPath
+	}
+}
+
+func TestRescanDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rescan")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	devicePath, restore := fakeSysBlock(t, dir, "sdb", true)
+	defer restore()
+
+	m := &Mount{}
+	assert.NoError(t, m.RescanDevice(devicePath))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sys", "block", "sdb", "device", "rescan"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+}
+
+// Test virtio-blk disks, which have no rescan file, are left alone
+func TestRescanDeviceVirtio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rescan")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	devicePath, restore := fakeSysBlock(t, dir, "vdb", false)
+	defer restore()
+
+	m := &Mount{}
+	assert.NoError(t, m.RescanDevice(devicePath))
+	_, err = os.Stat(filepath.Join(dir, "sys", "block", "vdb", "device", "rescan"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRescanDeviceMissing(t *testing.T) {
+	m := &Mount{}
+	err := m.RescanDevice("/nonexistent/vdb")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to resolve device /nonexistent/vdb")
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// sysClassPath is where the kernel lists the SCSI and FibreChannel hosts and
+// the iSCSI sessions, replaced in tests
+var sysClassPath = "/sys/class"
+
+// newProbeExec returns the exec running the rescan commands, replaced in tests
+var newProbeExec = func() mount.Exec {
+	return mount.NewOsExec()
+}
+
+// probeVolume rescans the buses for new devices: the FibreChannel hosts get a
+// LIP and the iSCSI sessions are rescanned on the nodes having them, e.g. bare
+// metal ones, before every SCSI host is scanned and udev triggered. A
+// transport failing to rescan is logged, the others are still rescanned.
+func probeVolume() error {
+	log := logging.With(logging.Op, "probeVolume")
+	exec := newProbeExec()
+
+	issueFCLIPs(log)
+	rescanISCSISessions(exec, log)
+	scanSCSIHosts(log)
+
+	if _, err := exec.Run("udevadm", "trigger"); err != nil {
+		log.V(3).Infof("Error running udevadm trigger: %v", err)
+		return err
+	}
+	return nil
+}
+
+// sysClassEntries returns the entries of a class of /sys/class, none when
+// the node doesn't have the class
+func sysClassEntries(class string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(sysClassPath, class))
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// scanSCSIHosts makes every SCSI host scan all its channels, targets and LUNs
+func scanSCSIHosts(log logging.Logger) {
+	for _, host := range sysClassEntries("scsi_host") {
+		scan := filepath.Join(sysClassPath, "scsi_host", host, "scan")
+		if err := ioutil.WriteFile(scan, []byte("- - -"), 0666); err != nil {
+			log.V(4).Infof("Failed to scan SCSI host %s: %v", host, err)
+		}
+	}
+}
+
+// issueFCLIPs makes the FibreChannel hosts issue a LIP, so that the fabric
+// reports the LUNs mapped to the node since the last one
+func issueFCLIPs(log logging.Logger) {
+	for _, host := range sysClassEntries("fc_host") {
+		lip := filepath.Join(sysClassPath, "fc_host", host, "issue_lip")
+		if err := ioutil.WriteFile(lip, []byte("1"), 0666); err != nil {
+			log.V(3).Infof("Failed to issue a LIP on FibreChannel host %s: %v", host, err)
+		}
+	}
+}
+
+// rescanISCSISessions rescans the LUNs of the active iSCSI sessions
+func rescanISCSISessions(exec mount.Exec, log logging.Logger) {
+	if len(sysClassEntries("iscsi_session")) == 0 {
+		return
+	}
+	if out, err := exec.Run("iscsiadm", "-m", "session", "--rescan"); err != nil {
+		log.V(3).Infof("Failed to rescan the iSCSI sessions: %v, output: %s", err, string(out))
+	}
+}
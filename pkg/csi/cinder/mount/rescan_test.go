@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// fakeProbeExec records the commands run, failing those in failing
+type fakeProbeExec struct {
+	commands []string
+	failing  map[string]bool
+}
+
+func (e *fakeProbeExec) Run(cmd string, args ...string) ([]byte, error) {
+	e.commands = append(e.commands, strings.Join(append([]string{cmd}, args...), " "))
+	if e.failing[cmd] {
+		return []byte(cmd + ": failed"), fakeExitError(1)
+	}
+	return nil, nil
+}
+
+// fakeSysClass creates the entries of /sys/class under a temporary directory
+// used by probeVolume, with exec running its commands, until restore is called
+func fakeSysClass(t *testing.T, exec *fakeProbeExec, entries ...string) (dir string, restore func()) {
+	dir, err := ioutil.TempDir("", "sys-class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath, oldExec := sysClassPath, newProbeExec
+	sysClassPath = dir
+	newProbeExec = func() mount.Exec { return exec }
+	return dir, func() {
+		sysClassPath, newProbeExec = oldPath, oldExec
+		os.RemoveAll(dir)
+	}
+}
+
+// written returns what was written to the file of the fake /sys/class
+func written(t *testing.T, dir, entry string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, entry))
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestProbeVolumeTransports(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []string
+		lips     []string
+		commands []string
+	}{
+		{
+			name:     "virtio-scsi",
+			entries:  []string{"scsi_host/host0/scan"},
+			commands: []string{"udevadm trigger"},
+		},
+		{
+			name:     "no scsi host",
+			commands: []string{"udevadm trigger"},
+		},
+		{
+			name:     "fibre channel",
+			entries:  []string{"scsi_host/host0/scan", "scsi_host/host1/scan", "fc_host/host0/issue_lip", "fc_host/host1/issue_lip"},
+			lips:     []string{"fc_host/host0/issue_lip", "fc_host/host1/issue_lip"},
+			commands: []string{"udevadm trigger"},
+		},
+		{
+			name:     "iscsi",
+			entries:  []string{"scsi_host/host0/scan", "iscsi_session/session1/state"},
+			commands: []string{"iscsiadm -m session --rescan", "udevadm trigger"},
+		},
+		{
+			name:     "fibre channel and iscsi",
+			entries:  []string{"scsi_host/host0/scan", "scsi_host/host1/scan", "fc_host/host1/issue_lip", "iscsi_session/session1/state", "iscsi_session/session2/state"},
+			lips:     []string{"fc_host/host1/issue_lip"},
+			commands: []string{"iscsiadm -m session --rescan", "udevadm trigger"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exec := &fakeProbeExec{}
+			dir, restore := fakeSysClass(t, exec, tt.entries...)
+			defer restore()
+
+			assert.NoError(t, probeVolume())
+			assert.Equal(t, tt.commands, exec.commands)
+			for _, entry := range tt.entries {
+				if strings.HasPrefix(entry, "scsi_host/") {
+					assert.Equal(t, "- - -", written(t, dir, entry))
+				}
+			}
+			for _, lip := range tt.lips {
+				assert.Equal(t, "1", written(t, dir, lip))
+			}
+		})
+	}
+}
+
+// Test a transport failing to rescan doesn't keep the others from being
+// rescanned
+func TestProbeVolumeTransportFailure(t *testing.T) {
+	exec := &fakeProbeExec{failing: map[string]bool{"iscsiadm": true}}
+	dir, restore := fakeSysClass(t, exec, "scsi_host/host0/scan", "fc_host/host0/issue_lip", "iscsi_session/session1/state")
+	defer restore()
+	// a host without the LIP file, e.g. of a driver not supporting it
+	lip := filepath.Join(dir, "fc_host/host0/issue_lip")
+	assert.NoError(t, os.Remove(lip))
+	assert.NoError(t, os.Mkdir(lip, 0755))
+
+	assert.NoError(t, probeVolume())
+	assert.Equal(t, []string{"iscsiadm -m session --rescan", "udevadm trigger"}, exec.commands)
+	assert.Equal(t, "- - -", written(t, dir, "scsi_host/host0/scan"))
+}
+
+func TestProbeVolumeUdevFailure(t *testing.T) {
+	exec := &fakeProbeExec{failing: map[string]bool{"udevadm": true}}
+	_, restore := fakeSysClass(t, exec, "scsi_host/host0/scan")
+	defer restore()
+
+	assert.Error(t, probeVolume())
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// resizeThreshold is how much larger than its filesystem the device must be
+// for the filesystem to be grown. Filesystems may leave the end of the device
+// unused, short of a block or a group, while Cinder grows volumes by GiB.
+const resizeThreshold = 64 * 1024 * 1024
+
+// NeedsResize returns whether the device mounted at deviceMountPath is larger
+// than its filesystem, e.g. after the volume was expanded while detached.
+// Filesystems other than ext, xfs and btrfs are never resized.
+func (m *Mount) NeedsResize(devicePath string, deviceMountPath string) (bool, error) {
+	log := logging.With(logging.Op, "NeedsResize", logging.DevicePath, devicePath)
+	diskMounter := newDiskMounter()
+	format, err := diskMounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the format of %s: %v", devicePath, err)
+	}
+
+	var fsSize int64
+	switch {
+	case strings.HasPrefix(format, "ext"):
+		fsSize, err = extFSSize(diskMounter.Exec, devicePath)
+	case format == "xfs":
+		fsSize, err = xfsFSSize(diskMounter.Exec, deviceMountPath)
+	case format == "btrfs":
+		fsSize, err = btrfsFSSize(diskMounter.Exec, devicePath)
+	default:
+		log.V(4).Infof("Not resizing the unknown filesystem %q", format)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get the size of the %s filesystem of %s: %v", format, devicePath, err)
+	}
+	deviceSize, err := blockDeviceSize(diskMounter.Exec, devicePath)
+	if err != nil {
+		return false, err
+	}
+
+	if deviceSize-fsSize <= resizeThreshold {
+		log.V(5).Infof("The %s filesystem of %d bytes fills its device of %d bytes", format, fsSize, deviceSize)
+		return false, nil
+	}
+	log.Infof("The device is larger than its filesystem, growing the %s filesystem from %d to %d bytes", format, fsSize, deviceSize)
+	return true, nil
+}
+
+// blockDeviceSize returns the size of the device in bytes
+func blockDeviceSize(exec mount.Exec, devicePath string) (int64, error) {
+	out, err := exec.Run("blockdev", "--getsize64", devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the size of %s: %v, output: %s", devicePath, err, string(out))
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size of %s %q", devicePath, strings.TrimSpace(string(out)))
+	}
+	return size, nil
+}
+
+// extFSSize returns the size of the ext filesystem of the device, from the
+// block count and size of its superblock
+func extFSSize(exec mount.Exec, devicePath string) (int64, error) {
+	out, err := exec.Run("dumpe2fs", "-h", devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("%v, output: %s", err, string(out))
+	}
+	return blocksSize(string(out), ":", "Block count", "Block size")
+}
+
+// xfsFSSize returns the size of the data section of the xfs filesystem
+// mounted at deviceMountPath
+func xfsFSSize(exec mount.Exec, deviceMountPath string) (int64, error) {
+	out, err := exec.Run("xfs_io", "-c", "statfs", deviceMountPath)
+	if err != nil {
+		return 0, fmt.Errorf("%v, output: %s", err, string(out))
+	}
+	return blocksSize(string(out), "=", "geom.datablocks", "geom.bsize")
+}
+
+// btrfsFSSize returns the size of the btrfs filesystem on the device, from
+// its superblock
+func btrfsFSSize(exec mount.Exec, devicePath string) (int64, error) {
+	out, err := exec.Run("btrfs", "inspect-internal", "dump-super", "-f", devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("%v, output: %s", err, string(out))
+	}
+	return blocksSize(string(out), "", "dev_item.total_bytes", "")
+}
+
+// blocksSize returns the number of blocks times the block size read from the
+// "key<sep>value" lines of out, separated by blanks if sep is empty. It is
+// the number of bytes when sizeKey is empty.
+func blocksSize(out, sep, countKey, sizeKey string) (int64, error) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		var parts []string
+		if sep == "" {
+			parts = strings.Fields(line)
+		} else {
+			parts = strings.SplitN(line, sep, 2)
+		}
+		if len(parts) == 2 {
+			values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	size := int64(1)
+	for _, key := range []string{countKey, sizeKey} {
+		if key == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(values[key], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("no %s in the output", key)
+		}
+		size *= value
+	}
+	return size, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const gib = 1024 * 1024 * 1024
+
+func TestNeedsResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		deviceSize int64
+		fsSize     int64
+		expected   bool
+	}{
+		{"ext4 expanded", "ext4", 2 * gib, gib, true},
+		{"ext4 same size", "ext4", gib, gib, false},
+		{"ext4 end of the device unused", "ext4", gib + 4*1024*1024, gib, false},
+		{"ext3 expanded", "ext3", 2 * gib, gib, true},
+		{"xfs expanded", "xfs", 3 * gib, gib, true},
+		{"xfs same size", "xfs", gib, gib, false},
+		{"btrfs expanded", "btrfs", 2 * gib, gib, true},
+		{"btrfs same size", "btrfs", gib, gib, false},
+		{"unknown filesystem", "vfat", 2 * gib, gib, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := &fakeDisk{format: tt.format, deviceSize: tt.deviceSize, fsSize: tt.fsSize}
+			defer fakeDiskMounter(disk)()
+
+			m := &Mount{}
+			needed, err := m.NeedsResize("/dev/vdb", "/staging")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, needed)
+		})
+	}
+}
+
+// Test the filesystem is resized only until it fills its device
+func TestNeedsResizeAfterResize(t *testing.T) {
+	disk := &fakeDisk{format: "ext4", deviceSize: 2 * gib, fsSize: gib}
+	defer fakeDiskMounter(disk)()
+
+	m := &Mount{}
+	needed, err := m.NeedsResize("/dev/vdb", "/staging")
+	assert.NoError(t, err)
+	assert.True(t, needed)
+	assert.Contains(t, disk.commands, "dumpe2fs -h /dev/vdb")
+	assert.Contains(t, disk.commands, "blockdev --getsize64 /dev/vdb")
+
+	assert.NoError(t, m.ResizeFS("/dev/vdb", "/staging"))
+	assert.Contains(t, disk.commands, "resize2fs /dev/vdb")
+	needed, err = m.NeedsResize("/dev/vdb", "/staging")
+	assert.NoError(t, err)
+	assert.False(t, needed)
+}
+
+func TestBlocksSize(t *testing.T) {
+	size, err := blocksSize("Block count:  10\nBlock size:  4096\n", ":", "Block count", "Block size")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40960), size)
+
+	size, err = blocksSize("dev_item.total_bytes\t\t1073741824\n", "", "dev_item.total_bytes", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(gib), size)
+
+	_, err = blocksSize("Block count:  10\n", ":", "Block count", "Block size")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no Block size in the output")
+	}
+}
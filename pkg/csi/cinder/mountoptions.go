@@ -0,0 +1,129 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// exclusiveMountOptions are the groups of mount options of which a volume may
+// be mounted with only one
+var exclusiveMountOptions = [][]string{
+	{"ro", "rw"},
+	{"sync", "async"},
+	{"dev", "nodev"},
+	{"exec", "noexec"},
+	{"suid", "nosuid"},
+	{"mand", "nomand"},
+	{"atime", "noatime", "relatime", "strictatime"},
+	{"diratime", "nodiratime"},
+	{"lazytime", "nolazytime"},
+	{"iversion", "noiversion"},
+	{"discard", "nodiscard"},
+}
+
+// SetMountOptionsDenylist configures the mount options volumes are never
+// mounted with, dropped from their mount flags with a warning, none if empty
+func (d *CinderDriver) SetMountOptionsDenylist(denylist []string) error {
+	for _, option := range denylist {
+		if option == "" || strings.ContainsAny(option, "=,") {
+			return fmt.Errorf("invalid denied mount option %q", option)
+		}
+	}
+	d.mountOptionsDenylist = denylist
+	return nil
+}
+
+// normalizeMountOptions returns the mount flags of a volume capability
+// without the options denied by --mount-options-denylist
+func (d *CinderDriver) normalizeMountOptions(flags []string) ([]string, error) {
+	return normalizeMountOptions(flags, d.mountOptionsDenylist)
+}
+
+// normalizeMountOptions splits the comma separated mount options of flags,
+// drops the empty, duplicated and denied ones, the latter with a warning, and
+// returns an error for options that contradict each other, like ro and rw or
+// the same option with different values
+func normalizeMountOptions(flags, denylist []string) ([]string, error) {
+	denied := make(map[string]bool, len(denylist))
+	for _, option := range denylist {
+		denied[option] = true
+	}
+
+	var options []string
+	seen := make(map[string]bool)
+	values := make(map[string]string)
+	for _, flag := range flags {
+		for _, option := range splitMountOptions(flag) {
+			if option == "" || seen[option] {
+				continue
+			}
+			name, value := option, ""
+			hasValue := false
+			if i := strings.Index(option, "="); i >= 0 {
+				name, value, hasValue = option[:i], option[i+1:], true
+			}
+			if denied[name] {
+				klog.Warningf("Ignoring the mount option %q denied by --mount-options-denylist", option)
+				continue
+			}
+			if hasValue {
+				if other, ok := values[name]; ok {
+					return nil, fmt.Errorf("conflicting mount options %s=%s and %s", name, other, option)
+				}
+				values[name] = value
+			}
+			seen[option] = true
+			options = append(options, option)
+		}
+	}
+
+	for _, group := range exclusiveMountOptions {
+		var found []string
+		for _, option := range group {
+			if seen[option] {
+				found = append(found, option)
+			}
+		}
+		if len(found) > 1 {
+			return nil, fmt.Errorf("conflicting mount options %s", strings.Join(found, " and "))
+		}
+	}
+	return options, nil
+}
+
+// splitMountOptions splits the comma separated mount options of flag, but not
+// at the commas of quoted values like SELinux contexts, trimming the blanks
+// around them
+func splitMountOptions(flag string) []string {
+	var options []string
+	quoted := false
+	start := 0
+	for i, c := range flag {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			options = append(options, strings.TrimSpace(flag[start:i]))
+			start = i + 1
+		}
+	}
+	return append(options, strings.TrimSpace(flag[start:]))
+}
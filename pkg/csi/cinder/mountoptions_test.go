@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeMountOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []string
+		denylist []string
+		expected []string
+		errMsg   string
+	}{
+		{name: "none"},
+		{name: "unchanged", flags: []string{"noatime", "nobarrier"}, expected: []string{"noatime", "nobarrier"}},
+		{name: "duplicated", flags: []string{"ro", "noatime", "ro"}, expected: []string{"ro", "noatime"}},
+		{name: "comma separated", flags: []string{"ro,noatime", "noatime"}, expected: []string{"ro", "noatime"}},
+		{name: "blanks and empty options", flags: []string{" ro , ", "", ",noatime"}, expected: []string{"ro", "noatime"}},
+		{name: "quoted commas", flags: []string{`context="system_u:object_r:container_file_t:s0:c1,c2",ro`}, expected: []string{`context="system_u:object_r:container_file_t:s0:c1,c2"`, "ro"}},
+		{name: "same value twice", flags: []string{"commit=60", "commit=60"}, expected: []string{"commit=60"}},
+		{name: "ro and rw", flags: []string{"ro", "rw"}, errMsg: "conflicting mount options ro and rw"},
+		{name: "ro and rw in one flag", flags: []string{"rw,noatime,ro"}, errMsg: "conflicting mount options ro and rw"},
+		{name: "atime modes", flags: []string{"relatime", "noatime"}, errMsg: "conflicting mount options noatime and relatime"},
+		{name: "nodev and dev", flags: []string{"nodev", "nosuid", "dev"}, errMsg: "conflicting mount options dev and nodev"},
+		{name: "different values", flags: []string{"commit=60", "commit=5"}, errMsg: "conflicting mount options commit=60 and commit=5"},
+		{name: "denied", flags: []string{"discard", "noatime", "_netdev"}, denylist: []string{"discard", "_netdev"}, expected: []string{"noatime"}},
+		{name: "denied with a value", flags: []string{"commit=5", "noatime"}, denylist: []string{"commit"}, expected: []string{"noatime"}},
+		{name: "denied conflict", flags: []string{"discard", "nodiscard"}, denylist: []string{"discard"}, expected: []string{"nodiscard"}},
+		{name: "denied prefix only", flags: []string{"discard_max=1"}, denylist: []string{"discard"}, expected: []string{"discard_max=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := normalizeMountOptions(tt.flags, tt.denylist)
+			if tt.errMsg != "" {
+				if assert.Error(t, err) {
+					assert.Equal(t, tt.errMsg, err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, options)
+		})
+	}
+}
+
+func TestSetMountOptionsDenylist(t *testing.T) {
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	assert.NoError(t, d.SetMountOptionsDenylist([]string{"discard", "_netdev"}))
+	assert.NoError(t, d.SetMountOptionsDenylist(nil))
+
+	for _, denylist := range [][]string{{""}, {"commit=5"}, {"discard,_netdev"}} {
+		assert.Error(t, d.SetMountOptionsDenylist(denylist), "denylist %q", denylist)
+	}
+}
@@ -17,7 +17,11 @@ limitations under the License.
 package cinder
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
@@ -27,7 +31,6 @@ import (
 
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
-	"k8s.io/cloud-provider-openstack/pkg/util/metadata"
 )
 
 type nodeServer struct {
@@ -37,8 +40,6 @@ type nodeServer struct {
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.V(4).Infof("NodePublishVolume: called with args %+v", *req)
-
 	source := req.GetStagingTargetPath()
 	targetPath := req.GetTargetPath()
 	volumeCapability := req.GetVolumeCapability()
@@ -59,16 +60,14 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if notMnt {
 		// Perform a bind mount
 		options := []string{"bind"}
-		fsType := "ext4"
+		fsType := ns.Driver.defaultFsType
 		if req.GetReadonly() {
 			options = append(options, "ro")
 		} else {
 			options = append(options, "rw")
 		}
-		if mnt := volumeCapability.GetMount(); mnt != nil {
-			if mnt.FsType != "" {
-				fsType = mnt.FsType
-			}
+		if volFsType := volumeFsType(volumeCapability, req.GetVolumeContext()); volFsType != "" {
+			fsType = volFsType
 		}
 		// Mount
 		err = m.Mount(source, targetPath, fsType, options)
@@ -81,8 +80,6 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.V(4).Infof("NodeUnPublishVolume: called with args %+v", *req)
-
 	targetPath := req.GetTargetPath()
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Target Path must be provided")
@@ -107,8 +104,6 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	klog.V(4).Infof("NodeStageVolume: called with args %+v", *req)
-
 	stagingTarget := req.GetStagingTargetPath()
 	volumeCapability := req.GetVolumeCapability()
 	volumeID := req.GetVolumeId()
@@ -119,14 +114,24 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if volumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
-	// Do not trust the path provided by cinder, get the real path on node
-	devicePath, err := ns.getDevicePath(volumeID)
+	// Unless configured otherwise, the path reported by Nova is only a hint
+	resolver := &mount.DevicePathResolver{
+		Mount:              ns.Mount,
+		TrustDevicePath:    ns.Driver.trustDevicePath,
+		MetadataDevicePath: openstack.GetDevicePathFromMetadata,
+		Strategy:           mount.DiscoveryStrategyOf(ns.Mount),
+	}
+	devicePath, err := resolver.Resolve(volumeID, devicePathsByID(req.GetPublishContext()), req.GetPublishContext()["DevicePath"])
+	if err == nil {
+		// a no-op when the device exists, the Nova path may not yet
+		err = ns.Mount.ScanForAttach(ctx, devicePath)
+	}
 	if err != nil {
 		klog.V(3).Infof("Failed to GetDevicePath: %v", err)
-		return nil, err
-	}
-	if devicePath == "" {
-		return nil, status.Error(codes.Internal, "Unable to find Device path for volume")
+		if req.GetPublishContext()[instanceStoppedPublishKey] == "true" {
+			return nil, status.Errorf(codes.Unavailable, "%v, the volume was attached while the instance was stopped, its device may not appear until the instance boots", err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	m := ns.Mount
@@ -138,32 +143,83 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 
 	// Volume Mount
 	if notMnt {
-		// set default fstype is ext4
-		fsType := "ext4"
+		fsType := ns.Driver.defaultFsType
 		var options []string
 		if mnt := volumeCapability.GetMount(); mnt != nil {
-			if mnt.FsType != "" {
-				fsType = mnt.FsType
+			if volFsType := volumeFsType(volumeCapability, req.GetVolumeContext()); volFsType != "" {
+				fsType = volFsType
+			}
+			mountFlags, err := ns.Driver.normalizeMountOptions(mnt.GetMountFlags())
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid mount flags of volume %s: %v", volumeID, err)
 			}
-			mountFlags := mnt.GetMountFlags()
 			options = append(options, mountFlags...)
 		} else if blk := volumeCapability.GetBlock(); blk != nil {
 			// TODO(#341): Block volume support
 			return nil, status.Errorf(codes.Unimplemented, "Block volume support is not yet implemented")
 		}
+		if err := ns.Driver.checkFsType(fsType); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "refusing to format volume %s: %v", volumeID, err)
+		}
 		// Mount
 		err = m.FormatAndMount(devicePath, stagingTarget, fsType, options)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+		// the volume may have been expanded while it was detached, e.g. with
+		// its pod down, and not every kubelet calls NodeExpandVolume for it
+		if !isReadOnlyStaging(volumeCapability, options) {
+			if err := ns.growStagedFS(devicePath, stagingTarget); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	klog.V(4).Infof("NodeUnstageVolume: called with args %+v", *req)
+// isReadOnlyStaging returns whether the volume is staged readonly, by its
+// access mode or its mount flags
+func isReadOnlyStaging(volumeCapability *csi.VolumeCapability, options []string) bool {
+	switch volumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	for _, option := range options {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
 
+// growStagedFS grows the filesystem staged at stagingTarget when its device is
+// larger. Failing to compare their sizes leaves the filesystem as is.
+func (ns *nodeServer) growStagedFS(devicePath, stagingTarget string) error {
+	needed, err := ns.Mount.NeedsResize(devicePath, stagingTarget)
+	if err != nil {
+		klog.Warningf("Failed to compare the size of the filesystem of %s with its device, not resizing it: %v", devicePath, err)
+		return nil
+	}
+	if !needed {
+		return nil
+	}
+	return ns.Mount.ResizeFS(devicePath, stagingTarget)
+}
+
+// devicePathsByID returns the by-id paths of the publish context, none for
+// the volumes published before the controller passed them
+func devicePathsByID(publishContext map[string]string) []string {
+	var paths []string
+	for _, p := range strings.Split(publishContext[devicePathsByIDPublishKey], ",") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	stagingTargetPath := req.GetStagingTargetPath()
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging Target Path must be provided")
@@ -189,12 +245,13 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 
-	nodeID, err := getNodeID(ns.Mount, ns.Metadata)
+	nodeID, _, err := getNodeID(ns.Driver.nodeID, ns.Mount, ns.Metadata)
 	if err != nil {
 		return nil, err
 	}
 	zone, err := getAvailabilityZoneMetadataService(ns.Metadata)
-	topology := &csi.Topology{Segments: map[string]string{topologyKey: zone}}
+	topology := &csi.Topology{Segments: ns.Driver.nodeTopology(zone)}
+	klog.V(4).Infof("NodeGetInfo: node %s in zone %q on the %s hypervisor", nodeID, zone, ns.hypervisor())
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:             nodeID,
@@ -202,6 +259,12 @@ func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 	}, nil
 }
 
+// hypervisor returns the hypervisor the mount provider detected, which decides
+// how the devices of the volumes are looked for
+func (ns *nodeServer) hypervisor() string {
+	return mount.DiscoveryStrategyOf(ns.Mount).Hypervisor()
+}
+
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	klog.V(5).Infof("NodeGetCapabilities called with req: %#v", req)
 
@@ -214,37 +277,71 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	return nil, status.Error(codes.Unimplemented, fmt.Sprintf("NodeGetVolumeStats is not yet implemented"))
 }
 
+// NodeExpandVolume grows the filesystem of a volume extended by the
+// controller, after rescanning its device so that the kernel sees the new
+// size of a volume extended while attached
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, fmt.Sprintf("NodeExpandVolume is not yet implemented"))
-}
-
-func (ns *nodeServer) getDevicePath(volumeID string) (string, error) {
-	var devicePath string
-	devicePath, _ = ns.Mount.GetDevicePath(volumeID)
-	if devicePath == "" {
-		// try to get from metadata service
-		devicePath = metadata.GetDevicePath(volumeID)
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	if len(volumeID) == 0 || len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume ID and Volume Path must be provided")
 	}
 
-	return devicePath, nil
+	m := ns.Mount
+	notMnt, err := m.IsLikelyNotMountPointDetach(volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		return nil, status.Errorf(codes.NotFound, "Volume %s not mounted at %s", volumeID, volumePath)
+	}
 
-}
-func getNodeIDMountProvider(m mount.IMount) (string, error) {
-	nodeID, err := m.GetInstanceID()
+	// there is no Nova path to trust here, the device is found by serial
+	resolver := &mount.DevicePathResolver{
+		Mount:              m,
+		MetadataDevicePath: openstack.GetDevicePathFromMetadata,
+		Strategy:           mount.DiscoveryStrategyOf(m),
+	}
+	devicePath, err := resolver.Resolve(volumeID, nil, "")
 	if err != nil {
-		klog.V(3).Infof("Failed to GetInstanceID: %v", err)
-		return "", err
+		klog.V(3).Infof("Failed to GetDevicePath: %v", err)
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err := m.RescanDevice(devicePath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if err := m.ResizeFS(devicePath, volumePath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	klog.V(4).Infof("NodeExpandVolume resized the filesystem of volume %s at %s", volumeID, volumePath)
 
-	return nodeID, nil
+	return &csi.NodeExpandVolumeResponse{}, nil
+}
+
+func getNodeIDMountProvider(m mount.IMount) (string, error) {
+	return m.GetInstanceID()
 }
 
 func getNodeIDMetdataService(m openstack.IMetadata) (string, error) {
+	if m == nil {
+		return "", errors.New("no metadata service")
+	}
+	return m.GetInstanceID()
+}
+
+// dmiProductUUIDFile holds the SMBIOS system UUID, set by libvirt to the
+// instance ID on Nova guests
+var dmiProductUUIDFile = "/sys/class/dmi/id/product_uuid"
 
-	nodeID, err := m.GetInstanceID()
+func getNodeIDDMI(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return "", err
 	}
+	nodeID := strings.ToLower(strings.TrimSpace(string(data)))
+	if !isInstanceID(nodeID) {
+		return "", fmt.Errorf("%s does not hold a UUID: %q", path, nodeID)
+	}
 	return nodeID, nil
 }
 
@@ -257,19 +354,46 @@ func getAvailabilityZoneMetadataService(m openstack.IMetadata) (string, error) {
 	return zone, nil
 }
 
-func getNodeID(mount mount.IMount, metadata openstack.IMetadata) (string, error) {
-	// First try to get instance id from mount provider
-	nodeID, err := getNodeIDMountProvider(mount)
-	if err == nil || nodeID != "" {
-		return nodeID, nil
+// instanceIDPattern matches the UUIDs Nova uses as instance IDs
+var instanceIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// isInstanceID returns whether id looks like a Nova instance ID
+func isInstanceID(id string) bool {
+	return instanceIDPattern.MatchString(id)
+}
+
+// nodeIDSource is a place the instance ID of the node can be found in
+type nodeIDSource struct {
+	name string
+	get  func() (string, error)
+}
+
+// getNodeID returns the instance ID of the node and where it was found. The
+// override given with --nodeid is used if it is an instance ID, otherwise the
+// ID written by cloud-init, the one of the metadata service and the DMI product
+// UUID are tried. The latter comes last as a few hypervisors set it to another
+// UUID than the instance ID.
+func getNodeID(override string, mount mount.IMount, metadata openstack.IMetadata) (string, string, error) {
+	if isInstanceID(override) {
+		return override, "the --nodeid flag", nil
 	}
 
-	klog.V(3).Infof("Failed to GetInstanceID from mount data: %v", err)
-	klog.V(3).Info("Trying to GetInstanceID from metadata service")
-	nodeID, err = getNodeIDMetdataService(metadata)
-	if err != nil {
-		klog.V(3).Infof("Failed to GetInstanceID from metadata service: %v", err)
-		return "", err
+	sources := []nodeIDSource{
+		{"the cloud-init data", func() (string, error) { return getNodeIDMountProvider(mount) }},
+		{"the metadata service", func() (string, error) { return getNodeIDMetdataService(metadata) }},
+		{"the DMI product UUID", func() (string, error) { return getNodeIDDMI(dmiProductUUIDFile) }},
 	}
-	return nodeID, nil
+	var failures []string
+	for _, source := range sources {
+		nodeID, err := source.get()
+		if err == nil && nodeID == "" {
+			err = errors.New("empty instance ID")
+		}
+		if err == nil {
+			return nodeID, source.name, nil
+		}
+		klog.V(3).Infof("Failed to GetInstanceID from %s: %v", source.name, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", source.name, err))
+	}
+	return "", "", fmt.Errorf("no instance ID found in %s", strings.Join(failures, ", "))
 }
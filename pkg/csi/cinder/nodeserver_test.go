@@ -17,12 +17,22 @@ limitations under the License.
 package cinder
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
 )
@@ -33,6 +43,9 @@ var metamock *openstack.OpenStackMock
 
 // Init Node Server
 func init() {
+	// the tests must not find the instance ID of the machine running them
+	dmiProductUUIDFile = "/nonexistent/product_uuid"
+
 	if fakeNs == nil {
 		// to avoid annoying ERROR: logging before flag.Parse
 		flag.Parse()
@@ -63,7 +76,7 @@ func TestNodeGetInfo(t *testing.T) {
 	// Expected Result
 	expectedRes := &csi.NodeGetInfoResponse{
 		NodeId:             FakeNodeID,
-		AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyKey: FakeAvailability}},
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{defaultTopologyKey: FakeAvailability}},
 	}
 
 	// Fake request
@@ -79,11 +92,179 @@ func TestNodeGetInfo(t *testing.T) {
 	assert.Equal(expectedRes, actualRes)
 }
 
+// Test NodeGetInfo reports the instance ID given with --nodeid
+func TestNodeGetInfoNodeIDOverride(t *testing.T) {
+	instanceID := "1b2d3c4e-5f60-4a7b-8c9d-0e1f2a3b4c5d"
+
+	mountmock := new(mount.MountMock)
+	metadatamock := new(openstack.OpenStackMock)
+	metadatamock.On("GetAvailabilityZone").Return(FakeAvailability, nil)
+	ns := NewNodeServer(NewDriver(instanceID, FakeEndpoint, FakeCluster), mountmock, metadatamock)
+
+	res, err := ns.NodeGetInfo(FakeCtx, &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, instanceID, res.GetNodeId())
+	mountmock.AssertNotCalled(t, "GetInstanceID")
+}
+
+// Test NodeGetInfo reads the instance ID and the zone with a single request
+// to the metadata service
+func TestNodeGetInfoMetadataService(t *testing.T) {
+	instanceID := "1b2d3c4e-5f60-4a7b-8c9d-0e1f2a3b4c5d"
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, `{"uuid": %q, "availability_zone": %q}`, instanceID, FakeAvailability)
+	}))
+	defer server.Close()
+
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetInstanceID").Return("", errors.New("no cloud-init data"))
+	metadata := openstack.NewMetadataService(server.URL + "/openstack/latest/meta_data.json")
+	ns := NewNodeServer(NewDriver("", FakeEndpoint, FakeCluster), mountmock, metadata)
+
+	res, err := ns.NodeGetInfo(FakeCtx, &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, instanceID, res.GetNodeId())
+	assert.Equal(t, FakeAvailability, res.GetAccessibleTopology().GetSegments()[defaultTopologyKey])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestIsInstanceID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected bool
+	}{
+		{"1b2d3c4e-5f60-4a7b-8c9d-0e1f2a3b4c5d", true},
+		{"1B2D3C4E-5F60-4A7B-8C9D-0E1F2A3B4C5D", true},
+		{"", false},
+		{"CSINodeID", false},
+		{"node-1.example.com", false},
+		{"1b2d3c4e5f604a7b8c9d0e1f2a3b4c5d", false},
+		{"1b2d3c4e-5f60-4a7b-8c9d-0e1f2a3b4c5d0", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, isInstanceID(tt.id), tt.id)
+	}
+}
+
+// fakeNodeIDMetadata is a metadata service only knowing the instance ID
+type fakeNodeIDMetadata struct {
+	id  string
+	err error
+}
+
+func (m *fakeNodeIDMetadata) GetInstanceID() (string, error) {
+	return m.id, m.err
+}
+
+func (m *fakeNodeIDMetadata) GetAvailabilityZone() (string, error) {
+	return "", nil
+}
+
+// Test the instance ID is looked up in every source until one has it, an
+// empty ID not counting as found
+func TestGetNodeID(t *testing.T) {
+	instanceID := "1b2d3c4e-5f60-4a7b-8c9d-0e1f2a3b4c5d"
+
+	tests := []struct {
+		name           string
+		mountID        string
+		mountErr       error
+		metadataID     string
+		metadataErr    error
+		dmiUUID        string
+		expectedID     string
+		expectedSource string
+	}{
+		{
+			name:           "cloud-init data",
+			mountID:        instanceID,
+			metadataErr:    errors.New("not to be called"),
+			expectedID:     instanceID,
+			expectedSource: "the cloud-init data",
+		},
+		{
+			name:           "no cloud-init data",
+			mountErr:       errors.New("no such file"),
+			metadataID:     instanceID,
+			expectedID:     instanceID,
+			expectedSource: "the metadata service",
+		},
+		{
+			name:           "empty cloud-init data",
+			metadataID:     instanceID,
+			expectedID:     instanceID,
+			expectedSource: "the metadata service",
+		},
+		{
+			name:        "no source",
+			mountErr:    errors.New("no such file"),
+			metadataErr: errors.New("connection refused"),
+		},
+		{
+			name:     "empty metadata",
+			mountErr: errors.New("no such file"),
+		},
+		{
+			name: "empty sources",
+		},
+		{
+			name:           "DMI product UUID",
+			mountErr:       errors.New("no such file"),
+			metadataErr:    errors.New("connection refused"),
+			dmiUUID:        "1B2D3C4E-5F60-4A7B-8C9D-0E1F2A3B4C5D\n",
+			expectedID:     instanceID,
+			expectedSource: "the DMI product UUID",
+		},
+		{
+			name:        "DMI product UUID not a UUID",
+			mountErr:    errors.New("no such file"),
+			metadataErr: errors.New("connection refused"),
+			dmiUUID:     "Not Settable\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountmock := new(mount.MountMock)
+			mountmock.On("GetInstanceID").Return(tt.mountID, tt.mountErr)
+			metadata := &fakeNodeIDMetadata{id: tt.metadataID, err: tt.metadataErr}
+
+			// a fake sysfs, without product_uuid unless the test has one
+			sysfs, err := ioutil.TempDir("", "dmi")
+			assert.NoError(t, err)
+			defer os.RemoveAll(sysfs)
+			defer func(path string) { dmiProductUUIDFile = path }(dmiProductUUIDFile)
+			dmiProductUUIDFile = filepath.Join(sysfs, "product_uuid")
+			if tt.dmiUUID != "" {
+				assert.NoError(t, ioutil.WriteFile(dmiProductUUIDFile, []byte(tt.dmiUUID), 0444))
+			}
+
+			nodeID, source, err := getNodeID("", mountmock, metadata)
+			if tt.expectedID == "" {
+				// the error tells what each source failed with
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "the cloud-init data")
+					assert.Contains(t, err.Error(), "the metadata service")
+					assert.Contains(t, err.Error(), "the DMI product UUID")
+				}
+				assert.Equal(t, "", nodeID)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedID, nodeID)
+			assert.Equal(t, tt.expectedSource, source)
+		})
+	}
+}
+
 // Test NodePublishVolume
 func TestNodePublishVolume(t *testing.T) {
 
-	// ScanForAttach(devicePath string) error
-	mmock.On("ScanForAttach", FakeDevicePath).Return(nil)
+	// ScanForAttach(ctx context.Context, devicePath string) error
+	mmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
 	// IsLikelyNotMountPointAttach(targetpath string) (bool, error)
 	mmock.On("IsLikelyNotMountPointAttach", FakeTargetPath).Return(true, nil)
 	// Mount(source string, target string, fstype string, options []string) error
@@ -127,10 +308,14 @@ func TestNodeStageVolume(t *testing.T) {
 
 	// GetDevicePath(volumeID string) error
 	mmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+	mmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
 	// IsLikelyNotMountPointAttach(targetpath string) (bool, error)
 	mmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
 	// FormatAndMount(source string, target string, fstype string, options []string) error
 	mmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "ext4", []string(nil)).Return(nil)
+	// ResizeFS(devicePath string, deviceMountPath string) error
+	mmock.On("ResizeFS", FakeDevicePath, FakeStagingTargetPath).Return(nil)
+	mmock.On("NeedsResize", FakeDevicePath, FakeStagingTargetPath).Return(true, nil)
 
 	// Init assert
 	assert := assert.New(t)
@@ -164,6 +349,413 @@ func TestNodeStageVolume(t *testing.T) {
 	assert.Equal(expectedRes, actualRes)
 }
 
+// Test NodeStageVolume formats volumes with the default filesystem type, and
+// only with the supported ones
+func TestNodeStageVolumeFsTypes(t *testing.T) {
+	tests := []struct {
+		name           string
+		fsType         string
+		volumeContext  map[string]string
+		expectedFsType string
+		expectedCode   codes.Code
+	}{
+		{name: "default", expectedFsType: "xfs"},
+		{name: "allowed", fsType: "ext4", expectedFsType: "ext4"},
+		{name: "allowed volume attribute", volumeContext: map[string]string{"fsType": "ext4"}, expectedFsType: "ext4"},
+		{name: "rejected", fsType: "ntfs", expectedCode: codes.InvalidArgument},
+		{name: "typo", fsType: "ext5", expectedCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountmock := new(mount.MountMock)
+			mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+			mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
+			mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+			mountmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, mock.Anything, []string(nil)).Return(nil)
+			mountmock.On("ResizeFS", FakeDevicePath, FakeStagingTargetPath).Return(nil)
+			mountmock.On("NeedsResize", FakeDevicePath, FakeStagingTargetPath).Return(true, nil)
+
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			if err := d.SetFsTypes("xfs", []string{"ext4", "xfs"}); err != nil {
+				t.Fatalf("failed to set the filesystem types: %v", err)
+			}
+			ns := NewNodeServer(d, mountmock, nil)
+
+			_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+				VolumeId:          FakeVolID,
+				PublishContext:    map[string]string{"DevicePath": FakeDevicePath},
+				StagingTargetPath: FakeStagingTargetPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{FsType: tt.fsType},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+				VolumeContext: tt.volumeContext,
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode != codes.OK {
+				assert.Contains(t, err.Error(), fmt.Sprintf("filesystem type %q is not supported, the supported types are ext4, xfs", tt.fsType))
+				mountmock.AssertNotCalled(t, "FormatAndMount", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			mountmock.AssertCalled(t, "FormatAndMount", FakeDevicePath, FakeStagingTargetPath, tt.expectedFsType, []string(nil))
+		})
+	}
+}
+
+// Test the volume is mounted with its mount flags deduplicated and without
+// the denied ones, and not mounted with contradicting ones
+func TestNodeStageVolumeMountOptions(t *testing.T) {
+	tests := []struct {
+		name            string
+		mountFlags      []string
+		expectedOptions []string
+		expectedCode    codes.Code
+	}{
+		{name: "normalized", mountFlags: []string{"noatime", "discard,_netdev", "noatime"}, expectedOptions: []string{"noatime"}},
+		{name: "contradicting", mountFlags: []string{"ro", "rw"}, expectedCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountmock := new(mount.MountMock)
+			mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+			mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
+			mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+			mountmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "ext4", mock.Anything).Return(nil)
+			mountmock.On("NeedsResize", FakeDevicePath, FakeStagingTargetPath).Return(false, nil)
+
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			if err := d.SetMountOptionsDenylist([]string{"discard", "_netdev"}); err != nil {
+				t.Fatalf("failed to set the mount options denylist: %v", err)
+			}
+			ns := NewNodeServer(d, mountmock, nil)
+
+			_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+				VolumeId:          FakeVolID,
+				PublishContext:    map[string]string{"DevicePath": FakeDevicePath},
+				StagingTargetPath: FakeStagingTargetPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: tt.mountFlags},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			if tt.expectedCode != codes.OK {
+				assert.Contains(t, err.Error(), "conflicting mount options ro and rw")
+				mountmock.AssertNotCalled(t, "FormatAndMount", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			mountmock.AssertCalled(t, "FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "ext4", tt.expectedOptions)
+		})
+	}
+}
+
+// Test a btrfs volume is staged once btrfs is supported, with the compression
+// of its mount flags
+func TestNodeStageVolumeBtrfs(t *testing.T) {
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+	mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
+	mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+	mountmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "btrfs", []string{"compress=zstd"}).Return(nil)
+	mountmock.On("ResizeFS", FakeDevicePath, FakeStagingTargetPath).Return(nil)
+	mountmock.On("NeedsResize", FakeDevicePath, FakeStagingTargetPath).Return(true, nil)
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	if err := d.SetFsTypes("ext4", []string{"ext4", "xfs", "btrfs"}); err != nil {
+		t.Fatalf("failed to set the filesystem types: %v", err)
+	}
+	ns := NewNodeServer(d, mountmock, nil)
+
+	_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+		VolumeId:          FakeVolID,
+		PublishContext:    map[string]string{"DevicePath": FakeDevicePath},
+		StagingTargetPath: FakeStagingTargetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "btrfs", MountFlags: []string{"compress=zstd"}},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+	assert.NoError(t, err)
+	mountmock.AssertCalled(t, "FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "btrfs", []string{"compress=zstd"})
+	mountmock.AssertCalled(t, "ResizeFS", FakeDevicePath, FakeStagingTargetPath)
+}
+
+// Test NodeStageVolume stages on the Nova device path only when trusted
+func TestNodeStageVolumeTrustDevicePath(t *testing.T) {
+	novaPath := "/dev/vdb"
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	fakeReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          FakeVolID,
+		PublishContext:    map[string]string{"DevicePath": novaPath},
+		StagingTargetPath: FakeStagingTargetPath,
+		VolumeCapability:  volCap,
+	}
+
+	tests := []struct {
+		trust    bool
+		expected string
+	}{
+		{true, novaPath},
+		{false, FakeDevicePath},
+	}
+	for _, tt := range tests {
+		mountmock := new(mount.MountMock)
+		mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+		mountmock.On("ScanForAttach", mock.Anything, tt.expected).Return(nil)
+		mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+		mountmock.On("FormatAndMount", tt.expected, FakeStagingTargetPath, "ext4", []string(nil)).Return(nil)
+		mountmock.On("ResizeFS", tt.expected, FakeStagingTargetPath).Return(nil)
+		mountmock.On("NeedsResize", tt.expected, FakeStagingTargetPath).Return(true, nil)
+
+		d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+		d.SetTrustDevicePath(tt.trust)
+		ns := NewNodeServer(d, mountmock, nil)
+
+		_, err := ns.NodeStageVolume(FakeCtx, fakeReq)
+		assert.NoError(t, err)
+		mountmock.AssertCalled(t, "FormatAndMount", tt.expected, FakeStagingTargetPath, "ext4", []string(nil))
+	}
+}
+
+// Test NodeStageVolume stages on the first by-id path of the publish context
+// that exists, without looking the device up
+func TestNodeStageVolumeByIDPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "by-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	byIDPath := filepath.Join(dir, "scsi-0QEMU_QEMU_HARDDISK_CSIVolumeID")
+	if err := ioutil.WriteFile(byIDPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trust := range []bool{false, true} {
+		mountmock := new(mount.MountMock)
+		mountmock.On("ScanForAttach", mock.Anything, byIDPath).Return(nil)
+		mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+		mountmock.On("FormatAndMount", byIDPath, FakeStagingTargetPath, "ext4", []string(nil)).Return(nil)
+		mountmock.On("ResizeFS", byIDPath, FakeStagingTargetPath).Return(nil)
+		mountmock.On("NeedsResize", byIDPath, FakeStagingTargetPath).Return(true, nil)
+
+		d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+		d.SetTrustDevicePath(trust)
+		ns := NewNodeServer(d, mountmock, nil)
+
+		_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+			VolumeId: FakeVolID,
+			PublishContext: map[string]string{
+				"DevicePath":              "/dev/vdb",
+				devicePathsByIDPublishKey: filepath.Join(dir, "virtio-CSIVolumeID") + "," + byIDPath,
+			},
+			StagingTargetPath: FakeStagingTargetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+		})
+		assert.NoError(t, err)
+		mountmock.AssertCalled(t, "FormatAndMount", byIDPath, FakeStagingTargetPath, "ext4", []string(nil))
+		mountmock.AssertNotCalled(t, "GetDevicePath", FakeVolID)
+	}
+}
+
+// Test NodeStageVolume fails when the device doesn't show up, as Unavailable
+// for a volume attached to a stopped instance
+func TestNodeStageVolumeDeviceMissing(t *testing.T) {
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	tests := []struct {
+		name         string
+		stopped      bool
+		expectedCode codes.Code
+	}{
+		{"running instance", false, codes.Internal},
+		{"stopped instance", true, codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountmock := new(mount.MountMock)
+			mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+			mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(errors.New("timeout"))
+			ns := NewNodeServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), mountmock, nil)
+
+			publishContext := map[string]string{"DevicePath": FakeDevicePath}
+			if tt.stopped {
+				publishContext[instanceStoppedPublishKey] = "true"
+			}
+			_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+				VolumeId:          FakeVolID,
+				PublishContext:    publishContext,
+				StagingTargetPath: FakeStagingTargetPath,
+				VolumeCapability:  volCap,
+			})
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			mountmock.AssertNotCalled(t, "FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "ext4", []string(nil))
+		})
+	}
+}
+
+// Test NodeStageVolume fails when the filesystem of a volume expanded while
+// detached cannot be grown
+func TestNodeStageVolumeResizeFailure(t *testing.T) {
+	mountmock := new(mount.MountMock)
+	mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+	mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
+	mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+	mountmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "ext4", []string(nil)).Return(nil)
+	mountmock.On("ResizeFS", FakeDevicePath, FakeStagingTargetPath).Return(errors.New("resize2fs failed"))
+	mountmock.On("NeedsResize", FakeDevicePath, FakeStagingTargetPath).Return(true, nil)
+	ns := NewNodeServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), mountmock, nil)
+
+	_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+		VolumeId:          FakeVolID,
+		StagingTargetPath: FakeStagingTargetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+		},
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+// Test NodeStageVolume grows the filesystem of a volume expanded while
+// detached only when its device is larger, and never for readonly staging
+func TestNodeStageVolumeGrowFS(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        csi.VolumeCapability_AccessMode_Mode
+		mountFlags  []string
+		needsResize bool
+		needsErr    error
+		checked     bool
+		resized     bool
+	}{
+		{name: "expanded", needsResize: true, checked: true, resized: true},
+		{name: "same size", needsResize: false, checked: true},
+		{name: "size unknown", needsErr: errors.New("dumpe2fs failed"), checked: true},
+		{name: "readonly access mode", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, needsResize: true},
+		{name: "readonly mount flag", mountFlags: []string{"ro"}, needsResize: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountmock := new(mount.MountMock)
+			mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+			mountmock.On("ScanForAttach", mock.Anything, FakeDevicePath).Return(nil)
+			mountmock.On("IsLikelyNotMountPointAttach", FakeStagingTargetPath).Return(true, nil)
+			mountmock.On("FormatAndMount", FakeDevicePath, FakeStagingTargetPath, "ext4", mock.Anything).Return(nil)
+			mountmock.On("NeedsResize", FakeDevicePath, FakeStagingTargetPath).Return(tt.needsResize, tt.needsErr)
+			mountmock.On("ResizeFS", FakeDevicePath, FakeStagingTargetPath).Return(nil)
+			ns := NewNodeServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), mountmock, nil)
+
+			mode := tt.mode
+			if mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+				mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+			}
+			_, err := ns.NodeStageVolume(FakeCtx, &csi.NodeStageVolumeRequest{
+				VolumeId:          FakeVolID,
+				PublishContext:    map[string]string{"DevicePath": FakeDevicePath},
+				StagingTargetPath: FakeStagingTargetPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: tt.mountFlags},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+				},
+			})
+			assert.NoError(t, err)
+			if tt.checked {
+				mountmock.AssertCalled(t, "NeedsResize", FakeDevicePath, FakeStagingTargetPath)
+			} else {
+				mountmock.AssertNotCalled(t, "NeedsResize", FakeDevicePath, FakeStagingTargetPath)
+			}
+			if tt.resized {
+				mountmock.AssertCalled(t, "ResizeFS", FakeDevicePath, FakeStagingTargetPath)
+			} else {
+				mountmock.AssertNotCalled(t, "ResizeFS", FakeDevicePath, FakeStagingTargetPath)
+			}
+		})
+	}
+}
+
+// Test NodeExpandVolume rescans the device before growing the filesystem
+func TestNodeExpandVolume(t *testing.T) {
+	mountmock := new(mount.MountMock)
+	mountmock.On("IsLikelyNotMountPointDetach", FakeTargetPath).Return(false, nil)
+	mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+	var calls []string
+	mountmock.On("RescanDevice", FakeDevicePath).Return(nil).Run(func(mock.Arguments) {
+		calls = append(calls, "RescanDevice")
+	})
+	mountmock.On("ResizeFS", FakeDevicePath, FakeTargetPath).Return(nil).Run(func(mock.Arguments) {
+		calls = append(calls, "ResizeFS")
+	})
+	ns := NewNodeServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), mountmock, nil)
+
+	actualRes, err := ns.NodeExpandVolume(FakeCtx, &csi.NodeExpandVolumeRequest{
+		VolumeId:   FakeVolID,
+		VolumePath: FakeTargetPath,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &csi.NodeExpandVolumeResponse{}, actualRes)
+	assert.Equal(t, []string{"RescanDevice", "ResizeFS"}, calls)
+}
+
+func TestNodeExpandVolumeErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		req          *csi.NodeExpandVolumeRequest
+		notMnt       bool
+		rescanErr    error
+		expectedCode codes.Code
+	}{
+		{"no volume path", &csi.NodeExpandVolumeRequest{VolumeId: FakeVolID}, false, nil, codes.InvalidArgument},
+		{"not mounted", &csi.NodeExpandVolumeRequest{VolumeId: FakeVolID, VolumePath: FakeTargetPath}, true, nil, codes.NotFound},
+		{"rescan failure", &csi.NodeExpandVolumeRequest{VolumeId: FakeVolID, VolumePath: FakeTargetPath}, false, errors.New("permission denied"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountmock := new(mount.MountMock)
+			mountmock.On("IsLikelyNotMountPointDetach", FakeTargetPath).Return(tt.notMnt, nil)
+			mountmock.On("GetDevicePath", FakeVolID).Return(FakeDevicePath, nil)
+			mountmock.On("RescanDevice", FakeDevicePath).Return(tt.rescanErr)
+			ns := NewNodeServer(NewDriver(FakeNodeID, FakeEndpoint, FakeCluster), mountmock, nil)
+
+			_, err := ns.NodeExpandVolume(FakeCtx, tt.req)
+			assert.Equal(t, tt.expectedCode, status.Code(err))
+			mountmock.AssertNotCalled(t, "ResizeFS", FakeDevicePath, FakeTargetPath)
+		})
+	}
+}
+
 // Test NodeUnpublishVolume
 func TestNodeUnpublishVolume(t *testing.T) {
 
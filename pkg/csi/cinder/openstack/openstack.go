@@ -17,40 +17,126 @@ limitations under the License.
 package openstack
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumetypes"
 	gcfg "gopkg.in/gcfg.v1"
 	netutil "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
 	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	"k8s.io/cloud-provider-openstack/pkg/version"
 	"k8s.io/klog"
 )
 
 type IOpenStack interface {
-	CreateVolume(name string, size int, vtype, availability string, snapshotID string, tags *map[string]string) (string, string, int, error)
-	DeleteVolume(volumeID string) error
-	AttachVolume(instanceID, volumeID string) (string, error)
-	ListVolumes() ([]Volume, error)
-	WaitDiskAttached(instanceID string, volumeID string) error
-	DetachVolume(instanceID, volumeID string) error
-	WaitDiskDetached(instanceID string, volumeID string) error
-	GetAttachmentDiskPath(instanceID, volumeID string) (string, error)
-	GetVolumesByName(name string) ([]Volume, error)
-	CreateSnapshot(name, volID, description string, tags *map[string]string) (*snapshots.Snapshot, error)
-	ListSnapshots(limit, offset int, filters map[string]string) ([]snapshots.Snapshot, error)
-	DeleteSnapshot(snapID string) error
-	GetSnapshotByNameAndVolumeID(n string, volumeId string) ([]snapshots.Snapshot, error)
-	GetSnapshotByID(snapshotID string) (*snapshots.Snapshot, error)
-	WaitSnapshotReady(snapshotID string) error
+	CreateVolume(ctx context.Context, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error)
+	DeleteVolume(ctx context.Context, volumeID string, knownDetached bool) error
+	AttachVolume(ctx context.Context, instanceID, volumeID string) (string, error)
+	AttachFetchedVolume(ctx context.Context, instanceID string, volume *Volume) (string, error)
+	ListVolumes(ctx context.Context) ([]Volume, error)
+	ListVolumesWithPage(ctx context.Context, limit int, marker string, filters map[string]string) ([]Volume, string, error)
+	WaitDiskAttached(ctx context.Context, instanceID string, volumeID string) (Volume, error)
+	DetachVolume(ctx context.Context, instanceID, volumeID string) error
+	WaitDiskDetached(ctx context.Context, instanceID string, volumeID string) error
+	GetAttachmentDiskPath(ctx context.Context, instanceID, volumeID string) (string, error)
+	GetVolumesByName(ctx context.Context, name string) ([]Volume, error)
+	CreateSnapshot(ctx context.Context, name, volID, description string, tags *map[string]string) (*snapshots.Snapshot, error)
+	ListSnapshots(ctx context.Context, limit int, marker string, filters map[string]string) ([]snapshots.Snapshot, string, error)
+	DeleteSnapshot(ctx context.Context, snapID string) error
+	GetSnapshotsByName(ctx context.Context, n string) ([]snapshots.Snapshot, error)
+	GetSnapshotByID(ctx context.Context, snapshotID string) (*snapshots.Snapshot, error)
+	WaitSnapshotReady(ctx context.Context, snapshotID string) error
+	WaitVolumeCreated(ctx context.Context, volumeID string) error
+	GetBlockStorageOpts() BlockStorageOpts
+	GetVolume(ctx context.Context, volumeID string) (Volume, error)
+	ExpandVolume(ctx context.Context, volumeID string, newSize int) error
+	SetVolumeMetadata(ctx context.Context, volumeID string, metadata map[string]string) error
+	SetVolumeImageMetadata(ctx context.Context, volumeID string, metadata map[string]string) error
+	RenameVolume(ctx context.Context, volumeID, name string) error
+	GetInstanceAZ(ctx context.Context, instanceID string) (string, error)
+	GetInstanceState(ctx context.Context, instanceID string) (string, error)
+	GetAttachmentCount(ctx context.Context, instanceID string) (int, error)
+	CheckBlockStorageAPI(ctx context.Context) error
+	GetAvailableCapacity(ctx context.Context, volumeType string) (int64, error)
+	GetAvailabilityZones(ctx context.Context) ([]string, error)
+	ProbeFeatures(ctx context.Context) (*BackendFeatures, error)
+	FailoverReplication(ctx context.Context, host, backendID string) error
 }
 
 type OpenStack struct {
 	compute      *gophercloud.ServiceClient
 	blockstorage *gophercloud.ServiceClient
+	bsVersion    string // v2 or v3, only creating and listing volumes differ between both
+	bsOpts       BlockStorageOpts
+	instances    *instanceCache
+	pools        *poolCache
+	zones        *zoneCache
+	tagging      *attachTagging
+	deviceHints  *deviceHints
+}
+
+// MyDuration is the encoding.TextUnmarshaler interface for time.Duration
+type MyDuration struct {
+	time.Duration
+}
+
+// UnmarshalText is used to convert from text to Duration
+func (d *MyDuration) UnmarshalText(text []byte) error {
+	res, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = res
+	return nil
+}
+
+// BlockStorageOpts is used to talk to Cinder service
+type BlockStorageOpts struct {
+	BSVersion               string     `gcfg:"bs-version"` // auto, v2 or v3
+	IgnoreVolumeAZ          bool       `gcfg:"ignore-volume-az"`
+	AZMapping               AZMapping  `gcfg:"az-mapping"`                // novaAZ=cinderAZ pairs, or the file holding them
+	DefaultAvailabilityZone string     `gcfg:"default-availability-zone"` // used when neither the storage class nor the topology sets a zone
+	DefaultVolumeType       string     `gcfg:"default-volume-type"`       // used when the storage class doesn't set a type
+	VolumeDescription       string     `gcfg:"volume-description"`        // {cluster} is replaced by the cluster name
+	VolumeNamePrefix        string     `gcfg:"volume-name-prefix"`        // prepended to the display name of new volumes
+	NodeVolumeAttachLimit   int        `gcfg:"node-volume-attach-limit"`  // maximum number of volumes attached to one instance, 0 for no limit
+	AttachInitDelay         MyDuration `gcfg:"attach-init-delay"`
+	AttachFactor            float64    `gcfg:"attach-factor"`
+	AttachSteps             int        `gcfg:"attach-steps"`
+	AttachJitter            float64    `gcfg:"attach-jitter"`
+	DetachInitDelay         MyDuration `gcfg:"detach-init-delay"`
+	DetachFactor            float64    `gcfg:"detach-factor"`
+	DetachSteps             int        `gcfg:"detach-steps"`
+	DetachJitter            float64    `gcfg:"detach-jitter"`
+	OperationInitDelay      MyDuration `gcfg:"operation-init-delay"`
+	OperationFactor         float64    `gcfg:"operation-factor"`
+	OperationSteps          int        `gcfg:"operation-steps"`
+	OperationJitter         float64    `gcfg:"operation-jitter"`
+	DevicePathInitDelay     MyDuration `gcfg:"device-path-init-delay"` // used by the node while looking for the device of an attached volume
+	DevicePathFactor        float64    `gcfg:"device-path-factor"`
+	DevicePathSteps         int        `gcfg:"device-path-steps"`
+	DevicePathJitter        float64    `gcfg:"device-path-jitter"`
+	TrustDevicePath         bool       `gcfg:"trust-device-path"` // stage volumes on the device path reported by Nova
+	RetryInitDelay          MyDuration `gcfg:"retry-init-delay"`  // used when a request is rejected with 429, 502, 503 or 504
+	RetryMaxDelay           MyDuration `gcfg:"retry-max-delay"`
+	RetrySteps              int        `gcfg:"retry-steps"`  // 0 turns the retries off
+	APIReadQPS              float64    `gcfg:"api-read-qps"` // GET requests per second, 0 for no limit
+	APIReadBurst            int        `gcfg:"api-read-burst"`
+	APIWriteQPS             float64    `gcfg:"api-write-qps"` // other requests per second, 0 for no limit
+	APIWriteBurst           int        `gcfg:"api-write-burst"`
+	StuckVolumeThreshold    MyDuration `gcfg:"stuck-volume-threshold"` // attaching or detaching for longer is an error
+	RecoverStuckVolumes     bool       `gcfg:"recover-stuck-volumes"`  // reset the status of stuck volumes, needs admin rights
+	VolumeCreateTimeout     MyDuration `gcfg:"volume-create-timeout"`  // creating for longer deletes the volume, 0 never does
+	ExplicitDeviceNames     bool       `gcfg:"explicit-device-names"`  // attach volumes as the next free device name rather than the one Nova picks
 }
 
 type Config struct {
@@ -66,6 +152,7 @@ type Config struct {
 		Region     string
 		CAFile     string `gcfg:"ca-file"`
 	}
+	BlockStorage BlockStorageOpts
 }
 
 func (cfg Config) toAuthOptions() gophercloud.AuthOptions {
@@ -84,10 +171,152 @@ func (cfg Config) toAuthOptions() gophercloud.AuthOptions {
 	}
 }
 
+// defaultBlockStorageOpts returns the wait parameters used when none are configured
+func defaultBlockStorageOpts() BlockStorageOpts {
+	return BlockStorageOpts{
+		BSVersion:             bsVersionAuto,
+		NodeVolumeAttachLimit: defaultNodeVolumeAttachLimit,
+		AttachInitDelay:       MyDuration{diskAttachInitDelay},
+		AttachFactor:          diskAttachFactor,
+		AttachSteps:           diskAttachSteps,
+		AttachJitter:          waitJitter,
+		DetachInitDelay:       MyDuration{diskDetachInitDelay},
+		DetachFactor:          diskDetachFactor,
+		DetachSteps:           diskDetachSteps,
+		DetachJitter:          waitJitter,
+		OperationInitDelay:    MyDuration{operationFinishInitDelay},
+		OperationFactor:       operationFinishFactor,
+		OperationSteps:        operationFinishSteps,
+		OperationJitter:       waitJitter,
+		DevicePathInitDelay:   MyDuration{devicePathInitDelay},
+		DevicePathFactor:      devicePathFactor,
+		DevicePathSteps:       devicePathSteps,
+		DevicePathJitter:      waitJitter,
+		RetryInitDelay:        MyDuration{requestRetryInitDelay},
+		RetryMaxDelay:         MyDuration{requestRetryMaxDelay},
+		RetrySteps:            requestRetrySteps,
+		StuckVolumeThreshold:  MyDuration{stuckVolumeThreshold},
+		VolumeCreateTimeout:   MyDuration{volumeCreateTimeout},
+	}
+}
+
+// validate checks the wait parameters, naming the offending key on error
+func (opts BlockStorageOpts) validate() error {
+	switch opts.BSVersion {
+	case bsVersionAuto, bsVersionV2, bsVersionV3:
+	default:
+		return fmt.Errorf("invalid [BlockStorage] bs-version %q: must be auto, v2 or v3", opts.BSVersion)
+	}
+
+	backoffs := []struct {
+		prefix  string
+		backoff wait.Backoff
+	}{
+		{"attach", opts.attachBackoff()},
+		{"detach", opts.detachBackoff()},
+		{"operation", opts.operationBackoff()},
+		{"device-path", opts.DevicePathBackoff()},
+	}
+	for _, b := range backoffs {
+		if b.backoff.Duration <= 0 {
+			return fmt.Errorf("invalid [BlockStorage] %s-init-delay %v: must be positive", b.prefix, b.backoff.Duration)
+		}
+		if b.backoff.Factor < 1 {
+			return fmt.Errorf("invalid [BlockStorage] %s-factor %v: must be at least 1", b.prefix, b.backoff.Factor)
+		}
+		if b.backoff.Steps < 1 {
+			return fmt.Errorf("invalid [BlockStorage] %s-steps %d: must be at least 1", b.prefix, b.backoff.Steps)
+		}
+		if b.backoff.Jitter < 0 || b.backoff.Jitter > 1 {
+			return fmt.Errorf("invalid [BlockStorage] %s-jitter %v: must be between 0 and 1", b.prefix, b.backoff.Jitter)
+		}
+	}
+	if opts.RetryInitDelay.Duration <= 0 {
+		return fmt.Errorf("invalid [BlockStorage] retry-init-delay %v: must be positive", opts.RetryInitDelay.Duration)
+	}
+	if opts.RetryMaxDelay.Duration < opts.RetryInitDelay.Duration {
+		return fmt.Errorf("invalid [BlockStorage] retry-max-delay %v: must not be shorter than retry-init-delay", opts.RetryMaxDelay.Duration)
+	}
+	if opts.RetrySteps < 0 {
+		return fmt.Errorf("invalid [BlockStorage] retry-steps %d: must not be negative", opts.RetrySteps)
+	}
+	if opts.StuckVolumeThreshold.Duration <= 0 {
+		return fmt.Errorf("invalid [BlockStorage] stuck-volume-threshold %v: must be positive", opts.StuckVolumeThreshold.Duration)
+	}
+	if opts.VolumeCreateTimeout.Duration < 0 {
+		return fmt.Errorf("invalid [BlockStorage] volume-create-timeout %v: must not be negative", opts.VolumeCreateTimeout.Duration)
+	}
+	limits := []struct {
+		prefix string
+		qps    float64
+		burst  int
+	}{
+		{"api-read", opts.APIReadQPS, opts.APIReadBurst},
+		{"api-write", opts.APIWriteQPS, opts.APIWriteBurst},
+	}
+	for _, l := range limits {
+		if l.qps < 0 {
+			return fmt.Errorf("invalid [BlockStorage] %s-qps %v: must not be negative", l.prefix, l.qps)
+		}
+		if l.qps > 0 && l.burst < 1 {
+			return fmt.Errorf("invalid [BlockStorage] %s-burst %d: must be at least 1 when %s-qps is set", l.prefix, l.burst, l.prefix)
+		}
+	}
+	if len(opts.VolumeNamePrefix) > maxVolumeNamePrefixLength {
+		return fmt.Errorf("invalid [BlockStorage] volume-name-prefix %q: must not be longer than %d characters", opts.VolumeNamePrefix, maxVolumeNamePrefixLength)
+	}
+	if opts.NodeVolumeAttachLimit < 0 {
+		return fmt.Errorf("invalid [BlockStorage] node-volume-attach-limit %d: must not be negative", opts.NodeVolumeAttachLimit)
+	}
+	return nil
+}
+
+// attachBackoff returns the backoff used while waiting for a volume to attach
+func (opts BlockStorageOpts) attachBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: opts.AttachInitDelay.Duration,
+		Factor:   opts.AttachFactor,
+		Steps:    opts.AttachSteps,
+		Jitter:   opts.AttachJitter,
+	}
+}
+
+// detachBackoff returns the backoff used while waiting for a volume to detach
+func (opts BlockStorageOpts) detachBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: opts.DetachInitDelay.Duration,
+		Factor:   opts.DetachFactor,
+		Steps:    opts.DetachSteps,
+		Jitter:   opts.DetachJitter,
+	}
+}
+
+// operationBackoff returns the backoff used while waiting for other Cinder operations
+func (opts BlockStorageOpts) operationBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: opts.OperationInitDelay.Duration,
+		Factor:   opts.OperationFactor,
+		Steps:    opts.OperationSteps,
+		Jitter:   opts.OperationJitter,
+	}
+}
+
+// DevicePathBackoff returns the backoff used by the node while looking for
+// the device of an attached volume
+func (opts BlockStorageOpts) DevicePathBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: opts.DevicePathInitDelay.Duration,
+		Factor:   opts.DevicePathFactor,
+		Steps:    opts.DevicePathSteps,
+		Jitter:   opts.DevicePathJitter,
+	}
+}
+
 // GetConfigFromFile retrieves config options from file
 func GetConfigFromFile(configFilePath string) (Config, gophercloud.EndpointOpts, error) {
 	var epOpts gophercloud.EndpointOpts
 	var cfg Config
+	cfg.BlockStorage = defaultBlockStorageOpts()
 	config, err := os.Open(configFilePath)
 	if err != nil {
 		klog.V(3).Infof("Failed to open OpenStack configuration file: %v", err)
@@ -100,6 +329,9 @@ func GetConfigFromFile(configFilePath string) (Config, gophercloud.EndpointOpts,
 		klog.V(3).Infof("Failed to read OpenStack configuration file: %v", err)
 		return cfg, epOpts, err
 	}
+	if err := cfg.BlockStorage.validate(); err != nil {
+		return cfg, epOpts, err
+	}
 
 	epOpts = gophercloud.EndpointOpts{
 		Region: cfg.Global.Region,
@@ -133,17 +365,77 @@ func InitOpenStackProvider(cfg string) {
 	klog.V(2).Infof("InitOpenStackProvider configFile: %s", configFile)
 }
 
+var userAgentCluster, userAgentNode string
+
+// SetUserAgentInfo sets the cluster ID and the Kubernetes node name reported
+// in the User-Agent of the requests made by the driver, empty values are left out
+func SetUserAgentInfo(cluster, node string) {
+	userAgentCluster = cluster
+	userAgentNode = node
+}
+
+// userAgent returns the User-Agent prefix of the requests made by the driver
+func userAgent() string {
+	ua := fmt.Sprintf("cinder-csi-plugin/%s", version.Version)
+	if userAgentCluster != "" {
+		ua += " cluster/" + userAgentCluster
+	}
+	if userAgentNode != "" {
+		ua += " node/" + userAgentNode
+	}
+	return ua
+}
+
+// requestIDLogger logs the OpenStack request ID of every response, so that
+// the requests of the driver can be found in the logs of the cloud
+type requestIDLogger struct {
+	rt http.RoundTripper
+}
+
+func (l *requestIDLogger) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := l.rt.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	// the request context carries the ID of the gRPC request it is made for
+	logging.FromContext(req.Context()).With(logging.OpenStackRequestID, requestID(resp)).V(4).Infof("OpenStack %s %s returned %d", req.Method, req.URL.Path, resp.StatusCode)
+	return resp, nil
+}
+
+// requestID returns the request ID set by the OpenStack service on resp
+func requestID(resp *http.Response) string {
+	if id := resp.Header.Get("X-Openstack-Request-Id"); id != "" {
+		return id
+	}
+	// older Nova releases only set the compute specific header
+	return resp.Header.Get("X-Compute-Request-Id")
+}
+
+// withRequestIDLogger wraps the transport of client with a requestIDLogger
+func withRequestIDLogger(client *http.Client) {
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	client.Transport = &requestIDLogger{rt: rt}
+}
+
 // CreateOpenStackProvider creates Openstack Instance
 func CreateOpenStackProvider() (IOpenStack, error) {
 	var authOpts gophercloud.AuthOptions
 	var authURL string
 	var caFile string
+	bsOpts := defaultBlockStorageOpts()
 	// Get config from file
 	cfg, epOpts, err := GetConfigFromFile(configFile)
 	if err == nil {
 		authOpts = cfg.toAuthOptions()
 		authURL = authOpts.IdentityEndpoint
 		caFile = cfg.Global.CAFile
+		bsOpts = cfg.BlockStorage
+	} else if !os.IsNotExist(err) {
+		// an invalid config file must not silently fall back to the environment
+		return nil, err
 	} else {
 		// Get config from env
 		authOpts, epOpts, err = GetConfigFromEnv()
@@ -157,6 +449,8 @@ func CreateOpenStackProvider() (IOpenStack, error) {
 	if err != nil {
 		return nil, err
 	}
+	// let operators identify the requests made by the driver
+	provider.UserAgent.Prepend(userAgent())
 	if caFile != "" {
 		roots, err := certutil.NewPool(caFile)
 		if err != nil {
@@ -166,6 +460,10 @@ func CreateOpenStackProvider() (IOpenStack, error) {
 		config.RootCAs = roots
 		provider.HTTPClient.Transport = netutil.SetOldTransportDefaults(&http.Transport{TLSClientConfig: config})
 	}
+	withRequestIDLogger(&provider.HTTPClient)
+	// every attempt is rate limited and logged with its own request ID
+	withRateLimits(&provider.HTTPClient, bsOpts)
+	withRetries(&provider.HTTPClient, bsOpts)
 
 	err = openstack.Authenticate(provider, authOpts)
 	if err != nil {
@@ -178,20 +476,161 @@ func CreateOpenStackProvider() (IOpenStack, error) {
 	}
 
 	// Init Cinder ServiceClient
-	blockstorageclient, err := openstack.NewBlockStorageV3(provider, epOpts)
+	blockstorageclient, bsVersion, err := newBlockStorageClient(provider, epOpts, bsOpts.BSVersion)
 	if err != nil {
 		return nil, err
 	}
+	klog.Infof("Using the Block Storage API %s", bsVersion)
+
+	if bsOpts.DefaultVolumeType != "" {
+		if err := validateVolumeType(blockstorageclient, bsOpts.DefaultVolumeType); err != nil {
+			return nil, err
+		}
+	}
 
 	// Init OpenStack
 	OsInstance = &OpenStack{
 		compute:      computeclient,
 		blockstorage: blockstorageclient,
+		bsVersion:    bsVersion,
+		bsOpts:       bsOpts,
+		instances:    newInstanceCache(),
+		pools:        newPoolCache(),
+		zones:        newZoneCache(),
+		tagging:      newAttachTagging(),
+		deviceHints:  newDeviceHints(),
 	}
 
 	return OsInstance, nil
 }
 
+// newBlockStorageClient returns the Cinder client of the requested API version
+// and the version, auto picks the newest version in the service catalog
+func newBlockStorageClient(provider *gophercloud.ProviderClient, epOpts gophercloud.EndpointOpts, bsVersion string) (*gophercloud.ServiceClient, string, error) {
+	switch bsVersion {
+	case bsVersionV2:
+		client, err := openstack.NewBlockStorageV2(provider, epOpts)
+		return client, bsVersionV2, err
+	case bsVersionV3:
+		client, err := openstack.NewBlockStorageV3(provider, epOpts)
+		return client, bsVersionV3, err
+	case bsVersionAuto:
+		if client, err := openstack.NewBlockStorageV3(provider, epOpts); err == nil {
+			return client, bsVersionV3, nil
+		}
+		if client, err := openstack.NewBlockStorageV2(provider, epOpts); err == nil {
+			return client, bsVersionV2, nil
+		}
+		return nil, "", fmt.Errorf("no Block Storage API v3 or v2 endpoint found in the service catalog, set bs-version in the [BlockStorage] section")
+	}
+	return nil, "", fmt.Errorf("unknown bs-version %q", bsVersion)
+}
+
+// validateVolumeType checks that the volume type exists, so that a typo in
+// default-volume-type fails startup rather than the first provisioning. Clouds
+// which don't let the user list the volume types are trusted.
+func validateVolumeType(client *gophercloud.ServiceClient, name string) error {
+	pages, err := volumetypes.List(client, volumetypes.ListOpts{}).AllPages()
+	if err != nil {
+		klog.Warningf("Failed to list the volume types, not validating default-volume-type %q: %v", name, err)
+		return nil
+	}
+	types, err := volumetypes.ExtractVolumeTypes(pages)
+	if err != nil {
+		klog.Warningf("Failed to list the volume types, not validating default-volume-type %q: %v", name, err)
+		return nil
+	}
+	for _, t := range types {
+		if t.Name == name || t.ID == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid [BlockStorage] default-volume-type %q: no such volume type", name)
+}
+
+// blockStorageClient returns the Cinder client, with its requests bound to ctx
+func (os *OpenStack) blockStorageClient(ctx context.Context) *gophercloud.ServiceClient {
+	return withContext(ctx, os.blockstorage)
+}
+
+// computeClient returns the Nova client, with its requests bound to ctx
+func (os *OpenStack) computeClient(ctx context.Context) *gophercloud.ServiceClient {
+	return withContext(ctx, os.compute)
+}
+
+// withContext returns a copy of client whose requests are cancelled when ctx
+// is done. The copy uses the token client holds when it is made, and the one
+// obtained by reauthenticating when the token expired. The tokens are only
+// read and written through the accessors, which lock them against the
+// reauthentications of concurrent requests.
+func withContext(ctx context.Context, client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	original := client.ProviderClient
+	provider := &gophercloud.ProviderClient{
+		IdentityBase:     original.IdentityBase,
+		IdentityEndpoint: original.IdentityEndpoint,
+		HTTPClient:       original.HTTPClient,
+		UserAgent:        original.UserAgent,
+		Context:          ctx,
+	}
+	provider.UseTokenLock()
+	provider.SetToken(original.Token())
+	if reauth := original.ReauthFunc; reauth != nil {
+		// the reauthentication stores the new token in the original client
+		provider.ReauthFunc = func() error {
+			if err := reauth(); err != nil {
+				return err
+			}
+			provider.SetToken(original.Token())
+			return nil
+		}
+	}
+	sc := *client
+	sc.ProviderClient = provider
+	return &sc
+}
+
+// waitWithContext works like wait.ExponentialBackoff, but returns ctx.Err()
+// as soon as ctx is done instead of waiting for the next step, including
+// when the condition fails because its request was cancelled
+func waitWithContext(ctx context.Context, backoff wait.Backoff, condition wait.ConditionFunc) error {
+	duration := backoff.Duration
+	for i := 0; i < backoff.Steps; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ok, err := condition(); err != nil || ok {
+			if err != nil && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if i == backoff.Steps-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(duration, backoff.Jitter)):
+		}
+		duration = time.Duration(float64(duration) * backoff.Factor)
+	}
+	return wait.ErrWaitTimeout
+}
+
+// jitter returns duration randomly lengthened by up to maxFactor of it, as
+// wait.Backoff does, or duration itself for a maxFactor of 0
+func jitter(duration time.Duration, maxFactor float64) time.Duration {
+	if maxFactor <= 0 {
+		return duration
+	}
+	return wait.Jitter(duration, maxFactor)
+}
+
+// GetBlockStorageOpts returns the block storage options from the cloud config
+func (os *OpenStack) GetBlockStorageOpts() BlockStorageOpts {
+	return os.bsOpts
+}
+
 // GetOpenStackProvider returns Openstack Instance
 func GetOpenStackProvider() (IOpenStack, error) {
 
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+// circuitBreaker short-circuits the calls to an unreachable service: after
+// threshold consecutive failures the calls fail right away for coolDown, then
+// a single call probes the service again
+type circuitBreaker struct {
+	name      string
+	threshold int
+	coolDown  time.Duration
+	// set to 1 while the calls are short-circuited
+	open prometheus.Gauge
+	now  func() time.Time
+
+	mux       sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(name string, threshold int, coolDown time.Duration, open prometheus.Gauge) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		coolDown:  coolDown,
+		open:      open,
+		now:       time.Now,
+	}
+}
+
+// call runs f unless the calls are short-circuited, and records its result.
+// A panic of f is recorded as a failure, so that a panicking probe doesn't
+// leave the circuit half-open.
+func (b *circuitBreaker) call(f func() error) (err error) {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err = fmt.Errorf("%s panicked", b.name)
+	defer func() {
+		b.record(err)
+	}()
+	err = f()
+	return err
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return fmt.Errorf("%s skipped after %d consecutive failures", b.name, b.failures)
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	if err == nil {
+		if wasOpen {
+			klog.Infof("%s is reachable again", b.name)
+		}
+		b.failures = 0
+		b.open.Set(0)
+		return
+	}
+
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+	b.openUntil = b.now().Add(b.coolDown)
+	b.open.Set(1)
+	if !wasOpen {
+		klog.Warningf("%s failed %d times in a row, skipping it for %v: %v", b.name, b.failures, b.coolDown, err)
+	} else {
+		klog.V(4).Infof("%s still failing, skipping it for %v: %v", b.name, b.coolDown, err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatalf("failed to read the gauge: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	open := prometheus.NewGauge(prometheus.GaugeOpts{Name: "open"})
+	b := newCircuitBreaker("fake service", 2, time.Minute, open)
+	b.now = func() time.Time { return now }
+
+	calls := 0
+	failure := errors.New("connection timed out")
+	result := failure
+	call := func() error {
+		return b.call(func() error {
+			calls++
+			return result
+		})
+	}
+
+	// the failures below the threshold are not short-circuited
+	assert.Equal(failure, call())
+	assert.Equal(failure, call())
+	assert.Equal(2, calls)
+	assert.Equal(float64(1), gaugeValue(t, open))
+
+	// open: the calls fail without reaching the service
+	err := call()
+	assert.Error(err)
+	assert.NotEqual(failure, err)
+	assert.Equal(2, calls)
+
+	// after the cool-down a single call probes the service, and reopens on failure
+	now = now.Add(time.Minute)
+	assert.Equal(failure, call())
+	assert.Equal(3, calls)
+	assert.Error(call())
+	assert.Equal(3, calls)
+
+	// a successful probe closes the circuit
+	now = now.Add(time.Minute)
+	result = nil
+	assert.NoError(call())
+	assert.NoError(call())
+	assert.Equal(5, calls)
+	assert.Equal(float64(0), gaugeValue(t, open))
+
+	// a success resets the count of consecutive failures
+	result = failure
+	call()
+	result = nil
+	call()
+	result = failure
+	call()
+	assert.Equal(failure, call())
+	assert.Equal(9, calls)
+}
+
+// Test the calls made while a probe is in flight are short-circuited
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker("fake service", 1, time.Minute, prometheus.NewGauge(prometheus.GaugeOpts{Name: "open"}))
+	b.now = func() time.Time { return now }
+
+	b.call(func() error { return errors.New("connection refused") })
+	now = now.Add(time.Minute)
+
+	probed := false
+	err := b.call(func() error {
+		probed = true
+		assert.Error(t, b.call(func() error {
+			t.Error("called during the probe")
+			return nil
+		}))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, probed)
+}
+
+// Test a probe that panics lets the next one through after the cool-down
+func TestCircuitBreakerProbePanic(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker("fake service", 1, time.Minute, prometheus.NewGauge(prometheus.GaugeOpts{Name: "open"}))
+	b.now = func() time.Time { return now }
+
+	b.call(func() error { return errors.New("connection refused") })
+	now = now.Add(time.Minute)
+
+	assert.Panics(t, func() {
+		b.call(func() error { panic("fake probe failure") })
+	})
+	// the panic counts as a failure
+	assert.Error(t, b.call(func() error {
+		t.Error("called during the cool-down")
+		return nil
+	}))
+
+	now = now.Add(time.Minute)
+	probed := false
+	assert.NoError(t, b.call(func() error {
+		probed = true
+		return nil
+	}))
+	assert.True(t, probed)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumetypes"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+// listing the pools makes the scheduler report on every backend, which is
+// slow on big clouds
+const poolCacheTTL = 1 * time.Minute
+
+// ErrCapacityUnknown is returned by GetAvailableCapacity when neither the
+// pools nor the quota of the project bound the capacity
+var ErrCapacityUnknown = errors.New("the available capacity is unknown")
+
+// Pool is a Cinder backend pool as reported by the scheduler
+type Pool struct {
+	Name              string
+	VolumeBackendName string
+	// in GiB, +Inf for backends reporting an infinite capacity and -1 for
+	// those reporting it unknown
+	TotalCapacityGB float64
+	FreeCapacityGB  float64
+}
+
+// poolList is the result of listing the pools, either the pools or the 403
+// returned when the user isn't allowed to list them
+type poolList struct {
+	pools []Pool
+	err   error
+}
+
+// poolCache keeps the pools listed last
+type poolCache struct {
+	mux     sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	list    poolList
+	expires time.Time
+}
+
+func newPoolCache() *poolCache {
+	return &poolCache{ttl: poolCacheTTL, now: time.Now}
+}
+
+// get returns the cached pool list, false if it is not cached or expired
+func (c *poolCache) get() (poolList, bool) {
+	if c == nil {
+		return poolList{}, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.expires.IsZero() || c.now().After(c.expires) {
+		return poolList{}, false
+	}
+	return c.list, true
+}
+
+func (c *poolCache) set(list poolList) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.list = list
+	c.expires = c.now().Add(c.ttl)
+}
+
+// capacityGB parses a capacity reported by a Cinder driver, a number of GiB
+// or one of "infinite" and "unknown"
+func capacityGB(raw json.RawMessage) float64 {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return -1
+	}
+	switch v := value.(type) {
+	case float64:
+		return v
+	case string:
+		if v == "infinite" {
+			return math.Inf(1)
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return -1
+}
+
+// GetSchedulerPools returns the backend pools reported by the Cinder
+// scheduler. Listing them is allowed to administrators only by default, the
+// 403 returned otherwise is cached like the pools.
+func (os *OpenStack) GetSchedulerPools(ctx context.Context) ([]Pool, error) {
+	if list, ok := os.pools.get(); ok {
+		return list.pools, list.err
+	}
+
+	client := os.blockStorageClient(ctx)
+	var body struct {
+		Pools []struct {
+			Name         string `json:"name"`
+			Capabilities struct {
+				VolumeBackendName string          `json:"volume_backend_name"`
+				TotalCapacityGB   json.RawMessage `json:"total_capacity_gb"`
+				FreeCapacityGB    json.RawMessage `json:"free_capacity_gb"`
+			} `json:"capabilities"`
+		} `json:"pools"`
+	}
+	_, err := client.Get(client.ServiceURL("scheduler-stats", "get_pools")+"?detail=true", &body, nil)
+	if err != nil {
+		if cpoerrors.IsForbidden(err) {
+			os.pools.set(poolList{err: err})
+		}
+		return nil, err
+	}
+
+	pools := make([]Pool, 0, len(body.Pools))
+	for _, p := range body.Pools {
+		pools = append(pools, Pool{
+			Name:              p.Name,
+			VolumeBackendName: p.Capabilities.VolumeBackendName,
+			TotalCapacityGB:   capacityGB(p.Capabilities.TotalCapacityGB),
+			FreeCapacityGB:    capacityGB(p.Capabilities.FreeCapacityGB),
+		})
+	}
+	os.pools.set(poolList{pools: pools})
+	return pools, nil
+}
+
+// GetAvailableCapacity returns the GiB available to new volumes of the
+// volume type, from the free capacity of the pools of its backend when the
+// user may list them, else from the gigabytes quota of the project
+func (os *OpenStack) GetAvailableCapacity(ctx context.Context, volumeType string) (int64, error) {
+	pools, err := os.GetSchedulerPools(ctx)
+	switch {
+	case err == nil:
+		backend, err := os.volumeTypeBackend(ctx, volumeType)
+		if err != nil {
+			return 0, err
+		}
+		if free, ok := poolsCapacity(pools, backend); ok {
+			return free, nil
+		}
+		logging.FromContext(ctx).V(4).Infof("No pool reports a bounded capacity for volume type %q, using the quota", volumeType)
+	case cpoerrors.IsForbidden(err):
+		logging.FromContext(ctx).V(4).Infof("Not allowed to list the scheduler pools, using the quota: %v", err)
+	default:
+		return 0, err
+	}
+	return os.quotaCapacity(ctx)
+}
+
+// volumeTypeBackend returns the volume_backend_name extra spec of the volume
+// type, given by name or ID, empty if the type doesn't pin a backend
+func (os *OpenStack) volumeTypeBackend(ctx context.Context, volumeType string) (string, error) {
+	if volumeType == "" {
+		return "", nil
+	}
+	pages, err := volumetypes.List(os.blockStorageClient(ctx), volumetypes.ListOpts{}).AllPages()
+	if err != nil {
+		return "", err
+	}
+	types, err := volumetypes.ExtractVolumeTypes(pages)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range types {
+		if t.Name == volumeType || t.ID == volumeType {
+			return t.ExtraSpecs["volume_backend_name"], nil
+		}
+	}
+	return "", fmt.Errorf("volume type %q not found", volumeType)
+}
+
+// poolsCapacity returns the free GiB of the pools of the backend, of all the
+// pools if backend is empty, false if none matches or one of them doesn't
+// report a bounded capacity
+func poolsCapacity(pools []Pool, backend string) (int64, bool) {
+	var free float64
+	matched := false
+	for _, p := range pools {
+		if backend != "" && p.VolumeBackendName != backend {
+			continue
+		}
+		if p.FreeCapacityGB < 0 || math.IsInf(p.FreeCapacityGB, 1) {
+			return 0, false
+		}
+		free += p.FreeCapacityGB
+		matched = true
+	}
+	if !matched {
+		return 0, false
+	}
+	return int64(math.Floor(free)), true
+}
+
+// quotaCapacity returns the GiB left in the gigabytes quota of the project
+func (os *OpenStack) quotaCapacity(ctx context.Context) (int64, error) {
+	client := os.blockStorageClient(ctx)
+	var body struct {
+		Limits struct {
+			Absolute struct {
+				MaxTotalVolumeGigabytes int64 `json:"maxTotalVolumeGigabytes"`
+				TotalGigabytesUsed      int64 `json:"totalGigabytesUsed"`
+			} `json:"absolute"`
+		} `json:"limits"`
+	}
+	if _, err := client.Get(client.ServiceURL("limits"), &body, nil); err != nil {
+		return 0, err
+	}
+
+	limits := body.Limits.Absolute
+	if limits.MaxTotalVolumeGigabytes < 0 {
+		return 0, ErrCapacityUnknown
+	}
+	if limits.TotalGigabytesUsed >= limits.MaxTotalVolumeGigabytes {
+		return 0, nil
+	}
+	return limits.MaxTotalVolumeGigabytes - limits.TotalGigabytesUsed, nil
+}
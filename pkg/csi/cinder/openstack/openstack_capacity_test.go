@@ -0,0 +1,150 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSchedulerPools(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	now := time.Now()
+	cloud.pools.now = func() time.Time { return now }
+	server.addPool("host1@lvm#lvm", "lvm", 1000, 250.5)
+	server.addPool("host2@ceph#ceph", "ceph", "infinite", "infinite")
+	server.addPool("host3@nfs#nfs", "nfs", "unknown", "unknown")
+
+	pools, err := cloud.GetSchedulerPools(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []Pool{
+		{Name: "host1@lvm#lvm", VolumeBackendName: "lvm", TotalCapacityGB: 1000, FreeCapacityGB: 250.5},
+		{Name: "host2@ceph#ceph", VolumeBackendName: "ceph", TotalCapacityGB: math.Inf(1), FreeCapacityGB: math.Inf(1)},
+		{Name: "host3@nfs#nfs", VolumeBackendName: "nfs", TotalCapacityGB: -1, FreeCapacityGB: -1},
+	}, pools)
+
+	// cached until the TTL passes
+	_, err = cloud.GetSchedulerPools(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.requestCount("GET /volume/scheduler-stats/get_pools"))
+
+	now = now.Add(poolCacheTTL + time.Second)
+	_, err = cloud.GetSchedulerPools(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.requestCount("GET /volume/scheduler-stats/get_pools"))
+}
+
+// Test the capacity is the free space of the pools of the backend of the
+// volume type
+func TestGetAvailableCapacity(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	server.addPool("host1@ssd#a", "ssd", 1000, 100.5)
+	server.addPool("host2@ssd#b", "ssd", 1000, 50)
+	server.addPool("host1@hdd#a", "hdd", 5000, 300)
+	server.addPool("host3@thin#a", "thin", "infinite", "infinite")
+	server.addVolumeType("fast", "ssd")
+	server.addVolumeType("slow", "hdd")
+	server.addVolumeType("thin", "thin")
+	server.addVolumeType("nfs", "nfs")
+	server.addVolumeType("any", "")
+	server.setQuota(500)
+	server.addVolume(fakeServerVolume{Name: "vol", Size: 20})
+
+	tests := []struct {
+		name       string
+		volumeType string
+		expected   int64
+		err        bool
+	}{
+		{name: "ssd backend", volumeType: "fast", expected: 150},
+		{name: "hdd backend", volumeType: "slow", expected: 300},
+		{name: "by ID", volumeType: "type-1", expected: 150},
+		{name: "infinite backend uses the quota", volumeType: "thin", expected: 480},
+		{name: "backend without pools uses the quota", volumeType: "nfs", expected: 480},
+		{name: "type without backend uses the quota", volumeType: "any", expected: 480},
+		{name: "no type uses the quota", expected: 480},
+		{name: "unknown type", volumeType: "gold", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacity, err := cloud.GetAvailableCapacity(context.Background(), tt.volumeType)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, capacity)
+		})
+	}
+}
+
+// Test users not allowed to list the pools get the capacity left in the
+// quota, without asking the scheduler each time
+func TestGetAvailableCapacityForbidden(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	server.inject("GET /volume/scheduler-stats/get_pools", fakeServerFault{code: http.StatusForbidden})
+	server.addVolumeType("fast", "ssd")
+	server.setQuota(100)
+	server.addVolume(fakeServerVolume{Name: "vol", Size: 30})
+
+	for i := 0; i < 2; i++ {
+		capacity, err := cloud.GetAvailableCapacity(ctx, "fast")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(70), capacity)
+	}
+	assert.Equal(t, 1, server.requestCount("GET /volume/scheduler-stats/get_pools"))
+	assert.Equal(t, 2, server.requestCount("GET /volume/limits"))
+	assert.Equal(t, 0, server.requestCount("GET /volume/types"))
+}
+
+func TestGetAvailableCapacityUnlimited(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	server.inject("GET /volume/scheduler-stats/get_pools", fakeServerFault{code: http.StatusForbidden})
+	server.setQuota(-1)
+
+	_, err := cloud.GetAvailableCapacity(context.Background(), "")
+	assert.Equal(t, ErrCapacityUnknown, err)
+}
+
+func TestGetAvailableCapacityOverQuota(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	server.inject("GET /volume/scheduler-stats/get_pools", fakeServerFault{code: http.StatusForbidden})
+	server.setQuota(10)
+	server.addVolume(fakeServerVolume{Name: "vol", Size: 20})
+
+	capacity, err := cloud.GetAvailableCapacity(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), capacity)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+const (
+	// the first Nova microversion returning the locked_reason of the servers
+	lockedReasonMicroversion = "2.73"
+	// InstanceStoppedState is the vm_state of a shut off instance, volumes
+	// attached to it show up in the guest once it boots
+	InstanceStoppedState          = "stopped"
+	instanceShelvedState          = "shelved"
+	instanceShelvedOffloadedState = "shelved_offloaded"
+)
+
+var (
+	// e.g. Cannot 'attach_volume' instance 9f3c... while it is in task_state rebooting
+	novaTaskStateConflict = regexp.MustCompile(`while it is in task_state (\S+)`)
+	// e.g. Instance 9f3c... is locked
+	novaLockedConflict = regexp.MustCompile(`[Ii]nstance \S+ is locked`)
+)
+
+// InstanceLockedError is returned when Nova refuses to attach a volume to a
+// locked instance. The instance stays locked until whoever locked it unlocks
+// it, retrying doesn't help.
+type InstanceLockedError struct {
+	InstanceID string
+	// Reason is the locked_reason of the instance, empty if not set or the
+	// cloud doesn't report it
+	Reason string
+}
+
+func (e *InstanceLockedError) Error() string {
+	msg := fmt.Sprintf("instance %s is locked", e.InstanceID)
+	if e.Reason != "" {
+		msg += fmt.Sprintf(" (reason: %s)", e.Reason)
+	}
+	return msg
+}
+
+// InstanceShelvedError is returned when attaching a volume to a shelved
+// instance. Nova refuses the attach until the instance is unshelved.
+type InstanceShelvedError struct {
+	InstanceID string
+	VMState    string
+}
+
+func (e *InstanceShelvedError) Error() string {
+	return fmt.Sprintf("instance %s is shelved (vm_state %s)", e.InstanceID, e.VMState)
+}
+
+// isShelved returns whether the vm_state is the one of a shelved instance,
+// offloaded from its host or not
+func isShelved(vmState string) bool {
+	return vmState == instanceShelvedState || vmState == instanceShelvedOffloadedState
+}
+
+// novaFault returns the message of the fault in the body of an error
+// response, e.g. {"conflictingRequest": {"code": 409, "message": "..."}}, or
+// an empty string if err is not one
+func novaFault(err error) string {
+	var body []byte
+	switch e := err.(type) {
+	case gophercloud.ErrDefault409:
+		body = e.Body
+	case gophercloud.ErrUnexpectedResponseCode:
+		body = e.Body
+	default:
+		return ""
+	}
+
+	// the fault is the only member, named after its kind
+	var faults map[string]struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &faults); err != nil {
+		return ""
+	}
+	for _, fault := range faults {
+		if fault.Message != "" {
+			return fault.Message
+		}
+	}
+	return ""
+}
+
+// transientTaskState returns the task state of the instance if err is the
+// conflict returned by Nova for an instance busy with another operation,
+// e.g. a reboot, which usually completes within a minute
+func transientTaskState(err error) string {
+	if !cpoerrors.IsConflict(err) {
+		return ""
+	}
+	match := novaTaskStateConflict.FindStringSubmatch(novaFault(err))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// isInstanceLocked returns whether err is the conflict returned by Nova for a
+// locked instance
+func isInstanceLocked(err error) bool {
+	return cpoerrors.IsConflict(err) && novaLockedConflict.MatchString(novaFault(err))
+}
+
+// lockedReason returns why the instance is locked, or an empty string when
+// Nova is too old to tell or the lookup fails
+func (os *OpenStack) lockedReason(ctx context.Context, instanceID string) string {
+	client := os.computeClient(ctx)
+	client.Microversion = lockedReasonMicroversion
+
+	var body struct {
+		Server struct {
+			LockedReason string `json:"locked_reason"`
+		} `json:"server"`
+	}
+	if _, err := client.Get(client.ServiceURL("servers", instanceID), &body, nil); err != nil {
+		logging.FromContext(ctx).V(4).Infof("Failed to get the locked reason of instance %s: %v", instanceID, err)
+		return ""
+	}
+	return strings.TrimSpace(body.Server.LockedReason)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func conflict(body string) error {
+	return gophercloud.ErrDefault409{ErrUnexpectedResponseCode: gophercloud.ErrUnexpectedResponseCode{
+		Actual: http.StatusConflict,
+		Body:   []byte(body),
+	}}
+}
+
+func TestNovaConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		taskState string
+		locked    bool
+	}{
+		{
+			name:      "task state",
+			err:       conflict(`{"conflictingRequest": {"code": 409, "message": "Cannot 'attach_volume' instance 9f3c while it is in task_state rebooting"}}`),
+			taskState: "rebooting",
+		},
+		{
+			name:   "locked",
+			err:    conflict(`{"conflictingRequest": {"code": 409, "message": "Instance 9f3c is locked"}}`),
+			locked: true,
+		},
+		{
+			name: "vm state",
+			err:  conflict(`{"conflictingRequest": {"code": 409, "message": "Cannot 'attach_volume' instance 9f3c while it is in vm_state shelved_offloaded"}}`),
+		},
+		{
+			name: "not json",
+			err:  conflict(`<html>409 Conflict</html>`),
+		},
+		{
+			name: "not a conflict",
+			err: gophercloud.ErrUnexpectedResponseCode{
+				Actual: http.StatusBadRequest,
+				Body:   []byte(`{"badRequest": {"code": 400, "message": "Instance 9f3c is locked"}}`),
+			},
+		},
+		{
+			name: "other error",
+			err:  errors.New("while it is in task_state rebooting"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.taskState, transientTaskState(tt.err))
+			assert.Equal(t, tt.locked, isInstanceLocked(tt.err))
+		})
+	}
+}
+
+// Test the attach is retried until the instance is done rebooting
+func TestAttachVolumeTransientTaskState(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	server.setTaskStates(fakeInstanceID, "rebooting", "reboot_started")
+
+	_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+}
+
+func TestAttachVolumeTransientTaskStateGivesUp(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	server.setTaskStates(fakeInstanceID, "migrating", "migrating", "migrating", "migrating", "migrating", "migrating")
+
+	_, err := cloud.AttachVolume(context.Background(), fakeInstanceID, vol.ID)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "task_state migrating")
+	assert.Equal(t, cloud.bsOpts.AttachSteps, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test the retries stop at the deadline of the request
+func TestAttachVolumeTransientTaskStateDeadline(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	server.setTaskStates(fakeInstanceID, "rebooting", "rebooting")
+	cloud.bsOpts.AttachInitDelay = MyDuration{Duration: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test a locked instance fails the attach at once, with the lock reason
+func TestAttachVolumeInstanceLocked(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	server.lockServer(fakeInstanceID, "hypervisor maintenance")
+
+	_, err := cloud.AttachVolume(context.Background(), fakeInstanceID, vol.ID)
+	locked, ok := err.(*InstanceLockedError)
+	if !ok {
+		t.Fatalf("expected an InstanceLockedError, got %v", err)
+	}
+	assert.Equal(t, fakeInstanceID, locked.InstanceID)
+	assert.Equal(t, "hypervisor maintenance", locked.Reason)
+	assert.Equal(t, 1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test a locked instance is reported without reason by clouds not supporting
+// the microversion returning it
+func TestAttachVolumeInstanceLockedNoReason(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	server.lockServer(fakeInstanceID, "")
+	// cached, the instance isn't fetched again before the attach
+	_, err := cloud.GetInstanceAZ(context.Background(), fakeInstanceID)
+	assert.NoError(t, err)
+	server.inject("GET /compute/servers/{id}", fakeServerFault{code: http.StatusNotAcceptable})
+
+	_, err = cloud.AttachVolume(context.Background(), fakeInstanceID, vol.ID)
+	assert.Equal(t, &InstanceLockedError{InstanceID: fakeInstanceID}, err)
+}
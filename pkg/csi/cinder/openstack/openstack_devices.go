@@ -0,0 +1,157 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"regexp"
+	"sync"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+// deviceNamePattern matches the device names Nova gives the disks of its
+// instances, the prefix of the bus followed by the letters of the disk
+var deviceNamePattern = regexp.MustCompile(`^(/dev/(?:x?v|s|h)d)([a-z]+)$`)
+
+// the prefix of the device names of instances without attachments, the
+// virtio one of libvirt
+const defaultDevicePrefix = "/dev/vd"
+
+// deviceHints remembers whether the cloud refused an explicit device name on
+// attach, in which case Nova picks the device of the attachments
+type deviceHints struct {
+	mux     sync.Mutex
+	refused bool
+}
+
+func newDeviceHints() *deviceHints {
+	return &deviceHints{}
+}
+
+// supported returns whether attachments are given an explicit device name
+func (h *deviceHints) supported() bool {
+	if h == nil {
+		return true
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	return !h.refused
+}
+
+// refuse records the cloud refused an explicit device name
+func (h *deviceHints) refuse() {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.refused = true
+}
+
+// deviceHint returns the device name to attach a volume to the instance as,
+// the first free one after its existing attachments. It is "" when the
+// device names are left to Nova: explicit-device-names is not set, the cloud
+// refused them or the attachments of the instance could not be listed.
+func (os *OpenStack) deviceHint(ctx context.Context, instanceID string) string {
+	if !os.bsOpts.ExplicitDeviceNames || !os.deviceHints.supported() {
+		return ""
+	}
+	log := logging.FromContext(ctx).With(logging.Op, "AttachVolume", logging.InstanceID, instanceID)
+	pages, err := volumeattach.List(os.computeClient(ctx), instanceID).AllPages()
+	if err != nil {
+		log.V(4).Infof("Failed to list the attachments of the instance, letting Nova pick the device: %v", err)
+		return ""
+	}
+	attachments, err := volumeattach.ExtractVolumeAttachments(pages)
+	if err != nil {
+		log.V(4).Infof("Failed to list the attachments of the instance, letting Nova pick the device: %v", err)
+		return ""
+	}
+	devices := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		devices = append(devices, a.Device)
+	}
+	return nextDeviceName(devices)
+}
+
+// nextDeviceName returns the first device name not among the devices, with
+// the prefix of the first of them Nova named. The first disk, e.g. /dev/vda,
+// is never returned: it is the root disk, attached or not.
+func nextDeviceName(devices []string) string {
+	prefix := ""
+	used := make(map[string]bool)
+	for _, device := range devices {
+		match := deviceNamePattern.FindStringSubmatch(device)
+		if match == nil {
+			continue
+		}
+		if prefix == "" {
+			prefix = match[1]
+		}
+		if match[1] == prefix {
+			used[match[2]] = true
+		}
+	}
+	if prefix == "" {
+		prefix = defaultDevicePrefix
+	}
+	for i := 1; ; i++ {
+		if letters := diskLetters(i); !used[letters] {
+			return prefix + letters
+		}
+	}
+}
+
+// diskLetters returns the letters naming the ith disk, from 0: a to z, then
+// aa, ab and so on
+func diskLetters(i int) string {
+	letters := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		letters = string(rune('a'+(i-1)%26)) + letters
+	}
+	return letters
+}
+
+// createHintedAttachment attaches the volume to the instance as the device
+// hint, and returns the device reported by Nova and the hint it was attached
+// as. A cloud refusing the hint gets the volume attached as the device Nova
+// picks, and is remembered as refusing explicit device names.
+func (os *OpenStack) createHintedAttachment(ctx context.Context, instanceID, volumeID, hint string) (string, string, error) {
+	if hint == "" || !os.deviceHints.supported() {
+		device, err := os.createAttachment(ctx, instanceID, volumeID, "")
+		return device, "", err
+	}
+
+	device, err := os.createAttachment(ctx, instanceID, volumeID, hint)
+	if !cpoerrors.IsBadRequest(err) {
+		return device, hint, err
+	}
+	log := logging.FromContext(ctx).With(logging.Op, "AttachVolume", logging.VolumeID, volumeID, logging.InstanceID, instanceID)
+	log.V(4).Infof("Attach as %s refused, letting Nova pick the device: %v", hint, err)
+	device, autoErr := os.createAttachment(ctx, instanceID, volumeID, "")
+	if autoErr == nil {
+		// the refusal was about the device name, not the volume
+		log.Infof("The cloud refused the device name %s, leaving the device names of the next attachments to Nova", hint)
+		os.deviceHints.refuse()
+	}
+	return device, "", autoErr
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextDeviceName(t *testing.T) {
+	allVirtio := []string{}
+	for c := 'b'; c <= 'z'; c++ {
+		allVirtio = append(allVirtio, "/dev/vd"+string(c))
+	}
+	tests := []struct {
+		name     string
+		devices  []string
+		expected string
+	}{
+		{"no attachment", nil, "/dev/vdb"},
+		{"boot from volume", []string{"/dev/vda"}, "/dev/vdb"},
+		{"in order", []string{"/dev/vda", "/dev/vdb", "/dev/vdc"}, "/dev/vdd"},
+		{"gap", []string{"/dev/vda", "/dev/vdb", "/dev/vdd", "/dev/vde"}, "/dev/vdc"},
+		{"gaps unordered", []string{"/dev/vdf", "/dev/vdb", "/dev/vdc", "/dev/vde"}, "/dev/vdd"},
+		{"scsi", []string{"/dev/sdb", "/dev/sdc"}, "/dev/sdd"},
+		{"xen", []string{"/dev/xvdb"}, "/dev/xvdc"},
+		{"other bus ignored", []string{"/dev/vdb", "/dev/sdc"}, "/dev/vdc"},
+		{"unknown names ignored", []string{"", "/dev/disk/by-id/virtio-vol", "/dev/vdb"}, "/dev/vdc"},
+		{"past z", allVirtio, "/dev/vdaa"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, nextDeviceName(tt.devices))
+		})
+	}
+}
+
+func TestDiskLetters(t *testing.T) {
+	for i, expected := range map[int]string{0: "a", 1: "b", 25: "z", 26: "aa", 27: "ab", 51: "az", 52: "ba", 701: "zz", 702: "aaa"} {
+		assert.Equal(t, expected, diskLetters(i), "disk %d", i)
+	}
+}
+
+// addAttachedVolume preloads a volume attached to the instance as the device
+func (s *fakeServer) addAttachedVolume(instanceID, device string) *fakeServerVolume {
+	return s.addVolume(fakeServerVolume{
+		Size:        1,
+		Status:      VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{{ServerID: instanceID, Device: device}},
+	})
+}
+
+// Test volumes are attached as the first free device name, recorded on the
+// volume
+func TestAttachVolumeDeviceHint(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	cloud.bsOpts.ExplicitDeviceNames = true
+	ctx := context.Background()
+
+	server.addAttachedVolume(fakeInstanceID, "/dev/vdb")
+	server.addAttachedVolume(fakeInstanceID, "/dev/vdd")
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+
+	device, err := cloud.AttachFetchedVolume(ctx, fakeInstanceID, &volume)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdc", device)
+	assert.Equal(t, "/dev/vdc", volume.RequestedDevice)
+	assert.Equal(t, 1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test a cloud refusing device names gets the volume attached as the device
+// Nova picks, and the next attachments are not named
+func TestAttachVolumeDeviceHintRefused(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	cloud.bsOpts.ExplicitDeviceNames = true
+	server.refuseDeviceNames()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+	device, err := cloud.AttachFetchedVolume(ctx, fakeInstanceID, &volume)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdb", device)
+	assert.Equal(t, "", volume.RequestedDevice)
+	// named tagged, named untagged, then tagged
+	assert.Equal(t, 3, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+	// the tag was accepted, only the device name was refused
+	assert.True(t, cloud.tagging.supported(fakeInstanceID))
+	assert.False(t, cloud.deviceHints.supported())
+
+	other := server.addVolume(fakeServerVolume{Name: "other", Size: 1})
+	_, err = cloud.AttachVolume(ctx, "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f", other.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+	assert.Equal(t, 1, server.requestCount("GET /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test a volume Nova refuses to attach, named or not, doesn't turn the
+// device names off
+func TestAttachVolumeRefusedKeepsDeviceHints(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	cloud.bsOpts.ExplicitDeviceNames = true
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: "error"})
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+	_, err = cloud.AttachFetchedVolume(ctx, fakeInstanceID, &volume)
+	assert.Error(t, err)
+	assert.True(t, cloud.deviceHints.supported())
+}
+
+// Test the device names are left to Nova by default
+func TestAttachVolumeNoDeviceHint(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	server.addAttachedVolume(fakeInstanceID, "/dev/vdc")
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+	device, err := cloud.AttachFetchedVolume(ctx, fakeInstanceID, &volume)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdb", device)
+	assert.Equal(t, "", volume.RequestedDevice)
+	assert.Equal(t, 0, server.requestCount("GET /compute/servers/{id}/os-volume_attachments"))
+}
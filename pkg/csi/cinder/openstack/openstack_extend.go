@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
+	"k8s.io/apimachinery/pkg/util/wait"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+const (
+	VolumeExtendingStatus      = "extending"
+	VolumeErrorExtendingStatus = "error_extending"
+	// the first Cinder microversion allowing to extend attached volumes
+	onlineExtendMicroversion = "volume 3.42"
+)
+
+// OnlineExtendUnsupportedError is returned when an attached volume cannot be
+// extended: the cloud is used through the Block Storage API v2, doesn't know
+// the microversion 3.42 or refuses it. The volume has to be detached first.
+type OnlineExtendUnsupportedError struct {
+	VolumeID string
+	Reason   string
+}
+
+func (e *OnlineExtendUnsupportedError) Error() string {
+	return fmt.Sprintf("cannot expand volume %s while it is in use: %s", e.VolumeID, e.Reason)
+}
+
+// extendVolume requests the extension of the volume, with the microversion
+// 3.42 when it is attached
+func (os *OpenStack) extendVolume(ctx context.Context, volume Volume, newSize int) error {
+	inUse := volume.Status == VolumeInUseStatus
+	if inUse && os.bsVersion == bsVersionV2 {
+		return &OnlineExtendUnsupportedError{
+			VolumeID: volume.ID,
+			Reason:   "online extend requires the Block Storage API v3, the cloud is used through v2",
+		}
+	}
+
+	body, err := volumeactions.ExtendSizeOpts{NewSize: newSize}.ToVolumeExtendSizeMap()
+	if err != nil {
+		return err
+	}
+	opts := &gophercloud.RequestOpts{OkCodes: []int{202}}
+	if inUse {
+		opts.MoreHeaders = map[string]string{"OpenStack-API-Version": onlineExtendMicroversion}
+	}
+	client := os.blockStorageClient(ctx)
+	_, err = client.Post(client.ServiceURL("volumes", volume.ID, "action"), body, nil, opts)
+	if err != nil && inUse && (cpoerrors.IsBadRequest(err) || cpoerrors.IsNotAcceptable(err)) {
+		// 406 when the microversion is unknown, 400 when the status is
+		// checked as if it was not sent, or the policy forbids online extend
+		return &OnlineExtendUnsupportedError{VolumeID: volume.ID, Reason: err.Error()}
+	}
+	return err
+}
+
+// waitVolumeExtended waits for the volume to reach its new size, and leave
+// the extending status for the one it had before
+func (os *OpenStack) waitVolumeExtended(ctx context.Context, volumeID string, newSize int) error {
+	var volume Volume
+	err := waitWithContext(ctx, os.bsOpts.operationBackoff(), func() (bool, error) {
+		var err error
+		volume, err = os.GetVolume(ctx, volumeID)
+		if err != nil {
+			return false, err
+		}
+		if volume.Status == VolumeErrorExtendingStatus {
+			msg := fmt.Sprintf("volume %s went to %s status", volumeID, volume.Status)
+			if fault := os.volumeFault(ctx, volumeID); fault != "" {
+				msg += ": " + fault
+			}
+			return false, fmt.Errorf("%s", msg)
+		}
+		return volume.Size >= newSize && volume.Status != VolumeExtendingStatus, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		err = fmt.Errorf("volume %q is still of size %d GiB in %s status", volumeID, volume.Size, volume.Status)
+	}
+	return err
+}
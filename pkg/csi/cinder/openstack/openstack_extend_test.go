@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAvailableStatus})
+	assert.NoError(t, cloud.ExpandVolume(context.Background(), vol.ID, 2))
+	assert.Equal(t, 2, server.volume(vol.ID).Size)
+	assert.Equal(t, VolumeAvailableStatus, server.volume(vol.ID).Status)
+}
+
+// Test an attached volume is extended with the microversion 3.42, and stays
+// in-use
+func TestExpandVolumeInUse(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeInUseStatus})
+	assert.NoError(t, cloud.ExpandVolume(context.Background(), vol.ID, 2))
+	assert.Equal(t, 2, server.volume(vol.ID).Size)
+	assert.Equal(t, VolumeInUseStatus, server.volume(vol.ID).Status)
+	assert.Equal(t, 1, server.requestCount("POST /volume/volumes/{id}/action"))
+}
+
+// Test a cloud too old for online extend tells to detach the volume
+func TestExpandVolumeOnlineExtendUnsupported(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeInUseStatus})
+	server.disableOnlineExtend()
+
+	err := cloud.ExpandVolume(context.Background(), vol.ID, 2)
+	unsupported, ok := err.(*OnlineExtendUnsupportedError)
+	if !ok {
+		t.Fatalf("expected an OnlineExtendUnsupportedError, got %v", err)
+	}
+	assert.Equal(t, vol.ID, unsupported.VolumeID)
+	assert.Contains(t, err.Error(), "406")
+	assert.Equal(t, 1, server.volume(vol.ID).Size)
+}
+
+// Test the fault of a volume the backend failed to extend is reported
+func TestExpandVolumeErrorExtending(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeInUseStatus})
+	server.addMessage(vol.ID, "Extend volume:Compute service failed to extend volume.")
+	server.mux.Lock()
+	// the GET before the extend leaves the volume in-use, the one after it
+	// finds the extend failed
+	server.queue(vol.ID, func() {}, func() { vol.Status = VolumeErrorExtendingStatus })
+	server.mux.Unlock()
+
+	err := cloud.ExpandVolume(context.Background(), vol.ID, 2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), VolumeErrorExtendingStatus)
+		assert.Contains(t, err.Error(), "Compute service failed to extend volume.")
+	}
+}
+
+// Test the wait gives up on a volume that stays extending
+func TestExpandVolumeStillExtending(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeInUseStatus})
+	server.mux.Lock()
+	noop := func() {}
+	server.queue(vol.ID, noop, noop, noop, noop, noop, noop, noop)
+	server.mux.Unlock()
+
+	err := cloud.ExpandVolume(context.Background(), vol.ID, 2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "still of size 1 GiB in extending status")
+	}
+}
@@ -0,0 +1,887 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+)
+
+// Availability zone of the volumes and instances of FakeOpenStack unless
+// set otherwise
+const fakeDefaultAZ = "nova"
+
+// Gigabytes quota of the project of FakeOpenStack
+const fakeCapacityGB = 1000
+
+// FakeOpenStack is an in-memory implementation of IOpenStack, to test the
+// driver logic without a cloud. Every call waits for the configured latency,
+// and fails with the next error scripted for its method, or else with the
+// error injected for it, if any.
+type FakeOpenStack struct {
+	mux sync.Mutex
+
+	latency  time.Duration
+	failures map[string]error
+	scripted map[string][]error
+	calls    map[string]int
+
+	bsOpts    BlockStorageOpts
+	nextID    int
+	volumes   map[string]*Volume
+	snapshots map[string]*snapshots.Snapshot
+	// source snapshot of each volume created from a snapshot
+	volumeSnapshots map[string]string
+	// availability zone of each known instance
+	instances map[string]string
+	// vm_state of the instances not active
+	instanceStates map[string]string
+	// Cinder availability zones
+	zones []string
+	// features returned by ProbeFeatures
+	features BackendFeatures
+}
+
+var _ IOpenStack = &FakeOpenStack{}
+
+// NewFakeOpenStack returns an empty FakeOpenStack
+func NewFakeOpenStack() *FakeOpenStack {
+	return &FakeOpenStack{
+		failures:        make(map[string]error),
+		scripted:        make(map[string][]error),
+		calls:           make(map[string]int),
+		bsOpts:          defaultBlockStorageOpts(),
+		volumes:         make(map[string]*Volume),
+		snapshots:       make(map[string]*snapshots.Snapshot),
+		volumeSnapshots: make(map[string]string),
+		instances:       make(map[string]string),
+		instanceStates:  make(map[string]string),
+		zones:           []string{fakeDefaultAZ},
+		features:        BackendFeatures{APIVersion: bsVersionV3, Snapshots: true, OnlineExtend: true},
+	}
+}
+
+// SetLatency makes every call wait for d before returning
+func (f *FakeOpenStack) SetLatency(d time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.latency = d
+}
+
+// InjectFailure makes the calls to method, e.g. "CreateVolume", fail with
+// err. A nil err removes the failure.
+func (f *FakeOpenStack) InjectFailure(method string, err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err == nil {
+		delete(f.failures, method)
+		return
+	}
+	f.failures[method] = err
+}
+
+// InjectFailures makes the next calls to method fail with errs, one error
+// per call, e.g. to fail the first call only. A nil error lets the call
+// succeed.
+func (f *FakeOpenStack) InjectFailures(method string, errs ...error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.scripted[method] = append(f.scripted[method], errs...)
+}
+
+// Calls returns the number of calls to method
+func (f *FakeOpenStack) Calls(method string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.calls[method]
+}
+
+// SetVolumeStatus sets the status of a volume, e.g. to make it fail while
+// the driver waits for it
+func (f *FakeOpenStack) SetVolumeStatus(volumeID, status string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	vol.Status = status
+	return nil
+}
+
+// SetBlockStorageOpts sets the options returned by GetBlockStorageOpts
+func (f *FakeOpenStack) SetBlockStorageOpts(opts BlockStorageOpts) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.bsOpts = opts
+}
+
+// AddInstance registers an instance in the given availability zone
+func (f *FakeOpenStack) AddInstance(instanceID, az string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.instances[instanceID] = az
+}
+
+// SetAvailabilityZones sets the Cinder availability zones, none for a cloud
+// not letting users list them
+func (f *FakeOpenStack) SetAvailabilityZones(zones ...string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.zones = zones
+}
+
+// SetFeatures sets the features returned by ProbeFeatures, all of them by
+// default
+func (f *FakeOpenStack) SetFeatures(features BackendFeatures) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.features = features
+}
+
+// SetInstanceState sets the vm_state of an instance, e.g. stopped
+func (f *FakeOpenStack) SetInstanceState(instanceID, vmState string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.instanceStates[instanceID] = vmState
+}
+
+// call waits for the latency and returns the failure scripted or injected
+// for method, or ctx.Err() if ctx is done first. It is called with the lock
+// held, and releases it while waiting.
+func (f *FakeOpenStack) call(ctx context.Context, method string) error {
+	f.calls[method]++
+	if f.latency > 0 {
+		latency := f.latency
+		f.mux.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(latency):
+		}
+		f.mux.Lock()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if errs := f.scripted[method]; len(errs) > 0 {
+		f.scripted[method] = errs[1:]
+		return errs[0]
+	}
+	return f.failures[method]
+}
+
+func (f *FakeOpenStack) newID(kind string) string {
+	f.nextID++
+	return fmt.Sprintf("fake-%s-%d", kind, f.nextID)
+}
+
+func notFound(kind, id string) error {
+	return gophercloud.ErrDefault404{
+		ErrUnexpectedResponseCode: gophercloud.ErrUnexpectedResponseCode{
+			Actual: 404,
+			Body:   []byte(fmt.Sprintf("%s %s not found", kind, id)),
+		},
+	}
+}
+
+// sortedVolumes returns copies of the volumes, ordered by ID
+func (f *FakeOpenStack) sortedVolumes() []Volume {
+	var vlist []Volume
+	for _, v := range f.volumes {
+		vlist = append(vlist, *v)
+	}
+	sort.Slice(vlist, func(i, j int) bool { return vlist[i].ID < vlist[j].ID })
+	return vlist
+}
+
+// CreateVolume creates an available volume
+func (f *FakeOpenStack) CreateVolume(ctx context.Context, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "CreateVolume"); err != nil {
+		return nil, err
+	}
+
+	if snapshotID != "" {
+		if _, ok := f.snapshots[snapshotID]; !ok {
+			return nil, notFound("snapshot", snapshotID)
+		}
+	}
+	if availability == "" {
+		availability = fakeDefaultAZ
+	}
+
+	metadata := make(map[string]string)
+	if tags != nil {
+		for k, v := range *tags {
+			metadata[k] = v
+		}
+	}
+	vol := &Volume{
+		ID:          f.newID("volume"),
+		Name:        name,
+		Description: description,
+		Status:      VolumeAvailableStatus,
+		Size:        size,
+		AZ:          availability,
+		Metadata:    metadata,
+		SnapshotID:  snapshotID,
+	}
+	f.volumes[vol.ID] = vol
+	if snapshotID != "" {
+		f.volumeSnapshots[vol.ID] = snapshotID
+	}
+	created := *vol
+	return &created, nil
+}
+
+// DeleteVolume deletes a volume which is not attached
+func (f *FakeOpenStack) DeleteVolume(ctx context.Context, volumeID string, knownDetached bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "DeleteVolume"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	if vol.AttachedServerId != "" {
+		return &VolumeInUseError{VolumeID: volumeID, ServerIDs: []string{vol.AttachedServerId}}
+	}
+	delete(f.volumes, volumeID)
+	delete(f.volumeSnapshots, volumeID)
+	return nil
+}
+
+// AttachVolume attaches a volume to an instance
+func (f *FakeOpenStack) AttachVolume(ctx context.Context, instanceID, volumeID string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "AttachVolume"); err != nil {
+		return "", err
+	}
+	if _, err := f.attach(instanceID, volumeID); err != nil {
+		return "", err
+	}
+	return volumeID, nil
+}
+
+// AttachFetchedVolume attaches a volume to an instance, and returns its device
+func (f *FakeOpenStack) AttachFetchedVolume(ctx context.Context, instanceID string, volume *Volume) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "AttachFetchedVolume"); err != nil {
+		return "", err
+	}
+	return f.attach(instanceID, volume.ID)
+}
+
+func (f *FakeOpenStack) attach(instanceID, volumeID string) (string, error) {
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return "", notFound("volume", volumeID)
+	}
+	if vol.AttachedServerId != "" {
+		if vol.AttachedServerId == instanceID {
+			return vol.AttachedDevice, nil
+		}
+		return "", fmt.Errorf("disk %s is attached to a different instance (%s)", volumeID, vol.AttachedServerId)
+	}
+	if state := f.instanceStates[instanceID]; isShelved(state) {
+		return "", &InstanceShelvedError{InstanceID: instanceID, VMState: state}
+	}
+
+	vol.setAttachments([]Attachment{{
+		ServerID:     instanceID,
+		Device:       fmt.Sprintf("/dev/vd%c", 'b'+rune(f.attachmentCount(instanceID))),
+		AttachmentID: "fake-attachment-" + volumeID,
+	}})
+	vol.Status = VolumeInUseStatus
+	return vol.AttachedDevice, nil
+}
+
+// ListVolumes lists all the volumes
+func (f *FakeOpenStack) ListVolumes(ctx context.Context) ([]Volume, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "ListVolumes"); err != nil {
+		return nil, err
+	}
+	return f.sortedVolumes(), nil
+}
+
+// ListVolumesWithPage lists the volumes matching filters by ID, up to limit
+// after marker
+func (f *FakeOpenStack) ListVolumesWithPage(ctx context.Context, limit int, marker string, filters map[string]string) ([]Volume, string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "ListVolumesWithPage"); err != nil {
+		return nil, "", err
+	}
+	opts, err := parseVolumeFilters(filters)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var vlist []Volume
+	found := marker == ""
+	for _, vol := range f.sortedVolumes() {
+		if !found {
+			found = vol.ID == marker
+			continue
+		}
+		if !opts.matches(vol) {
+			continue
+		}
+		if limit > 0 && len(vlist) == limit {
+			return vlist, vlist[limit-1].ID, nil
+		}
+		vlist = append(vlist, vol)
+	}
+	if !found {
+		return nil, "", &InvalidMarkerError{Marker: marker, Err: notFound("marker", marker)}
+	}
+	return vlist, "", nil
+}
+
+// WaitDiskAttached checks that the volume is attached to the instance, and
+// returns it
+func (f *FakeOpenStack) WaitDiskAttached(ctx context.Context, instanceID string, volumeID string) (Volume, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "WaitDiskAttached"); err != nil {
+		return Volume{}, err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return Volume{}, &VolumeDeletedError{VolumeID: volumeID}
+	}
+	if strings.HasPrefix(vol.Status, VolumeErrorStatus) {
+		return Volume{}, fmt.Errorf("volume %q went to %s status while being attached", volumeID, vol.Status)
+	}
+	if vol.AttachedServerId != instanceID {
+		return Volume{}, fmt.Errorf("Volume %q failed to be attached within the alloted time", volumeID)
+	}
+	return *vol, nil
+}
+
+// DetachVolume detaches a volume from an instance
+func (f *FakeOpenStack) DetachVolume(ctx context.Context, instanceID, volumeID string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "DetachVolume"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	if vol.Status == VolumeAvailableStatus {
+		return nil
+	}
+	if vol.AttachedServerId != instanceID {
+		return fmt.Errorf("disk: %s has no attachments or is not attached to compute: %s", vol.Name, instanceID)
+	}
+
+	vol.AttachedServerId = ""
+	vol.AttachedDevice = ""
+	vol.AttachmentID = ""
+	vol.Attachments = nil
+	vol.Status = VolumeAvailableStatus
+	return nil
+}
+
+// WaitDiskDetached checks that the volume is not attached to the instance
+func (f *FakeOpenStack) WaitDiskDetached(ctx context.Context, instanceID string, volumeID string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "WaitDiskDetached"); err != nil {
+		return err
+	}
+
+	if vol, ok := f.volumes[volumeID]; ok && vol.AttachedServerId == instanceID {
+		return fmt.Errorf("Volume %q failed to detach within the alloted time", volumeID)
+	}
+	return nil
+}
+
+// GetAttachmentDiskPath returns the device the volume is attached as
+func (f *FakeOpenStack) GetAttachmentDiskPath(ctx context.Context, instanceID, volumeID string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetAttachmentDiskPath"); err != nil {
+		return "", err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return "", notFound("volume", volumeID)
+	}
+	if vol.AttachedServerId != instanceID {
+		return "", fmt.Errorf("disk %q is attached to a different compute: %q, should be detached before proceeding", volumeID, vol.AttachedServerId)
+	}
+	if vol.AttachedDevice == "" {
+		return "", &NoDevicePathError{VolumeID: volumeID, InstanceID: instanceID}
+	}
+	return vol.AttachedDevice, nil
+}
+
+// GetVolumesByName returns the volumes with the given name
+func (f *FakeOpenStack) GetVolumesByName(ctx context.Context, name string) ([]Volume, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetVolumesByName"); err != nil {
+		return nil, err
+	}
+
+	var vlist []Volume
+	for _, v := range f.sortedVolumes() {
+		if v.Name == name {
+			vlist = append(vlist, v)
+		}
+	}
+	return vlist, nil
+}
+
+// CreateSnapshot creates an available snapshot of a volume
+func (f *FakeOpenStack) CreateSnapshot(ctx context.Context, name, volID, description string, tags *map[string]string) (*snapshots.Snapshot, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "CreateSnapshot"); err != nil {
+		return &snapshots.Snapshot{}, err
+	}
+
+	vol, ok := f.volumes[volID]
+	if !ok {
+		return &snapshots.Snapshot{}, notFound("volume", volID)
+	}
+
+	metadata := make(map[string]string)
+	if tags != nil {
+		for k, v := range *tags {
+			metadata[k] = v
+		}
+	}
+	snap := &snapshots.Snapshot{
+		ID:          f.newID("snapshot"),
+		Name:        name,
+		Description: description,
+		VolumeID:    volID,
+		Status:      SnapshotReadyStatus,
+		Size:        vol.Size,
+		CreatedAt:   time.Now(),
+		Metadata:    metadata,
+	}
+	f.snapshots[snap.ID] = snap
+
+	created := *snap
+	return &created, nil
+}
+
+// sortedSnapshots returns copies of the snapshots accepted by keep, ordered by ID
+func (f *FakeOpenStack) sortedSnapshots(keep func(*snapshots.Snapshot) bool) []snapshots.Snapshot {
+	var slist []snapshots.Snapshot
+	for _, s := range f.snapshots {
+		if keep(s) {
+			slist = append(slist, *s)
+		}
+	}
+	sort.Slice(slist, func(i, j int) bool { return slist[i].ID < slist[j].ID })
+	return slist
+}
+
+// ListSnapshots lists the snapshots by ID, filtered and paginated as Cinder
+// does
+func (f *FakeOpenStack) ListSnapshots(ctx context.Context, limit int, marker string, filters map[string]string) ([]snapshots.Snapshot, string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "ListSnapshots"); err != nil {
+		return nil, "", err
+	}
+	for k := range filters {
+		if k != SnapshotNameFilter && k != SnapshotStatusFilter && k != SnapshotVolumeIDFilter {
+			return nil, "", fmt.Errorf("unsupported snapshot filter %q", k)
+		}
+	}
+
+	var slist []snapshots.Snapshot
+	found := marker == ""
+	for _, snap := range f.sortedSnapshots(func(*snapshots.Snapshot) bool { return true }) {
+		if !found {
+			found = snap.ID == marker
+			continue
+		}
+		if !snapshotMatches(snap, filters) {
+			continue
+		}
+		if limit > 0 && len(slist) == limit {
+			return slist, slist[limit-1].ID, nil
+		}
+		slist = append(slist, snap)
+	}
+	if !found {
+		return nil, "", &InvalidMarkerError{Marker: marker, Err: notFound("marker", marker)}
+	}
+	return slist, "", nil
+}
+
+func snapshotMatches(snap snapshots.Snapshot, filters map[string]string) bool {
+	if name, ok := filters[SnapshotNameFilter]; ok && snap.Name != name {
+		return false
+	}
+	if status, ok := filters[SnapshotStatusFilter]; ok && snap.Status != status {
+		return false
+	}
+	if volumeID, ok := filters[SnapshotVolumeIDFilter]; ok && snap.VolumeID != volumeID {
+		return false
+	}
+	return true
+}
+
+// DeleteSnapshot deletes a snapshot no volume was created from
+func (f *FakeOpenStack) DeleteSnapshot(ctx context.Context, snapID string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "DeleteSnapshot"); err != nil {
+		return err
+	}
+
+	if _, ok := f.snapshots[snapID]; !ok {
+		return notFound("snapshot", snapID)
+	}
+
+	var vols []string
+	for volID, sourceID := range f.volumeSnapshots {
+		if sourceID == snapID {
+			vols = append(vols, volID)
+		}
+	}
+	if len(vols) > 0 {
+		sort.Strings(vols)
+		return &SnapshotInUseError{SnapshotID: snapID, Volumes: vols}
+	}
+
+	delete(f.snapshots, snapID)
+	return nil
+}
+
+// GetSnapshotsByName returns the snapshots with the given name
+func (f *FakeOpenStack) GetSnapshotsByName(ctx context.Context, n string) ([]snapshots.Snapshot, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetSnapshotsByName"); err != nil {
+		return nil, err
+	}
+
+	return f.sortedSnapshots(func(s *snapshots.Snapshot) bool {
+		return s.Name == n
+	}), nil
+}
+
+// GetSnapshotByID returns a snapshot
+func (f *FakeOpenStack) GetSnapshotByID(ctx context.Context, snapshotID string) (*snapshots.Snapshot, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetSnapshotByID"); err != nil {
+		return nil, err
+	}
+
+	snap, ok := f.snapshots[snapshotID]
+	if !ok {
+		return nil, notFound("snapshot", snapshotID)
+	}
+	found := *snap
+	return &found, nil
+}
+
+// WaitSnapshotReady checks that the snapshot is available
+func (f *FakeOpenStack) WaitSnapshotReady(ctx context.Context, snapshotID string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "WaitSnapshotReady"); err != nil {
+		return err
+	}
+
+	snap, ok := f.snapshots[snapshotID]
+	if !ok {
+		return notFound("snapshot", snapshotID)
+	}
+	if snap.Status != SnapshotReadyStatus {
+		return fmt.Errorf("Timeout, Snapshot  %s is still not Ready", snapshotID)
+	}
+	return nil
+}
+
+// WaitVolumeCreated checks that the volume is available, and deletes it if
+// it went to error
+func (f *FakeOpenStack) WaitVolumeCreated(ctx context.Context, volumeID string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "WaitVolumeCreated"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	if strings.HasPrefix(vol.Status, VolumeErrorStatus) {
+		delete(f.volumes, volumeID)
+		delete(f.volumeSnapshots, volumeID)
+		return &FailedVolumeError{VolumeID: volumeID, Status: vol.Status, Deleted: true}
+	}
+	if vol.Status != VolumeAvailableStatus {
+		return fmt.Errorf("volume %q is still in %s status", volumeID, vol.Status)
+	}
+	return nil
+}
+
+// GetBlockStorageOpts returns the configured block storage options
+func (f *FakeOpenStack) GetBlockStorageOpts() BlockStorageOpts {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.bsOpts
+}
+
+// GetVolume returns a volume
+func (f *FakeOpenStack) GetVolume(ctx context.Context, volumeID string) (Volume, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetVolume"); err != nil {
+		return Volume{}, err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return Volume{}, notFound("volume", volumeID)
+	}
+	return *vol, nil
+}
+
+// SetVolumeMetadata sets the given metadata keys of a volume
+func (f *FakeOpenStack) SetVolumeMetadata(ctx context.Context, volumeID string, metadata map[string]string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "SetVolumeMetadata"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	// the volumes returned before keep their metadata
+	updated := make(map[string]string, len(vol.Metadata)+len(metadata))
+	for k, v := range vol.Metadata {
+		updated[k] = v
+	}
+	for k, v := range metadata {
+		updated[k] = v
+	}
+	vol.Metadata = updated
+	return nil
+}
+
+// SetVolumeImageMetadata sets the given image metadata keys of a volume
+func (f *FakeOpenStack) SetVolumeImageMetadata(ctx context.Context, volumeID string, metadata map[string]string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "SetVolumeImageMetadata"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	// the volumes returned before keep their image metadata
+	updated := make(map[string]string, len(vol.ImageMetadata)+len(metadata))
+	for k, v := range vol.ImageMetadata {
+		updated[k] = v
+	}
+	for k, v := range metadata {
+		updated[k] = v
+	}
+	vol.ImageMetadata = updated
+	return nil
+}
+
+// RenameVolume sets the name of a volume
+func (f *FakeOpenStack) RenameVolume(ctx context.Context, volumeID, name string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "RenameVolume"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	vol.Name = name
+	return nil
+}
+
+// ExpandVolume grows a volume to newSize GiB
+func (f *FakeOpenStack) ExpandVolume(ctx context.Context, volumeID string, newSize int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "ExpandVolume"); err != nil {
+		return err
+	}
+
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return notFound("volume", volumeID)
+	}
+	if newSize <= vol.Size {
+		return fmt.Errorf("failed to expand volume %s to %d GiB: new size must be greater than %d GiB", volumeID, newSize, vol.Size)
+	}
+	vol.Size = newSize
+	return nil
+}
+
+// GetInstanceAZ returns the availability zone of an instance. Unknown
+// instances are in the default availability zone.
+func (f *FakeOpenStack) GetInstanceAZ(ctx context.Context, instanceID string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetInstanceAZ"); err != nil {
+		return "", err
+	}
+
+	if az, ok := f.instances[instanceID]; ok {
+		return az, nil
+	}
+	return fakeDefaultAZ, nil
+}
+
+// GetInstanceState returns the vm_state of an instance, active unless set
+func (f *FakeOpenStack) GetInstanceState(ctx context.Context, instanceID string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetInstanceState"); err != nil {
+		return "", err
+	}
+
+	if state, ok := f.instanceStates[instanceID]; ok {
+		return state, nil
+	}
+	return "active", nil
+}
+
+// GetAttachmentCount returns the number of volumes attached to an instance
+func (f *FakeOpenStack) GetAttachmentCount(ctx context.Context, instanceID string) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetAttachmentCount"); err != nil {
+		return 0, err
+	}
+	return f.attachmentCount(instanceID), nil
+}
+
+func (f *FakeOpenStack) attachmentCount(instanceID string) int {
+	count := 0
+	for _, v := range f.volumes {
+		if v.AttachedServerId == instanceID {
+			count++
+		}
+	}
+	return count
+}
+
+// CheckBlockStorageAPI fails only when a failure is injected
+func (f *FakeOpenStack) CheckBlockStorageAPI(ctx context.Context) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.call(ctx, "CheckBlockStorageAPI")
+}
+
+// GetAvailabilityZones returns the Cinder availability zones
+func (f *FakeOpenStack) GetAvailabilityZones(ctx context.Context) ([]string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetAvailabilityZones"); err != nil {
+		return nil, err
+	}
+
+	zones := make([]string, len(f.zones))
+	copy(zones, f.zones)
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// ProbeFeatures returns the features set with SetFeatures
+func (f *FakeOpenStack) ProbeFeatures(ctx context.Context) (*BackendFeatures, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "ProbeFeatures"); err != nil {
+		return nil, err
+	}
+	features := f.features
+	return &features, nil
+}
+
+// FailoverReplication fails the replicated volumes over to their replica at
+// once, the fake doesn't know their hosts
+func (f *FakeOpenStack) FailoverReplication(ctx context.Context, host, backendID string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "FailoverReplication"); err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("no host to fail over")
+	}
+
+	for _, vol := range f.volumes {
+		if vol.ReplicationStatus == ReplicationEnabledStatus {
+			vol.ReplicationStatus = ReplicationFailedOverStatus
+		}
+	}
+	return nil
+}
+
+// GetAvailableCapacity returns what the volumes leave of the gigabytes quota,
+// whatever the volume type
+func (f *FakeOpenStack) GetAvailableCapacity(ctx context.Context, volumeType string) (int64, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err := f.call(ctx, "GetAvailableCapacity"); err != nil {
+		return 0, err
+	}
+
+	used := 0
+	for _, v := range f.volumes {
+		used += v.Size
+	}
+	if used >= fakeCapacityGB {
+		return 0, nil
+	}
+	return int64(fakeCapacityGB - used), nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+func TestFakeOpenStackVolumes(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	created, err := f.CreateVolume(ctx, "vol", 2, "", "", "", "", &map[string]string{"key": "value"})
+	assert.NoError(err)
+	assert.Equal(fakeDefaultAZ, created.AZ)
+	assert.Equal(2, created.Size)
+	id := created.ID
+
+	vols, err := f.GetVolumesByName(ctx, "vol")
+	assert.NoError(err)
+	assert.Len(vols, 1)
+	assert.Equal(id, vols[0].ID)
+	assert.Equal("value", vols[0].Metadata["key"])
+
+	// Attach and detach
+	f.AddInstance("instance", "zone-1")
+	instanceAZ, err := f.GetInstanceAZ(ctx, "instance")
+	assert.NoError(err)
+	assert.Equal("zone-1", instanceAZ)
+
+	_, err = f.AttachVolume(ctx, "instance", id)
+	assert.NoError(err)
+	_, err = f.WaitDiskAttached(ctx, "instance", id)
+	assert.NoError(err)
+	path, err := f.GetAttachmentDiskPath(ctx, "instance", id)
+	assert.NoError(err)
+	assert.Equal("/dev/vdb", path)
+	count, err := f.GetAttachmentCount(ctx, "instance")
+	assert.NoError(err)
+	assert.Equal(1, count)
+
+	_, err = f.AttachVolume(ctx, "other-instance", id)
+	assert.Error(err)
+	assert.Error(f.DeleteVolume(ctx, id, false))
+
+	assert.NoError(f.DetachVolume(ctx, "instance", id))
+	assert.NoError(f.WaitDiskDetached(ctx, "instance", id))
+
+	// Expand
+	assert.NoError(f.ExpandVolume(ctx, id, 5))
+	vol, err := f.GetVolume(ctx, id)
+	assert.NoError(err)
+	assert.Equal(5, vol.Size)
+
+	// Delete
+	assert.NoError(f.DeleteVolume(ctx, id, false))
+	_, err = f.GetVolume(ctx, id)
+	assert.True(cpoerrors.IsNotFound(err))
+}
+
+func TestLegacyCreateVolume(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	id, az, size, err := LegacyCreateVolume(ctx, f, "vol", 3, "", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal(fakeDefaultAZ, az)
+	assert.Equal(3, size)
+	vol, err := f.GetVolume(ctx, id)
+	assert.NoError(err)
+	assert.Equal("vol", vol.Name)
+
+	f.InjectFailure("CreateVolume", errors.New("fake error"))
+	id, _, _, err = LegacyCreateVolume(ctx, f, "vol", 3, "", "", "", "", nil)
+	assert.Error(err)
+	assert.Equal("", id)
+}
+
+func TestFakeOpenStackListVolumesWithPage(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := f.CreateVolume(ctx, name, 1, "", "", "", "", nil)
+		assert.NoError(err)
+	}
+
+	first, next, err := f.ListVolumesWithPage(ctx, 2, "", nil)
+	assert.NoError(err)
+	assert.Len(first, 2)
+	assert.NotEqual("", next)
+	second, next, err := f.ListVolumesWithPage(ctx, 2, next, nil)
+	assert.NoError(err)
+	assert.Len(second, 1)
+	assert.Equal("", next)
+
+	vols, _, err := f.ListVolumesWithPage(ctx, 0, "", map[string]string{VolumeNameFilter: "b"})
+	assert.NoError(err)
+	assert.Len(vols, 1)
+
+	_, _, err = f.ListVolumesWithPage(ctx, 2, "missing", nil)
+	_, ok := err.(*InvalidMarkerError)
+	assert.True(ok, "invalid marker: %v", err)
+}
+
+func TestFakeOpenStackSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	vol, err := f.CreateVolume(ctx, "vol", 1, "", "", "", "", nil)
+	assert.NoError(err)
+	volID := vol.ID
+
+	snap, err := f.CreateSnapshot(ctx, "snap", volID, "", nil)
+	assert.NoError(err)
+	assert.NoError(f.WaitSnapshotReady(ctx, snap.ID))
+
+	snaps, err := f.GetSnapshotsByName(ctx, "snap")
+	assert.NoError(err)
+	assert.Len(snaps, 1)
+
+	// Snapshots with dependent volumes cannot be deleted
+	restored, err := f.CreateVolume(ctx, "restored", 1, "", "", snap.ID, "", nil)
+	assert.NoError(err)
+	assert.Equal(snap.ID, restored.SnapshotID)
+	restoredID := restored.ID
+	err = f.DeleteSnapshot(ctx, snap.ID)
+	assert.Equal(&SnapshotInUseError{SnapshotID: snap.ID, Volumes: []string{restoredID}}, err)
+
+	assert.NoError(f.DeleteVolume(ctx, restoredID, false))
+	assert.NoError(f.DeleteSnapshot(ctx, snap.ID))
+	assert.True(cpoerrors.IsNotFound(f.DeleteSnapshot(ctx, snap.ID)))
+
+	// Restoring a missing snapshot fails
+	_, err = f.CreateVolume(ctx, "restored", 1, "", "", snap.ID, "", nil)
+	assert.True(cpoerrors.IsNotFound(err))
+}
+
+func TestFakeOpenStackFailureInjection(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	fakeErr := errors.New("fake error")
+	f.InjectFailure("CreateVolume", fakeErr)
+	_, err := f.CreateVolume(ctx, "vol", 1, "", "", "", "", nil)
+	assert.Equal(fakeErr, err)
+
+	// Other methods are not affected
+	_, err = f.ListVolumes(ctx)
+	assert.NoError(err)
+
+	f.InjectFailure("CreateVolume", nil)
+	_, err = f.CreateVolume(ctx, "vol", 1, "", "", "", "", nil)
+	assert.NoError(err)
+}
+
+func TestFakeOpenStackScriptedFailures(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	fakeErr := errors.New("fake error")
+	f.InjectFailures("ListVolumes", fakeErr, nil, fakeErr)
+
+	_, err := f.ListVolumes(ctx)
+	assert.Equal(fakeErr, err)
+	_, err = f.ListVolumes(ctx)
+	assert.NoError(err)
+	_, err = f.ListVolumes(ctx)
+	assert.Equal(fakeErr, err)
+	// the script is over
+	_, err = f.ListVolumes(ctx)
+	assert.NoError(err)
+
+	assert.Equal(4, f.Calls("ListVolumes"))
+	assert.Equal(0, f.Calls("CreateVolume"))
+}
+
+func TestFakeOpenStackVolumeError(t *testing.T) {
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+
+	vol, err := f.CreateVolume(ctx, "vol", 1, "", "", "", "", nil)
+	assert.NoError(t, err)
+	volID := vol.ID
+	_, err = f.AttachVolume(ctx, "instance", volID)
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.SetVolumeStatus(volID, "error_attaching"))
+	_, err = f.WaitDiskAttached(ctx, "instance", volID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error_attaching")
+	}
+}
+
+func TestFakeOpenStackLatency(t *testing.T) {
+	f := NewFakeOpenStack()
+	ctx := context.Background()
+	f.SetLatency(10 * time.Millisecond)
+
+	start := time.Now()
+	_, err := f.ListVolumes(ctx)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+}
+
+func TestFakeOpenStackCancel(t *testing.T) {
+	f := NewFakeOpenStack()
+	f.SetLatency(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+
+	start := time.Now()
+	_, err := f.ListVolumes(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Minute)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+// BackendFeatures are the optional features of the Block Storage API of the
+// cloud, which the driver advertises as capabilities
+type BackendFeatures struct {
+	// Block Storage API version the cloud is used through, v2 or v3
+	APIVersion string
+	// Whether snapshots can be listed. Clouds without the snapshot API, or
+	// whose policy forbids listing snapshots, can't take them either.
+	Snapshots bool
+	// Whether attached volumes can be extended, with the microversion 3.42
+	OnlineExtend bool
+}
+
+// ProbeFeatures returns the optional features of the Block Storage API, with
+// a list of at most one snapshot and one volume
+func (os *OpenStack) ProbeFeatures(ctx context.Context) (*BackendFeatures, error) {
+	features := &BackendFeatures{APIVersion: os.bsVersion}
+
+	client := os.blockStorageClient(ctx)
+	var snapshots map[string]interface{}
+	_, err := client.Get(client.ServiceURL("snapshots")+"?limit=1", &snapshots, nil)
+	switch {
+	case err == nil:
+		features.Snapshots = true
+	case cpoerrors.IsNotFound(err) || cpoerrors.IsForbidden(err):
+		// no snapshot API, or not for this user
+	default:
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	if os.bsVersion == bsVersionV3 {
+		supported, err := os.supportsMicroversion(ctx, onlineExtendMicroversion)
+		if err != nil {
+			return nil, err
+		}
+		features.OnlineExtend = supported
+	}
+	return features, nil
+}
+
+// supportsMicroversion returns whether the Block Storage API knows the
+// microversion, e.g. "volume 3.42", listing a volume with it. Clouds knowing
+// it echo it back, older ones refuse it with 406 or ignore it.
+func (os *OpenStack) supportsMicroversion(ctx context.Context, version string) (bool, error) {
+	client := os.blockStorageClient(ctx)
+	var volumes map[string]interface{}
+	resp, err := client.Get(client.ServiceURL("volumes")+"?limit=1", &volumes, &gophercloud.RequestOpts{
+		MoreHeaders: map[string]string{"OpenStack-API-Version": version},
+	})
+	if cpoerrors.IsNotAcceptable(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to list volumes with the microversion %s: %v", version, err)
+	}
+	return resp.Header.Get("OpenStack-API-Version") == version, nil
+}
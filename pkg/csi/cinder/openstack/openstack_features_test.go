@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(s *fakeServer, cloud *OpenStack)
+		expected *BackendFeatures
+	}{
+		{
+			name:     "all",
+			setup:    func(s *fakeServer, cloud *OpenStack) {},
+			expected: &BackendFeatures{APIVersion: "v3", Snapshots: true, OnlineExtend: true},
+		},
+		{
+			name: "no online extend",
+			setup: func(s *fakeServer, cloud *OpenStack) {
+				s.disableOnlineExtend()
+			},
+			expected: &BackendFeatures{APIVersion: "v3", Snapshots: true},
+		},
+		{
+			name: "v2",
+			setup: func(s *fakeServer, cloud *OpenStack) {
+				cloud.bsVersion = bsVersionV2
+			},
+			expected: &BackendFeatures{APIVersion: "v2", Snapshots: true},
+		},
+		{
+			name: "no snapshot API",
+			setup: func(s *fakeServer, cloud *OpenStack) {
+				s.inject("GET /volume/snapshots", fakeServerFault{code: http.StatusNotFound})
+			},
+			expected: &BackendFeatures{APIVersion: "v3", OnlineExtend: true},
+		},
+		{
+			name: "snapshots forbidden",
+			setup: func(s *fakeServer, cloud *OpenStack) {
+				s.inject("GET /volume/snapshots", fakeServerFault{code: http.StatusForbidden})
+			},
+			expected: &BackendFeatures{APIVersion: "v3", OnlineExtend: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+			tt.setup(server, cloud)
+
+			features, err := cloud.ProbeFeatures(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, features)
+		})
+	}
+}
+
+// Test the features are not guessed when the cloud fails to answer
+func TestProbeFeaturesError(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	server.inject("GET /volume/volumes", fakeServerFault{code: http.StatusInternalServerError})
+
+	_, err := cloud.ProbeFeatures(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to list volumes with the microversion volume 3.42")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	instanceCacheSize = 1024
+	instanceCacheTTL  = 10 * time.Second
+	// instance IDs are never reused, a deleted instance stays deleted
+	instanceNotFoundTTL = 1 * time.Minute
+)
+
+// instanceRecord is what the controller knows of a compute instance
+type instanceRecord struct {
+	id string
+	// the 404 returned by Nova for a deleted instance, the fields below are then unset
+	notFound error
+
+	// the zone, the name and the vm_state come from the same request, hasAZ
+	// is set for all of them
+	az             string
+	name           string
+	vmState        string
+	hasAZ          bool
+	attachments    int
+	hasAttachments bool
+
+	expires time.Time
+}
+
+// instanceCache keeps the records of the instances the volumes are attached
+// to, so that validating a publish doesn't cost a Nova request every time.
+// The least recently used records are evicted past size.
+type instanceCache struct {
+	mux         sync.Mutex
+	size        int
+	ttl         time.Duration
+	notFoundTTL time.Duration
+	now         func() time.Time
+	// of *instanceRecord, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newInstanceCache() *instanceCache {
+	return &instanceCache{
+		size:        instanceCacheSize,
+		ttl:         instanceCacheTTL,
+		notFoundTTL: instanceNotFoundTTL,
+		now:         time.Now,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the record of the instance, false if it is not
+// cached or expired
+func (c *instanceCache) get(id string) (instanceRecord, bool) {
+	if c == nil {
+		return instanceRecord{}, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return instanceRecord{}, false
+	}
+	record := elem.Value.(*instanceRecord)
+	if c.now().After(record.expires) {
+		c.remove(elem)
+		return instanceRecord{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return *record, true
+}
+
+// update applies f to the record of the instance, created if needed, and
+// renews it
+func (c *instanceCache) update(id string, f func(*instanceRecord)) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	record := c.record(id)
+	if record.notFound != nil {
+		*record = instanceRecord{id: id}
+	}
+	f(record)
+	record.expires = c.now().Add(c.ttl)
+}
+
+// setNotFound records that Nova returned err, a 404, for the instance
+func (c *instanceCache) setNotFound(id string, err error) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	record := c.record(id)
+	*record = instanceRecord{id: id, notFound: err, expires: c.now().Add(c.notFoundTTL)}
+}
+
+// forgetAttachments drops the attachment count of the instance, after a
+// volume was attached to or detached from it
+func (c *instanceCache) forgetAttachments(id string) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		record := elem.Value.(*instanceRecord)
+		record.attachments, record.hasAttachments = 0, false
+	}
+}
+
+// record returns the record of the instance, adding an empty one in front
+// and evicting the least recently used one if needed. c.mux must be held.
+func (c *instanceCache) record(id string) *instanceRecord {
+	if elem, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*instanceRecord)
+	}
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+	record := &instanceRecord{id: id}
+	c.entries[id] = c.lru.PushFront(record)
+	return record
+}
+
+func (c *instanceCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*instanceRecord).id)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+func TestInstanceCache(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := newInstanceCache()
+	c.now = func() time.Time { return now }
+
+	_, ok := c.get("a")
+	assert.False(ok, "miss")
+
+	c.update("a", func(r *instanceRecord) { r.az, r.hasAZ = "nova", true })
+	c.update("a", func(r *instanceRecord) { r.attachments, r.hasAttachments = 2, true })
+	record, ok := c.get("a")
+	assert.True(ok, "hit")
+	assert.Equal("nova", record.az)
+	assert.Equal(2, record.attachments)
+
+	// an attach or detach only drops the count
+	c.forgetAttachments("a")
+	record, ok = c.get("a")
+	assert.True(ok)
+	assert.True(record.hasAZ)
+	assert.False(record.hasAttachments)
+
+	now = now.Add(instanceCacheTTL + time.Second)
+	_, ok = c.get("a")
+	assert.False(ok, "expired")
+
+	// deleted instances are remembered longer
+	notFound := errors.New("instance a could not be found")
+	c.setNotFound("a", notFound)
+	now = now.Add(instanceCacheTTL + time.Second)
+	record, ok = c.get("a")
+	assert.True(ok)
+	assert.Equal(notFound, record.notFound)
+	now = now.Add(instanceNotFoundTTL)
+	_, ok = c.get("a")
+	assert.False(ok)
+}
+
+func TestInstanceCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newInstanceCache()
+	c.size = 2
+	set := func(id string) {
+		c.update(id, func(r *instanceRecord) { r.az, r.hasAZ = "nova", true })
+	}
+
+	set("a")
+	set("b")
+	// a is now the most recently used
+	_, ok := c.get("a")
+	assert.True(ok)
+	set("c")
+
+	_, ok = c.get("b")
+	assert.False(ok, "least recently used is evicted")
+	_, ok = c.get("a")
+	assert.True(ok)
+	_, ok = c.get("c")
+	assert.True(ok)
+	assert.Equal(2, c.lru.Len())
+	assert.Len(c.entries, 2)
+}
+
+func TestInstanceCacheConcurrent(t *testing.T) {
+	c := newInstanceCache()
+	c.size = 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("instance-%d", (i+j)%12)
+				c.update(id, func(r *instanceRecord) { r.attachments, r.hasAttachments = j, true })
+				c.get(id)
+				c.forgetAttachments(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 8, c.lru.Len())
+	assert.Len(t, c.entries, 8)
+}
+
+func TestGetInstanceAZ(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	az, err := cloud.GetInstanceAZ(ctx, fakeInstanceID)
+	assert.NoError(err)
+	assert.Equal(fakeServerAZ, az)
+
+	// the zone is cached
+	_, err = cloud.GetInstanceAZ(ctx, fakeInstanceID)
+	assert.NoError(err)
+	assert.Equal(1, server.requestCount("GET /compute/servers/{id}"))
+
+	// and survives an attach, unlike the attachment count
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAvailableStatus})
+	_, err = cloud.GetAttachmentCount(ctx, fakeInstanceID)
+	assert.NoError(err)
+	_, err = cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	count, err := cloud.GetAttachmentCount(ctx, fakeInstanceID)
+	assert.NoError(err)
+	assert.Equal(1, count)
+	assert.Equal(2, server.requestCount("GET /compute/servers/{id}/os-volume_attachments"))
+	_, err = cloud.GetInstanceAZ(ctx, fakeInstanceID)
+	assert.NoError(err)
+	assert.Equal(1, server.requestCount("GET /compute/servers/{id}"))
+}
+
+// Test deleted instances are not looked up again
+func TestGetInstanceAZNotFound(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	server.deleteServer(fakeInstanceID)
+
+	for i := 0; i < 3; i++ {
+		_, err := cloud.GetInstanceAZ(ctx, fakeInstanceID)
+		assert.True(t, cpoerrors.IsNotFound(err), "not found: %v", err)
+		_, err = cloud.GetAttachmentCount(ctx, fakeInstanceID)
+		assert.True(t, cpoerrors.IsNotFound(err), "not found: %v", err)
+	}
+	assert.Equal(t, 1, server.requestCount("GET /compute/servers/{id}"))
+	assert.Equal(t, 0, server.requestCount("GET /compute/servers/{id}/os-volume_attachments"))
+}
@@ -5,22 +5,55 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
+
+	utilmetadata "k8s.io/cloud-provider-openstack/pkg/util/metadata"
+	"k8s.io/klog"
 )
 
 const (
 	defaultMetadataVersion = "latest"
 	metadataURLTemplate    = "http://169.254.169.254/openstack/%s/meta_data.json"
+	// the metadata service is skipped for a while once it failed that many times in a row
+	metadataFailureThreshold = 3
+	metadataCoolDown         = 1 * time.Minute
 )
 
+// metadataCircuit keeps an unreachable metadata service from adding an HTTP
+// timeout to every call, it is only a fallback of the node service
+var metadataCircuit = newCircuitBreaker("Metadata service", metadataFailureThreshold, metadataCoolDown, metadataCircuitOpen)
+
 // IMetadata implements GetInstanceID & GetAvailabilityZone
 type IMetadata interface {
 	GetInstanceID() (string, error)
 	GetAvailabilityZone() (string, error)
 }
 
-type metadata struct {
+// metadataInfo is what the driver reads of meta_data.json
+type metadataInfo struct {
 	UUID             string
-	AvailabilityZone string "json:\"availability_zone\""
+	AvailabilityZone string `json:"availability_zone"`
+}
+
+// metadata reads the instance metadata once for all its getters: the first
+// call fetches it, concurrent calls wait for that fetch, and later ones use
+// the result, the instance ID and zone not changing while the plugin runs.
+// A failed fetch is not kept, the next call tries again.
+type metadata struct {
+	url string
+
+	mux      sync.Mutex
+	info     *metadataInfo
+	fetching *metadataFetch
+}
+
+// metadataFetch is a fetch of the metadata in progress, done is closed once
+// info and err are set
+type metadataFetch struct {
+	done chan struct{}
+	info metadataInfo
+	err  error
 }
 
 // MetadataService instance of IMetadata
@@ -30,19 +63,25 @@ var MetadataService IMetadata
 func GetMetadataProvider() (IMetadata, error) {
 
 	if MetadataService == nil {
-		MetadataService = &metadata{}
+		MetadataService = NewMetadataService(fmt.Sprintf(metadataURLTemplate, defaultMetadataVersion))
 	}
 	return MetadataService, nil
 }
 
+// NewMetadataService returns the IMetadata reading meta_data.json at
+// metadataURL
+func NewMetadataService(metadataURL string) IMetadata {
+	return &metadata{url: metadataURL}
+}
+
 func getMetadata(metadataURL string) ([]byte, error) {
-	resp, err := http.Get(metadataURL)
+	resp, err := utilmetadata.Client().Get(metadataURL)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, err
+		return nil, fmt.Errorf("unexpected status code when reading metadata from %s: %s", metadataURL, resp.Status)
 	}
 
 	md, err := ioutil.ReadAll(resp.Body)
@@ -53,11 +92,15 @@ func getMetadata(metadataURL string) ([]byte, error) {
 }
 
 // getMetaDataInfo retrieves from metadata service and returns
-// info in metadata struct
-func getMetaDataInfo() (metadata, error) {
-	metadataURL := fmt.Sprintf(metadataURLTemplate, defaultMetadataVersion)
-	var m metadata
-	md, err := getMetadata(metadataURL)
+// info in metadataInfo struct
+func getMetaDataInfo(metadataURL string) (metadataInfo, error) {
+	var m metadataInfo
+	var md []byte
+	err := metadataCircuit.call(func() error {
+		var err error
+		md, err = getMetadata(metadataURL)
+		return err
+	})
 	if err != nil {
 		return m, err
 	}
@@ -68,20 +111,69 @@ func getMetaDataInfo() (metadata, error) {
 	return m, nil
 }
 
+// get returns the metadata, fetching it unless it was already or is being
+func (m *metadata) get() (metadataInfo, error) {
+	m.mux.Lock()
+	if m.info != nil {
+		info := *m.info
+		m.mux.Unlock()
+		return info, nil
+	}
+	if f := m.fetching; f != nil {
+		m.mux.Unlock()
+		<-f.done
+		return f.info, f.err
+	}
+	f := &metadataFetch{done: make(chan struct{})}
+	m.fetching = f
+	m.mux.Unlock()
+
+	f.info, f.err = getMetaDataInfo(m.url)
+
+	m.mux.Lock()
+	if f.err == nil {
+		m.info = &f.info
+	}
+	m.fetching = nil
+	m.mux.Unlock()
+	close(f.done)
+	return f.info, f.err
+}
+
 // GetInstanceID from metadata service
 func (m *metadata) GetInstanceID() (string, error) {
-	md, err := getMetaDataInfo()
+	md, err := m.get()
 	if err != nil {
 		return "", err
 	}
+	if md.UUID == "" {
+		return "", fmt.Errorf("no instance ID in the metadata from %s", m.url)
+	}
 	return md.UUID, nil
 }
 
 // GetAvailabilityZone returns zone from metadata service
 func (m *metadata) GetAvailabilityZone() (string, error) {
-	md, err := getMetaDataInfo()
+	md, err := m.get()
 	if err != nil {
 		return "", err
 	}
 	return md.AvailabilityZone, nil
 }
+
+// GetDevicePathFromMetadata looks the device of the volume up in the device
+// metadata of the instance, used on Hyper-V hosts which cannot set the serial
+// ID of the disks. It returns "" if the device or the metadata is not found.
+func GetDevicePathFromMetadata(volumeID string) string {
+	var md *utilmetadata.Metadata
+	err := metadataCircuit.call(func() error {
+		var err error
+		md, err = utilmetadata.GetFromMetadataService(defaultMetadataVersion)
+		return err
+	})
+	if err != nil {
+		klog.V(4).Infof("Could not retrieve instance metadata: %v", err)
+		return ""
+	}
+	return md.DevicePath(volumeID)
+}
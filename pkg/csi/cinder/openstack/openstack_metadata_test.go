@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const metadataRequest = "GET /openstack/latest/meta_data.json"
+
+// Test the instance ID and the zone come from a single request
+func TestMetadataFetchedOnce(t *testing.T) {
+	server, _ := newFakeServer(t)
+	defer server.close()
+	md := NewMetadataService(server.server.URL + "/openstack/latest/meta_data.json")
+
+	id, err := md.GetInstanceID()
+	assert.NoError(t, err)
+	assert.Equal(t, fakeServerInstanceID, id)
+	az, err := md.GetAvailabilityZone()
+	assert.NoError(t, err)
+	assert.Equal(t, fakeServerAZ, az)
+
+	assert.Equal(t, 1, server.requestCount(metadataRequest))
+}
+
+// Test concurrent first calls share one request
+func TestMetadataConcurrent(t *testing.T) {
+	server, _ := newFakeServer(t)
+	defer server.close()
+	md := NewMetadataService(server.server.URL + "/openstack/latest/meta_data.json")
+	server.inject(metadataRequest, fakeServerFault{delay: 50 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				id, err := md.GetInstanceID()
+				assert.NoError(t, err)
+				assert.Equal(t, fakeServerInstanceID, id)
+				return
+			}
+			az, err := md.GetAvailabilityZone()
+			assert.NoError(t, err)
+			assert.Equal(t, fakeServerAZ, az)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, server.requestCount(metadataRequest))
+}
+
+// Test a failed fetch fails every getter waiting for it, and is retried by
+// the next call
+func TestMetadataFailureNotKept(t *testing.T) {
+	server, _ := newFakeServer(t)
+	defer server.close()
+	md := NewMetadataService(server.server.URL + "/openstack/latest/meta_data.json")
+	server.inject(metadataRequest, fakeServerFault{code: http.StatusServiceUnavailable})
+
+	_, err := md.GetInstanceID()
+	assert.Error(t, err)
+
+	az, err := md.GetAvailabilityZone()
+	assert.NoError(t, err)
+	assert.Equal(t, fakeServerAZ, az)
+	_, err = md.GetInstanceID()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, server.requestCount(metadataRequest))
+}
+
+// Test metadata without an instance ID is an error rather than an empty ID
+func TestMetadataNoInstanceID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"availability_zone": "nova"}`)
+	}))
+	defer server.Close()
+	md := NewMetadataService(server.URL + "/openstack/latest/meta_data.json")
+
+	id, err := md.GetInstanceID()
+	assert.Error(t, err)
+	assert.Equal(t, "", id)
+	az, err := md.GetAvailabilityZone()
+	assert.NoError(t, err)
+	assert.Equal(t, "nova", az)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+const (
+	metricsNamespace = "cinder_csi"
+	metricsSubsystem = "openstack"
+)
+
+var (
+	rateLimitWaitingRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "rate_limit_waiting_requests",
+			Help:      "Number of OpenStack API requests waiting for the client-side rate limiter",
+		},
+		[]string{"bucket"},
+	)
+
+	metadataCircuitOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "metadata_circuit_open",
+			Help:      "1 while the calls to the metadata service are skipped after consecutive failures",
+		},
+	)
+)
+
+// RegisterMetrics registers the metrics of the OpenStack API and metadata service calls
+func RegisterMetrics() {
+	if err := prometheus.Register(rateLimitWaitingRequests); err != nil {
+		klog.V(5).Infof("unable to register for rate limit metrics")
+	}
+	if err := prometheus.Register(metadataCircuitOpen); err != nil {
+		klog.V(5).Infof("unable to register for metadata circuit metrics")
+	}
+}
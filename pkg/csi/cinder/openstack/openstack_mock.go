@@ -17,6 +17,7 @@ limitations under the License.
 package openstack
 
 import (
+	"context"
 	"strings"
 
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
@@ -53,19 +54,19 @@ type OpenStackMock struct {
 }
 
 // AttachVolume provides a mock function with given fields: instanceID, volumeID
-func (_m *OpenStackMock) AttachVolume(instanceID string, volumeID string) (string, error) {
-	ret := _m.Called(instanceID, volumeID)
+func (_m *OpenStackMock) AttachVolume(ctx context.Context, instanceID string, volumeID string) (string, error) {
+	ret := _m.Called(ctx, instanceID, volumeID)
 
 	var r0 string
-	if rf, ok := ret.Get(0).(func(string, string) string); ok {
-		r0 = rf(instanceID, volumeID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) string); ok {
+		r0 = rf(ctx, instanceID, volumeID)
 	} else {
 		r0 = ret.Get(0).(string)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(instanceID, volumeID)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, instanceID, volumeID)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -73,48 +74,55 @@ func (_m *OpenStackMock) AttachVolume(instanceID string, volumeID string) (strin
 	return r0, r1
 }
 
-// CreateVolume provides a mock function with given fields: name, size, vtype, availability, tags
-func (_m *OpenStackMock) CreateVolume(name string, size int, vtype string, availability string, snapshotID string, tags *map[string]string) (string, string, int, error) {
-	ret := _m.Called(name, size, vtype, availability, snapshotID, tags)
+// AttachFetchedVolume provides a mock function with given fields: instanceID, volume
+func (_m *OpenStackMock) AttachFetchedVolume(ctx context.Context, instanceID string, volume *Volume) (string, error) {
+	ret := _m.Called(ctx, instanceID, volume)
 
 	var r0 string
-	if rf, ok := ret.Get(0).(func(string, int, string, string, string, *map[string]string) string); ok {
-		r0 = rf(name, size, vtype, availability, snapshotID, tags)
+	if rf, ok := ret.Get(0).(func(context.Context, string, *Volume) string); ok {
+		r0 = rf(ctx, instanceID, volume)
 	} else {
 		r0 = ret.Get(0).(string)
 	}
 
-	var r1 string
-	if rf, ok := ret.Get(1).(func(string, int, string, string, string, *map[string]string) string); ok {
-		r1 = rf(name, size, vtype, availability, snapshotID, tags)
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, *Volume) error); ok {
+		r1 = rf(ctx, instanceID, volume)
 	} else {
-		r1 = ret.Get(1).(string)
+		r1 = ret.Error(1)
 	}
 
-	var r2 int
-	if rf, ok := ret.Get(2).(func(string, int, string, string, string, *map[string]string) int); ok {
-		r2 = rf(name, size, vtype, availability, snapshotID, tags)
-	} else {
-		r2 = ret.Get(2).(int)
+	return r0, r1
+}
+
+// CreateVolume provides a mock function with given fields: name, size, vtype, availability, tags
+func (_m *OpenStackMock) CreateVolume(ctx context.Context, name string, size int, vtype string, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error) {
+	ret := _m.Called(ctx, name, size, vtype, availability, snapshotID, description, tags)
+
+	var r0 *Volume
+	if rf, ok := ret.Get(0).(func(context.Context, string, int, string, string, string, string, *map[string]string) *Volume); ok {
+		r0 = rf(ctx, name, size, vtype, availability, snapshotID, description, tags)
+	} else if ret.Get(0) != nil {
+		r0 = ret.Get(0).(*Volume)
 	}
 
-	var r3 error
-	if rf, ok := ret.Get(3).(func(string, int, string, string, string, *map[string]string) error); ok {
-		r3 = rf(name, size, vtype, availability, snapshotID, tags)
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int, string, string, string, string, *map[string]string) error); ok {
+		r1 = rf(ctx, name, size, vtype, availability, snapshotID, description, tags)
 	} else {
-		r3 = ret.Error(3)
+		r1 = ret.Error(1)
 	}
 
-	return r0, r1, r2, r3
+	return r0, r1
 }
 
-// DeleteVolume provides a mock function with given fields: volumeID
-func (_m *OpenStackMock) DeleteVolume(volumeID string) error {
-	ret := _m.Called(volumeID)
+// DeleteVolume provides a mock function with given fields: volumeID, knownDetached
+func (_m *OpenStackMock) DeleteVolume(ctx context.Context, volumeID string, knownDetached bool) error {
+	ret := _m.Called(ctx, volumeID, knownDetached)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(volumeID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, bool) error); ok {
+		r0 = rf(ctx, volumeID, knownDetached)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -123,12 +131,12 @@ func (_m *OpenStackMock) DeleteVolume(volumeID string) error {
 }
 
 // DetachVolume provides a mock function with given fields: instanceID, volumeID
-func (_m *OpenStackMock) DetachVolume(instanceID string, volumeID string) error {
-	ret := _m.Called(instanceID, volumeID)
+func (_m *OpenStackMock) DetachVolume(ctx context.Context, instanceID string, volumeID string) error {
+	ret := _m.Called(ctx, instanceID, volumeID)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(instanceID, volumeID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, instanceID, volumeID)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -137,19 +145,19 @@ func (_m *OpenStackMock) DetachVolume(instanceID string, volumeID string) error
 }
 
 // GetAttachmentDiskPath provides a mock function with given fields: instanceID, volumeID
-func (_m *OpenStackMock) GetAttachmentDiskPath(instanceID string, volumeID string) (string, error) {
-	ret := _m.Called(instanceID, volumeID)
+func (_m *OpenStackMock) GetAttachmentDiskPath(ctx context.Context, instanceID string, volumeID string) (string, error) {
+	ret := _m.Called(ctx, instanceID, volumeID)
 
 	var r0 string
-	if rf, ok := ret.Get(0).(func(string, string) string); ok {
-		r0 = rf(instanceID, volumeID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) string); ok {
+		r0 = rf(ctx, instanceID, volumeID)
 	} else {
 		r0 = ret.Get(0).(string)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(instanceID, volumeID)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, instanceID, volumeID)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -158,26 +166,33 @@ func (_m *OpenStackMock) GetAttachmentDiskPath(instanceID string, volumeID strin
 }
 
 // WaitDiskAttached provides a mock function with given fields: instanceID, volumeID
-func (_m *OpenStackMock) WaitDiskAttached(instanceID string, volumeID string) error {
-	ret := _m.Called(instanceID, volumeID)
+func (_m *OpenStackMock) WaitDiskAttached(ctx context.Context, instanceID string, volumeID string) (Volume, error) {
+	ret := _m.Called(ctx, instanceID, volumeID)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(instanceID, volumeID)
+	var r0 Volume
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) Volume); ok {
+		r0 = rf(ctx, instanceID, volumeID)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(Volume)
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, instanceID, volumeID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // WaitDiskDetached provides a mock function with given fields: instanceID, volumeID
-func (_m *OpenStackMock) WaitDiskDetached(instanceID string, volumeID string) error {
-	ret := _m.Called(instanceID, volumeID)
+func (_m *OpenStackMock) WaitDiskDetached(ctx context.Context, instanceID string, volumeID string) error {
+	ret := _m.Called(ctx, instanceID, volumeID)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(instanceID, volumeID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, instanceID, volumeID)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -186,7 +201,7 @@ func (_m *OpenStackMock) WaitDiskDetached(instanceID string, volumeID string) er
 }
 
 // GetVolumesByName provides a mock function with given fields: name
-func (_m *OpenStackMock) GetVolumesByName(name string) ([]Volume, error) {
+func (_m *OpenStackMock) GetVolumesByName(ctx context.Context, name string) ([]Volume, error) {
 	var vlist []Volume
 	if strings.Contains(name, "fake-duplicate") {
 		vlist = append(vlist, fakeVol1)
@@ -200,36 +215,36 @@ func (_m *OpenStackMock) GetVolumesByName(name string) ([]Volume, error) {
 	return vlist, nil
 }
 
-// ListSnapshots provides a mock function with given fields: limit, offset, filters
-func (_m *OpenStackMock) ListSnapshots(limit int, offset int, filters map[string]string) ([]snapshots.Snapshot, error) {
-	ret := _m.Called(limit, offset, filters)
+// ListSnapshots provides a mock function with given fields: limit, marker, filters
+func (_m *OpenStackMock) ListSnapshots(ctx context.Context, limit int, marker string, filters map[string]string) ([]snapshots.Snapshot, string, error) {
+	ret := _m.Called(ctx, limit, marker, filters)
 
 	var r0 []snapshots.Snapshot
-	if rf, ok := ret.Get(0).(func(int, int, map[string]string) []snapshots.Snapshot); ok {
-		r0 = rf(limit, offset, filters)
-	} else {
-		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]snapshots.Snapshot)
-		}
+	if rf, ok := ret.Get(0).(func(context.Context, int, string, map[string]string) []snapshots.Snapshot); ok {
+		r0 = rf(ctx, limit, marker, filters)
+	} else if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]snapshots.Snapshot)
 	}
 
-	var r1 error
-	if rf, ok := ret.Get(1).(func(int, int, map[string]string) error); ok {
-		r1 = rf(limit, offset, filters)
+	r1 := ret.String(1)
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, int, string, map[string]string) error); ok {
+		r2 = rf(ctx, limit, marker, filters)
 	} else {
-		r1 = ret.Error(1)
+		r2 = ret.Error(2)
 	}
 
-	return r0, r1
+	return r0, r1, r2
 }
 
 // CreateSnapshot provides a mock function with given fields: name, volID, description, tags
-func (_m *OpenStackMock) CreateSnapshot(name string, volID string, description string, tags *map[string]string) (*snapshots.Snapshot, error) {
-	ret := _m.Called(name, volID, description, tags)
+func (_m *OpenStackMock) CreateSnapshot(ctx context.Context, name string, volID string, description string, tags *map[string]string) (*snapshots.Snapshot, error) {
+	ret := _m.Called(ctx, name, volID, description, tags)
 
 	var r0 *snapshots.Snapshot
-	if rf, ok := ret.Get(0).(func(string, string, string, *map[string]string) *snapshots.Snapshot); ok {
-		r0 = rf(name, volID, description, tags)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, *map[string]string) *snapshots.Snapshot); ok {
+		r0 = rf(ctx, name, volID, description, tags)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*snapshots.Snapshot)
@@ -237,8 +252,8 @@ func (_m *OpenStackMock) CreateSnapshot(name string, volID string, description s
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string, string, *map[string]string) error); ok {
-		r1 = rf(name, volID, description, tags)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, *map[string]string) error); ok {
+		r1 = rf(ctx, name, volID, description, tags)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -247,12 +262,12 @@ func (_m *OpenStackMock) CreateSnapshot(name string, volID string, description s
 }
 
 // DeleteSnapshot provides a mock function with given fields: snapID
-func (_m *OpenStackMock) DeleteSnapshot(snapID string) error {
-	ret := _m.Called(snapID)
+func (_m *OpenStackMock) DeleteSnapshot(ctx context.Context, snapID string) error {
+	ret := _m.Called(ctx, snapID)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(snapID)
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, snapID)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -261,13 +276,13 @@ func (_m *OpenStackMock) DeleteSnapshot(snapID string) error {
 }
 
 // ListVolumes provides a mock function without param
-func (_m *OpenStackMock) ListVolumes() ([]Volume, error) {
-	ret := _m.Called()
+func (_m *OpenStackMock) ListVolumes(ctx context.Context) ([]Volume, error) {
+	ret := _m.Called(ctx)
 	var vlist []Volume
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func() error); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -275,10 +290,50 @@ func (_m *OpenStackMock) ListVolumes() ([]Volume, error) {
 	return vlist, r0
 }
 
-func (_m *OpenStackMock) GetSnapshotByNameAndVolumeID(n string, volumeId string) ([]snapshots.Snapshot, error) {
-	var slist []snapshots.Snapshot
-	slist = append(slist, fakeSnapshot)
-	return slist, nil
+// ListVolumesWithPage provides a mock function with given fields: limit, marker, filters
+func (_m *OpenStackMock) ListVolumesWithPage(ctx context.Context, limit int, marker string, filters map[string]string) ([]Volume, string, error) {
+	ret := _m.Called(ctx, limit, marker, filters)
+
+	var r0 []Volume
+	if rf, ok := ret.Get(0).(func(context.Context, int, string, map[string]string) []Volume); ok {
+		r0 = rf(ctx, limit, marker, filters)
+	} else if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]Volume)
+	}
+
+	r1 := ret.String(1)
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, int, string, map[string]string) error); ok {
+		r2 = rf(ctx, limit, marker, filters)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// GetSnapshotsByName provides a mock function with given fields: n
+func (_m *OpenStackMock) GetSnapshotsByName(ctx context.Context, n string) ([]snapshots.Snapshot, error) {
+	ret := _m.Called(ctx, n)
+
+	var r0 []snapshots.Snapshot
+	if rf, ok := ret.Get(0).(func(context.Context, string) []snapshots.Snapshot); ok {
+		r0 = rf(ctx, n)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]snapshots.Snapshot)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, n)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 func (_m *OpenStackMock) GetAvailabilityZone() (string, error) {
@@ -304,17 +359,280 @@ func (_m *OpenStackMock) GetInstanceID() (string, error) {
 	return "", nil
 }
 
-func (_m *OpenStackMock) GetSnapshotByID(snapshotID string) (*snapshots.Snapshot, error) {
+func (_m *OpenStackMock) GetSnapshotByID(ctx context.Context, snapshotID string) (*snapshots.Snapshot, error) {
 
 	return &fakeSnapshot, nil
 }
 
-func (_m *OpenStackMock) WaitSnapshotReady(snapshotID string) error {
-	ret := _m.Called(snapshotID)
+func (_m *OpenStackMock) WaitSnapshotReady(ctx context.Context, snapshotID string) error {
+	ret := _m.Called(ctx, snapshotID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, snapshotID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// WaitVolumeCreated provides a mock function with given fields: volumeID
+func (_m *OpenStackMock) WaitVolumeCreated(ctx context.Context, volumeID string) error {
+	ret := _m.Called(ctx, volumeID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, volumeID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetBlockStorageOpts provides a mock function with given fields:
+func (_m *OpenStackMock) GetBlockStorageOpts() BlockStorageOpts {
+	ret := _m.Called()
+
+	var r0 BlockStorageOpts
+	if rf, ok := ret.Get(0).(func() BlockStorageOpts); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(BlockStorageOpts)
+	}
+
+	return r0
+}
+
+// GetVolume provides a mock function with given fields: volumeID
+func (_m *OpenStackMock) GetVolume(ctx context.Context, volumeID string) (Volume, error) {
+	ret := _m.Called(ctx, volumeID)
+
+	var r0 Volume
+	if rf, ok := ret.Get(0).(func(context.Context, string) Volume); ok {
+		r0 = rf(ctx, volumeID)
+	} else {
+		r0 = ret.Get(0).(Volume)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, volumeID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ExpandVolume provides a mock function with given fields: volumeID, newSize
+func (_m *OpenStackMock) ExpandVolume(ctx context.Context, volumeID string, newSize int) error {
+	ret := _m.Called(ctx, volumeID, newSize)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, int) error); ok {
+		r0 = rf(ctx, volumeID, newSize)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetVolumeMetadata provides a mock function with given fields: volumeID, metadata
+func (_m *OpenStackMock) SetVolumeMetadata(ctx context.Context, volumeID string, metadata map[string]string) error {
+	ret := _m.Called(ctx, volumeID, metadata)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, map[string]string) error); ok {
+		r0 = rf(ctx, volumeID, metadata)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetVolumeImageMetadata provides a mock function with given fields: ctx, volumeID, metadata
+func (_m *OpenStackMock) SetVolumeImageMetadata(ctx context.Context, volumeID string, metadata map[string]string) error {
+	ret := _m.Called(ctx, volumeID, metadata)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, map[string]string) error); ok {
+		r0 = rf(ctx, volumeID, metadata)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RenameVolume provides a mock function with given fields: ctx, volumeID, name
+func (_m *OpenStackMock) RenameVolume(ctx context.Context, volumeID, name string) error {
+	ret := _m.Called(ctx, volumeID, name)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, volumeID, name)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetInstanceAZ provides a mock function with given fields: instanceID
+func (_m *OpenStackMock) GetInstanceAZ(ctx context.Context, instanceID string) (string, error) {
+	ret := _m.Called(ctx, instanceID)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string) string); ok {
+		r0 = rf(ctx, instanceID)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, instanceID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetInstanceState provides a mock function with given fields: instanceID
+func (_m *OpenStackMock) GetInstanceState(ctx context.Context, instanceID string) (string, error) {
+	ret := _m.Called(ctx, instanceID)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string) string); ok {
+		r0 = rf(ctx, instanceID)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, instanceID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetAttachmentCount provides a mock function with given fields: instanceID
+func (_m *OpenStackMock) GetAttachmentCount(ctx context.Context, instanceID string) (int, error) {
+	ret := _m.Called(ctx, instanceID)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, string) int); ok {
+		r0 = rf(ctx, instanceID)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, instanceID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CheckBlockStorageAPI provides a mock function with given fields:
+func (_m *OpenStackMock) CheckBlockStorageAPI(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetAvailabilityZones provides a mock function with given fields:
+func (_m *OpenStackMock) GetAvailabilityZones(ctx context.Context) ([]string, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ProbeFeatures provides a mock function with given fields:
+func (_m *OpenStackMock) ProbeFeatures(ctx context.Context) (*BackendFeatures, error) {
+	ret := _m.Called(ctx)
+
+	var r0 *BackendFeatures
+	if rf, ok := ret.Get(0).(func(context.Context) *BackendFeatures); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*BackendFeatures)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetAvailableCapacity provides a mock function with given fields: volumeType
+func (_m *OpenStackMock) GetAvailableCapacity(ctx context.Context, volumeType string) (int64, error) {
+	ret := _m.Called(ctx, volumeType)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string) int64); ok {
+		r0 = rf(ctx, volumeType)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, volumeType)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FailoverReplication provides a mock function with given fields: ctx, host, backendID
+func (_m *OpenStackMock) FailoverReplication(ctx context.Context, host, backendID string) error {
+	ret := _m.Called(ctx, host, backendID)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(snapshotID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, host, backendID)
 	} else {
 		r0 = ret.Error(0)
 	}
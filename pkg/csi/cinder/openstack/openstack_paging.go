@@ -0,0 +1,187 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	volumesv2 "github.com/gophercloud/gophercloud/openstack/blockstorage/v2/volumes"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// Filters of ListVolumesWithPage
+const (
+	VolumeNameFilter   = "name"
+	VolumeStatusFilter = "status"
+	// VolumeMetadataFilterPrefix prefixes the metadata keys the volumes
+	// must have with the given value, e.g. metadata.cinder.csi.openstack.org/cluster
+	VolumeMetadataFilterPrefix = "metadata."
+)
+
+// InvalidMarkerError is returned when listing volumes or snapshots after a
+// marker Cinder doesn't know, e.g. one deleted since the previous page was
+// listed
+type InvalidMarkerError struct {
+	Marker string
+	Err    error
+}
+
+func (e *InvalidMarkerError) Error() string {
+	return fmt.Sprintf("invalid marker %q: %v", e.Marker, e.Err)
+}
+
+// volumeListOpts are the options of a volume listing common to both Block
+// Storage API versions
+type volumeListOpts struct {
+	name     string
+	status   string
+	metadata map[string]string
+	// ID of the snapshot the volumes were created from
+	snapshotID string
+	limit      int
+	marker     string
+}
+
+func parseVolumeFilters(filters map[string]string) (volumeListOpts, error) {
+	var opts volumeListOpts
+	for k, v := range filters {
+		switch {
+		case k == VolumeNameFilter:
+			opts.name = v
+		case k == VolumeStatusFilter:
+			opts.status = v
+		case strings.HasPrefix(k, VolumeMetadataFilterPrefix) && len(k) > len(VolumeMetadataFilterPrefix):
+			if opts.metadata == nil {
+				opts.metadata = make(map[string]string)
+			}
+			opts.metadata[strings.TrimPrefix(k, VolumeMetadataFilterPrefix)] = v
+		default:
+			return volumeListOpts{}, fmt.Errorf("unsupported volume filter %q", k)
+		}
+	}
+	return opts, nil
+}
+
+// matches returns whether the volume passes the filters of opts
+func (opts volumeListOpts) matches(vol Volume) bool {
+	if opts.name != "" && vol.Name != opts.name {
+		return false
+	}
+	if opts.status != "" && vol.Status != opts.status {
+		return false
+	}
+	if opts.snapshotID != "" && vol.SnapshotID != opts.snapshotID {
+		return false
+	}
+	for k, v := range opts.metadata {
+		if vol.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// volumePager returns the pager listing the volumes with the Block Storage
+// API version in use
+func (os *OpenStack) volumePager(ctx context.Context, opts volumeListOpts) pagination.Pager {
+	client := os.blockStorageClient(ctx)
+	if os.bsVersion == bsVersionV2 {
+		return volumesv2.List(client, snapshotListOpts{volumesv2.ListOpts{
+			Name:     opts.name,
+			Status:   opts.status,
+			Metadata: opts.metadata,
+			Limit:    opts.limit,
+			Marker:   opts.marker,
+		}, opts.snapshotID})
+	}
+	return volumes.List(client, snapshotListOpts{volumes.ListOpts{
+		Name:     opts.name,
+		Status:   opts.status,
+		Metadata: opts.metadata,
+		Limit:    opts.limit,
+		Marker:   opts.marker,
+	}, opts.snapshotID})
+}
+
+// volumeListQuery is the ListOptsBuilder of both API versions
+type volumeListQuery interface {
+	ToVolumeListQuery() (string, error)
+}
+
+// snapshotListOpts adds the snapshot_id filter, which the gophercloud
+// ListOpts lack, to the query of a volume listing
+type snapshotListOpts struct {
+	volumeListQuery
+	snapshotID string
+}
+
+func (opts snapshotListOpts) ToVolumeListQuery() (string, error) {
+	q, err := opts.volumeListQuery.ToVolumeListQuery()
+	if err != nil || opts.snapshotID == "" {
+		return q, err
+	}
+	filter := url.Values{"snapshot_id": {opts.snapshotID}}.Encode()
+	if q == "" {
+		return "?" + filter, nil
+	}
+	return q + "&" + filter, nil
+}
+
+// pageVolumes returns the volumes of a page of either API version
+func pageVolumes(page pagination.Page) ([]Volume, error) {
+	var vlist []Volume
+	if _, ok := page.(volumesv2.VolumePage); ok {
+		vols, err := volumesv2.ExtractVolumes(page)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vols {
+			vlist = append(vlist, *volumeFromV2(&v))
+		}
+		return vlist, nil
+	}
+
+	vols, err := volumes.ExtractVolumes(page)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		vlist = append(vlist, *volumeFromV3(&v))
+	}
+	return vlist, nil
+}
+
+// pageMarker returns the marker of the next page link of Cinder, empty if
+// there is no next page
+func pageMarker(nextURL string) (string, error) {
+	if nextURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(nextURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page link %q: %v", nextURL, err)
+	}
+	marker := u.Query().Get("marker")
+	if marker == "" {
+		return "", fmt.Errorf("next page link %q has no marker", nextURL)
+	}
+	return marker, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	readBucket  = "read"
+	writeBucket = "write"
+)
+
+// rateLimiter caps the rate of the requests sent to the cloud, so that the
+// driver doesn't get its service user throttled. Reads and writes are limited
+// by separate token buckets, a nil bucket doesn't limit.
+type rateLimiter struct {
+	rt    http.RoundTripper
+	read  *rate.Limiter
+	write *rate.Limiter
+}
+
+func (l *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket, limiter := writeBucket, l.write
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		bucket, limiter = readBucket, l.read
+	}
+	if limiter != nil {
+		waiting := rateLimitWaitingRequests.WithLabelValues(bucket)
+		waiting.Inc()
+		err := limiter.Wait(req.Context())
+		waiting.Dec()
+		if err != nil {
+			return nil, waitTokenError(req.Context(), err)
+		}
+	}
+	return l.rt.RoundTrip(req)
+}
+
+// waitTokenError returns the error of a wait for a token of the request
+// context ctx. The wait fails before ctx is done when its deadline would pass
+// first, which is reported as the deadline itself, so that callers checking
+// for the errors of ctx see them unwrapped.
+func waitTokenError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// newLimiter returns a token bucket refilled at qps, nil when qps is 0
+func newLimiter(qps float64, burst int) *rate.Limiter {
+	if qps == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(qps), burst)
+}
+
+// withRateLimits wraps the transport of client with a rateLimiter configured
+// by opts, nothing is limited when neither rate is set
+func withRateLimits(client *http.Client, opts BlockStorageOpts) {
+	if opts.APIReadQPS == 0 && opts.APIWriteQPS == 0 {
+		return
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	client.Transport = &rateLimiter{
+		rt:    rt,
+		read:  newLimiter(opts.APIReadQPS, opts.APIReadBurst),
+		write: newLimiter(opts.APIWriteQPS, opts.APIWriteBurst),
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+// limitRequests installs a rateLimiter under the retries of the fake server
+func limitRequests(cloud *OpenStack, read, write *rate.Limiter) {
+	retries := retryTransportOf(cloud)
+	retries.rt = &rateLimiter{rt: retries.rt, read: read, write: write}
+}
+
+func waitingRequests(t *testing.T, bucket string) float64 {
+	return gaugeValue(t, rateLimitWaitingRequests.WithLabelValues(bucket))
+}
+
+// Test the requests are delayed once the bucket is drained
+func TestRateLimitDelays(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAvailableStatus})
+	limitRequests(cloud, rate.NewLimiter(10, 2), nil)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err := cloud.GetVolume(ctx, vol.ID)
+		assert.NoError(err)
+	}
+	// the burst of 2 goes through, the 2 other requests wait 100ms each
+	assert.True(time.Since(start) >= 150*time.Millisecond, "4 reads took %v", time.Since(start))
+	assert.Equal(4, server.requestCount("GET /volume/volumes/{id}"))
+
+	// writes are not limited by the read bucket
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	start = time.Now()
+	assert.NoError(cloud.extendVolume(ctx, volume, 2))
+	assert.True(time.Since(start) < 100*time.Millisecond, "extend took %v", time.Since(start))
+}
+
+// Test cancelling the context interrupts the wait for a token
+func TestRateLimitCancel(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	// one request every 10 seconds
+	limitRequests(cloud, rate.NewLimiter(0.1, 1), nil)
+
+	_, err := cloud.GetVolume(context.Background(), vol.ID)
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		_, err := cloud.GetVolume(ctx, vol.ID)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(float64(1), waitingRequests(t, readBucket))
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Error(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the wait for a token was not interrupted")
+	}
+	assert.True(time.Since(start) < time.Second, "interrupted after %v", time.Since(start))
+	assert.Equal(float64(0), waitingRequests(t, readBucket))
+	assert.Equal(1, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+// Test a request that cannot get a token before its context is done fails
+// with the error of the context
+func TestRateLimitContextErrors(t *testing.T) {
+	// one request every 10 seconds, the burst is used
+	limiter := rate.NewLimiter(0.1, 1)
+	limiter.Allow()
+	l := &rateLimiter{rt: http.DefaultTransport, read: limiter}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/volumes", nil)
+	_, err := l.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, context.Canceled, err)
+
+	// the deadline would pass before the next token
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = l.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestWithRateLimits(t *testing.T) {
+	client := &http.Client{}
+	withRateLimits(client, defaultBlockStorageOpts())
+	assert.Nil(t, client.Transport, "limits are off by default")
+
+	opts := defaultBlockStorageOpts()
+	opts.APIWriteQPS, opts.APIWriteBurst = 5, 10
+	withRateLimits(client, opts)
+	limiter, ok := client.Transport.(*rateLimiter)
+	if assert.True(t, ok) {
+		assert.Nil(t, limiter.read)
+		assert.Equal(t, rate.Limit(5), limiter.write.Limit())
+		assert.Equal(t, 10, limiter.write.Burst())
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gophercloud/gophercloud"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+)
+
+const (
+	// the replication statuses of the volumes of replicated volume types
+	ReplicationEnabledStatus     = "enabled"
+	ReplicationFailingOverStatus = "failing-over"
+	ReplicationFailedOverStatus  = "failed-over"
+)
+
+// isFailingOver returns whether the backend of the volume is failing over to
+// its replica. Its status may then be anything until the failover completes,
+// so waits keep polling rather than failing.
+func isFailingOver(volume Volume) bool {
+	return volume.ReplicationStatus == ReplicationFailingOverStatus
+}
+
+// FailoverReplication fails the replicated volumes of the cinder-volume host,
+// e.g. cinder@ceph, over to the backend backendID, or to the one picked by
+// Cinder if empty. Their replication status is failing-over until Cinder is
+// done. Failing over is an admin action of Cinder by default.
+func (os *OpenStack) FailoverReplication(ctx context.Context, host, backendID string) error {
+	if host == "" {
+		return fmt.Errorf("no host to fail over")
+	}
+	body := map[string]interface{}{"host": host}
+	if backendID != "" {
+		body["backend_id"] = backendID
+	}
+
+	client := os.blockStorageClient(ctx)
+	_, err := client.Put(client.ServiceURL("os-services", "failover_host"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{http.StatusAccepted},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fail over host %s: %v", host, err)
+	}
+	logging.FromContext(ctx).With(logging.Op, "FailoverReplication").Infof("Failing over host %s to backend %q", host, backendID)
+	return nil
+}
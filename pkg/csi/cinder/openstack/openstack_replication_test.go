@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetVolumeReplicationStatus(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	replicated := server.addVolume(fakeServerVolume{Name: "replicated", Size: 1, ReplicationStatus: ReplicationEnabledStatus})
+	plain := server.addVolume(fakeServerVolume{Name: "plain", Size: 1})
+
+	vol, err := cloud.GetVolume(ctx, replicated.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, ReplicationEnabledStatus, vol.ReplicationStatus)
+
+	vol, err = cloud.GetVolume(ctx, plain.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", vol.ReplicationStatus)
+}
+
+// Test a volume whose backend is failing over is waited for whatever its
+// status, until the failover is done
+func TestWaitVolumeTargetStatusFailingOver(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		next        string
+		nextRepl    string
+		errMsg      string
+		expectedGet int
+	}{
+		{"failed over", "error", VolumeAvailableStatus, ReplicationFailedOverStatus, "", 3},
+		{"unexpected status", "deleting", VolumeAvailableStatus, ReplicationFailedOverStatus, "", 3},
+		{"failover error", "error", "error", "failover-error", "went to error status", 3},
+		{"timeout", "error", "error", ReplicationFailingOverStatus, "is still failing over in error status", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: tt.status, ReplicationStatus: ReplicationFailingOverStatus})
+			server.setReplicationStatus(vol.ID, tt.status, ReplicationFailingOverStatus)
+			server.setReplicationStatus(vol.ID, tt.next, tt.nextRepl)
+
+			err := cloud.WaitVolumeTargetStatus(context.Background(), vol.ID, VolumeAvailableStatus)
+			if tt.errMsg != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.errMsg)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedGet, server.requestCount("GET /volume/volumes/{id}"))
+		})
+	}
+}
+
+// Test a volume going to error while its backend fails over keeps being
+// waited for while detaching
+func TestWaitDiskDetachedFailingOver(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:              "vol",
+		Size:              1,
+		Status:            VolumeDetachingStatus,
+		ReplicationStatus: ReplicationFailingOverStatus,
+		Attachments:       []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+	server.mux.Lock()
+	stored := server.volumes[vol.ID]
+	server.queue(vol.ID,
+		func() { stored.Status = "error" },
+		func() {
+			stored.Status, stored.ReplicationStatus, stored.Attachments = VolumeAvailableStatus, ReplicationFailedOverStatus, nil
+		})
+	server.mux.Unlock()
+
+	assert.NoError(t, cloud.WaitDiskDetached(context.Background(), fakeInstanceID, vol.ID))
+	assert.Equal(t, 3, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+func TestFailoverReplication(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	assert.NoError(t, cloud.FailoverReplication(ctx, "cinder@ceph", "secondary"))
+	assert.NoError(t, cloud.FailoverReplication(ctx, "cinder@ceph", ""))
+	assert.Equal(t, []map[string]string{
+		{"host": "cinder@ceph", "backend_id": "secondary"},
+		{"host": "cinder@ceph"},
+	}, server.failovers)
+
+	err := cloud.FailoverReplication(ctx, "", "secondary")
+	if assert.Error(t, err) {
+		assert.Equal(t, "no host to fail over", err.Error())
+	}
+	assert.Equal(t, 2, server.requestCount("PUT /volume/os-services/failover_host"))
+
+	// failing over is an admin action
+	server.inject("PUT /volume/os-services/failover_host", fakeServerFault{code: http.StatusForbidden})
+	err = cloud.FailoverReplication(ctx, "cinder@ceph", "secondary")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to fail over host cinder@ceph")
+	}
+}
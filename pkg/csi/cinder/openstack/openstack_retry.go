@@ -0,0 +1,184 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+)
+
+const (
+	requestRetryInitDelay = 1 * time.Second
+	requestRetryMaxDelay  = 30 * time.Second
+	requestRetrySteps     = 5
+	// the delays are randomly lengthened by up to half, so that the requests
+	// rejected together are not retried together
+	requestRetryJitter = 0.5
+)
+
+// retryTransport retries the requests rejected by the rate limiter of the
+// cloud (429) or failed by an overloaded or restarting service (502, 503 and
+// 504). Only requests that can safely be sent twice are retried: creates are
+// not, the controller finds the volumes and snapshots by name instead, and
+// actions only when they were rejected.
+type retryTransport struct {
+	rt        http.RoundTripper
+	initDelay time.Duration
+	maxDelay  time.Duration
+	steps     int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !retriableRequest(req) {
+		return t.rt.RoundTrip(req)
+	}
+
+	delay := t.initDelay
+	for retry := 1; ; retry++ {
+		resp, err := t.rt.RoundTrip(req)
+		if err != nil || !retriableStatus(req, resp.StatusCode) || retry > t.steps {
+			return resp, err
+		}
+
+		pause, ok := retryAfter(resp)
+		if !ok {
+			pause = retryJitter(delay)
+		} else if pause > t.maxDelay {
+			// waiting less than asked would only get rejected again
+			return resp, nil
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(pause).After(deadline) {
+			return resp, nil
+		}
+		newReq, err := rewind(req)
+		if err != nil {
+			return resp, nil
+		}
+
+		logging.FromContext(req.Context()).With(logging.OpenStackRequestID, requestID(resp)).V(3).Infof("OpenStack %s %s returned %d, retry %d/%d in %v", req.Method, req.URL.Path, resp.StatusCode, retry, t.steps, pause)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		req = newReq
+		delay *= 2
+		if delay > t.maxDelay {
+			delay = t.maxDelay
+		}
+	}
+}
+
+// retriableRequest returns whether req can be sent again: reads, deletes and
+// the POST actions on existing volumes and servers
+func retriableRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(req.URL.Path, "/action")
+	}
+	return false
+}
+
+// retriableStatus returns whether req is sent again after a response with the
+// status code. Actions are only sent again when they were rejected (429 and
+// 503): a proxy may return 502 or 504 once the service performed the action,
+// and actions like os-extend or os-retype must not run twice.
+func retriableStatus(req *http.Request, code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return req.Method != http.MethodPost
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp,
+// given either in seconds or as a date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if pause := time.Until(date); pause > 0 {
+			return pause, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryJitter returns the delay before a retry randomly lengthened, so that
+// the requests failed together are not retried together
+func retryJitter(delay time.Duration) time.Duration {
+	return wait.Jitter(delay, requestRetryJitter)
+}
+
+// rewind returns a copy of req with a fresh body to send it again
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be read again")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	newReq := *req
+	newReq.Body = body
+	return &newReq, nil
+}
+
+// withRetries wraps the transport of client with a retryTransport configured
+// by opts, a number of steps of 0 turns the retries off
+func withRetries(client *http.Client, opts BlockStorageOpts) {
+	if opts.RetrySteps == 0 {
+		return
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	client.Transport = &retryTransport{
+		rt:        rt,
+		initDelay: opts.RetryInitDelay.Duration,
+		maxDelay:  opts.RetryMaxDelay.Duration,
+		steps:     opts.RetrySteps,
+	}
+}
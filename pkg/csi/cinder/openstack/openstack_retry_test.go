@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// retryTransportOf returns the retryTransport installed by newFakeServer
+func retryTransportOf(cloud *OpenStack) *retryTransport {
+	return cloud.blockstorage.ProviderClient.HTTPClient.Transport.(*retryTransport)
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		server, cloud := newFakeServer(t)
+		vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+		server.inject("GET /volume/volumes/{id}", fakeServerFault{code: code}, fakeServerFault{code: code})
+
+		_, err := cloud.GetVolume(context.Background(), vol.ID)
+		assert.NoError(t, err, "status %d", code)
+		assert.Equal(t, 3, server.requestCount("GET /volume/volumes/{id}"), "status %d", code)
+		server.close()
+	}
+}
+
+// Test the last response is returned once the retries are exhausted
+func TestRetryGivesUp(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	faults := make([]fakeServerFault, requestRetrySteps+1)
+	for i := range faults {
+		faults[i] = fakeServerFault{code: http.StatusServiceUnavailable}
+	}
+	server.inject("DELETE /volume/volumes/{id}", faults...)
+
+	err := cloud.DeleteVolume(context.Background(), vol.ID, false)
+	assert.Error(t, err)
+	assert.Equal(t, requestRetrySteps+1, server.requestCount("DELETE /volume/volumes/{id}"))
+	assert.NotNil(t, server.volume(vol.ID))
+}
+
+// Test creates are not retried, the controller finds them by name instead
+func TestRetryNotCreates(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	server.inject("POST /volume/volumes", fakeServerFault{code: http.StatusTooManyRequests})
+	server.inject("POST /compute/servers/{id}/os-volume_attachments", fakeServerFault{code: http.StatusServiceUnavailable})
+
+	_, err := cloud.CreateVolume(context.Background(), "vol", 1, "", "", "", "", nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, server.requestCount("POST /volume/volumes"))
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAvailableStatus})
+	_, err = cloud.AttachVolume(context.Background(), fakeInstanceID, vol.ID)
+	assert.Error(t, err)
+	assert.Equal(t, 1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test the body of a retried action is sent again
+func TestRetryAction(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAvailableStatus})
+	server.inject("POST /volume/volumes/{id}/action", fakeServerFault{code: http.StatusTooManyRequests})
+
+	err := cloud.ExpandVolume(context.Background(), vol.ID, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.requestCount("POST /volume/volumes/{id}/action"))
+	assert.Equal(t, 2, server.volume(vol.ID).Size)
+}
+
+// Test an action failed by a proxy is not retried, the service may have
+// performed it
+func TestRetryNotFailedActions(t *testing.T) {
+	for _, code := range []int{http.StatusBadGateway, http.StatusGatewayTimeout} {
+		server, cloud := newFakeServer(t)
+		vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAvailableStatus})
+		server.inject("POST /volume/volumes/{id}/action", fakeServerFault{code: code})
+
+		err := cloud.ExpandVolume(context.Background(), vol.ID, 2)
+		assert.Error(t, err, "status %d", code)
+		assert.Equal(t, 1, server.requestCount("POST /volume/volumes/{id}/action"), "status %d", code)
+		server.close()
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	retryTransportOf(cloud).maxDelay = 5 * time.Second
+	server.inject("GET /volume/volumes/{id}", fakeServerFault{code: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "1"}})
+
+	start := time.Now()
+	_, err := cloud.GetVolume(context.Background(), vol.ID)
+	assert.NoError(err)
+	assert.True(time.Since(start) >= time.Second, "retried after %v", time.Since(start))
+	assert.Equal(2, server.requestCount("GET /volume/volumes/{id}"))
+
+	// a wait longer than the maximum delay is not shortened, the request fails
+	server.inject("GET /volume/volumes/{id}", fakeServerFault{code: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "60"}})
+	_, err = cloud.GetVolume(context.Background(), vol.ID)
+	assert.Error(err)
+	assert.Equal(3, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+// Test no retry is attempted past the deadline of the request context
+func TestRetryAfterDeadline(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	retryTransportOf(cloud).maxDelay = 5 * time.Second
+	server.inject("GET /volume/volumes/{id}", fakeServerFault{code: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "2"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := cloud.GetVolume(ctx, vol.ID)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "gave up after %v", time.Since(start))
+	assert.Equal(t, 1, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", tt.value)
+		d, ok := retryAfter(resp)
+		assert.Equal(t, tt.ok, ok, tt.value)
+		assert.Equal(t, tt.expected, d, tt.value)
+	}
+
+	// dates in the future give the time left
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	d, ok := retryAfter(resp)
+	assert.True(t, ok)
+	assert.True(t, d > 50*time.Second && d <= time.Minute, "%v", d)
+}
@@ -0,0 +1,1097 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+const (
+	fakeServerInstanceID = "4b9f2d3c-8f6b-4c4e-9a55-2f7e1a4b9c01"
+	fakeServerAZ         = "nova"
+)
+
+// fakeServerVolume is a volume as returned by the Cinder API
+type fakeServerVolume struct {
+	ID               string                 `json:"id"`
+	Name             string                 `json:"name"`
+	Description      string                 `json:"description"`
+	Status           string                 `json:"status"`
+	Size             int                    `json:"size"`
+	AvailabilityZone string                 `json:"availability_zone"`
+	SnapshotID       string                 `json:"snapshot_id,omitempty"`
+	Metadata         map[string]string      `json:"metadata"`
+	Attachments      []fakeServerAttachment `json:"attachments"`
+	UpdatedAt        string                 `json:"updated_at,omitempty"`
+	CreatedAt        string                 `json:"created_at,omitempty"`
+	// set with os-set_image_metadata
+	ImageMetadata map[string]string `json:"volume_image_metadata,omitempty"`
+	// set for the volumes of replicated volume types
+	ReplicationStatus string `json:"replication_status,omitempty"`
+}
+
+type fakeServerAttachment struct {
+	AttachmentID string `json:"attachment_id,omitempty"`
+	ServerID     string `json:"server_id"`
+	VolumeID     string `json:"volume_id"`
+	Device       string `json:"device"`
+}
+
+// fakeServerSnapshot is a snapshot as returned by the Cinder API
+type fakeServerSnapshot struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Size     int               `json:"size"`
+	VolumeID string            `json:"volume_id"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// fakeServer serves the parts of the Cinder v3 and Nova APIs, and of the
+// metadata service, used by the driver from an in-memory store. Status
+// transitions, e.g. creating to available, are queued on the volume or
+// snapshot and applied one per GET of it, after the response is written, so
+// that waiting functions see the intermediate status first.
+type fakeServer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mux       sync.Mutex
+	nextID    int
+	volumes   map[string]*fakeServerVolume
+	snapshots map[string]*fakeServerSnapshot
+	pending   map[string][]func()
+	// number of requests per "METHOD /path" with the IDs replaced by {id}
+	requests map[string]int
+	// faults to apply to the next requests, per "METHOD /path"
+	faults map[string][]fakeServerFault
+	// token expected in X-Auth-Token, if set
+	token string
+	// Nova servers answered with 404, all others exist
+	deletedServers map[string]bool
+	// locked Nova servers, with their locked_reason
+	lockedServers map[string]string
+	// names of Nova servers, unnamed if not set
+	serverNames map[string]string
+	// vm_state of Nova servers, active if not set
+	vmStates map[string]string
+	// task states of Nova servers, one per attach refused with 409
+	taskStates map[string][]string
+	// devices of the Nova attachments, per volume, when not the Cinder ones
+	novaDevices map[string]string
+	// Cinder user messages, per resource
+	messages map[string][]string
+	// maximum number of volumes listed per page, as osapi_max_limit, if set
+	maxLimit int
+	// backend pools reported by the scheduler
+	pools []map[string]interface{}
+	// volume types, with their extra specs
+	volumeTypes []fakeServerVolumeType
+	// gigabytes quota of the project, -1 for unlimited
+	quotaGB int
+	// answer the microversion 3.42 with 406, as clouds older than Pike do
+	noOnlineExtend bool
+	// Cinder availability zones, with whether they are available
+	zones []fakeServerZone
+	// tags of the Nova attachments, per volume
+	attachTags map[string]string
+	// status code answering the tagged attaches, e.g. 406 for clouds older
+	// than the microversion 2.49, accepted if not set
+	taggedAttachFault int
+	// answer the attaches naming their device with 400, as the hypervisors
+	// not supporting device names do
+	noDeviceNames bool
+	// bodies of the failover_host requests
+	failovers []map[string]string
+}
+
+// fakeServerZone is an availability zone as listed by the Cinder API
+type fakeServerZone struct {
+	ZoneName  string `json:"zoneName"`
+	ZoneState struct {
+		Available bool `json:"available"`
+	} `json:"zoneState"`
+}
+
+// fakeServerVolumeType is a volume type as returned by the Cinder API
+type fakeServerVolumeType struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	ExtraSpecs map[string]string `json:"extra_specs"`
+}
+
+// fakeServerFault alters the response to one request
+type fakeServerFault struct {
+	// delay before handling the request
+	delay time.Duration
+	// close the connection without responding
+	drop bool
+	// respond with this status code instead of handling the request
+	code    int
+	headers map[string]string
+}
+
+// newFakeServer starts a fakeServer and returns an OpenStack using it, with
+// waits short enough for tests. The caller closes the server.
+func newFakeServer(t *testing.T) (*fakeServer, *OpenStack) {
+	s := &fakeServer{
+		t:              t,
+		volumes:        make(map[string]*fakeServerVolume),
+		snapshots:      make(map[string]*fakeServerSnapshot),
+		pending:        make(map[string][]func()),
+		requests:       make(map[string]int),
+		faults:         make(map[string][]fakeServerFault),
+		deletedServers: make(map[string]bool),
+		lockedServers:  make(map[string]string),
+		serverNames:    make(map[string]string),
+		vmStates:       make(map[string]string),
+		taskStates:     make(map[string][]string),
+		novaDevices:    make(map[string]string),
+		messages:       make(map[string][]string),
+		attachTags:     make(map[string]string),
+		quotaGB:        -1,
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	opts := defaultBlockStorageOpts()
+	fast := MyDuration{Duration: time.Millisecond}
+	opts.AttachInitDelay, opts.AttachFactor, opts.AttachSteps = fast, 1, 5
+	opts.DetachInitDelay, opts.DetachFactor, opts.DetachSteps = fast, 1, 5
+	opts.OperationInitDelay, opts.OperationFactor, opts.OperationSteps = fast, 1, 5
+	opts.RetryInitDelay, opts.RetryMaxDelay = fast, MyDuration{Duration: 10 * time.Millisecond}
+
+	// both services share the provider, as they do in CreateOpenStackProvider
+	provider := &gophercloud.ProviderClient{}
+	withRateLimits(&provider.HTTPClient, opts)
+	withRetries(&provider.HTTPClient, opts)
+
+	cloud := &OpenStack{
+		compute: &gophercloud.ServiceClient{
+			ProviderClient: provider,
+			Endpoint:       s.server.URL + "/compute/",
+			Type:           "compute",
+		},
+		blockstorage: &gophercloud.ServiceClient{
+			ProviderClient: provider,
+			Endpoint:       s.server.URL + "/volume/",
+		},
+		bsVersion:   bsVersionV3,
+		bsOpts:      opts,
+		instances:   newInstanceCache(),
+		pools:       newPoolCache(),
+		zones:       newZoneCache(),
+		tagging:     newAttachTagging(),
+		deviceHints: newDeviceHints(),
+	}
+	return s, cloud
+}
+
+func (s *fakeServer) close() {
+	s.server.Close()
+}
+
+// addVolume preloads a volume, IDs and zone are set when empty
+func (s *fakeServer) addVolume(vol fakeServerVolume) *fakeServerVolume {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if vol.ID == "" {
+		vol.ID = s.newID("volume")
+	}
+	if vol.AvailabilityZone == "" {
+		vol.AvailabilityZone = fakeServerAZ
+	}
+	if vol.Status == "" {
+		vol.Status = VolumeAvailableStatus
+	}
+	s.volumes[vol.ID] = &vol
+	return &vol
+}
+
+// volume returns a copy of the stored volume, or nil if it doesn't exist
+func (s *fakeServer) volume(id string) *fakeServerVolume {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	vol, ok := s.volumes[id]
+	if !ok {
+		return nil
+	}
+	v := *vol
+	return &v
+}
+
+// requestCount returns the number of requests received for "METHOD /path"
+func (s *fakeServer) requestCount(key string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.requests[key]
+}
+
+func (s *fakeServer) newID(kind string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-%d", kind, s.nextID)
+}
+
+// inject scripts faults for the next requests to "METHOD /path", with the
+// IDs in the path replaced by {id}, one fault per request
+func (s *fakeServer) inject(key string, faults ...fakeServerFault) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.faults[key] = append(s.faults[key], faults...)
+}
+
+// setToken makes the server reject requests without the given token
+func (s *fakeServer) setToken(token string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.token = token
+}
+
+// deleteServer makes Nova answer 404 for the server
+func (s *fakeServer) deleteServer(id string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.deletedServers[id] = true
+}
+
+// nameServer sets the name of the server
+func (s *fakeServer) nameServer(id, name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.serverNames[id] = name
+}
+
+// setVMState sets the vm_state of the server, Nova refuses to attach volumes
+// to shelved servers
+func (s *fakeServer) setVMState(id, state string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.vmStates[id] = state
+}
+
+// setDevices sets the device of the attachments of the volume as reported by
+// Cinder and by Nova, which don't always agree
+func (s *fakeServer) setDevices(volumeID, cinderDevice, novaDevice string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i := range s.volumes[volumeID].Attachments {
+		s.volumes[volumeID].Attachments[i].Device = cinderDevice
+	}
+	s.novaDevices[volumeID] = novaDevice
+}
+
+// lockServer makes Nova refuse to attach volumes to the server
+func (s *fakeServer) lockServer(id, reason string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lockedServers[id] = reason
+}
+
+// setTaskStates makes Nova refuse the next attaches to the server, one per
+// task state
+func (s *fakeServer) setTaskStates(id string, states ...string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.taskStates[id] = append(s.taskStates[id], states...)
+}
+
+// addMessage adds a Cinder user message about the resource, the last one
+// added being the most recent
+func (s *fakeServer) addMessage(resourceID, message string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.messages[resourceID] = append(s.messages[resourceID], message)
+}
+
+// addPool adds a backend pool reported by the scheduler, with capacities
+// either numbers or strings such as "infinite"
+func (s *fakeServer) addPool(name, backend string, total, free interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.pools = append(s.pools, map[string]interface{}{
+		"name": name,
+		"capabilities": map[string]interface{}{
+			"volume_backend_name": backend,
+			"total_capacity_gb":   total,
+			"free_capacity_gb":    free,
+		},
+	})
+}
+
+// addZone adds a Cinder availability zone
+func (s *fakeServer) addZone(name string, available bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	zone := fakeServerZone{ZoneName: name}
+	zone.ZoneState.Available = available
+	s.zones = append(s.zones, zone)
+}
+
+// addVolumeType adds a volume type, on the backend if not empty
+func (s *fakeServer) addVolumeType(name, backend string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	vt := fakeServerVolumeType{ID: s.newID("type"), Name: name, ExtraSpecs: map[string]string{}}
+	if backend != "" {
+		vt.ExtraSpecs["volume_backend_name"] = backend
+	}
+	s.volumeTypes = append(s.volumeTypes, vt)
+}
+
+// setQuota sets the gigabytes quota of the project, -1 for unlimited
+func (s *fakeServer) setQuota(gigabytes int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.quotaGB = gigabytes
+}
+
+// disableOnlineExtend makes the cloud refuse the microversion 3.42
+func (s *fakeServer) disableOnlineExtend() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.noOnlineExtend = true
+}
+
+// refuseTaggedAttach answers the tagged attaches with the status code
+func (s *fakeServer) refuseTaggedAttach(code int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.taggedAttachFault = code
+}
+
+// refuseDeviceNames makes the cloud refuse the attaches naming their device
+func (s *fakeServer) refuseDeviceNames() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.noDeviceNames = true
+}
+
+// attachTag returns the tag the volume was attached with
+func (s *fakeServer) attachTag(volumeID string) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.attachTags[volumeID]
+}
+
+// setVolumeStatus queues a change of the status of a volume, applied on its
+// next GET
+func (s *fakeServer) setVolumeStatus(id, status string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	vol := s.volumes[id]
+	s.queue(id, func() { vol.Status = status })
+}
+
+// setReplicationStatus queues a change of the status and the replication
+// status of a volume, applied on its next GET
+func (s *fakeServer) setReplicationStatus(id, status, replicationStatus string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	vol := s.volumes[id]
+	s.queue(id, func() { vol.Status, vol.ReplicationStatus = status, replicationStatus })
+}
+
+// applyFault applies the next fault scripted for key, and returns whether
+// the request was answered. It is called with the lock held, and releases
+// it while delaying.
+func (s *fakeServer) applyFault(w http.ResponseWriter, key string) bool {
+	if len(s.faults[key]) == 0 {
+		return false
+	}
+	fault := s.faults[key][0]
+	s.faults[key] = s.faults[key][1:]
+
+	if fault.delay > 0 {
+		s.mux.Unlock()
+		time.Sleep(fault.delay)
+		s.mux.Lock()
+	}
+	if fault.drop {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			s.t.Errorf("failed to drop the connection: %v", err)
+			return true
+		}
+		conn.Close()
+		return true
+	}
+	if fault.code != 0 {
+		for k, v := range fault.headers {
+			w.Header().Set(k, v)
+		}
+		s.fail(w, fault.code, "injected fault")
+		return true
+	}
+	return false
+}
+
+// queue adds status transitions of the object with the given ID
+func (s *fakeServer) queue(id string, transitions ...func()) {
+	s.pending[id] = append(s.pending[id], transitions...)
+}
+
+// step applies the next status transition of the object with the given ID
+func (s *fakeServer) step(id string) {
+	if len(s.pending[id]) == 0 {
+		return
+	}
+	next := s.pending[id][0]
+	s.pending[id] = s.pending[id][1:]
+	next()
+}
+
+func (s *fakeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	key := r.Method + " /" + strings.Join(requestKey(parts), "/")
+	s.requests[key]++
+
+	if s.applyFault(w, key) {
+		return
+	}
+	if s.token != "" && r.Header.Get("X-Auth-Token") != s.token {
+		s.fail(w, http.StatusUnauthorized, "the request you have made requires authentication")
+		return
+	}
+
+	switch {
+	case len(parts) >= 2 && parts[0] == "volume" && parts[1] == "volumes":
+		s.serveVolumes(w, r, parts[2:])
+	case len(parts) >= 2 && parts[0] == "volume" && parts[1] == "snapshots":
+		s.serveSnapshots(w, r, parts[2:])
+	case len(parts) == 2 && parts[0] == "volume" && parts[1] == "messages" && r.Method == "GET":
+		s.serveMessages(w, r)
+	case len(parts) == 3 && parts[0] == "volume" && parts[1] == "scheduler-stats" && parts[2] == "get_pools" && r.Method == "GET":
+		s.reply(w, http.StatusOK, map[string]interface{}{"pools": s.pools})
+	case len(parts) == 2 && parts[0] == "volume" && parts[1] == "os-availability-zone" && r.Method == "GET":
+		s.reply(w, http.StatusOK, map[string]interface{}{"availabilityZoneInfo": s.zones})
+	case len(parts) == 2 && parts[0] == "volume" && parts[1] == "types" && r.Method == "GET":
+		s.reply(w, http.StatusOK, map[string]interface{}{"volume_types": s.volumeTypes})
+	case len(parts) == 3 && parts[0] == "volume" && parts[1] == "os-services" && parts[2] == "failover_host" && r.Method == "PUT":
+		var body map[string]string
+		if !s.decode(w, r, &body) {
+			return
+		}
+		s.failovers = append(s.failovers, body)
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) == 2 && parts[0] == "volume" && parts[1] == "limits" && r.Method == "GET":
+		used := 0
+		for _, vol := range s.volumes {
+			used += vol.Size
+		}
+		absolute := map[string]int{"maxTotalVolumeGigabytes": s.quotaGB, "totalGigabytesUsed": used}
+		s.reply(w, http.StatusOK, map[string]interface{}{"limits": map[string]interface{}{"absolute": absolute, "rate": []string{}}})
+	case len(parts) >= 3 && parts[0] == "compute" && parts[1] == "servers" && s.deletedServers[parts[2]]:
+		s.fail(w, http.StatusNotFound, "instance %s could not be found", parts[2])
+	case len(parts) == 3 && parts[0] == "compute" && parts[1] == "servers" && r.Method == "GET":
+		server := map[string]string{"id": parts[2], "name": s.serverNames[parts[2]], "OS-EXT-AZ:availability_zone": fakeServerAZ, "OS-EXT-STS:vm_state": "active"}
+		if state, ok := s.vmStates[parts[2]]; ok {
+			server["OS-EXT-STS:vm_state"] = state
+		}
+		if r.Header.Get("X-OpenStack-Nova-API-Version") == lockedReasonMicroversion {
+			server["locked_reason"] = s.lockedServers[parts[2]]
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{"server": server})
+	case len(parts) == 4 && parts[0] == "compute" && parts[1] == "servers" && parts[3] == "os-volume_attachments":
+		s.serveAttachments(w, r, parts[2], "")
+	case len(parts) == 5 && parts[0] == "compute" && parts[1] == "servers" && parts[3] == "os-volume_attachments":
+		s.serveAttachments(w, r, parts[2], parts[4])
+	case r.URL.Path == "/openstack/latest/meta_data.json":
+		s.reply(w, http.StatusOK, map[string]string{"uuid": fakeServerInstanceID, "availability_zone": fakeServerAZ})
+	default:
+		s.fail(w, http.StatusNotFound, "unexpected %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// requestKey replaces the IDs in the path by {id}
+func requestKey(parts []string) []string {
+	key := make([]string, len(parts))
+	for i, p := range parts {
+		if strings.Contains(p, "-") && p != "os-volume_attachments" && p != "scheduler-stats" && p != "os-availability-zone" && p != "os-services" {
+			p = "{id}"
+		}
+		key[i] = p
+	}
+	return key
+}
+
+func (s *fakeServer) serveVolumes(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case r.Method == "GET" && (len(parts) == 0 || parts[0] == "detail"):
+		if version := r.Header.Get("OpenStack-API-Version"); version != "" {
+			if version == onlineExtendMicroversion && s.noOnlineExtend {
+				s.fail(w, http.StatusNotAcceptable, "version 3.42 is not supported by the API")
+				return
+			}
+			w.Header().Set("OpenStack-API-Version", version)
+		}
+		s.listVolumes(w, r)
+
+	case r.Method == "POST" && len(parts) == 0:
+		var body struct {
+			Volume fakeServerVolume `json:"volume"`
+		}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		vol := body.Volume
+		if vol.AvailabilityZone != "" && vol.AvailabilityZone != fakeServerAZ {
+			s.fail(w, http.StatusBadRequest, "availability zone '%s' is invalid", vol.AvailabilityZone)
+			return
+		}
+		if vol.SnapshotID != "" {
+			if _, ok := s.snapshots[vol.SnapshotID]; !ok {
+				s.fail(w, http.StatusNotFound, "snapshot %s could not be found", vol.SnapshotID)
+				return
+			}
+		}
+		vol.ID = s.newID("volume")
+		vol.Status = "creating"
+		vol.AvailabilityZone = fakeServerAZ
+		vol.CreatedAt = time.Now().UTC().Format("2006-01-02T15:04:05.000000")
+		stored := &vol
+		s.volumes[vol.ID] = stored
+		s.queue(vol.ID, func() { stored.Status = VolumeAvailableStatus })
+		s.reply(w, http.StatusAccepted, map[string]interface{}{"volume": vol})
+
+	case r.Method == "GET" && len(parts) == 1:
+		vol, ok := s.volumes[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", parts[0])
+			return
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{"volume": vol})
+		s.step(vol.ID)
+
+	case r.Method == "DELETE" && len(parts) == 1:
+		vol, ok := s.volumes[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", parts[0])
+			return
+		}
+		if vol.Status != VolumeAvailableStatus && vol.Status != VolumeErrorStatus {
+			s.fail(w, http.StatusBadRequest, "volume status must be available or error, but current status is: %s", vol.Status)
+			return
+		}
+		delete(s.volumes, vol.ID)
+		delete(s.pending, vol.ID)
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == "PUT" && len(parts) == 1:
+		vol, ok := s.volumes[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", parts[0])
+			return
+		}
+		var body struct {
+			Volume struct {
+				Name *string `json:"name"`
+			} `json:"volume"`
+		}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		if body.Volume.Name != nil {
+			vol.Name = *body.Volume.Name
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{"volume": vol})
+
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "metadata":
+		vol, ok := s.volumes[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", parts[0])
+			return
+		}
+		var body struct {
+			Metadata map[string]string `json:"metadata"`
+		}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		if vol.Metadata == nil {
+			vol.Metadata = make(map[string]string)
+		}
+		for k, v := range body.Metadata {
+			vol.Metadata[k] = v
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{"metadata": vol.Metadata})
+
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "action":
+		vol, ok := s.volumes[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", parts[0])
+			return
+		}
+		var body struct {
+			Extend *struct {
+				NewSize int `json:"new_size"`
+			} `json:"os-extend"`
+			ResetStatus *struct {
+				Status       string `json:"status"`
+				AttachStatus string `json:"attach_status"`
+			} `json:"os-reset_status"`
+			ForceDetach *struct {
+				AttachmentID string `json:"attachment_id"`
+			} `json:"os-force_detach"`
+			ForceDelete      *struct{} `json:"os-force_delete"`
+			SetImageMetadata *struct {
+				Metadata map[string]string `json:"metadata"`
+			} `json:"os-set_image_metadata"`
+		}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		switch {
+		case body.Extend != nil:
+			if body.Extend.NewSize <= vol.Size {
+				s.fail(w, http.StatusBadRequest, "new size for extend must be greater than current size")
+				return
+			}
+			if vol.Status == VolumeInUseStatus && r.Header.Get("OpenStack-API-Version") != onlineExtendMicroversion {
+				s.fail(w, http.StatusBadRequest, "volume status must be available to extend, but current status is: %s", vol.Status)
+				return
+			}
+			if vol.Status == VolumeInUseStatus && s.noOnlineExtend {
+				s.fail(w, http.StatusNotAcceptable, "version 3.42 is not supported by the API")
+				return
+			}
+			// the volume grows on its next GET
+			previous, size := vol.Status, body.Extend.NewSize
+			vol.Status = VolumeExtendingStatus
+			s.queue(vol.ID, func() {
+				vol.Status, vol.Size = previous, size
+			})
+		case body.ResetStatus != nil:
+			vol.Status = body.ResetStatus.Status
+			if body.ResetStatus.AttachStatus == "detached" {
+				vol.Attachments = nil
+			}
+		case body.ForceDetach != nil:
+			if len(vol.Attachments) == 0 || vol.Attachments[0].AttachmentID != body.ForceDetach.AttachmentID {
+				s.fail(w, http.StatusBadRequest, "invalid attachment %s", body.ForceDetach.AttachmentID)
+				return
+			}
+			vol.Status = VolumeAvailableStatus
+			vol.Attachments = nil
+		case body.ForceDelete != nil:
+			delete(s.volumes, vol.ID)
+			delete(s.pending, vol.ID)
+		case body.SetImageMetadata != nil:
+			if vol.ImageMetadata == nil {
+				vol.ImageMetadata = make(map[string]string)
+			}
+			for k, v := range body.SetImageMetadata.Metadata {
+				vol.ImageMetadata[k] = v
+			}
+			s.reply(w, http.StatusOK, map[string]interface{}{"metadata": vol.ImageMetadata})
+			return
+		default:
+			s.fail(w, http.StatusBadRequest, "unsupported volume action")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		s.fail(w, http.StatusNotFound, "unexpected %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// listVolumes lists the volumes by ID, filtered and paginated as Cinder does
+func (s *fakeServer) listVolumes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	metadata := parseMetadataFilter(query.Get("metadata"))
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			s.fail(w, http.StatusBadRequest, "invalid input received: limit %q", l)
+			return
+		}
+	}
+	if s.maxLimit > 0 && (limit == 0 || limit > s.maxLimit) {
+		limit = s.maxLimit
+	}
+
+	ids := make([]string, 0, len(s.volumes))
+	for id := range s.volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if marker := query.Get("marker"); marker != "" {
+		i := sort.SearchStrings(ids, marker)
+		if i == len(ids) || ids[i] != marker {
+			s.fail(w, http.StatusNotFound, "marker %s could not be found", marker)
+			return
+		}
+		ids = ids[i+1:]
+	}
+
+	list := []fakeServerVolume{}
+	links := []map[string]string{}
+	for _, id := range ids {
+		vol := s.volumes[id]
+		if !volumeMatches(vol, query.Get("name"), query.Get("status"), metadata) {
+			continue
+		}
+		if snapshotID := query.Get("snapshot_id"); snapshotID != "" && vol.SnapshotID != snapshotID {
+			continue
+		}
+		if limit > 0 && len(list) == limit {
+			next := *r.URL
+			q := next.Query()
+			q.Set("marker", list[len(list)-1].ID)
+			next.RawQuery = q.Encode()
+			links = append(links, map[string]string{"rel": "next", "href": s.server.URL + next.RequestURI()})
+			break
+		}
+		list = append(list, *vol)
+	}
+	s.reply(w, http.StatusOK, map[string]interface{}{"volumes": list, "volumes_links": links})
+}
+
+// listSnapshots lists the snapshots by ID, filtered and paginated as Cinder
+// does
+func (s *fakeServer) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			s.fail(w, http.StatusBadRequest, "invalid input received: limit %q", l)
+			return
+		}
+	}
+	if s.maxLimit > 0 && (limit == 0 || limit > s.maxLimit) {
+		limit = s.maxLimit
+	}
+
+	ids := make([]string, 0, len(s.snapshots))
+	for id := range s.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if marker := query.Get("marker"); marker != "" {
+		i := sort.SearchStrings(ids, marker)
+		if i == len(ids) || ids[i] != marker {
+			s.fail(w, http.StatusBadRequest, "invalid input received: marker %s not found", marker)
+			return
+		}
+		ids = ids[i+1:]
+	}
+
+	name, status, volumeID := query.Get("name"), query.Get("status"), query.Get("volume_id")
+	list := []fakeServerSnapshot{}
+	links := []map[string]string{}
+	for _, id := range ids {
+		snap := s.snapshots[id]
+		if (name != "" && snap.Name != name) || (status != "" && snap.Status != status) || (volumeID != "" && snap.VolumeID != volumeID) {
+			continue
+		}
+		if limit > 0 && len(list) == limit {
+			next := *r.URL
+			q := next.Query()
+			q.Set("marker", list[len(list)-1].ID)
+			next.RawQuery = q.Encode()
+			links = append(links, map[string]string{"rel": "next", "href": s.server.URL + next.RequestURI()})
+			break
+		}
+		list = append(list, *snap)
+	}
+	s.reply(w, http.StatusOK, map[string]interface{}{"snapshots": list, "snapshots_links": links})
+}
+
+// parseMetadataFilter parses the metadata filter sent by gophercloud, e.g.
+// {'key1':'value1', 'key2':'value2'}
+func parseMetadataFilter(filter string) map[string]string {
+	metadata := make(map[string]string)
+	filter = strings.TrimSuffix(strings.TrimPrefix(filter, "{"), "}")
+	for _, pair := range strings.Split(filter, ", ") {
+		kv := strings.SplitN(pair, "':'", 2)
+		if len(kv) == 2 {
+			metadata[strings.TrimPrefix(kv[0], "'")] = strings.TrimSuffix(kv[1], "'")
+		}
+	}
+	return metadata
+}
+
+func volumeMatches(vol *fakeServerVolume, name, status string, metadata map[string]string) bool {
+	if (name != "" && vol.Name != name) || (status != "" && vol.Status != status) {
+		return false
+	}
+	for k, v := range metadata {
+		if vol.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// serveMessages serves the Cinder user messages, which need microversion 3.3
+func (s *fakeServer) serveMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("OpenStack-API-Version") != messagesMicroversion {
+		s.fail(w, http.StatusNotFound, "unexpected %s %s", r.Method, r.URL.Path)
+		return
+	}
+	resourceID := r.URL.Query().Get("resource_uuid")
+	list := []map[string]string{}
+	for i, msg := range s.messages[resourceID] {
+		list = append(list, map[string]string{
+			"resource_uuid": resourceID,
+			"user_message":  msg,
+			"created_at":    fmt.Sprintf("2019-03-01T10:00:%02d.000000", i),
+		})
+	}
+	// Cinder lists the most recent messages first
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	s.reply(w, http.StatusOK, map[string]interface{}{"messages": list})
+}
+
+func (s *fakeServer) serveSnapshots(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case r.Method == "GET" && (len(parts) == 0 || parts[0] == "detail"):
+		s.listSnapshots(w, r)
+
+	case r.Method == "POST" && len(parts) == 0:
+		var body struct {
+			Snapshot fakeServerSnapshot `json:"snapshot"`
+		}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		snap := body.Snapshot
+		vol, ok := s.volumes[snap.VolumeID]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", snap.VolumeID)
+			return
+		}
+		snap.ID = s.newID("snapshot")
+		snap.Status = "creating"
+		snap.Size = vol.Size
+		stored := &snap
+		s.snapshots[snap.ID] = stored
+		s.queue(snap.ID, func() { stored.Status = SnapshotReadyStatus })
+		s.reply(w, http.StatusAccepted, map[string]interface{}{"snapshot": snap})
+
+	case r.Method == "GET" && len(parts) == 1:
+		snap, ok := s.snapshots[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "snapshot %s could not be found", parts[0])
+			return
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{"snapshot": snap})
+		s.step(snap.ID)
+
+	case r.Method == "DELETE" && len(parts) == 1:
+		snap, ok := s.snapshots[parts[0]]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "snapshot %s could not be found", parts[0])
+			return
+		}
+		for _, vol := range s.volumes {
+			if vol.SnapshotID == snap.ID {
+				s.fail(w, http.StatusBadRequest, "invalid snapshot: snapshot %s has dependent volumes", snap.ID)
+				return
+			}
+		}
+		delete(s.snapshots, snap.ID)
+		delete(s.pending, snap.ID)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		s.fail(w, http.StatusNotFound, "unexpected %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// serveAttachments serves the volume attachments of a Nova server, the
+// attachment ID being the volume ID as in Nova
+func (s *fakeServer) serveAttachments(w http.ResponseWriter, r *http.Request, serverID, volumeID string) {
+	switch {
+	case r.Method == "GET" && volumeID == "":
+		list := []map[string]string{}
+		for _, vol := range s.volumes {
+			for _, a := range vol.Attachments {
+				if a.ServerID == serverID {
+					list = append(list, attachmentBody(a))
+				}
+			}
+		}
+		s.reply(w, http.StatusOK, map[string]interface{}{"volumeAttachments": list})
+
+	case r.Method == "POST" && volumeID == "":
+		var body struct {
+			VolumeAttachment struct {
+				VolumeID string `json:"volumeId"`
+				Tag      string `json:"tag"`
+				Device   string `json:"device"`
+			} `json:"volumeAttachment"`
+		}
+		if !s.decode(w, r, &body) {
+			return
+		}
+		if tag := body.VolumeAttachment.Tag; tag != "" {
+			if s.taggedAttachFault != 0 {
+				s.fail(w, s.taggedAttachFault, "tagged attach refused")
+				return
+			}
+			if r.Header.Get("X-OpenStack-Nova-API-Version") != taggedAttachMicroversion {
+				s.fail(w, http.StatusBadRequest, "Invalid input for field/attribute volumeAttachment. Value: %v. Additional properties are not allowed ('tag' was unexpected)", body.VolumeAttachment)
+				return
+			}
+		}
+		vol, ok := s.volumes[body.VolumeAttachment.VolumeID]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "volume %s could not be found", body.VolumeAttachment.VolumeID)
+			return
+		}
+		if vol.Status != VolumeAvailableStatus {
+			s.fail(w, http.StatusBadRequest, "invalid volume: volume %s status must be available, but current status is: %s", vol.ID, vol.Status)
+			return
+		}
+		if _, ok := s.lockedServers[serverID]; ok {
+			s.fail(w, http.StatusConflict, "Instance %s is locked", serverID)
+			return
+		}
+		if state := s.vmStates[serverID]; state == "shelved" || state == "shelved_offloaded" {
+			s.fail(w, http.StatusConflict, "Cannot 'attach_volume' instance %s while it is in vm_state %s", serverID, state)
+			return
+		}
+		if states := s.taskStates[serverID]; len(states) > 0 {
+			s.taskStates[serverID] = states[1:]
+			s.fail(w, http.StatusConflict, "Cannot 'attach_volume' instance %s while it is in task_state %s", serverID, states[0])
+			return
+		}
+		device := body.VolumeAttachment.Device
+		if device != "" && s.noDeviceNames {
+			s.fail(w, http.StatusBadRequest, "Invalid input for field/attribute device. Value: %s. Specifying a device name is not supported", device)
+			return
+		}
+		if device == "" {
+			device = s.nextDevice(serverID)
+		}
+		attachment := fakeServerAttachment{ServerID: serverID, VolumeID: vol.ID, Device: device}
+		s.attachTags[vol.ID] = body.VolumeAttachment.Tag
+		vol.Status = "attaching"
+		s.queue(vol.ID, func() {
+			vol.Status = VolumeInUseStatus
+			vol.Attachments = []fakeServerAttachment{attachment}
+		})
+		s.reply(w, http.StatusOK, map[string]interface{}{"volumeAttachment": attachmentBody(attachment)})
+
+	case r.Method == "GET" && volumeID != "":
+		if vol, ok := s.volumes[volumeID]; ok {
+			for _, a := range vol.Attachments {
+				if a.ServerID != serverID {
+					continue
+				}
+				if device, ok := s.novaDevices[volumeID]; ok {
+					a.Device = device
+				}
+				s.reply(w, http.StatusOK, map[string]interface{}{"volumeAttachment": attachmentBody(a)})
+				return
+			}
+		}
+		s.fail(w, http.StatusNotFound, "volume %s is not attached to server %s", volumeID, serverID)
+
+	case r.Method == "DELETE" && volumeID != "":
+		vol, ok := s.volumes[volumeID]
+		index := -1
+		if ok {
+			for i, a := range vol.Attachments {
+				if a.ServerID == serverID {
+					index = i
+				}
+			}
+		}
+		if index < 0 {
+			s.fail(w, http.StatusNotFound, "volume %s is not attached to server %s", volumeID, serverID)
+			return
+		}
+		vol.Status = "detaching"
+		s.queue(vol.ID, func() {
+			// a multiattach volume stays in-use while attached to others
+			vol.Attachments = append(vol.Attachments[:index], vol.Attachments[index+1:]...)
+			vol.Status = VolumeAvailableStatus
+			if len(vol.Attachments) > 0 {
+				vol.Status = VolumeInUseStatus
+			}
+		})
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		s.fail(w, http.StatusNotFound, "unexpected %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// nextDevice returns the first /dev/vdX device not used on the server
+func (s *fakeServer) nextDevice(serverID string) string {
+	used := make(map[string]bool)
+	for _, vol := range s.volumes {
+		for _, a := range vol.Attachments {
+			if a.ServerID == serverID {
+				used[a.Device] = true
+			}
+		}
+	}
+	for c := 'b'; c <= 'z'; c++ {
+		if device := "/dev/vd" + string(c); !used[device] {
+			return device
+		}
+	}
+	return ""
+}
+
+func attachmentBody(a fakeServerAttachment) map[string]string {
+	return map[string]string{"id": a.VolumeID, "volumeId": a.VolumeID, "serverId": a.ServerID, "device": a.Device}
+}
+
+func (s *fakeServer) decode(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		s.fail(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return false
+	}
+	return true
+}
+
+func (s *fakeServer) reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.t.Errorf("failed to encode the response: %v", err)
+	}
+}
+
+// fail writes an error in the format of the OpenStack APIs
+func (s *fakeServer) fail(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	s.reply(w, code, map[string]interface{}{
+		http.StatusText(code): map[string]interface{}{"code": code, "message": msg},
+	})
+}
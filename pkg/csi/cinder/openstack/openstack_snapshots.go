@@ -19,24 +19,51 @@ limitations under the License.
 package openstack
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/pagination"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/klog"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
 )
 
 const (
 	SnapshotReadyStatus = "available"
+	SnapshotErrorStatus = "error"
 	snapReadyDuration   = 1 * time.Second
 	snapReadyFactor     = 1.2
 	snapReadySteps      = 10
 )
 
+// Filters of ListSnapshots
+const (
+	SnapshotNameFilter     = "name"
+	SnapshotStatusFilter   = "status"
+	SnapshotVolumeIDFilter = "volume_id"
+)
+
+// SnapshotInUseError is returned when a snapshot cannot be deleted because
+// volumes created from it still exist
+type SnapshotInUseError struct {
+	SnapshotID string
+	// IDs of the volumes created from the snapshot
+	Volumes []string
+}
+
+func (e *SnapshotInUseError) Error() string {
+	return fmt.Sprintf("snapshot %s is in use by volume(s) %s", e.SnapshotID, strings.Join(e.Volumes, ", "))
+}
+
 // CreateSnapshot issues a request to take a Snapshot of the specified Volume with the corresponding ID and
 // returns the resultant gophercloud Snapshot Item upon success
-func (os *OpenStack) CreateSnapshot(name, volID, description string, tags *map[string]string) (*snapshots.Snapshot, error) {
+func (os *OpenStack) CreateSnapshot(ctx context.Context, name, volID, description string, tags *map[string]string) (*snapshots.Snapshot, error) {
 	opts := &snapshots.CreateOpts{
 		VolumeID:    volID,
 		Name:        name,
@@ -47,7 +74,7 @@ func (os *OpenStack) CreateSnapshot(name, volID, description string, tags *map[s
 	}
 	// TODO: Do some check before really call openstack API on the input
 
-	snap, err := snapshots.Create(os.blockstorage, opts).Extract()
+	snap, err := snapshots.Create(os.blockStorageClient(ctx), opts).Extract()
 	if err != nil {
 		return &snapshots.Snapshot{}, err
 	}
@@ -56,41 +83,75 @@ func (os *OpenStack) CreateSnapshot(name, volID, description string, tags *map[s
 	return snap, nil
 }
 
-// ListSnapshots retrieves a list of active snapshots from Cinder for the corresponding Tenant.  We also
-// provide the ability to provide limit and offset to enable the consumer to provide accurate pagination.
-// In addition the filters argument provides a mechanism for passing in valid filter strings to the list
-// operation.  Valid filter keys are:  Name, Status, VolumeID (TenantID has no effect)
-func (os *OpenStack) ListSnapshots(limit, offset int, filters map[string]string) ([]snapshots.Snapshot, error) {
-	// FIXME: honor the limit, offset and filters later
-	opts := snapshots.ListOpts{Status: SnapshotReadyStatus}
-	pages, err := snapshots.List(os.blockstorage, opts).AllPages()
-	if err != nil {
-		klog.V(3).Infof("Failed to retrieve snapshots from Cinder: %v", err)
-		return nil, err
+// ListSnapshots lists up to limit snapshots matching filters, whatever their
+// status, starting after the snapshot marker, and returns the marker of the
+// next page, empty after the last one. With limit 0 Cinder returns up to its
+// osapi_max_limit. The filters are SnapshotNameFilter, SnapshotStatusFilter
+// and SnapshotVolumeIDFilter. A marker Cinder doesn't know is returned as an
+// *InvalidMarkerError.
+func (os *OpenStack) ListSnapshots(ctx context.Context, limit int, marker string, filters map[string]string) ([]snapshots.Snapshot, string, error) {
+	log := logging.FromContext(ctx).With(logging.Op, "ListSnapshots")
+	query := url.Values{}
+	for k, v := range filters {
+		switch k {
+		case SnapshotNameFilter, SnapshotStatusFilter, SnapshotVolumeIDFilter:
+			query.Set(k, v)
+		default:
+			return nil, "", fmt.Errorf("unsupported snapshot filter %q", k)
+		}
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+
+	// gophercloud lists all the pages, the next ones are left to the next call
+	client := os.blockStorageClient(ctx)
+	listURL := client.ServiceURL("snapshots", "detail")
+	if len(query) > 0 {
+		listURL += "?" + query.Encode()
+	}
+	var body struct {
+		Snapshots []snapshots.Snapshot `json:"snapshots"`
+		Links     []gophercloud.Link   `json:"snapshots_links"`
+	}
+	_, err := client.Get(listURL, &body, nil)
+	if err != nil && marker != "" && (cpoerrors.IsNotFound(err) || cpoerrors.IsBadRequest(err)) {
+		return nil, "", &InvalidMarkerError{Marker: marker, Err: err}
 	}
-	snaps, err := snapshots.ExtractSnapshots(pages)
 	if err != nil {
-		klog.V(3).Infof("Failed to extract snapshot pages from Cinder: %v", err)
-		return nil, err
+		log.V(3).Infof("Failed to retrieve snapshots from Cinder: %v", err)
+		return nil, "", err
+	}
+
+	var next string
+	for _, link := range body.Links {
+		if link.Rel == "next" {
+			if next, err = pageMarker(link.Href); err != nil {
+				return nil, "", err
+			}
+		}
 	}
 	// There's little value in rewrapping these gophercloud types into yet another abstraction/type, instead just
 	// return the gophercloud item
-	return snaps, nil
-
+	return body.Snapshots, next, nil
 }
 
-// GetVolumesByName is a wrapper around ListVolumes that creates a Name filter to act as a GetByName
-// Returns a list of Volume references with the specified name
-func (os *OpenStack) GetSnapshotByNameAndVolumeID(n string, volumeId string) ([]snapshots.Snapshot, error) {
-	opts := snapshots.ListOpts{Name: n, VolumeID: volumeId}
-	pages, err := snapshots.List(os.blockstorage, opts).AllPages()
+// GetSnapshotsByName is a wrapper around ListSnapshots that creates a Name filter to act as a GetByName
+// Returns a list of Snapshot references with the specified name, whatever their source volume
+func (os *OpenStack) GetSnapshotsByName(ctx context.Context, n string) ([]snapshots.Snapshot, error) {
+	log := logging.FromContext(ctx).With(logging.Op, "GetSnapshotsByName", "name", n)
+	opts := snapshots.ListOpts{Name: n}
+	pages, err := snapshots.List(os.blockStorageClient(ctx), opts).AllPages()
 	if err != nil {
-		klog.V(3).Infof("Failed to retrieve snapshots from Cinder: %v", err)
+		log.V(3).Infof("Failed to retrieve snapshots from Cinder: %v", err)
 		return nil, err
 	}
 	snaps, err := snapshots.ExtractSnapshots(pages)
 	if err != nil {
-		klog.V(3).Infof("Failed to extract snapshot pages from Cinder: %v", err)
+		log.V(3).Infof("Failed to extract snapshot pages from Cinder: %v", err)
 		return nil, err
 	}
 	// There's little value in rewrapping these gophercloud types into yet another abstraction/type, instead just
@@ -98,35 +159,63 @@ func (os *OpenStack) GetSnapshotByNameAndVolumeID(n string, volumeId string) ([]
 	return snaps, nil
 }
 
-// DeleteSnapshot issues a request to delete the Snapshot with the specified ID from the Cinder backend
-func (os *OpenStack) DeleteSnapshot(snapID string) error {
-	err := snapshots.Delete(os.blockstorage, snapID).ExtractErr()
+// DeleteSnapshot issues a request to delete the Snapshot with the specified ID from the Cinder backend.
+// If Cinder refuses because volumes were created from the snapshot, a *SnapshotInUseError is returned.
+func (os *OpenStack) DeleteSnapshot(ctx context.Context, snapID string) error {
+	log := logging.FromContext(ctx).With(logging.Op, "DeleteSnapshot", logging.SnapshotID, snapID)
+	err := snapshots.Delete(os.blockStorageClient(ctx), snapID).ExtractErr()
 	if err != nil {
-		klog.V(3).Infof("Failed to delete snapshot: %v", err)
+		log.V(3).Infof("Failed to delete snapshot: %v", err)
+		if cpoerrors.IsConflict(err) || cpoerrors.IsBadRequest(err) {
+			vols, lerr := os.getVolumesFromSnapshot(ctx, snapID)
+			if lerr != nil {
+				log.V(3).Infof("Failed to list volumes created from snapshot: %v", lerr)
+				return err
+			}
+			if len(vols) > 0 {
+				return &SnapshotInUseError{SnapshotID: snapID, Volumes: vols}
+			}
+		}
 	}
 	return err
 }
 
+// getVolumesFromSnapshot returns the IDs of the volumes created from the given snapshot
+func (os *OpenStack) getVolumesFromSnapshot(ctx context.Context, snapID string) ([]string, error) {
+	var ids []string
+	err := os.volumePager(ctx, volumeListOpts{snapshotID: snapID}).EachPage(func(page pagination.Page) (bool, error) {
+		vols, err := pageVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range vols {
+			ids = append(ids, v.ID)
+		}
+		return true, nil
+	})
+	return ids, err
+}
+
 //GetSnapshotByID returns snapshot details by id
-func (os *OpenStack) GetSnapshotByID(snapshotID string) (*snapshots.Snapshot, error) {
-	s, err := snapshots.Get(os.blockstorage, snapshotID).Extract()
+func (os *OpenStack) GetSnapshotByID(ctx context.Context, snapshotID string) (*snapshots.Snapshot, error) {
+	s, err := snapshots.Get(os.blockStorageClient(ctx), snapshotID).Extract()
 	if err != nil {
-		klog.V(3).Infof("Failed to get snapshot: %v", err)
+		logging.FromContext(ctx).With(logging.Op, "GetSnapshotByID", logging.SnapshotID, snapshotID).V(3).Infof("Failed to get snapshot: %v", err)
 		return nil, err
 	}
 	return s, nil
 }
 
 // WaitSnapshotReady waits till snapshot is ready
-func (os *OpenStack) WaitSnapshotReady(snapshotID string) error {
+func (os *OpenStack) WaitSnapshotReady(ctx context.Context, snapshotID string) error {
 	backoff := wait.Backoff{
 		Duration: snapReadyDuration,
 		Factor:   snapReadyFactor,
 		Steps:    snapReadySteps,
 	}
 
-	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		ready, err := os.snapshotIsReady(snapshotID)
+	err := waitWithContext(ctx, backoff, func() (bool, error) {
+		ready, err := os.snapshotIsReady(ctx, snapshotID)
 		if err != nil {
 			return false, err
 		}
@@ -140,8 +229,8 @@ func (os *OpenStack) WaitSnapshotReady(snapshotID string) error {
 	return err
 }
 
-func (os *OpenStack) snapshotIsReady(snapshotID string) (bool, error) {
-	snap, err := os.GetSnapshotByID(snapshotID)
+func (os *OpenStack) snapshotIsReady(ctx context.Context, snapshotID string) (bool, error) {
+	snap, err := os.GetSnapshotByID(ctx, snapshotID)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,267 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+)
+
+const (
+	VolumeAttachingStatus = "attaching"
+	VolumeDetachingStatus = "detaching"
+	VolumeCreatingStatus  = "creating"
+	// a volume being migrated between backends, or retyped
+	VolumeMaintenanceStatus = "maintenance"
+	VolumeRetypingStatus    = "retyping"
+	stuckVolumeThreshold    = 10 * time.Minute
+	volumeCreateTimeout     = 30 * time.Minute
+	// the first Cinder microversion with the user messages API
+	messagesMicroversion = "volume 3.3"
+)
+
+// StuckVolumeError is returned when a volume stays attaching or detaching for
+// longer than the stuck-volume-threshold, e.g. after a restart of Nova compute.
+// Waiting longer or retrying doesn't help, the status of the volume must be
+// reset first.
+type StuckVolumeError struct {
+	VolumeID string
+	Status   string
+	For      time.Duration
+	// Recovered is set when the status of the volume was reset, the operation
+	// can then be retried
+	Recovered bool
+	// RecoveryErr is the error of the failed attempt to reset the status
+	RecoveryErr error
+}
+
+func (e *StuckVolumeError) Error() string {
+	msg := fmt.Sprintf("volume %s is stuck in %s status for %v", e.VolumeID, e.Status, e.For.Round(time.Second))
+	if e.Recovered {
+		msg += ", its status was reset"
+	} else if e.RecoveryErr != nil {
+		msg += fmt.Sprintf(", failed to reset its status: %v", e.RecoveryErr)
+	}
+	return msg
+}
+
+// FailedVolumeError is returned when a new volume went to error, or stayed
+// creating for longer than the volume-create-timeout. The volume is deleted so
+// that the next attempt to create it starts clean.
+type FailedVolumeError struct {
+	VolumeID string
+	Status   string
+	// For is how long the volume has been creating
+	For time.Duration
+	// Fault is the last message of Cinder about the volume, if any
+	Fault string
+	// Deleted is set when the volume was deleted, the creation can then be
+	// retried
+	Deleted bool
+	// DeleteErr is the error of the failed attempt to delete the volume
+	DeleteErr error
+}
+
+func (e *FailedVolumeError) Error() string {
+	var msg string
+	if e.Status == VolumeCreatingStatus {
+		msg = fmt.Sprintf("volume %s is stuck in %s status for %v", e.VolumeID, e.Status, e.For.Round(time.Second))
+	} else {
+		msg = fmt.Sprintf("volume %s went to %s status", e.VolumeID, e.Status)
+	}
+	if e.Fault != "" {
+		msg += ": " + e.Fault
+	}
+	if e.Deleted {
+		msg += ", it was deleted"
+	} else if e.DeleteErr != nil {
+		msg += fmt.Sprintf(", failed to delete it: %v", e.DeleteErr)
+	}
+	return msg
+}
+
+// transitionalStatuses are the statuses a volume stays in for a while during
+// an operation of the admin, e.g. a migration, before going back to the status
+// it had. Waits keep polling through them.
+var transitionalStatuses = map[string]bool{
+	VolumeMaintenanceStatus: true,
+	VolumeRetypingStatus:    true,
+}
+
+// isTransitionalStatus returns whether the volume is in one of the
+// transitional statuses
+func isTransitionalStatus(status string) bool {
+	return transitionalStatuses[status]
+}
+
+// statusTracker remembers since when a wait sees a volume in the same status
+type statusTracker struct {
+	status string
+	since  time.Time
+}
+
+func (t *statusTracker) observe(status string) time.Time {
+	if status != t.status || t.since.IsZero() {
+		t.status, t.since = status, time.Now()
+	}
+	return t.since
+}
+
+// checkStuck returns a StuckVolumeError if the volume has been attaching or
+// detaching for longer than the threshold, since its last update or since
+// seen, whichever is earlier. The status is reset first when configured to.
+func (os *OpenStack) checkStuck(ctx context.Context, volume Volume, seen time.Time) error {
+	if volume.Status != VolumeAttachingStatus && volume.Status != VolumeDetachingStatus {
+		return nil
+	}
+	since := seen
+	if !volume.UpdatedAt.IsZero() && volume.UpdatedAt.Before(since) {
+		since = volume.UpdatedAt
+	}
+	elapsed := time.Since(since)
+	if elapsed < os.bsOpts.StuckVolumeThreshold.Duration {
+		return nil
+	}
+
+	log := logging.FromContext(ctx).With(logging.Op, "RecoverStuckVolume", logging.VolumeID, volume.ID)
+	stuck := &StuckVolumeError{VolumeID: volume.ID, Status: volume.Status, For: elapsed}
+	if !os.bsOpts.RecoverStuckVolumes {
+		log.Warningf("Volume stuck in %s status for %v", volume.Status, elapsed.Round(time.Second))
+		return stuck
+	}
+
+	if err := os.resetStuckVolume(ctx, volume); err != nil {
+		log.Warningf("Failed to reset the %s status of the volume: %v", volume.Status, err)
+		stuck.RecoveryErr = err
+		return stuck
+	}
+	log.Warningf("Reset the status of the volume stuck in %s status for %v", volume.Status, elapsed.Round(time.Second))
+	stuck.Recovered = true
+	return stuck
+}
+
+// resetStuckVolume makes an attaching volume available again, and force
+// detaches a detaching one. Both are admin actions of Cinder by default.
+func (os *OpenStack) resetStuckVolume(ctx context.Context, volume Volume) error {
+	var body map[string]interface{}
+	if volume.Status == VolumeAttachingStatus {
+		body = map[string]interface{}{
+			"os-reset_status": map[string]string{
+				"status":        VolumeAvailableStatus,
+				"attach_status": "detached",
+			},
+		}
+	} else {
+		detach := map[string]interface{}{}
+		if volume.AttachmentID != "" {
+			detach["attachment_id"] = volume.AttachmentID
+		}
+		body = map[string]interface{}{"os-force_detach": detach}
+	}
+
+	client := os.blockStorageClient(ctx)
+	_, err := client.Post(client.ServiceURL("volumes", volume.ID, "action"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{http.StatusAccepted},
+	})
+	return err
+}
+
+// checkCreateFailed returns a FailedVolumeError after deleting the volume if
+// it went to error, or has been creating for longer than the
+// volume-create-timeout. A volume whose creation time is unknown is never
+// considered stuck.
+func (os *OpenStack) checkCreateFailed(ctx context.Context, volume Volume) error {
+	failed := &FailedVolumeError{VolumeID: volume.ID, Status: volume.Status}
+	switch {
+	case strings.HasPrefix(volume.Status, VolumeErrorStatus):
+		failed.Fault = os.volumeFault(ctx, volume.ID)
+	case volume.Status == VolumeCreatingStatus:
+		timeout := os.bsOpts.VolumeCreateTimeout.Duration
+		if timeout == 0 || volume.CreatedAt.IsZero() {
+			return nil
+		}
+		failed.For = time.Since(volume.CreatedAt)
+		if failed.For < timeout {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	log := logging.FromContext(ctx).With(logging.Op, "DeleteFailedVolume", logging.VolumeID, volume.ID)
+	if err := os.deleteFailedVolume(ctx, volume); err != nil {
+		log.Warningf("Failed to delete the volume in %s status: %v", volume.Status, err)
+		failed.DeleteErr = err
+		return failed
+	}
+	log.Warningf("Deleted the volume in %s status", volume.Status)
+	failed.Deleted = true
+	return failed
+}
+
+// deleteFailedVolume deletes a volume in error status, or force deletes one
+// stuck creating, which Cinder refuses to delete otherwise. Force deleting is
+// an admin action of Cinder by default.
+func (os *OpenStack) deleteFailedVolume(ctx context.Context, volume Volume) error {
+	client := os.blockStorageClient(ctx)
+	if volume.Status != VolumeCreatingStatus {
+		return volumes.Delete(client, volume.ID, nil).ExtractErr()
+	}
+	body := map[string]interface{}{"os-force_delete": map[string]interface{}{}}
+	_, err := client.Post(client.ServiceURL("volumes", volume.ID, "action"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{http.StatusAccepted},
+	})
+	return err
+}
+
+// volumeFault returns the last user message of Cinder about the volume, e.g.
+// "No valid backend was found", or an empty string if there is none or the
+// messages cannot be listed
+func (os *OpenStack) volumeFault(ctx context.Context, volumeID string) string {
+	if os.bsVersion == bsVersionV2 {
+		return ""
+	}
+	var body struct {
+		Messages []struct {
+			UserMessage string `json:"user_message"`
+			CreatedAt   string `json:"created_at"`
+		} `json:"messages"`
+	}
+	client := os.blockStorageClient(ctx)
+	_, err := client.Get(client.ServiceURL("messages")+"?resource_uuid="+volumeID, &body, &gophercloud.RequestOpts{
+		MoreHeaders: map[string]string{"OpenStack-API-Version": messagesMicroversion},
+	})
+	if err != nil {
+		logging.FromContext(ctx).V(4).Infof("Failed to list the messages of volume %s: %v", volumeID, err)
+		return ""
+	}
+	var fault, last string
+	for _, m := range body.Messages {
+		// the timestamps are in the same ISO 8601 format
+		if m.CreatedAt >= last {
+			fault, last = m.UserMessage, m.CreatedAt
+		}
+	}
+	return fault
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cinderTime formats a time as Cinder does, e.g. in updated_at
+func cinderTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000")
+}
+
+func stuckError(t *testing.T, err error) *StuckVolumeError {
+	stuck, ok := err.(*StuckVolumeError)
+	if !ok {
+		t.Fatalf("expected a StuckVolumeError, got %v", err)
+	}
+	return stuck
+}
+
+// Test a volume attaching since long ago is reported without waiting, and
+// left alone when recovery is off
+func TestWaitDiskAttachedStuck(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAttachingStatus, UpdatedAt: cinderTime(time.Now().Add(-time.Hour))})
+
+	_, err := cloud.WaitDiskAttached(context.Background(), fakeInstanceID, vol.ID)
+	stuck := stuckError(t, err)
+	assert.Equal(t, VolumeAttachingStatus, stuck.Status)
+	assert.True(t, stuck.For >= time.Hour, "stuck for %v", stuck.For)
+	assert.False(t, stuck.Recovered)
+	assert.Equal(t, 1, server.requestCount("GET /volume/volumes/{id}"))
+	assert.Equal(t, 0, server.requestCount("POST /volume/volumes/{id}/action"))
+	assert.Equal(t, VolumeAttachingStatus, server.volume(vol.ID).Status)
+}
+
+// Test a volume seen in the same status for longer than the threshold is
+// stuck, even if Cinder doesn't report when it was updated
+func TestWaitDiskDetachedStuckWhileWaiting(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeDetachingStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+	cloud.bsOpts.DetachSteps = 100
+	cloud.bsOpts.StuckVolumeThreshold = MyDuration{Duration: 20 * time.Millisecond}
+
+	err := cloud.WaitDiskDetached(context.Background(), fakeInstanceID, vol.ID)
+	assert.Equal(t, VolumeDetachingStatus, stuckError(t, err).Status)
+	assert.True(t, server.requestCount("GET /volume/volumes/{id}") > 1)
+}
+
+func TestAttachVolumeStuckRecovery(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAttachingStatus, UpdatedAt: cinderTime(time.Now().Add(-time.Hour))})
+	cloud.bsOpts.RecoverStuckVolumes = true
+
+	_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.True(t, stuckError(t, err).Recovered)
+	assert.Equal(t, VolumeAvailableStatus, server.volume(vol.ID).Status)
+	assert.Equal(t, 0, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+
+	// the retried attach goes through
+	_, err = cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+}
+
+func TestDetachVolumeStuckRecovery(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeDetachingStatus,
+		Attachments: []fakeServerAttachment{{AttachmentID: "b0d2d5b4-6a8e-4f0e-9f3c-1d2e3f4a5b6c", ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+		UpdatedAt:   cinderTime(time.Now().Add(-time.Hour)),
+	})
+	cloud.bsOpts.RecoverStuckVolumes = true
+
+	err := cloud.DetachVolume(context.Background(), fakeInstanceID, vol.ID)
+	assert.True(t, stuckError(t, err).Recovered)
+	assert.Equal(t, VolumeAvailableStatus, server.volume(vol.ID).Status)
+	assert.Empty(t, server.volume(vol.ID).Attachments)
+}
+
+// Test the stuck volume is still reported when the credentials don't allow
+// resetting its status
+func TestStuckRecoveryForbidden(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAttachingStatus, UpdatedAt: cinderTime(time.Now().Add(-time.Hour))})
+	cloud.bsOpts.RecoverStuckVolumes = true
+	server.inject("POST /volume/volumes/{id}/action", fakeServerFault{code: http.StatusForbidden})
+
+	_, err := cloud.AttachVolume(context.Background(), fakeInstanceID, vol.ID)
+	stuck := stuckError(t, err)
+	assert.False(t, stuck.Recovered)
+	assert.Error(t, stuck.RecoveryErr)
+	assert.Equal(t, VolumeAttachingStatus, server.volume(vol.ID).Status)
+}
+
+// Test a recent transition is not mistaken for a stuck volume
+func TestDetachVolumeNotStuck(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeDetachingStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+		UpdatedAt:   cinderTime(time.Now()),
+	})
+
+	err := cloud.DetachVolume(context.Background(), fakeInstanceID, vol.ID)
+	assert.Error(t, err)
+	_, stuck := err.(*StuckVolumeError)
+	assert.False(t, stuck)
+}
+
+// Test a slow volume is waited for, and not deleted once available whatever
+// its age
+func TestWaitVolumeCreatedSlow(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeCreatingStatus, CreatedAt: cinderTime(time.Now())})
+	server.setVolumeStatus(vol.ID, VolumeCreatingStatus)
+	server.setVolumeStatus(vol.ID, VolumeAvailableStatus)
+
+	assert.NoError(t, cloud.WaitVolumeCreated(context.Background(), vol.ID))
+	assert.Equal(t, 3, server.requestCount("GET /volume/volumes/{id}"))
+
+	old := server.addVolume(fakeServerVolume{Name: "old", Size: 1, CreatedAt: cinderTime(time.Now().Add(-time.Hour))})
+	assert.NoError(t, cloud.WaitVolumeCreated(context.Background(), old.ID))
+	assert.NotNil(t, server.volume(old.ID))
+	assert.Equal(t, 0, server.requestCount("POST /volume/volumes/{id}/action"))
+}
+
+func TestWaitVolumeCreatedStuck(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeCreatingStatus, CreatedAt: cinderTime(time.Now().Add(-time.Hour))})
+
+	err := cloud.WaitVolumeCreated(context.Background(), vol.ID)
+	failed, ok := err.(*FailedVolumeError)
+	if !ok {
+		t.Fatalf("expected a FailedVolumeError, got %v", err)
+	}
+	assert.True(t, failed.Deleted)
+	assert.True(t, failed.For >= time.Hour, "creating for %v", failed.For)
+	assert.Nil(t, server.volume(vol.ID))
+	assert.Equal(t, 1, server.requestCount("POST /volume/volumes/{id}/action"))
+}
+
+// Test a volume creating for less than the volume-create-timeout is left
+// alone when the wait gives up
+func TestWaitVolumeCreatedWithinTimeout(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeCreatingStatus, CreatedAt: cinderTime(time.Now())})
+
+	err := cloud.WaitVolumeCreated(context.Background(), vol.ID)
+	assert.Error(t, err)
+	_, failed := err.(*FailedVolumeError)
+	assert.False(t, failed)
+	assert.NotNil(t, server.volume(vol.ID))
+
+	// nor ever with the timeout off
+	cloud.bsOpts.VolumeCreateTimeout = MyDuration{}
+	stuck := server.addVolume(fakeServerVolume{Name: "stuck", Size: 1, Status: VolumeCreatingStatus, CreatedAt: cinderTime(time.Now().Add(-time.Hour))})
+	assert.Error(t, cloud.WaitVolumeCreated(context.Background(), stuck.ID))
+	assert.NotNil(t, server.volume(stuck.ID))
+	assert.Equal(t, 0, server.requestCount("POST /volume/volumes/{id}/action"))
+}
+
+func TestWaitVolumeCreatedError(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeCreatingStatus, CreatedAt: cinderTime(time.Now())})
+	server.setVolumeStatus(vol.ID, VolumeErrorStatus)
+	server.addMessage(vol.ID, "Schedule allocate volume:Could not find any available weighted backend.")
+	server.addMessage(vol.ID, "Create volume:Image download failed.")
+
+	err := cloud.WaitVolumeCreated(context.Background(), vol.ID)
+	failed, ok := err.(*FailedVolumeError)
+	if !ok {
+		t.Fatalf("expected a FailedVolumeError, got %v", err)
+	}
+	assert.True(t, failed.Deleted)
+	assert.Equal(t, VolumeErrorStatus, failed.Status)
+	assert.Equal(t, "Create volume:Image download failed.", failed.Fault)
+	assert.Contains(t, err.Error(), failed.Fault)
+	assert.Nil(t, server.volume(vol.ID))
+	assert.Equal(t, 1, server.requestCount("DELETE /volume/volumes/{id}"))
+}
+
+// Test the stuck volume is still reported when the credentials don't allow
+// force deleting it
+func TestWaitVolumeCreatedForceDeleteForbidden(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeCreatingStatus, CreatedAt: cinderTime(time.Now().Add(-time.Hour))})
+	server.inject("POST /volume/volumes/{id}/action", fakeServerFault{code: http.StatusForbidden})
+
+	err := cloud.WaitVolumeCreated(context.Background(), vol.ID)
+	failed, ok := err.(*FailedVolumeError)
+	if !ok {
+		t.Fatalf("expected a FailedVolumeError, got %v", err)
+	}
+	assert.False(t, failed.Deleted)
+	assert.Error(t, failed.DeleteErr)
+	assert.NotNil(t, server.volume(vol.ID))
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+// the first Nova microversion accepting a tag on volume attachments
+const taggedAttachMicroversion = "2.49"
+
+// attachTagging remembers where Nova refused tagged attachments: the whole
+// cloud when it doesn't know the microversion 2.49, else the instances whose
+// hypervisor doesn't support tagging
+type attachTagging struct {
+	mux         sync.Mutex
+	unsupported bool
+	untagged    map[string]bool
+}
+
+func newAttachTagging() *attachTagging {
+	return &attachTagging{untagged: make(map[string]bool)}
+}
+
+// supported returns whether attachments to the instance are tagged
+func (t *attachTagging) supported(instanceID string) bool {
+	if t == nil {
+		return true
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return !t.unsupported && !t.untagged[instanceID]
+}
+
+// refused records Nova refused a tagged attachment to the instance with err
+func (t *attachTagging) refused(instanceID string, err error) {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if cpoerrors.IsNotAcceptable(err) {
+		t.unsupported = true
+	} else {
+		t.untagged[instanceID] = true
+	}
+}
+
+// createAttachment attaches the volume to the instance as the device, or as
+// the one Nova picks if "", and returns the device reported by Nova. The
+// attachment is tagged with the volume ID, so that the
+// node finds its device in the metadata service on hypervisors not setting
+// the serial of the disks. Clouds or hypervisors refusing the tag get the
+// volume attached untagged.
+func (os *OpenStack) createAttachment(ctx context.Context, instanceID, volumeID, device string) (string, error) {
+	if !os.tagging.supported(instanceID) {
+		return os.createUntaggedAttachment(ctx, instanceID, volumeID, device)
+	}
+
+	attached, err := os.createTaggedAttachment(ctx, instanceID, volumeID, device)
+	// 406 when the microversion is unknown, 400 when the tag is unexpected
+	// or the hypervisor doesn't support tagging
+	if !cpoerrors.IsNotAcceptable(err) && !cpoerrors.IsBadRequest(err) {
+		return attached, err
+	}
+	log := logging.FromContext(ctx).With(logging.Op, "AttachVolume", logging.VolumeID, volumeID, logging.InstanceID, instanceID)
+	log.V(4).Infof("Tagged attach refused, attaching untagged: %v", err)
+	attached, untaggedErr := os.createUntaggedAttachment(ctx, instanceID, volumeID, device)
+	if untaggedErr == nil {
+		// the refusal was about the tag, not the volume
+		os.tagging.refused(instanceID, err)
+	}
+	return attached, untaggedErr
+}
+
+func (os *OpenStack) createTaggedAttachment(ctx context.Context, instanceID, volumeID, device string) (string, error) {
+	client := os.computeClient(ctx)
+	client.Microversion = taggedAttachMicroversion
+
+	volumeAttachment := map[string]string{
+		"volumeId": volumeID,
+		"tag":      volumeID,
+	}
+	if device != "" {
+		volumeAttachment["device"] = device
+	}
+	body := map[string]interface{}{"volumeAttachment": volumeAttachment}
+	var attachment struct {
+		VolumeAttachment volumeattach.VolumeAttachment `json:"volumeAttachment"`
+	}
+	_, err := client.Post(client.ServiceURL("servers", instanceID, "os-volume_attachments"), body, &attachment, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	if err != nil {
+		return "", err
+	}
+	return attachment.VolumeAttachment.Device, nil
+}
+
+func (os *OpenStack) createUntaggedAttachment(ctx context.Context, instanceID, volumeID, device string) (string, error) {
+	attachment, err := volumeattach.Create(os.computeClient(ctx), instanceID, &volumeattach.CreateOpts{
+		VolumeID: volumeID,
+		Device:   device,
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+	return attachment.Device, nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test volumes are attached tagged with their ID
+func TestAttachVolumeTagged(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	id, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, vol.ID, id)
+	assert.Equal(t, vol.ID, server.attachTag(vol.ID))
+	assert.Equal(t, 1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test clouds refusing tags get the volumes attached untagged, the cloud
+// being remembered as not supporting the microversion and the instance as not
+// supporting tagging
+func TestAttachVolumeTaggingRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		// whether the attach to another instance is tagged again
+		retagged bool
+	}{
+		{"microversion unsupported", http.StatusNotAcceptable, false},
+		{"hypervisor unsupported", http.StatusBadRequest, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+			ctx := context.Background()
+			server.refuseTaggedAttach(tt.code)
+
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+			_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "", server.attachTag(vol.ID))
+			assert.Equal(t, 2, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+
+			// the next attach to the instance is not tagged
+			other := server.addVolume(fakeServerVolume{Name: "other", Size: 1})
+			_, err = cloud.AttachVolume(ctx, fakeInstanceID, other.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+
+			third := server.addVolume(fakeServerVolume{Name: "third", Size: 1})
+			_, err = cloud.AttachVolume(ctx, "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f", third.ID)
+			assert.NoError(t, err)
+			expected := 4
+			if tt.retagged {
+				expected = 5
+			}
+			assert.Equal(t, expected, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+		})
+	}
+}
+
+// Test a volume Nova refuses to attach, tagged or not, doesn't turn the
+// tagging off
+func TestAttachVolumeRefusedKeepsTagging(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: "error"})
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+	_, err = cloud.AttachFetchedVolume(ctx, fakeInstanceID, &volume)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "status must be available")
+	}
+	assert.True(t, cloud.tagging.supported(fakeInstanceID))
+}
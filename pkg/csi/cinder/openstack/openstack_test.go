@@ -17,12 +17,18 @@ limitations under the License.
 package openstack
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 var fakeFileName = "cloud.conf"
@@ -70,6 +76,7 @@ region=` + fakeRegion + `
 	expectedOpts.Global.CAFile = fakeCAfile
 	expectedOpts.Global.TenantId = fakeTenantID
 	expectedOpts.Global.Region = fakeRegion
+	expectedOpts.BlockStorage = defaultBlockStorageOpts()
 
 	expectedEpOpts := gophercloud.EndpointOpts{
 		Region: fakeRegion,
@@ -86,6 +93,111 @@ region=` + fakeRegion + `
 	assert.Equal(expectedEpOpts, actualEpOpts)
 }
 
+// Test GetConfigFromFile with wait parameters set in the BlockStorage section
+func TestGetConfigFromFileBlockStorage(t *testing.T) {
+	// init file
+	var fakeFileContent = `
+[Global]
+username=` + fakeUserName + `
+password=` + fakePassword + `
+auth-url=` + fakeAuthUrl + `
+[BlockStorage]
+attach-init-delay=2s
+attach-factor=1.5
+attach-steps=20
+detach-init-delay=5s
+detach-factor=1.3
+detach-steps=25
+attach-jitter=0.3
+az-mapping=az1=az1-storage, az2=az2-storage
+`
+
+	f, err := os.Create(fakeFileName)
+	if err != nil {
+		t.Errorf("failed to create file: %v", err)
+	}
+
+	_, err = f.WriteString(fakeFileContent)
+	f.Close()
+	if err != nil {
+		t.Errorf("failed to write file: %v", err)
+	}
+	defer os.Remove(fakeFileName)
+
+	// Init assert
+	assert := assert.New(t)
+
+	// Invoke GetConfigFromFile
+	cfg, _, err := GetConfigFromFile(fakeFileName)
+	if err != nil {
+		t.Errorf("failed to GetConfigFromFile: %v", err)
+	}
+
+	opts := cfg.BlockStorage
+
+	// Assert
+	assert.Equal(wait.Backoff{Duration: 2 * time.Second, Factor: 1.5, Steps: 20, Jitter: 0.3}, opts.attachBackoff())
+	// Options not present in the file keep their defaults
+	assert.Equal(wait.Backoff{Duration: 5 * time.Second, Factor: 1.3, Steps: 25, Jitter: waitJitter}, opts.detachBackoff())
+	assert.Equal(wait.Backoff{Duration: operationFinishInitDelay, Factor: operationFinishFactor, Steps: operationFinishSteps, Jitter: waitJitter}, opts.operationBackoff())
+	assert.Equal("az2-storage", opts.AZMapping.CinderAZ("az2"))
+}
+
+// Test invalid wait parameters are rejected with the offending key
+func TestGetConfigFromFileInvalidBlockStorage(t *testing.T) {
+	tests := []struct {
+		option string
+		key    string
+	}{
+		{"attach-factor=0.5", "attach-factor"},
+		{"detach-steps=0", "detach-steps"},
+		{"operation-init-delay=0s", "operation-init-delay"},
+		{"device-path-steps=-1", "device-path-steps"},
+		{"attach-jitter=-0.1", "attach-jitter"},
+		{"device-path-jitter=2", "device-path-jitter"},
+		{"node-volume-attach-limit=-1", "node-volume-attach-limit"},
+		{"bs-version=v1", "bs-version"},
+		{"volume-name-prefix=" + strings.Repeat("k", 65), "volume-name-prefix"},
+		{"retry-init-delay=0s", "retry-init-delay"},
+		{"retry-max-delay=100ms", "retry-max-delay"},
+		{"retry-steps=-1", "retry-steps"},
+		{"api-read-qps=-1", "api-read-qps"},
+		{"api-write-qps=5", "api-write-burst"},
+		{"stuck-volume-threshold=0s", "stuck-volume-threshold"},
+		{"volume-create-timeout=-1m", "volume-create-timeout"},
+		{"az-mapping=az1", "az-mapping"},
+		{"az-mapping=az1=a,az1=b", "az-mapping"},
+	}
+
+	for _, tt := range tests {
+		content := "[Global]\nusername=" + fakeUserName + "\n[BlockStorage]\n" + tt.option + "\n"
+		if err := ioutil.WriteFile(fakeFileName, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		_, _, err := GetConfigFromFile(fakeFileName)
+		if assert.Error(t, err, tt.option) {
+			assert.Contains(t, err.Error(), tt.key)
+		}
+	}
+	os.Remove(fakeFileName)
+}
+
+// Test the default wait parameters match the historical behaviour, up to the
+// jitter
+func TestDefaultBlockStorageOpts(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := defaultBlockStorageOpts()
+
+	assert.Equal(wait.Backoff{Duration: 1 * time.Second, Factor: 1.2, Steps: 15, Jitter: 0.1}, opts.attachBackoff())
+	assert.Equal(wait.Backoff{Duration: 1 * time.Second, Factor: 1.2, Steps: 13, Jitter: 0.1}, opts.detachBackoff())
+	assert.Equal(wait.Backoff{Duration: 1 * time.Second, Factor: 1.1, Steps: 10, Jitter: 0.1}, opts.operationBackoff())
+	assert.Equal(wait.Backoff{Duration: 1 * time.Second, Factor: 1.1, Steps: 15, Jitter: 0.1}, opts.DevicePathBackoff())
+	assert.Equal(5, opts.RetrySteps)
+	assert.NoError(opts.validate())
+}
+
 // Test GetConfigFromEnv
 func TestGetConfigFromEnv(t *testing.T) {
 	env := clearEnviron(t)
@@ -144,3 +256,210 @@ func resetEnviron(t *testing.T, items []string) {
 		}
 	}
 }
+
+func TestUserAgent(t *testing.T) {
+	defer SetUserAgentInfo("", "")
+
+	tests := []struct {
+		cluster, node string
+		expected      string
+	}{
+		{"", "", "cinder-csi-plugin/dev"},
+		{"kubernetes", "", "cinder-csi-plugin/dev cluster/kubernetes"},
+		{"kubernetes", "node-1", "cinder-csi-plugin/dev cluster/kubernetes node/node-1"},
+		{"", "node-1", "cinder-csi-plugin/dev node/node-1"},
+	}
+	for _, tt := range tests {
+		SetUserAgentInfo(tt.cluster, tt.node)
+		assert.Equal(t, tt.expected, userAgent())
+	}
+}
+
+// Test the request ID logger passes the responses through and reads the
+// request ID headers
+func TestRequestIDLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/volumes":
+			w.Header().Set("X-Openstack-Request-Id", "req-volumes")
+		case "/servers":
+			w.Header().Set("X-Compute-Request-Id", "req-servers")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	client := &http.Client{}
+	withRequestIDLogger(client)
+
+	for path, expected := range map[string]string{
+		"/volumes": "req-volumes",
+		"/servers": "req-servers",
+		"/other":   "",
+	} {
+		resp, err := client.Get(server.URL + path)
+		assert.NoError(err)
+		assert.Equal(http.StatusAccepted, resp.StatusCode)
+		assert.Equal(expected, requestID(resp))
+		resp.Body.Close()
+	}
+}
+
+// Test waitWithContext stops polling as soon as the context is cancelled
+func TestWaitWithContextCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backoff := wait.Backoff{Duration: time.Hour, Factor: 1, Steps: 3}
+
+	calls := 0
+	go cancel()
+	start := time.Now()
+	err := waitWithContext(ctx, backoff, func() (bool, error) {
+		calls++
+		return false, nil
+	})
+	assert.Equal(context.Canceled, err)
+	assert.True(time.Since(start) < time.Minute)
+	assert.True(calls <= 1)
+
+	// without a cancellation the usual timeout error is returned
+	backoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+	err = waitWithContext(context.Background(), backoff, func() (bool, error) {
+		return false, nil
+	})
+	assert.Equal(wait.ErrWaitTimeout, err)
+}
+
+// Test the jitter spreads the delays of the waits, so that plugins started
+// together don't poll Cinder in lockstep
+func TestJitter(t *testing.T) {
+	assert := assert.New(t)
+	backoff := defaultBlockStorageOpts().attachBackoff()
+
+	// delays returns the delays waitWithContext sleeps for with the backoff
+	delays := func() []time.Duration {
+		var delays []time.Duration
+		duration := backoff.Duration
+		for i := 0; i < backoff.Steps; i++ {
+			delays = append(delays, jitter(duration, backoff.Jitter))
+			duration = time.Duration(float64(duration) * backoff.Factor)
+		}
+		return delays
+	}
+
+	base := backoff.Duration
+	for i := 0; i < 1000; i++ {
+		d := jitter(base, backoff.Jitter)
+		assert.True(d >= base && d <= base+base/10, "delay %v out of bounds", d)
+	}
+
+	identical := 0
+	for i := 0; i < 100; i++ {
+		first, second := delays(), delays()
+		for step := range first {
+			if first[step] == second[step] {
+				identical++
+			}
+		}
+	}
+	// two nanosecond-precision random delays are very unlikely to be equal
+	assert.True(identical < 10, "%d identical delays", identical)
+
+	assert.Equal(base, jitter(base, 0))
+}
+
+// Test the Block Storage API version is picked from the service catalog
+func TestNewBlockStorageClient(t *testing.T) {
+	tests := []struct {
+		name      string
+		catalog   []string
+		bsVersion string
+		expected  string
+		endpoint  string
+	}{
+		{"auto prefers v3", []string{"volumev2", "volumev3"}, "auto", "v3", "https://volumev3/"},
+		{"auto falls back to v2", []string{"volumev2"}, "auto", "v2", "https://volumev2/"},
+		{"forced v2", []string{"volumev2", "volumev3"}, "v2", "v2", "https://volumev2/"},
+		{"forced v3 missing", []string{"volumev2"}, "v3", "", ""},
+		{"auto without endpoint", []string{"compute"}, "auto", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &gophercloud.ProviderClient{
+				EndpointLocator: func(opts gophercloud.EndpointOpts) (string, error) {
+					for _, service := range tt.catalog {
+						if service == opts.Type {
+							return "https://" + service + "/", nil
+						}
+					}
+					return "", &gophercloud.ErrEndpointNotFound{}
+				},
+			}
+
+			client, version, err := newBlockStorageClient(provider, gophercloud.EndpointOpts{}, tt.bsVersion)
+			if tt.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+			assert.Equal(t, tt.endpoint, client.Endpoint)
+		})
+	}
+}
+
+// Test extending an attached volume through the v2 API fails clearly
+func TestExpandVolumeV2InUse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"volume": {"id": "vol-1", "status": "in-use", "size": 1}}`))
+	}))
+	defer server.Close()
+
+	cloud := &OpenStack{
+		blockstorage: &gophercloud.ServiceClient{
+			ProviderClient: &gophercloud.ProviderClient{},
+			Endpoint:       server.URL + "/",
+		},
+		bsVersion: bsVersionV2,
+	}
+
+	err := cloud.ExpandVolume(context.Background(), "vol-1", 2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires the Block Storage API v3")
+	}
+}
+
+// Test default-volume-type is checked against the volume types of the cloud
+func TestValidateVolumeType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"volume_types": [{"id": "6685584b-1eac-4da6-b5c3-555430cf68ff", "name": "ssd"}]}`))
+	}))
+	defer server.Close()
+
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+
+	assert.NoError(t, validateVolumeType(client, "ssd"))
+	assert.NoError(t, validateVolumeType(client, "6685584b-1eac-4da6-b5c3-555430cf68ff"))
+	err := validateVolumeType(client, "sdd")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "default-volume-type")
+	}
+
+	// volume types that can't be listed are not validated
+	server.Close()
+	assert.NoError(t, validateVolumeType(client, "sdd"))
+}
@@ -17,15 +17,21 @@ limitations under the License.
 package openstack
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/gophercloud/gophercloud"
+	volumesv2 "github.com/gophercloud/gophercloud/openstack/blockstorage/v2/volumes"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/pagination"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
 	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
-
-	"k8s.io/klog"
 )
 
 const (
@@ -42,11 +48,26 @@ const (
 	diskDetachInitDelay      = 1 * time.Second
 	diskDetachFactor         = 1.2
 	diskDetachSteps          = 13
-	volumeDescription        = "Created by OpenStack Cinder CSI driver"
+	devicePathInitDelay      = 1 * time.Second
+	devicePathFactor         = 1.1
+	devicePathSteps          = 15
+	waitJitter               = 0.1 // lengthens the waits by up to a tenth, the plugins don't poll in lockstep
+	attachNotFoundRetries    = 2   // polls not finding a volume never seen yet, reads may lag behind
+	bsVersionAuto            = "auto"
+	bsVersionV2              = "v2"
+	bsVersionV3              = "v3"
+	// DefaultVolumeDescription is the description of the volumes when
+	// volume-description is not set
+	DefaultVolumeDescription = "Created by OpenStack Cinder CSI driver"
+	// Leave room in the 255 characters of the display name for the PV name
+	maxVolumeNamePrefixLength = 64
+	// Default maximum number of volumes attached to one instance
+	defaultNodeVolumeAttachLimit = 256
 )
 
 type Volume struct {
 	// ID of the instance, to which this volume is attached. "" if not attached
+	// and the first of them for a multiattach volume
 	AttachedServerId string
 	// Device file path
 	AttachedDevice string
@@ -54,219 +75,621 @@ type Volume struct {
 	ID string
 	// Human-readable display name for the volume.
 	Name string
+	// Human-readable description for the volume.
+	Description string
 	// Current status of the volume.
 	Status string
+	// Replication status of the volume, e.g. enabled or failing-over for a
+	// replicated volume type
+	ReplicationStatus string
 	// Volume size in GB
 	Size int
 	// Availability Zone the volume belongs to
 	AZ string
+	// Metadata key/value pairs of the volume
+	Metadata map[string]string
+	// ID of the Cinder attachment, to force detach the volume
+	AttachmentID string
+	// Device name the volume was just attached as, "" when Nova picked it
+	RequestedDevice string
+	// Last time the volume was updated, e.g. its status changed
+	UpdatedAt time.Time
+	// Time the volume was created at
+	CreatedAt time.Time
+	// Attachments of the volume, one per instance for a multiattach volume
+	Attachments []Attachment
+	// Whether the volume can be booted from
+	Bootable bool
+	// ID of the snapshot the volume was created from, if any
+	SnapshotID string
+	// Image metadata of the volume, e.g. hw_disk_bus, which Nova applies to
+	// the disk of the volume
+	ImageMetadata map[string]string
+}
+
+// Attachment is the attachment of a volume to an instance
+type Attachment struct {
+	ServerID     string
+	Device       string
+	AttachmentID string
+}
+
+// AttachedTo returns the attachment of the volume to the instance, false if
+// it is not attached to it
+func (v Volume) AttachedTo(instanceID string) (Attachment, bool) {
+	for _, a := range v.Attachments {
+		if a.ServerID == instanceID {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// rootDevices are the devices of the first disk of the buses instances boot
+// from
+var rootDevices = map[string]bool{
+	"/dev/vda":  true,
+	"/dev/sda":  true,
+	"/dev/xvda": true,
+	"/dev/hda":  true,
+}
+
+// RootAttachment returns the attachment of a bootable volume as the root disk
+// of the instance, or of any instance if instanceID is empty, false if there
+// is none. Bootable volumes attached as another disk are data volumes that
+// were merely created from an image.
+func (v Volume) RootAttachment(instanceID string) (Attachment, bool) {
+	if !v.Bootable {
+		return Attachment{}, false
+	}
+	for _, a := range v.Attachments {
+		if (instanceID == "" || a.ServerID == instanceID) && rootDevices[a.Device] {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// setAttachments sets the attachments of the volume, the first one being the
+// attachment of a volume attached to a single instance
+func (v *Volume) setAttachments(attachments []Attachment) {
+	v.Attachments = attachments
+	if len(attachments) > 0 {
+		v.AttachedServerId = attachments[0].ServerID
+		v.AttachedDevice = attachments[0].Device
+		v.AttachmentID = attachments[0].AttachmentID
+	}
+}
+
+// volumeFromV3 returns the Volume of a volume of the Block Storage API v3
+func volumeFromV3(vol *volumes.Volume) *Volume {
+	volume := &Volume{
+		ID:                vol.ID,
+		Name:              vol.Name,
+		Description:       vol.Description,
+		Status:            vol.Status,
+		ReplicationStatus: vol.ReplicationStatus,
+		Size:              vol.Size,
+		AZ:                vol.AvailabilityZone,
+		Metadata:          vol.Metadata,
+		UpdatedAt:         vol.UpdatedAt,
+		CreatedAt:         vol.CreatedAt,
+		Bootable:          vol.Bootable == "true",
+		SnapshotID:        vol.SnapshotID,
+		ImageMetadata:     vol.VolumeImageMetadata,
+	}
+	var attachments []Attachment
+	for _, a := range vol.Attachments {
+		attachments = append(attachments, Attachment{ServerID: a.ServerID, Device: a.Device, AttachmentID: a.AttachmentID})
+	}
+	volume.setAttachments(attachments)
+	return volume
+}
+
+// volumeFromV2 returns the Volume of a volume of the Block Storage API v2
+func volumeFromV2(vol *volumesv2.Volume) *Volume {
+	volume := &Volume{
+		ID:                vol.ID,
+		Name:              vol.Name,
+		Description:       vol.Description,
+		Status:            vol.Status,
+		ReplicationStatus: vol.ReplicationStatus,
+		Size:              vol.Size,
+		AZ:                vol.AvailabilityZone,
+		Metadata:          vol.Metadata,
+		UpdatedAt:         vol.UpdatedAt,
+		CreatedAt:         vol.CreatedAt,
+		Bootable:          vol.Bootable == "true",
+		SnapshotID:        vol.SnapshotID,
+		ImageMetadata:     vol.VolumeImageMetadata,
+	}
+	var attachments []Attachment
+	for _, a := range vol.Attachments {
+		attachments = append(attachments, Attachment{ServerID: a.ServerID, Device: a.Device, AttachmentID: a.AttachmentID})
+	}
+	volume.setAttachments(attachments)
+	return volume
+}
+
+// LegacyCreateVolume creates a volume and returns its ID, zone and size.
+//
+// Deprecated: use IOpenStack.CreateVolume, which returns the new volume.
+func LegacyCreateVolume(ctx context.Context, cloud IOpenStack, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (string, string, int, error) {
+	vol, err := cloud.CreateVolume(ctx, name, size, vtype, availability, snapshotID, description, tags)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return vol.ID, vol.AZ, vol.Size, nil
 }
 
-// CreateVolume creates a volume of given size
-func (os *OpenStack) CreateVolume(name string, size int, vtype, availability string, snapshotID string, tags *map[string]string) (string, string, int, error) {
+// CreateVolume creates a volume of given size and returns it as Cinder
+// reported it at creation, usually still creating
+func (os *OpenStack) CreateVolume(ctx context.Context, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error) {
+	if os.bsVersion == bsVersionV2 {
+		return os.createVolumeV2(ctx, name, size, vtype, availability, snapshotID, description, tags)
+	}
+
 	opts := &volumes.CreateOpts{
 		Name:             name,
 		Size:             size,
 		VolumeType:       vtype,
 		AvailabilityZone: availability,
-		Description:      volumeDescription,
+		Description:      description,
 		SnapshotID:       snapshotID,
 	}
 	if tags != nil {
 		opts.Metadata = *tags
 	}
 
-	vol, err := volumes.Create(os.blockstorage, opts).Extract()
+	vol, err := volumes.Create(os.blockStorageClient(ctx), opts).Extract()
 	if err != nil {
-		return "", "", 0, err
+		return nil, err
 	}
 
-	return vol.ID, vol.AvailabilityZone, vol.Size, nil
+	return volumeFromV3(vol), nil
 }
 
-// ListVolumes list all the volumes
-func (os *OpenStack) ListVolumes() ([]Volume, error) {
+// createVolumeV2 is CreateVolume for the Block Storage API v2
+func (os *OpenStack) createVolumeV2(ctx context.Context, name string, size int, vtype, availability string, snapshotID string, description string, tags *map[string]string) (*Volume, error) {
+	opts := &volumesv2.CreateOpts{
+		Name:             name,
+		Size:             size,
+		VolumeType:       vtype,
+		AvailabilityZone: availability,
+		Description:      description,
+		SnapshotID:       snapshotID,
+	}
+	if tags != nil {
+		opts.Metadata = *tags
+	}
 
-	var vlist []Volume
-	opts := volumes.ListOpts{}
-	pages, err := volumes.List(os.blockstorage, opts).AllPages()
+	vol, err := volumesv2.Create(os.blockStorageClient(ctx), opts).Extract()
 	if err != nil {
-		return vlist, err
+		return nil, err
 	}
-	vols, err := volumes.ExtractVolumes(pages)
+
+	return volumeFromV2(vol), nil
+}
+
+// ListVolumes list all the volumes
+func (os *OpenStack) ListVolumes(ctx context.Context) ([]Volume, error) {
+	var vlist []Volume
+	err := os.volumePager(ctx, volumeListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+		vols, err := pageVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		vlist = append(vlist, vols...)
+		return true, nil
+	})
+	return vlist, err
+}
+
+// ListVolumesWithPage lists up to limit volumes matching filters, starting
+// after the volume marker, and returns the marker of the next page, empty
+// after the last one. With limit 0 Cinder returns up to its osapi_max_limit.
+// The filters are VolumeNameFilter, VolumeStatusFilter and metadata keys
+// prefixed with VolumeMetadataFilterPrefix.
+func (os *OpenStack) ListVolumesWithPage(ctx context.Context, limit int, marker string, filters map[string]string) ([]Volume, string, error) {
+	opts, err := parseVolumeFilters(filters)
 	if err != nil {
-		return vlist, err
+		return nil, "", err
 	}
+	opts.limit, opts.marker = limit, marker
 
-	for _, v := range vols {
-		volume := Volume{
-			ID:     v.ID,
-			Name:   v.Name,
-			Status: v.Status,
-			AZ:     v.AvailabilityZone,
-			Size:   v.Size,
+	var vlist []Volume
+	var next string
+	err = os.volumePager(ctx, opts).EachPage(func(page pagination.Page) (bool, error) {
+		var err error
+		if vlist, err = pageVolumes(page); err != nil {
+			return false, err
+		}
+		nextURL, err := page.NextPageURL()
+		if err != nil {
+			return false, err
 		}
-		vlist = append(vlist, volume)
+		next, err = pageMarker(nextURL)
+		// the next pages are left to the next call
+		return false, err
+	})
+	if err != nil && marker != "" && (cpoerrors.IsNotFound(err) || cpoerrors.IsBadRequest(err)) {
+		return nil, "", &InvalidMarkerError{Marker: marker, Err: err}
+	}
+	if err != nil {
+		return nil, "", err
 	}
-	return vlist, nil
+	return vlist, next, nil
 }
 
 // GetVolumesByName is a wrapper around ListVolumes that creates a Name filter to act as a GetByName
 // Returns a list of Volume references with the specified name
-func (os *OpenStack) GetVolumesByName(n string) ([]Volume, error) {
+func (os *OpenStack) GetVolumesByName(ctx context.Context, n string) ([]Volume, error) {
 	var vlist []Volume
-	opts := volumes.ListOpts{Name: n}
-	pages, err := volumes.List(os.blockstorage, opts).AllPages()
-	if err != nil {
-		return vlist, err
-	}
+	err := os.volumePager(ctx, volumeListOpts{name: n}).EachPage(func(page pagination.Page) (bool, error) {
+		vols, err := pageVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		vlist = append(vlist, vols...)
+		return true, nil
+	})
+	return vlist, err
+}
 
-	vols, err := volumes.ExtractVolumes(pages)
-	if err != nil {
-		return vlist, err
-	}
+// VolumeInUseError is returned when a volume cannot be deleted because it is
+// still attached
+type VolumeInUseError struct {
+	VolumeID string
+	// IDs of the instances the volume is attached to
+	ServerIDs []string
+	// names of the instances, the names of their nodes, by ID. Instances
+	// whose name couldn't be fetched are missing.
+	ServerNames map[string]string
+}
 
-	for _, v := range vols {
-		volume := Volume{
-			ID:     v.ID,
-			Name:   v.Name,
-			Status: v.Status,
-			Size:   v.Size,
-			AZ:     v.AvailabilityZone,
+func (e *VolumeInUseError) Error() string {
+	servers := make([]string, 0, len(e.ServerIDs))
+	for _, id := range e.ServerIDs {
+		if name := e.ServerNames[id]; name != "" {
+			servers = append(servers, fmt.Sprintf("%s (instance %s)", name, id))
+		} else {
+			servers = append(servers, "instance "+id)
 		}
-		vlist = append(vlist, volume)
 	}
-	return vlist, nil
+	return fmt.Sprintf("volume %s is still attached to %s", e.VolumeID, strings.Join(servers, ", "))
 }
 
-// DeleteVolume delete a volume
-func (os *OpenStack) DeleteVolume(volumeID string) error {
-	used, err := os.diskIsUsed(volumeID)
-	if err != nil {
-		return err
-	}
-	if used {
-		return fmt.Errorf("Cannot delete the volume %q, it's still attached to a node", volumeID)
+// DeleteVolume delete a volume. The volume is checked not to be attached
+// first, unless it is known to have been detached, e.g. right after waiting
+// for it: Cinder refuses to delete an attached volume anyway, the check is
+// made then.
+func (os *OpenStack) DeleteVolume(ctx context.Context, volumeID string, knownDetached bool) error {
+	if !knownDetached {
+		if err := os.checkNotInUse(ctx, volumeID); err != nil {
+			return err
+		}
 	}
 
-	err = volumes.Delete(os.blockstorage, volumeID, nil).ExtractErr()
+	err := volumes.Delete(os.blockStorageClient(ctx), volumeID, nil).ExtractErr()
+	if err != nil && knownDetached && cpoerrors.IsBadRequest(err) {
+		// attached again since it was detached
+		if inUse := os.checkNotInUse(ctx, volumeID); inUse != nil {
+			return inUse
+		}
+	}
 	return err
 }
 
 // GetVolume retrieves Volume by its ID.
-func (os *OpenStack) GetVolume(volumeID string) (Volume, error) {
+func (os *OpenStack) GetVolume(ctx context.Context, volumeID string) (Volume, error) {
 
-	vol, err := volumes.Get(os.blockstorage, volumeID).Extract()
+	vol, err := volumes.Get(os.blockStorageClient(ctx), volumeID).Extract()
 	if err != nil {
 		return Volume{}, err
 	}
 
-	volume := Volume{
-		ID:     vol.ID,
-		Name:   vol.Name,
-		Status: vol.Status,
-	}
+	return *volumeFromV3(vol), nil
+}
+
+// WaitVolumeCreated waits for a new volume to become available. A volume
+// that went to error, or is stuck creating, is deleted and a
+// FailedVolumeError returned.
+func (os *OpenStack) WaitVolumeCreated(ctx context.Context, volumeID string) error {
+	var volume Volume
+	err := waitWithContext(ctx, os.bsOpts.operationBackoff(), func() (bool, error) {
+		var err error
+		volume, err = os.GetVolume(ctx, volumeID)
+		if err != nil {
+			return false, err
+		}
+		if volume.Status == VolumeAvailableStatus {
+			return true, nil
+		}
+		return false, os.checkCreateFailed(ctx, volume)
+	})
 
-	if len(vol.Attachments) > 0 {
-		volume.AttachedServerId = vol.Attachments[0].ServerID
-		volume.AttachedDevice = vol.Attachments[0].Device
+	if err == wait.ErrWaitTimeout {
+		err = fmt.Errorf("volume %q is still in %s status", volumeID, volume.Status)
 	}
+	return err
+}
 
-	return volume, nil
+// WaitVolumeTargetStatus waits for the volume to reach one of the target
+// statuses. It keeps polling through the transitional statuses and the
+// attaching and detaching ones until they are stuck, and fails as soon as
+// the volume goes to an error or any other status.
+func (os *OpenStack) WaitVolumeTargetStatus(ctx context.Context, volumeID string, targets ...string) error {
+	var tracker statusTracker
+	var volume Volume
+	err := waitWithContext(ctx, os.bsOpts.operationBackoff(), func() (bool, error) {
+		var err error
+		volume, err = os.GetVolume(ctx, volumeID)
+		if err != nil {
+			return false, err
+		}
+		for _, target := range targets {
+			if volume.Status == target {
+				return true, nil
+			}
+		}
+		switch {
+		case isFailingOver(volume):
+			logging.FromContext(ctx).V(4).Infof("Volume %s is failing over in %s status, waiting", volumeID, volume.Status)
+			return false, nil
+		case strings.HasPrefix(volume.Status, VolumeErrorStatus):
+			return false, fmt.Errorf("volume %q went to %s status", volumeID, volume.Status)
+		case isTransitionalStatus(volume.Status):
+			logging.FromContext(ctx).V(4).Infof("Volume %s is in %s status, waiting", volumeID, volume.Status)
+			return false, nil
+		case volume.Status == VolumeAttachingStatus || volume.Status == VolumeDetachingStatus:
+			return false, os.checkStuck(ctx, volume, tracker.observe(volume.Status))
+		}
+		return false, fmt.Errorf("volume %q is in %s status, expected %s", volumeID, volume.Status, strings.Join(targets, " or "))
+	})
+
+	if err == wait.ErrWaitTimeout && isFailingOver(volume) {
+		err = fmt.Errorf("volume %q is still failing over in %s status", volumeID, volume.Status)
+	} else if err == wait.ErrWaitTimeout {
+		err = fmt.Errorf("volume %q is still in %s status", volumeID, volume.Status)
+	}
+	return err
 }
 
 // AttachVolume attaches given cinder volume to the compute
-func (os *OpenStack) AttachVolume(instanceID, volumeID string) (string, error) {
-	volume, err := os.GetVolume(volumeID)
+func (os *OpenStack) AttachVolume(ctx context.Context, instanceID, volumeID string) (string, error) {
+	volume, err := os.GetVolume(ctx, volumeID)
 	if err != nil {
 		return "", err
 	}
+	if _, err := os.AttachFetchedVolume(ctx, instanceID, &volume); err != nil {
+		return "", err
+	}
+	return volume.ID, nil
+}
 
-	if volume.AttachedServerId != "" {
-		if instanceID == volume.AttachedServerId {
-			klog.V(4).Infof("Disk %s is already attached to instance %s", volumeID, instanceID)
-			return volume.ID, nil
+// AttachFetchedVolume attaches a volume the caller already got to the
+// compute, and returns the device of the attachment: the one Nova reserved
+// for a new attachment, the one known to Cinder for an existing one
+func (os *OpenStack) AttachFetchedVolume(ctx context.Context, instanceID string, volume *Volume) (string, error) {
+	volumeID := volume.ID
+	log := logging.FromContext(ctx).With(logging.Op, "AttachVolume", logging.VolumeID, volumeID, logging.InstanceID, instanceID)
+
+	// any attachment of a multiattach volume may be the one to the instance
+	attachment, attached := volume.AttachedTo(instanceID)
+	if !attached && volume.AttachedServerId == instanceID {
+		attachment, attached = Attachment{ServerID: instanceID, Device: volume.AttachedDevice, AttachmentID: volume.AttachmentID}, true
+	}
+	if attached {
+		// e.g. a publish retried after a restart of the controller, given
+		// the device Nova reports as a new attachment would be
+		log.V(4).Infof("Volume is already attached to the instance")
+		device, err := os.attachmentDevice(ctx, volumeID, attachment)
+		if err != nil {
+			log.V(3).Infof("Failed to get the device of the attachment: %v", err)
+			return "", nil
 		}
+		return device, nil
+	}
+	if volume.AttachedServerId != "" {
 		return "", fmt.Errorf("disk %s is attached to a different instance (%s)", volumeID, volume.AttachedServerId)
 	}
+	if err := os.checkStuck(ctx, *volume, time.Now()); err != nil {
+		return "", err
+	}
+	// Nova refuses to attach a volume being migrated or retyped, it is
+	// attachable again once available
+	if isTransitionalStatus(volume.Status) {
+		log.V(3).Infof("Volume is in %s status, waiting for it to be available", volume.Status)
+		if err := os.WaitVolumeTargetStatus(ctx, volumeID, VolumeAvailableStatus); err != nil {
+			return "", err
+		}
+		volume.Status = VolumeAvailableStatus
+	}
+	// Nova refuses to attach volumes to shelved instances until they are
+	// unshelved, the attach would fail for good
+	if state, err := os.GetInstanceState(ctx, instanceID); err != nil {
+		log.V(4).Infof("Failed to get the state of the instance: %v", err)
+	} else if isShelved(state) {
+		return "", &InstanceShelvedError{InstanceID: instanceID, VMState: state}
+	}
 
-	_, err = volumeattach.Create(os.compute, instanceID, &volumeattach.CreateOpts{
-		VolumeID: volume.ID,
-	}).Extract()
+	// an instance busy with e.g. a reboot refuses the attach for a while, it
+	// is retried with the attach backoff within the deadline of the request
+	hint := os.deviceHint(ctx, instanceID)
+	var conflict error
+	var device, requested string
+	err := waitWithContext(ctx, os.bsOpts.attachBackoff(), func() (bool, error) {
+		var err error
+		device, requested, err = os.createHintedAttachment(ctx, instanceID, volumeID, hint)
+		if state := transientTaskState(err); state != "" {
+			log.V(3).Infof("Instance is in task_state %s, retrying the attach", state)
+			conflict = err
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	})
 
+	if err == wait.ErrWaitTimeout {
+		err = conflict
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return "", err
+	}
+	if isInstanceLocked(err) {
+		return "", &InstanceLockedError{InstanceID: instanceID, Reason: os.lockedReason(ctx, instanceID)}
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to attach %s volume to %s compute: %v", volumeID, instanceID, err)
 	}
-	klog.V(2).Infof("Successfully attached %s volume to %s compute", volumeID, instanceID)
-	return volume.ID, nil
+	os.instances.forgetAttachments(instanceID)
+	volume.RequestedDevice = requested
+	log.V(2).Infof("Successfully attached volume as %s", device)
+	return device, nil
 }
 
-// WaitDiskAttached waits for attched
-func (os *OpenStack) WaitDiskAttached(instanceID string, volumeID string) error {
-	backoff := wait.Backoff{
-		Duration: diskAttachInitDelay,
-		Factor:   diskAttachFactor,
-		Steps:    diskAttachSteps,
-	}
+// VolumeDeletedError is returned when a volume is deleted while waiting for
+// it to be attached
+type VolumeDeletedError struct {
+	VolumeID string
+}
+
+func (e *VolumeDeletedError) Error() string {
+	return fmt.Sprintf("volume %s deleted while waiting for attach", e.VolumeID)
+}
 
-	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		attached, err := os.diskIsAttached(instanceID, volumeID)
-		if err != nil && !cpoerrors.IsNotFound(err) {
-			// if this is a race condition indicate the volume is deleted
-			// during sleep phase, ignore the error and return attach=false
+// WaitDiskAttached waits for attched and returns the attached volume, with
+// its attachments. Cinder is polled rather than Nova, which reports the
+// attachment as soon as the device is reserved, before the volume is attached.
+func (os *OpenStack) WaitDiskAttached(ctx context.Context, instanceID string, volumeID string) (Volume, error) {
+	backoff := os.bsOpts.attachBackoff()
+
+	var tracker statusTracker
+	var attached Volume
+	seen, notFound := false, 0
+	err := waitWithContext(ctx, backoff, func() (bool, error) {
+		volume, err := os.GetVolume(ctx, volumeID)
+		if err != nil {
+			if !cpoerrors.IsNotFound(err) {
+				return false, err
+			}
+			// a replica of the database lagging behind the attach request
+			// may not know the volume yet, once seen it was deleted
+			if !seen && notFound < attachNotFoundRetries {
+				notFound++
+				logging.FromContext(ctx).V(4).Infof("Volume %s not found yet, retrying", volumeID)
+				return false, nil
+			}
+			return false, &VolumeDeletedError{VolumeID: volumeID}
+		}
+		seen = true
+		attached = volume
+		// the attachment to the instance is not the first one of a volume
+		// already attached to other instances
+		_, ok := volume.AttachedTo(instanceID)
+		if isFailingOver(volume) {
+			logging.FromContext(ctx).V(4).Infof("Volume %s is failing over in %s status, waiting", volumeID, volume.Status)
+			return ok, nil
+		}
+		// no point in waiting for a volume that failed
+		if strings.HasPrefix(volume.Status, VolumeErrorStatus) {
+			return false, fmt.Errorf("volume %q went to %s status while being attached", volumeID, volume.Status)
+		}
+		if isTransitionalStatus(volume.Status) {
+			logging.FromContext(ctx).V(4).Infof("Volume %s is in %s status, waiting", volumeID, volume.Status)
+		}
+		if err := os.checkStuck(ctx, volume, tracker.observe(volume.Status)); err != nil {
 			return false, err
 		}
-		return attached, nil
+		return ok, nil
 	})
 
 	if err == wait.ErrWaitTimeout {
 		err = fmt.Errorf("Volume %q failed to be attached within the alloted time", volumeID)
 	}
-
-	return err
+	if err != nil {
+		return Volume{}, err
+	}
+	return attached, nil
 }
 
 // DetachVolume detaches given cinder volume from the compute
-func (os *OpenStack) DetachVolume(instanceID, volumeID string) error {
-	volume, err := os.GetVolume(volumeID)
+func (os *OpenStack) DetachVolume(ctx context.Context, instanceID, volumeID string) error {
+	log := logging.FromContext(ctx).With(logging.Op, "DetachVolume", logging.VolumeID, volumeID, logging.InstanceID, instanceID)
+	volume, err := os.GetVolume(ctx, volumeID)
 	if err != nil {
 		return err
 	}
 	if volume.Status == VolumeAvailableStatus {
-		klog.V(2).Infof("volume: %s has been detached from compute: %s ", volume.ID, instanceID)
+		log.V(2).Infof("Volume is already detached")
 		return nil
 	}
 
+	if err := os.checkStuck(ctx, volume, time.Now()); err != nil {
+		return err
+	}
+	// a volume being migrated, retyped or already detached, e.g. by a
+	// previous attempt, is waited for
+	if volume.Status == VolumeDetachingStatus || isTransitionalStatus(volume.Status) {
+		log.V(3).Infof("Volume is in %s status, waiting for it to settle", volume.Status)
+		if err := os.WaitVolumeTargetStatus(ctx, volumeID, VolumeInUseStatus, VolumeAvailableStatus); err != nil {
+			return err
+		}
+		if volume, err = os.GetVolume(ctx, volumeID); err != nil {
+			return err
+		}
+		if _, ok := volume.AttachedTo(instanceID); !ok {
+			log.V(2).Infof("Volume is already detached")
+			return nil
+		}
+	}
 	if volume.Status != VolumeInUseStatus {
 		return fmt.Errorf("can not detach volume %s, its status is %s", volume.Name, volume.Status)
 	}
 
-	if volume.AttachedServerId != instanceID {
+	// a multiattach volume stays attached to the other instances, Nova
+	// deletes the attachment of this one only
+	if _, ok := volume.AttachedTo(instanceID); !ok {
 		return fmt.Errorf("disk: %s has no attachments or is not attached to compute: %s", volume.Name, instanceID)
-	} else {
-		err = volumeattach.Delete(os.compute, instanceID, volume.ID).ExtractErr()
-		if err != nil {
-			return fmt.Errorf("failed to delete volume %s from compute %s attached %v", volume.ID, instanceID, err)
-		}
-		klog.V(2).Infof("Successfully detached volume: %s from compute: %s", volume.ID, instanceID)
 	}
+	err = volumeattach.Delete(os.computeClient(ctx), instanceID, volume.ID).ExtractErr()
+	if err != nil {
+		return fmt.Errorf("failed to delete volume %s from compute %s attached %v", volume.ID, instanceID, err)
+	}
+	os.instances.forgetAttachments(instanceID)
+	log.V(2).Infof("Successfully detached volume")
 
 	return nil
 }
 
 // WaitDiskDetached waits for detached
-func (os *OpenStack) WaitDiskDetached(instanceID string, volumeID string) error {
-	backoff := wait.Backoff{
-		Duration: diskDetachInitDelay,
-		Factor:   diskDetachFactor,
-		Steps:    diskDetachSteps,
-	}
+func (os *OpenStack) WaitDiskDetached(ctx context.Context, instanceID string, volumeID string) error {
+	backoff := os.bsOpts.detachBackoff()
 
-	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-		attached, err := os.diskIsAttached(instanceID, volumeID)
+	var tracker statusTracker
+	err := waitWithContext(ctx, backoff, func() (bool, error) {
+		volume, err := os.GetVolume(ctx, volumeID)
 		if err != nil {
 			return false, err
 		}
+		if isFailingOver(volume) {
+			logging.FromContext(ctx).V(4).Infof("Volume %s is failing over in %s status, waiting", volumeID, volume.Status)
+			_, attached := volume.AttachedTo(instanceID)
+			return !attached, nil
+		}
+		// no point in waiting for a volume that failed
+		if strings.HasPrefix(volume.Status, VolumeErrorStatus) {
+			return false, fmt.Errorf("volume %q went to %s status while being detached", volumeID, volume.Status)
+		}
+		if isTransitionalStatus(volume.Status) {
+			logging.FromContext(ctx).V(4).Infof("Volume %s is in %s status, waiting", volumeID, volume.Status)
+		}
+		if err := os.checkStuck(ctx, volume, tracker.observe(volume.Status)); err != nil {
+			return false, err
+		}
+		_, attached := volume.AttachedTo(instanceID)
 		return !attached, nil
 	})
 
@@ -277,40 +700,262 @@ func (os *OpenStack) WaitDiskDetached(instanceID string, volumeID string) error
 	return err
 }
 
-// GetAttachmentDiskPath gets device path of attached volume to the compute
-func (os *OpenStack) GetAttachmentDiskPath(instanceID, volumeID string) (string, error) {
-	volume, err := os.GetVolume(volumeID)
+// NoDevicePathError is returned when neither Cinder nor Nova know the device
+// of an attachment, as for Ironic instances, the node then has to find the
+// disk by its serial
+type NoDevicePathError struct {
+	VolumeID   string
+	InstanceID string
+}
+
+func (e *NoDevicePathError) Error() string {
+	return fmt.Sprintf("no device path known for volume %s attached to instance %s", e.VolumeID, e.InstanceID)
+}
+
+// GetAttachmentDiskPath gets device path of attached volume to the compute.
+// The device Cinder reports is often missing or stale, so the one of the Nova
+// attachment wins when both are known.
+func (os *OpenStack) GetAttachmentDiskPath(ctx context.Context, instanceID, volumeID string) (string, error) {
+	volume, err := os.GetVolume(ctx, volumeID)
 	if err != nil {
 		return "", err
 	}
-	if volume.Status != VolumeInUseStatus {
+	// a volume being migrated or retyped stays attached
+	if volume.Status != VolumeInUseStatus && !isTransitionalStatus(volume.Status) {
 		return "", fmt.Errorf("can not get device path of volume %s, its status is %s ", volume.Name, volume.Status)
 	}
-	if volume.AttachedServerId != "" {
-		if instanceID == volume.AttachedServerId {
-			return volume.AttachedDevice, nil
-		} else {
+	attachment, ok := volume.AttachedTo(instanceID)
+	if !ok {
+		if volume.AttachedServerId != "" {
 			return "", fmt.Errorf("disk %q is attached to a different compute: %q, should be detached before proceeding", volumeID, volume.AttachedServerId)
 		}
+		return "", fmt.Errorf("volume %s has no ServerId", volumeID)
 	}
-	return "", fmt.Errorf("volume %s has no ServerId", volumeID)
+
+	return os.attachmentDevice(ctx, volumeID, attachment)
 }
 
-// diskIsAttached queries if a volume is attached to a compute instance
-func (os *OpenStack) diskIsAttached(instanceID, volumeID string) (bool, error) {
-	volume, err := os.GetVolume(volumeID)
+// attachmentDevice returns the device of the attachment of the volume as
+// reported by Nova, the one reported by Cinder when Nova doesn't know it
+func (os *OpenStack) attachmentDevice(ctx context.Context, volumeID string, attachment Attachment) (string, error) {
+	instanceID := attachment.ServerID
+	log := logging.FromContext(ctx).With(logging.Op, "GetAttachmentDiskPath", logging.VolumeID, volumeID, logging.InstanceID, instanceID)
+	novaAttachment, err := volumeattach.Get(os.computeClient(ctx), instanceID, volumeID).Extract()
 	if err != nil {
-		return false, err
+		if attachment.Device == "" {
+			return "", err
+		}
+		log.V(3).Infof("Failed to get the Nova attachment, using the device reported by Cinder: %v", err)
+		return attachment.Device, nil
 	}
 
-	return instanceID == volume.AttachedServerId, nil
+	switch {
+	case novaAttachment.Device == "" && attachment.Device == "":
+		return "", &NoDevicePathError{VolumeID: volumeID, InstanceID: instanceID}
+	case novaAttachment.Device == "":
+		return attachment.Device, nil
+	case attachment.Device != "" && attachment.Device != novaAttachment.Device:
+		log.Warningf("Cinder reports device %s, using %s reported by Nova", attachment.Device, novaAttachment.Device)
+	}
+	return novaAttachment.Device, nil
 }
 
-// diskIsUsed returns true a disk is attached to any node.
-func (os *OpenStack) diskIsUsed(volumeID string) (bool, error) {
-	volume, err := os.GetVolume(volumeID)
+// ExpandVolume expands the volume to new size, and waits for Cinder to
+// finish. Attached volumes are extended online, which needs the microversion
+// 3.42; an OnlineExtendUnsupportedError is returned when the cloud refuses it.
+func (os *OpenStack) ExpandVolume(ctx context.Context, volumeID string, newSize int) error {
+	volume, err := os.GetVolume(ctx, volumeID)
 	if err != nil {
-		return false, err
+		return err
+	}
+	if err := os.extendVolume(ctx, volume, newSize); err != nil {
+		if _, ok := err.(*OnlineExtendUnsupportedError); ok {
+			return err
+		}
+		return fmt.Errorf("failed to expand volume %s to %d GiB: %v", volumeID, newSize, err)
+	}
+	if err := os.waitVolumeExtended(ctx, volumeID, newSize); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).With(logging.Op, "ExpandVolume", logging.VolumeID, volumeID).V(2).Infof("Successfully expanded %s volume to %d GiB", volume.Status, newSize)
+	return nil
+}
+
+// SetVolumeMetadata sets the given metadata keys of the volume, its other
+// metadata is left as is
+func (os *OpenStack) SetVolumeMetadata(ctx context.Context, volumeID string, metadata map[string]string) error {
+	client := os.blockStorageClient(ctx)
+	body := map[string]interface{}{"metadata": metadata}
+	_, err := client.Post(client.ServiceURL("volumes", volumeID, "metadata"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set the metadata of volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// SetVolumeImageMetadata sets the given image metadata keys of the volume, its
+// other image metadata is left as is
+func (os *OpenStack) SetVolumeImageMetadata(ctx context.Context, volumeID string, metadata map[string]string) error {
+	client := os.blockStorageClient(ctx)
+	body := map[string]interface{}{
+		"os-set_image_metadata": map[string]interface{}{"metadata": metadata},
+	}
+	_, err := client.Post(client.ServiceURL("volumes", volumeID, "action"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set the image metadata of volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// RenameVolume sets the display name of the volume
+func (os *OpenStack) RenameVolume(ctx context.Context, volumeID, name string) error {
+	client := os.blockStorageClient(ctx)
+	body := map[string]interface{}{
+		"volume": map[string]string{"name": name},
+	}
+	_, err := client.Put(client.ServiceURL("volumes", volumeID), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// CheckBlockStorageAPI verifies that the Cinder API can be reached with the
+// configured credentials, by listing at most one volume
+func (os *OpenStack) CheckBlockStorageAPI(ctx context.Context) error {
+	opts := volumes.ListOpts{
+		Limit: 1,
+	}
+	err := volumes.List(os.blockStorageClient(ctx), opts).EachPage(func(page pagination.Page) (bool, error) {
+		// the first page is enough
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list volumes: %v", err)
+	}
+	return nil
+}
+
+// GetInstanceAZ returns the availability zone of the compute instance.
+// The zone is cached briefly, as well as the instance not being found.
+func (os *OpenStack) GetInstanceAZ(ctx context.Context, instanceID string) (string, error) {
+	record, err := os.getInstance(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+	return record.az, nil
+}
+
+// GetInstanceState returns the vm_state of the compute instance, e.g. active
+// or stopped. It is cached along with the zone.
+func (os *OpenStack) GetInstanceState(ctx context.Context, instanceID string) (string, error) {
+	record, err := os.getInstance(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+	return record.vmState, nil
+}
+
+// instanceName returns the name of the compute instance, the name of its
+// node. It is cached along with the zone.
+func (os *OpenStack) instanceName(ctx context.Context, instanceID string) (string, error) {
+	record, err := os.getInstance(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+	return record.name, nil
+}
+
+// getInstance returns the record of the compute instance, fetching the
+// instance unless it is cached
+func (os *OpenStack) getInstance(ctx context.Context, instanceID string) (instanceRecord, error) {
+	if record, ok := os.instances.get(instanceID); ok {
+		if record.notFound != nil {
+			return instanceRecord{}, record.notFound
+		}
+		if record.hasAZ {
+			return record, nil
+		}
+	}
+
+	var server struct {
+		servers.Server
+		availabilityzones.ServerAvailabilityZoneExt
+		VMState string `json:"OS-EXT-STS:vm_state"`
+	}
+	err := servers.Get(os.computeClient(ctx), instanceID).ExtractInto(&server)
+	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			os.instances.setNotFound(instanceID, err)
+		}
+		return instanceRecord{}, err
+	}
+
+	record := instanceRecord{id: instanceID, az: server.AvailabilityZone, name: server.Name, vmState: server.VMState, hasAZ: true}
+	os.instances.update(instanceID, func(r *instanceRecord) {
+		r.az, r.name, r.vmState, r.hasAZ = record.az, record.name, record.vmState, true
+	})
+	return record, nil
+}
+
+// GetAttachmentCount returns the number of volumes attached to the compute instance.
+// The count is cached briefly, attaching or detaching a volume resets it.
+func (os *OpenStack) GetAttachmentCount(ctx context.Context, instanceID string) (int, error) {
+	if record, ok := os.instances.get(instanceID); ok {
+		if record.notFound != nil {
+			return 0, record.notFound
+		}
+		if record.hasAttachments {
+			return record.attachments, nil
+		}
+	}
+
+	pages, err := volumeattach.List(os.computeClient(ctx), instanceID).AllPages()
+	if err != nil {
+		if cpoerrors.IsNotFound(err) {
+			os.instances.setNotFound(instanceID, err)
+		}
+		return 0, err
+	}
+	attachments, err := volumeattach.ExtractVolumeAttachments(pages)
+	if err != nil {
+		return 0, err
+	}
+
+	os.instances.update(instanceID, func(r *instanceRecord) {
+		r.attachments, r.hasAttachments = len(attachments), true
+	})
+	return len(attachments), nil
+}
+
+// checkNotInUse returns a VolumeInUseError if the volume is attached to any
+// node, naming the nodes whose instance can be fetched
+func (os *OpenStack) checkNotInUse(ctx context.Context, volumeID string) error {
+	volume, err := os.GetVolume(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+	if len(volume.Attachments) == 0 {
+		return nil
+	}
+
+	inUse := &VolumeInUseError{VolumeID: volumeID, ServerNames: make(map[string]string)}
+	for _, a := range volume.Attachments {
+		inUse.ServerIDs = append(inUse.ServerIDs, a.ServerID)
+		name, err := os.instanceName(ctx, a.ServerID)
+		if err != nil {
+			logging.FromContext(ctx).V(4).Infof("Failed to get the name of instance %s: %v", a.ServerID, err)
+			continue
+		}
+		if name != "" {
+			inUse.ServerNames[a.ServerID] = name
+		}
 	}
-	return volume.AttachedServerId != "", nil
+	return inUse
 }
@@ -0,0 +1,1130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+const fakeInstanceID = "7c2b1f9e-3d4a-4e5f-8a6b-9c0d1e2f3a4b"
+
+func TestCreateVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	tags := map[string]string{"cinder.csi.openstack.org/cluster": "cluster"}
+	created, err := cloud.CreateVolume(ctx, "vol", 2, "", "", "", DefaultVolumeDescription, &tags)
+	assert.NoError(err)
+	assert.Equal(fakeServerAZ, created.AZ)
+	assert.Equal(2, created.Size)
+	assert.Equal(tags, created.Metadata)
+	assert.False(created.Bootable)
+	assert.False(created.CreatedAt.IsZero())
+	id := created.ID
+
+	vol := server.volume(id)
+	if assert.NotNil(vol) {
+		assert.Equal("vol", vol.Name)
+		assert.Equal(DefaultVolumeDescription, vol.Description)
+		assert.Equal(tags, vol.Metadata)
+		assert.Equal("creating", vol.Status)
+	}
+
+	// the volume becomes available on the next GET
+	volume, err := cloud.GetVolume(ctx, id)
+	assert.NoError(err)
+	assert.Equal("creating", volume.Status)
+	volume, err = cloud.GetVolume(ctx, id)
+	assert.NoError(err)
+	assert.Equal(VolumeAvailableStatus, volume.Status)
+	assert.Equal(DefaultVolumeDescription, volume.Description)
+	assert.Equal(tags, volume.Metadata)
+}
+
+func TestCreateVolumeErrors(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	_, err := cloud.CreateVolume(ctx, "vol", 1, "", "missing-zone", "", "", nil)
+	assert.True(t, cpoerrors.IsBadRequest(err), "invalid zone: %v", err)
+
+	_, err = cloud.CreateVolume(ctx, "vol", 1, "", "", "snapshot-missing", "", nil)
+	assert.True(t, cpoerrors.IsNotFound(err), "missing snapshot: %v", err)
+}
+
+func TestGetVolumesByName(t *testing.T) {
+	for _, version := range []string{bsVersionV3, bsVersionV2} {
+		t.Run(version, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+			cloud.bsVersion = version
+			assert := assert.New(t)
+			ctx := context.Background()
+
+			source := server.addVolume(fakeServerVolume{Name: "source", Size: 1})
+			snap, err := cloud.CreateSnapshot(ctx, "snap", source.ID, "", nil)
+			assert.NoError(err)
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, SnapshotID: snap.ID, Metadata: map[string]string{"key": "value"}})
+			server.addVolume(fakeServerVolume{Name: "other", Size: 1})
+
+			// the volumes are filled in as by GetVolume, e.g. the source
+			// snapshot of the volume found by the retry of CreateVolume
+			vols, err := cloud.GetVolumesByName(ctx, "vol")
+			assert.NoError(err)
+			if assert.Len(vols, 1) {
+				expected, err := cloud.GetVolume(ctx, vol.ID)
+				assert.NoError(err)
+				assert.Equal(expected, vols[0])
+				assert.Equal(snap.ID, vols[0].SnapshotID)
+				assert.Equal(map[string]string{"key": "value"}, vols[0].Metadata)
+			}
+
+			vols, err = cloud.GetVolumesByName(ctx, "missing")
+			assert.NoError(err)
+			assert.Empty(vols)
+		})
+	}
+}
+
+func TestListVolumesWithPage(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, server.addVolume(fakeServerVolume{Name: fmt.Sprintf("vol%d", i), Size: 1}).ID)
+	}
+	sort.Strings(ids)
+
+	// the marker of each page lists the next one
+	var listed []string
+	marker := ""
+	for pages := 0; pages < 5; pages++ {
+		vols, next, err := cloud.ListVolumesWithPage(ctx, 2, marker, nil)
+		assert.NoError(err)
+		assert.True(len(vols) <= 2, "page of %d volumes", len(vols))
+		for _, v := range vols {
+			listed = append(listed, v.ID)
+		}
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+	assert.Equal(ids, listed)
+	assert.Equal(3, server.requestCount("GET /volume/volumes/detail"))
+
+	_, _, err := cloud.ListVolumesWithPage(ctx, 2, "volume-missing", nil)
+	invalid, ok := err.(*InvalidMarkerError)
+	if assert.True(ok, "invalid marker: %v", err) {
+		assert.Equal("volume-missing", invalid.Marker)
+	}
+}
+
+func TestListVolumesWithPageFilters(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	owned := map[string]string{"cinder.csi.openstack.org/cluster": "cluster"}
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Metadata: owned})
+	server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeInUseStatus, Metadata: owned})
+	server.addVolume(fakeServerVolume{Name: "other", Size: 1})
+
+	vols, next, err := cloud.ListVolumesWithPage(ctx, 0, "", map[string]string{
+		VolumeNameFilter:   "vol",
+		VolumeStatusFilter: VolumeAvailableStatus,
+		VolumeMetadataFilterPrefix + "cinder.csi.openstack.org/cluster": "cluster",
+	})
+	assert.NoError(err)
+	assert.Equal("", next)
+	if assert.Len(vols, 1) {
+		assert.Equal(vol.ID, vols[0].ID)
+	}
+
+	vols, _, err = cloud.ListVolumesWithPage(ctx, 0, "", map[string]string{VolumeMetadataFilterPrefix + "cinder.csi.openstack.org/cluster": "other"})
+	assert.NoError(err)
+	assert.Empty(vols)
+
+	_, _, err = cloud.ListVolumesWithPage(ctx, 0, "", map[string]string{"size": "1"})
+	assert.Error(err)
+}
+
+// Test ListVolumes walks all the pages Cinder splits the volumes in
+func TestListVolumesPages(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	server.maxLimit = 2
+	for i := 0; i < 5; i++ {
+		server.addVolume(fakeServerVolume{Name: fmt.Sprintf("vol%d", i), Size: 1})
+	}
+
+	vols, err := cloud.ListVolumes(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, vols, 5)
+	assert.Equal(t, 3, server.requestCount("GET /volume/volumes/detail"))
+}
+
+func TestAttachVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+
+	id, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	assert.Equal(vol.ID, id)
+	assert.Equal("attaching", server.volume(vol.ID).Status)
+
+	// the volume of the last poll has the attachment
+	attached, err := cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	attachment, ok := attached.AttachedTo(fakeInstanceID)
+	assert.True(ok)
+	assert.Equal("/dev/vdb", attachment.Device)
+	devicePath, err := cloud.GetAttachmentDiskPath(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	assert.Equal("/dev/vdb", devicePath)
+
+	// attaching again to the same instance is a no-op
+	_, err = cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	assert.Equal(1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+
+	// but not to another one
+	_, err = cloud.AttachVolume(ctx, "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f", vol.ID)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "attached to a different instance")
+	}
+
+	_, err = cloud.AttachVolume(ctx, fakeInstanceID, "volume-missing")
+	assert.True(cpoerrors.IsNotFound(err), "missing volume: %v", err)
+}
+
+// Test the device path of an attachment is the one Nova reports, Cinder's
+// being used when Nova has none
+func TestGetAttachmentDiskPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		cinderDevice string
+		novaDevice   string
+		expected     string
+		noDevice     bool
+	}{
+		{name: "agreeing", cinderDevice: "/dev/vdb", novaDevice: "/dev/vdb", expected: "/dev/vdb"},
+		{name: "no Cinder device", cinderDevice: "", novaDevice: "/dev/vdb", expected: "/dev/vdb"},
+		{name: "no Nova device", cinderDevice: "/dev/vdb", novaDevice: "", expected: "/dev/vdb"},
+		{name: "disagreeing", cinderDevice: "/dev/vdb", novaDevice: "/dev/vdc", expected: "/dev/vdc"},
+		{name: "no device", cinderDevice: "", novaDevice: "", noDevice: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+			assert := assert.New(t)
+			ctx := context.Background()
+
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+			_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+			assert.NoError(err)
+			_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+			assert.NoError(err)
+			server.setDevices(vol.ID, tt.cinderDevice, tt.novaDevice)
+
+			devicePath, err := cloud.GetAttachmentDiskPath(ctx, fakeInstanceID, vol.ID)
+			if tt.noDevice {
+				assert.Equal(&NoDevicePathError{VolumeID: vol.ID, InstanceID: fakeInstanceID}, err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tt.expected, devicePath)
+		})
+	}
+}
+
+// Test the device reported by Cinder is used when the Nova attachment can't
+// be read
+func TestGetAttachmentDiskPathNovaFailure(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+
+	server.inject("GET /compute/servers/{id}/os-volume_attachments/{id}", fakeServerFault{code: http.StatusForbidden})
+	devicePath, err := cloud.GetAttachmentDiskPath(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	assert.Equal("/dev/vdb", devicePath)
+
+	server.setDevices(vol.ID, "", "/dev/vdb")
+	server.inject("GET /compute/servers/{id}/os-volume_attachments/{id}", fakeServerFault{code: http.StatusForbidden})
+	_, err = cloud.GetAttachmentDiskPath(ctx, fakeInstanceID, vol.ID)
+	assert.True(cpoerrors.IsForbidden(err), "forbidden: %v", err)
+}
+
+// Test volumes are attached to active and stopped instances but not to
+// shelved ones, whose state is told by the instance cached for the zone check
+func TestAttachVolumeInstanceState(t *testing.T) {
+	tests := []struct {
+		vmState string
+		shelved bool
+	}{
+		{vmState: "active"},
+		{vmState: InstanceStoppedState},
+		{vmState: "shelved", shelved: true},
+		{vmState: "shelved_offloaded", shelved: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.vmState, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+			assert := assert.New(t)
+			ctx := context.Background()
+
+			server.setVMState(fakeInstanceID, tt.vmState)
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+			_, err := cloud.GetInstanceAZ(ctx, fakeInstanceID)
+			assert.NoError(err)
+
+			_, err = cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+			if tt.shelved {
+				assert.Equal(&InstanceShelvedError{InstanceID: fakeInstanceID, VMState: tt.vmState}, err)
+				assert.Equal(0, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+				return
+			}
+			assert.NoError(err)
+			_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+			assert.NoError(err)
+
+			state, err := cloud.GetInstanceState(ctx, fakeInstanceID)
+			assert.NoError(err)
+			assert.Equal(tt.vmState, state)
+			assert.Equal(1, server.requestCount("GET /compute/servers/{id}"))
+		})
+	}
+}
+
+// Test attaching a volume already fetched costs no other Cinder request than
+// the polls of the wait, where a publish used to get the volume twice more:
+// in AttachVolume and for the device path
+func TestAttachFetchedVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// the former flow
+	old := server.addVolume(fakeServerVolume{Name: "old", Size: 1})
+	_, err := cloud.GetVolume(ctx, old.ID)
+	assert.NoError(err)
+	_, err = cloud.AttachVolume(ctx, fakeInstanceID, old.ID)
+	assert.NoError(err)
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, old.ID)
+	assert.NoError(err)
+	_, err = cloud.GetAttachmentDiskPath(ctx, fakeInstanceID, old.ID)
+	assert.NoError(err)
+	assert.Equal(5, server.requestCount("GET /volume/volumes/{id}"))
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	devicePath, err := cloud.AttachFetchedVolume(ctx, fakeInstanceID, &volume)
+	assert.NoError(err)
+	assert.Equal("/dev/vdc", devicePath)
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	assert.Equal(5+3, server.requestCount("GET /volume/volumes/{id}"))
+	assert.Equal(1, server.requestCount("GET /compute/servers/{id}/os-volume_attachments/{id}"))
+
+	// the device reserved by Nova is the one Cinder reports
+	attached, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	assert.Equal(devicePath, attached.AttachedDevice)
+
+	// a retried publish gets the device of the existing attachment
+	devicePath, err = cloud.AttachFetchedVolume(ctx, fakeInstanceID, &attached)
+	assert.NoError(err)
+	assert.Equal("/dev/vdc", devicePath)
+	assert.Equal(2, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+// Test a publish retried after a restart of the controller, the volume being
+// already attached, gets the device Nova reports as a new attachment would
+func TestAttachFetchedVolumeAlreadyAttached(t *testing.T) {
+	tests := []struct {
+		name         string
+		cinderDevice string
+		novaDevice   string
+		expected     string
+	}{
+		{name: "agreeing", cinderDevice: "/dev/vdb", novaDevice: "/dev/vdb", expected: "/dev/vdb"},
+		{name: "no Cinder device", cinderDevice: "", novaDevice: "/dev/vdb", expected: "/dev/vdb"},
+		{name: "disagreeing", cinderDevice: "/dev/vdb", novaDevice: "/dev/vdc", expected: "/dev/vdc"},
+		{name: "no Nova device", cinderDevice: "/dev/vdb", novaDevice: "", expected: "/dev/vdb"},
+		{name: "no device", cinderDevice: "", novaDevice: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+			assert := assert.New(t)
+			ctx := context.Background()
+
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+			_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+			assert.NoError(err)
+			_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+			assert.NoError(err)
+			server.setDevices(vol.ID, tt.cinderDevice, tt.novaDevice)
+
+			attached, err := cloud.GetVolume(ctx, vol.ID)
+			assert.NoError(err)
+			devicePath, err := cloud.AttachFetchedVolume(ctx, fakeInstanceID, &attached)
+			assert.NoError(err)
+			assert.Equal(tt.expected, devicePath)
+			assert.Equal(1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+		})
+	}
+}
+
+func TestWaitDiskAttachedTimeout(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	// stuck attaching
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: "attaching"})
+
+	_, err := cloud.WaitDiskAttached(context.Background(), fakeInstanceID, vol.ID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to be attached within the alloted time")
+	}
+}
+
+// Test WaitDiskAttached returns the context error when the API is too slow
+func TestWaitDiskAttachedDeadline(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: "attaching"})
+	server.inject("GET /volume/volumes/{id}", fakeServerFault{delay: 200 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// Test WaitDiskAttached gives up as soon as the volume fails
+func TestWaitDiskAttachedVolumeError(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: "attaching"})
+	server.setVolumeStatus(vol.ID, "error_attaching")
+
+	_, err := cloud.WaitDiskAttached(context.Background(), fakeInstanceID, vol.ID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error_attaching")
+	}
+	assert.Equal(t, 2, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+// Test a volume going through maintenance and retyping while attaching is
+// waited for
+func TestWaitDiskAttachedMaintenance(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeAttachingStatus})
+	server.mux.Lock()
+	stored := server.volumes[vol.ID]
+	server.queue(vol.ID,
+		func() { stored.Status = VolumeMaintenanceStatus },
+		func() { stored.Status = VolumeRetypingStatus },
+		func() {
+			stored.Status = VolumeInUseStatus
+			stored.Attachments = []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}}
+		})
+	server.mux.Unlock()
+
+	_, err := cloud.WaitDiskAttached(context.Background(), fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+// Test an available volume under maintenance is attached once available again
+func TestAttachVolumeMaintenance(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeMaintenanceStatus})
+	server.setVolumeStatus(vol.ID, VolumeMaintenanceStatus)
+	server.setVolumeStatus(vol.ID, VolumeAvailableStatus)
+
+	_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+func TestWaitVolumeTargetStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []string
+		targets     []string
+		errMsg      string
+		expectedGet int
+	}{
+		{"maintenance", []string{VolumeMaintenanceStatus, VolumeInUseStatus}, []string{VolumeInUseStatus}, "", 2},
+		{"any target", []string{VolumeRetypingStatus, VolumeAvailableStatus}, []string{VolumeInUseStatus, VolumeAvailableStatus}, "", 2},
+		{"error", []string{VolumeMaintenanceStatus, "error_migrating"}, []string{VolumeInUseStatus}, "went to error_migrating status", 2},
+		{"unexpected", []string{"deleting"}, []string{VolumeInUseStatus}, "is in deleting status, expected in-use", 1},
+		{"timeout", []string{VolumeMaintenanceStatus}, []string{VolumeAvailableStatus}, "is still in maintenance status", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cloud := newFakeServer(t)
+			defer server.close()
+
+			vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: VolumeMaintenanceStatus})
+			for _, status := range tt.statuses {
+				server.setVolumeStatus(vol.ID, status)
+			}
+
+			err := cloud.WaitVolumeTargetStatus(context.Background(), vol.ID, tt.targets...)
+			if tt.errMsg != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.errMsg)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedGet, server.requestCount("GET /volume/volumes/{id}"))
+		})
+	}
+}
+
+// Test WaitDiskAttached gives up as soon as the volume is deleted
+func TestWaitDiskAttachedVolumeDeleted(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Status: "attaching"})
+	server.mux.Lock()
+	server.queue(vol.ID, func() { delete(server.volumes, vol.ID) })
+	server.mux.Unlock()
+
+	_, err := cloud.WaitDiskAttached(context.Background(), fakeInstanceID, vol.ID)
+	assert.Equal(t, &VolumeDeletedError{VolumeID: vol.ID}, err)
+	assert.Equal(t, 2, server.requestCount("GET /volume/volumes/{id}"))
+
+	// a volume never found is deleted after the polls allowed for lagging reads
+	_, err = cloud.WaitDiskAttached(context.Background(), fakeInstanceID, "volume-missing")
+	assert.Equal(t, &VolumeDeletedError{VolumeID: "volume-missing"}, err)
+	assert.Equal(t, 2+attachNotFoundRetries+1, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+// Test a volume not found by the first polls, e.g. by a lagging replica of the
+// database, is waited for
+func TestWaitDiskAttachedLaggingRead(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	_, err := cloud.AttachVolume(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+	server.inject("GET /volume/volumes/{id}",
+		fakeServerFault{code: http.StatusNotFound},
+		fakeServerFault{code: http.StatusNotFound})
+
+	_, err = cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(t, err)
+}
+
+// Test the requests bound to a context use the token obtained by
+// reauthenticating after a 401
+func TestReauthenticate(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	server.setToken("valid")
+
+	provider := cloud.blockstorage.ProviderClient
+	provider.SetToken("expired")
+	reauths := 0
+	provider.ReauthFunc = func() error {
+		reauths++
+		provider.SetToken("valid")
+		return nil
+	}
+
+	_, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	assert.Equal(1, reauths)
+	assert.Equal(2, server.requestCount("GET /volume/volumes/{id}"))
+
+	// the next requests use the new token
+	_, err = cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	assert.Equal(1, reauths)
+	assert.Equal(3, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+// Test the 413 returned when the project is over its quota is recognized
+func TestCreateVolumeOverQuota(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	server.inject("POST /volume/volumes", fakeServerFault{code: http.StatusRequestEntityTooLarge})
+
+	_, err := cloud.CreateVolume(context.Background(), "vol", 1, "", "", "", "", nil)
+	assert.True(t, cpoerrors.IsOverQuota(err), "over quota: %v", err)
+
+	// the fault is only injected once
+	_, err = cloud.CreateVolume(context.Background(), "vol", 1, "", "", "", "", nil)
+	assert.NoError(t, err)
+}
+
+func TestDetachVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+
+	// not attached to this instance
+	err := cloud.DetachVolume(ctx, "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f", vol.ID)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "is not attached to compute")
+	}
+
+	assert.NoError(cloud.DetachVolume(ctx, fakeInstanceID, vol.ID))
+	assert.Equal("detaching", server.volume(vol.ID).Status)
+
+	// a second detach waits for the first one
+	assert.NoError(cloud.DetachVolume(ctx, fakeInstanceID, vol.ID))
+	assert.Equal(1, server.requestCount("DELETE /compute/servers/{id}/os-volume_attachments/{id}"))
+
+	assert.NoError(cloud.WaitDiskDetached(ctx, fakeInstanceID, vol.ID))
+	assert.Equal(VolumeAvailableStatus, server.volume(vol.ID).Status)
+
+	// detaching an available volume is a no-op
+	assert.NoError(cloud.DetachVolume(ctx, fakeInstanceID, vol.ID))
+}
+
+// Test a volume migrated or retyped while attached is detached once in-use
+// again, and one that failed meanwhile is not
+func TestDetachVolumeMaintenance(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeMaintenanceStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+	server.setVolumeStatus(vol.ID, VolumeRetypingStatus)
+	server.setVolumeStatus(vol.ID, VolumeInUseStatus)
+
+	assert.NoError(t, cloud.DetachVolume(ctx, fakeInstanceID, vol.ID))
+	assert.NoError(t, cloud.WaitDiskDetached(ctx, fakeInstanceID, vol.ID))
+	assert.Equal(t, 1, server.requestCount("DELETE /compute/servers/{id}/os-volume_attachments/{id}"))
+
+	failed := server.addVolume(fakeServerVolume{
+		Name:        "failed",
+		Size:        1,
+		Status:      VolumeMaintenanceStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdc"}},
+	})
+	server.setVolumeStatus(failed.ID, VolumeMaintenanceStatus)
+	server.setVolumeStatus(failed.ID, "error_migrating")
+
+	err := cloud.DetachVolume(ctx, fakeInstanceID, failed.ID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "went to error_migrating status")
+	}
+	assert.Equal(t, 1, server.requestCount("DELETE /compute/servers/{id}/os-volume_attachments/{id}"))
+}
+
+// Test detaching a multiattach volume from one of its instances keeps it
+// attached to the others
+func TestDetachVolumeMultiattach(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	other := "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f"
+	vol := server.addVolume(fakeServerVolume{
+		Name:   "vol",
+		Size:   1,
+		Status: VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{
+			{ServerID: other, Device: "/dev/vdb"},
+			{ServerID: fakeInstanceID, Device: "/dev/vdc"},
+		},
+	})
+
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	assert.Equal(other, volume.AttachedServerId)
+	attachment, ok := volume.AttachedTo(fakeInstanceID)
+	assert.True(ok)
+	assert.Equal("/dev/vdc", attachment.Device)
+
+	// attached to neither
+	err = cloud.DetachVolume(ctx, "8f9e0d1c-2b3a-4c5d-9e6f-7a8b9c0d1e2f", vol.ID)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "is not attached to compute")
+	}
+
+	// the second attachment
+	assert.NoError(cloud.DetachVolume(ctx, fakeInstanceID, vol.ID))
+	assert.NoError(cloud.WaitDiskDetached(ctx, fakeInstanceID, vol.ID))
+	volume, err = cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	assert.Equal(VolumeInUseStatus, volume.Status)
+	assert.Equal([]Attachment{{ServerID: other, Device: "/dev/vdb"}}, volume.Attachments)
+	_, ok = volume.AttachedTo(fakeInstanceID)
+	assert.False(ok)
+
+	// the last one
+	assert.NoError(cloud.DetachVolume(ctx, other, vol.ID))
+	assert.NoError(cloud.WaitDiskDetached(ctx, other, vol.ID))
+	assert.Equal(VolumeAvailableStatus, server.volume(vol.ID).Status)
+	assert.Equal(2, server.requestCount("DELETE /compute/servers/{id}/os-volume_attachments/{id}"))
+}
+
+// Test a multiattach volume attached to the instance after another one is
+// seen attached to it, by the wait and by a retried attach
+func TestWaitDiskAttachedMultiattach(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	other := "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f"
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{{ServerID: other, Device: "/dev/vdb"}},
+	})
+	server.mux.Lock()
+	stored := server.volumes[vol.ID]
+	server.queue(vol.ID, func() {
+		stored.Attachments = append(stored.Attachments, fakeServerAttachment{ServerID: fakeInstanceID, Device: "/dev/vdc"})
+	})
+	server.mux.Unlock()
+
+	attached, err := cloud.WaitDiskAttached(ctx, fakeInstanceID, vol.ID)
+	assert.NoError(err)
+	assert.Equal(other, attached.AttachedServerId)
+	assert.Equal(1, server.requestCount("GET /volume/volumes/{id}"))
+
+	devicePath, err := cloud.AttachFetchedVolume(ctx, fakeInstanceID, &attached)
+	assert.NoError(err)
+	assert.Equal("/dev/vdc", devicePath)
+	assert.Equal(0, server.requestCount("POST /compute/servers/{id}/os-volume_attachments"))
+}
+
+func TestWaitDiskDetachedTimeout(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+
+	// stuck detaching
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      "detaching",
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+
+	err := cloud.WaitDiskDetached(context.Background(), fakeInstanceID, vol.ID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to detach within the alloted time")
+	}
+}
+
+// Test a volume going through maintenance while detaching is waited for, and
+// one failing to detach is given up on
+func TestWaitDiskDetachedMaintenance(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeDetachingStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+	server.mux.Lock()
+	stored := server.volumes[vol.ID]
+	server.queue(vol.ID,
+		func() { stored.Status = VolumeMaintenanceStatus },
+		func() { stored.Status, stored.Attachments = VolumeAvailableStatus, nil })
+	server.mux.Unlock()
+
+	assert.NoError(t, cloud.WaitDiskDetached(ctx, fakeInstanceID, vol.ID))
+	assert.Equal(t, 2, server.requestCount("GET /volume/volumes/{id}"))
+
+	failed := server.addVolume(fakeServerVolume{
+		Name:        "failed",
+		Size:        1,
+		Status:      VolumeDetachingStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdc"}},
+	})
+	server.setVolumeStatus(failed.ID, "error_detaching")
+
+	err := cloud.WaitDiskDetached(ctx, fakeInstanceID, failed.ID)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error_detaching")
+	}
+	assert.Equal(t, 3, server.requestCount("GET /volume/volumes/{id}"))
+}
+
+func TestDeleteVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	attached := server.addVolume(fakeServerVolume{
+		Name:        "attached",
+		Size:        1,
+		Status:      VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+
+	assert.NoError(cloud.DeleteVolume(ctx, vol.ID, false))
+	assert.Nil(server.volume(vol.ID))
+
+	err := cloud.DeleteVolume(ctx, vol.ID, false)
+	assert.True(cpoerrors.IsNotFound(err), "deleted volume: %v", err)
+
+	err = cloud.DeleteVolume(ctx, attached.ID, false)
+	if inUse, ok := err.(*VolumeInUseError); assert.True(ok, "unexpected error: %v", err) {
+		assert.Equal([]string{fakeInstanceID}, inUse.ServerIDs)
+	}
+	assert.NotNil(server.volume(attached.ID))
+}
+
+// Test setting metadata keeps the other keys of the volume
+func TestSetVolumeMetadata(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Metadata: map[string]string{"a": "1", "b": "2"}})
+	assert.NoError(cloud.SetVolumeMetadata(ctx, vol.ID, map[string]string{"b": "3", "c": "4"}))
+
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"a": "1", "b": "3", "c": "4"}, volume.Metadata)
+
+	err = cloud.SetVolumeMetadata(ctx, "missing", map[string]string{"a": "1"})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "failed to set the metadata of volume missing")
+	}
+}
+
+func TestRenameVolume(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, Metadata: map[string]string{"a": "1"}})
+	assert.NoError(t, cloud.RenameVolume(ctx, vol.ID, "deleted-vol"))
+
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "deleted-vol", volume.Name)
+	assert.Equal(t, map[string]string{"a": "1"}, volume.Metadata)
+
+	err = cloud.RenameVolume(ctx, "missing", "deleted-vol")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to rename volume missing")
+	}
+}
+
+func TestSetVolumeImageMetadata(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1, ImageMetadata: map[string]string{"hw_scsi_model": "virtio-scsi"}})
+	assert.NoError(t, cloud.SetVolumeImageMetadata(ctx, vol.ID, map[string]string{"hw_disk_bus": "scsi"}))
+
+	volume, err := cloud.GetVolume(ctx, vol.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"hw_scsi_model": "virtio-scsi", "hw_disk_bus": "scsi"}, volume.ImageMetadata)
+	assert.Equal(t, 1, server.requestCount("POST /volume/volumes/{id}/action"))
+
+	err = cloud.SetVolumeImageMetadata(ctx, "missing", map[string]string{"hw_disk_bus": "scsi"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to set the image metadata of volume missing")
+	}
+}
+
+// Test deleting an attached volume names the nodes it is attached to, those
+// whose instance can be fetched
+func TestDeleteVolumeInUse(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	deleted := "5d6e7f80-9a0b-4c1d-8e2f-3a4b5c6d7e8f"
+	server.nameServer(fakeInstanceID, "node-1")
+	server.deleteServer(deleted)
+	vol := server.addVolume(fakeServerVolume{
+		Name:   "vol",
+		Size:   1,
+		Status: VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{
+			{ServerID: fakeInstanceID, Device: "/dev/vdb"},
+			{ServerID: deleted, Device: "/dev/vdb"},
+		},
+	})
+
+	err := cloud.DeleteVolume(ctx, vol.ID, false)
+	inUse, ok := err.(*VolumeInUseError)
+	if assert.True(ok, "unexpected error: %v", err) {
+		assert.Equal([]string{fakeInstanceID, deleted}, inUse.ServerIDs)
+		assert.Equal(map[string]string{fakeInstanceID: "node-1"}, inUse.ServerNames)
+		assert.Equal(fmt.Sprintf("volume %s is still attached to node-1 (instance %s), instance %s", vol.ID, fakeInstanceID, deleted), err.Error())
+	}
+	assert.Equal(0, server.requestCount("DELETE /volume/volumes/{id}"))
+}
+
+// Test a volume known to be detached is deleted without being fetched first,
+// unless Cinder refuses to delete it
+func TestDeleteVolumeKnownDetached(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	assert.NoError(cloud.DeleteVolume(ctx, vol.ID, true))
+	assert.Nil(server.volume(vol.ID))
+	assert.Equal(0, server.requestCount("GET /volume/volumes/{id}"))
+
+	// attached again since
+	server.nameServer(fakeInstanceID, "node-1")
+	attached := server.addVolume(fakeServerVolume{
+		Name:        "attached",
+		Size:        1,
+		Status:      VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+	err := cloud.DeleteVolume(ctx, attached.ID, true)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "still attached to node-1")
+	}
+	assert.NotNil(server.volume(attached.ID))
+}
+
+func TestDeleteSnapshotInUse(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	snap, err := cloud.CreateSnapshot(ctx, "snap", vol.ID, "", nil)
+	assert.NoError(err)
+	restored := server.addVolume(fakeServerVolume{Name: "restored", Size: 1, SnapshotID: snap.ID})
+	for i := 0; i < 3; i++ {
+		server.addVolume(fakeServerVolume{Name: fmt.Sprintf("other%d", i), Size: 1})
+	}
+	server.maxLimit = 1
+
+	err = cloud.DeleteSnapshot(ctx, snap.ID)
+	if inUse, ok := err.(*SnapshotInUseError); assert.True(ok, "unexpected error: %v", err) {
+		assert.Equal([]string{restored.ID}, inUse.Volumes)
+	}
+	// Cinder lists only the volumes created from the snapshot
+	assert.Equal(1, server.requestCount("GET /volume/volumes/detail"))
+
+	assert.NoError(cloud.DeleteVolume(ctx, restored.ID, false))
+	assert.NoError(cloud.DeleteSnapshot(ctx, snap.ID))
+}
+
+func TestListSnapshots(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	vol := server.addVolume(fakeServerVolume{Name: "vol", Size: 1})
+	other := server.addVolume(fakeServerVolume{Name: "other", Size: 1})
+	var ids []string
+	for i := 0; i < 5; i++ {
+		source := vol
+		if i%2 == 1 {
+			source = other
+		}
+		snap, err := cloud.CreateSnapshot(ctx, fmt.Sprintf("snap%d", i), source.ID, "", nil)
+		assert.NoError(err)
+		ids = append(ids, snap.ID)
+	}
+	sort.Strings(ids)
+
+	// the marker of each page lists the next one
+	var listed []string
+	marker := ""
+	for pages := 0; pages < 5; pages++ {
+		snaps, next, err := cloud.ListSnapshots(ctx, 2, marker, nil)
+		assert.NoError(err)
+		assert.True(len(snaps) <= 2, "page of %d snapshots", len(snaps))
+		for _, s := range snaps {
+			listed = append(listed, s.ID)
+		}
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+	assert.Equal(ids, listed)
+	assert.Equal(3, server.requestCount("GET /volume/snapshots/detail"))
+
+	snaps, next, err := cloud.ListSnapshots(ctx, 0, "", map[string]string{SnapshotVolumeIDFilter: other.ID})
+	assert.NoError(err)
+	assert.Equal("", next)
+	assert.Len(snaps, 2)
+	for _, s := range snaps {
+		assert.Equal(other.ID, s.VolumeID)
+	}
+
+	_, _, err = cloud.ListSnapshots(ctx, 2, "snapshot-missing", nil)
+	invalid, ok := err.(*InvalidMarkerError)
+	if assert.True(ok, "invalid marker: %v", err) {
+		assert.Equal("snapshot-missing", invalid.Marker)
+	}
+
+	_, _, err = cloud.ListSnapshots(ctx, 0, "", map[string]string{"size": "1"})
+	assert.Error(err)
+}
+
+func TestGetAttachmentCount(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	server.addVolume(fakeServerVolume{
+		Name:        "vol",
+		Size:        1,
+		Status:      VolumeInUseStatus,
+		Attachments: []fakeServerAttachment{{ServerID: fakeInstanceID, Device: "/dev/vdb"}},
+	})
+
+	count, err := cloud.GetAttachmentCount(ctx, fakeInstanceID)
+	assert.NoError(err)
+	assert.Equal(1, count)
+
+	// the count is cached
+	_, err = cloud.GetAttachmentCount(ctx, fakeInstanceID)
+	assert.NoError(err)
+	assert.Equal(1, server.requestCount("GET /compute/servers/{id}/os-volume_attachments"))
+}
+
+func TestGetMetadata(t *testing.T) {
+	server, _ := newFakeServer(t)
+	defer server.close()
+
+	md, err := getMetadata(server.server.URL + "/openstack/latest/meta_data.json")
+	assert.NoError(t, err)
+	assert.Contains(t, string(md), fakeServerInstanceID)
+
+	_, err = getMetadata(server.server.URL + "/openstack/missing/meta_data.json")
+	assert.Error(t, err)
+}
+
+func TestVolumeRootAttachment(t *testing.T) {
+	tests := []struct {
+		name     string
+		bootable bool
+		device   string
+		expected bool
+	}{
+		{"bootable root disk", true, "/dev/vda", true},
+		{"bootable data disk", true, "/dev/vdb", false},
+		{"root disk", false, "/dev/vda", false},
+		{"data disk", false, "/dev/vdb", false},
+		{"bootable scsi root disk", true, "/dev/sda", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume := Volume{ID: "vol", Bootable: tt.bootable}
+			volume.setAttachments([]Attachment{{ServerID: fakeInstanceID, Device: tt.device}})
+
+			root, ok := volume.RootAttachment("")
+			assert.Equal(t, tt.expected, ok)
+			if ok {
+				assert.Equal(t, tt.device, root.Device)
+			}
+			_, ok = volume.RootAttachment(fakeInstanceID)
+			assert.Equal(t, tt.expected, ok)
+			_, ok = volume.RootAttachment("other")
+			assert.False(t, ok)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
+	cpoerrors "k8s.io/cloud-provider-openstack/pkg/util/errors"
+)
+
+// availability zones are seldom added or removed
+const zoneCacheTTL = 1 * time.Hour
+
+// AZMapping maps the availability zones of Nova to the ones of Cinder, for
+// clouds naming them differently. Zones it doesn't map are the same in both.
+type AZMapping struct {
+	cinderAZs map[string]string
+}
+
+// NewAZMapping returns the mapping of the Nova zones to the Cinder ones
+func NewAZMapping(cinderAZs map[string]string) AZMapping {
+	return AZMapping{cinderAZs: cinderAZs}
+}
+
+// UnmarshalText reads comma separated novaAZ=cinderAZ pairs or, when given
+// an absolute path, the file holding them one per line
+func (m *AZMapping) UnmarshalText(text []byte) error {
+	value, separator := strings.TrimSpace(string(text)), ","
+	if strings.HasPrefix(value, "/") {
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return fmt.Errorf("invalid [BlockStorage] az-mapping: %v", err)
+		}
+		value, separator = string(data), "\n"
+	}
+
+	cinderAZs := make(map[string]string)
+	for _, pair := range strings.Split(value, separator) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return fmt.Errorf("invalid [BlockStorage] az-mapping %q: must be novaAZ=cinderAZ pairs", pair)
+		}
+		novaAZ, cinderAZ := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, ok := cinderAZs[novaAZ]; ok {
+			return fmt.Errorf("invalid [BlockStorage] az-mapping: zone %s is mapped twice", novaAZ)
+		}
+		cinderAZs[novaAZ] = cinderAZ
+	}
+	m.cinderAZs = cinderAZs
+	return nil
+}
+
+// CinderAZ returns the Cinder zone of the volumes of the instances of the
+// Nova zone
+func (m AZMapping) CinderAZ(novaAZ string) string {
+	if cinderAZ, ok := m.cinderAZs[novaAZ]; ok {
+		return cinderAZ
+	}
+	return novaAZ
+}
+
+// NovaAZs returns the sorted Nova zones of the instances the volumes of the
+// Cinder zone are attached to, several of them may share one Cinder zone
+func (m AZMapping) NovaAZs(cinderAZ string) []string {
+	var novaAZs []string
+	for novaAZ, az := range m.cinderAZs {
+		if az == cinderAZ {
+			novaAZs = append(novaAZs, novaAZ)
+		}
+	}
+	if len(novaAZs) == 0 {
+		return []string{cinderAZ}
+	}
+	sort.Strings(novaAZs)
+	return novaAZs
+}
+
+// zoneCache keeps the Cinder availability zones listed last
+type zoneCache struct {
+	mux     sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	zones   []string
+	expires time.Time
+}
+
+func newZoneCache() *zoneCache {
+	return &zoneCache{ttl: zoneCacheTTL, now: time.Now}
+}
+
+// get returns the cached zones, false if they are not cached or expired
+func (c *zoneCache) get() ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.expires.IsZero() || c.now().After(c.expires) {
+		return nil, false
+	}
+	return c.zones, true
+}
+
+func (c *zoneCache) set(zones []string) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.zones = zones
+	c.expires = c.now().Add(c.ttl)
+}
+
+// GetAvailabilityZones returns the sorted names of the available Cinder
+// availability zones. Some clouds don't let users list them: the list is then
+// empty, which means the zones cannot be validated, not that there are none.
+func (os *OpenStack) GetAvailabilityZones(ctx context.Context) ([]string, error) {
+	if zones, ok := os.zones.get(); ok {
+		return zones, nil
+	}
+
+	client := os.blockStorageClient(ctx)
+	var body struct {
+		AvailabilityZoneInfo []struct {
+			ZoneName  string `json:"zoneName"`
+			ZoneState struct {
+				Available bool `json:"available"`
+			} `json:"zoneState"`
+		} `json:"availabilityZoneInfo"`
+	}
+	_, err := client.Get(client.ServiceURL("os-availability-zone"), &body, nil)
+	if err != nil {
+		if cpoerrors.IsForbidden(err) || cpoerrors.IsNotFound(err) {
+			logging.FromContext(ctx).V(4).Infof("Cannot list the availability zones, they are not validated: %v", err)
+			os.zones.set(nil)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var zones []string
+	for _, z := range body.AvailabilityZoneInfo {
+		if z.ZoneState.Available {
+			zones = append(zones, z.ZoneName)
+		}
+	}
+	sort.Strings(zones)
+	os.zones.set(zones)
+	return zones, nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAZMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	var m AZMapping
+	assert.NoError(m.UnmarshalText([]byte("az1=az1-storage, az2 = az2-storage,az3=az2-storage")))
+
+	// Nova to Cinder
+	assert.Equal("az1-storage", m.CinderAZ("az1"))
+	assert.Equal("az2-storage", m.CinderAZ("az3"))
+	assert.Equal("az4", m.CinderAZ("az4"))
+
+	// Cinder to Nova
+	assert.Equal([]string{"az1"}, m.NovaAZs("az1-storage"))
+	assert.Equal([]string{"az2", "az3"}, m.NovaAZs("az2-storage"))
+	assert.Equal([]string{"az4"}, m.NovaAZs("az4"))
+}
+
+// Test zones are the same in Nova and Cinder without a mapping
+func TestAZMappingIdentity(t *testing.T) {
+	var m AZMapping
+	assert.Equal(t, "nova", m.CinderAZ("nova"))
+	assert.Equal(t, []string{"nova"}, m.NovaAZs("nova"))
+
+	assert.NoError(t, m.UnmarshalText([]byte("")))
+	assert.Equal(t, "nova", m.CinderAZ("nova"))
+}
+
+func TestAZMappingFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "az-mapping")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# zones of the storage cluster\naz1=az1-storage\n\naz2=az2-storage\n")
+	assert.NoError(t, err)
+	f.Close()
+
+	var m AZMapping
+	assert.NoError(t, m.UnmarshalText([]byte(f.Name())))
+	assert.Equal(t, "az1-storage", m.CinderAZ("az1"))
+	assert.Equal(t, []string{"az2"}, m.NovaAZs("az2-storage"))
+
+	assert.Error(t, m.UnmarshalText([]byte("/nonexistent/az-mapping")))
+}
+
+func TestAZMappingInvalid(t *testing.T) {
+	for _, value := range []string{"az1", "az1=", "=az1-storage", "az1=a,az1=b"} {
+		var m AZMapping
+		assert.Error(t, m.UnmarshalText([]byte(value)), value)
+	}
+}
+
+func TestGetAvailabilityZones(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	now := time.Now()
+	cloud.zones.now = func() time.Time { return now }
+	server.addZone("zone-b", true)
+	server.addZone("zone-a", true)
+	server.addZone("zone-down", false)
+
+	zones, err := cloud.GetAvailabilityZones(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zone-a", "zone-b"}, zones)
+
+	// cached until the TTL passes
+	_, err = cloud.GetAvailabilityZones(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.requestCount("GET /volume/os-availability-zone"))
+
+	now = now.Add(zoneCacheTTL + time.Second)
+	_, err = cloud.GetAvailabilityZones(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.requestCount("GET /volume/os-availability-zone"))
+}
+
+// Test a cloud not letting users list the zones gives an empty list, without
+// being asked each time
+func TestGetAvailabilityZonesForbidden(t *testing.T) {
+	server, cloud := newFakeServer(t)
+	defer server.close()
+	ctx := context.Background()
+
+	server.inject("GET /volume/os-availability-zone", fakeServerFault{code: http.StatusForbidden})
+	server.addZone("zone-a", true)
+
+	for i := 0; i < 2; i++ {
+		zones, err := cloud.GetAvailabilityZones(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, zones)
+	}
+	assert.Equal(t, 1, server.requestCount("GET /volume/os-availability-zone"))
+}
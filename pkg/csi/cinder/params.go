@@ -0,0 +1,253 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// provisionerParamPrefix is the prefix of the parameters external-provisioner
+// reserves for itself, e.g. the ones of --extra-create-metadata
+const provisionerParamPrefix = "csi.storage.k8s.io/"
+
+// imageMetadataParamPrefix is the prefix of the parameters setting the image
+// metadata of the volumes, e.g. imageMetadata/hw_disk_bus
+const imageMetadataParamPrefix = "imageMetadata/"
+
+// volumeParams are the storage class parameters of CreateVolume and
+// GetCapacity
+type volumeParams struct {
+	// Cinder volume type, the default-volume-type of the cloud config if empty
+	Type string
+	// Cinder availability zone, picked by getVolumeAZ if empty
+	Availability string
+	// Filesystem type of the in-tree plugin, formatted by the node
+	FsType string
+	// Whether the volume is protected from deletion
+	Protected bool
+	// Whether DeleteVolume retains the volume instead of deleting it, retain
+	// or delete
+	OnDelete string
+	// Image metadata set on the volume once created, the keys being allowed
+	// by the driver
+	ImageMetadata map[string]string
+	// PVC and PV of the volume, passed with --extra-create-metadata
+	PVCName      string
+	PVCNamespace string
+	PVName       string
+}
+
+// volumeParam is a storage class parameter known to the driver, set checks
+// the value and stores it in p
+type volumeParam struct {
+	key string
+	set func(p *volumeParams, value string) error
+}
+
+var volumeParamSchema = []volumeParam{
+	{"type", func(p *volumeParams, value string) error {
+		p.Type = value
+		return nil
+	}},
+	{"availability", func(p *volumeParams, value string) error {
+		if strings.TrimSpace(value) != value {
+			return fmt.Errorf("must not start or end with spaces")
+		}
+		p.Availability = value
+		return nil
+	}},
+	// checked against the filesystems the driver supports by parseVolumeParams
+	{fsTypeParam, func(p *volumeParams, value string) error {
+		p.FsType = value
+		return nil
+	}},
+	{protectedParam, func(p *volumeParams, value string) error {
+		protected, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		p.Protected = protected
+		return nil
+	}},
+	{onDeleteParam, func(p *volumeParams, value string) error {
+		if value != onDeleteRetain && value != onDeleteDelete {
+			return fmt.Errorf("must be %s or %s", onDeleteRetain, onDeleteDelete)
+		}
+		p.OnDelete = value
+		return nil
+	}},
+	{pvcNameParam, func(p *volumeParams, value string) error {
+		p.PVCName = value
+		return nil
+	}},
+	{pvcNamespaceParam, func(p *volumeParams, value string) error {
+		p.PVCNamespace = value
+		return nil
+	}},
+	{pvNameParam, func(p *volumeParams, value string) error {
+		p.PVName = value
+		return nil
+	}},
+}
+
+// parseVolumeParams parses the storage class parameters. The values of the
+// known parameters are checked, an InvalidArgument is returned for the first
+// invalid one. Unknown parameters are logged and ignored, unless the driver
+// runs with --strict-parameters, then they are an InvalidArgument listing the
+// accepted parameters.
+func parseVolumeParams(params map[string]string, d *CinderDriver) (*volumeParams, error) {
+	// storage classes of the in-tree plugin may spell the parameters differently
+	params = normalizeParameters(params)
+
+	p := &volumeParams{}
+	// in a stable order, so that the same invalid parameter is reported
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var unknown []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, imageMetadataParamPrefix) {
+			if err := p.setImageMetadata(strings.TrimPrefix(key, imageMetadataParamPrefix), params[key], d); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, %v", key, params[key], err)
+			}
+			continue
+		}
+		param := findVolumeParam(key)
+		if param == nil {
+			if !strings.HasPrefix(key, provisionerParamPrefix) {
+				unknown = append(unknown, key)
+			}
+			continue
+		}
+		if err := param.set(p, params[key]); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, %v", key, params[key], err)
+		}
+	}
+	if p.FsType != "" {
+		if err := d.checkFsType(p.FsType); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", fsTypeParam, err)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return p, nil
+	}
+	var msgs []string
+	for _, key := range unknown {
+		msg := fmt.Sprintf("%q", key)
+		if suggestion := suggestVolumeParam(key); suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		msgs = append(msgs, msg)
+	}
+	if !d.strictParameters {
+		klog.Warningf("Ignoring unknown storage class parameters %s", strings.Join(msgs, ", "))
+		return p, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unknown storage class parameters %s, the accepted parameters are %s, the %s<key> ones of the image metadata keys and the %s* ones of the provisioner", strings.Join(msgs, ", "), strings.Join(acceptedVolumeParams(), ", "), imageMetadataParamPrefix, provisionerParamPrefix)
+}
+
+// setImageMetadata checks the image metadata key is allowed by the driver and
+// stores its value in p
+func (p *volumeParams) setImageMetadata(key, value string, d *CinderDriver) error {
+	if err := d.checkImageMetadataKey(key); err != nil {
+		return err
+	}
+	if value == "" || len(value) > maxMetadataLength {
+		return fmt.Errorf("must not be empty or longer than %d characters", maxMetadataLength)
+	}
+	if p.ImageMetadata == nil {
+		p.ImageMetadata = make(map[string]string)
+	}
+	p.ImageMetadata[key] = value
+	return nil
+}
+
+func findVolumeParam(key string) *volumeParam {
+	for i := range volumeParamSchema {
+		if volumeParamSchema[i].key == key {
+			return &volumeParamSchema[i]
+		}
+	}
+	return nil
+}
+
+// acceptedVolumeParams returns the keys of the parameters set in storage
+// classes, sorted
+func acceptedVolumeParams() []string {
+	var keys []string
+	for _, param := range volumeParamSchema {
+		if !strings.HasPrefix(param.key, provisionerParamPrefix) {
+			keys = append(keys, param.key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// suggestVolumeParam returns the accepted parameter key is most likely a
+// misspelling of, or an empty string if none is close enough
+func suggestVolumeParam(key string) string {
+	best, bestDistance := "", 3
+	for _, accepted := range acceptedVolumeParams() {
+		if d := editDistance(strings.ToLower(key), accepted); d < bestDistance {
+			best, bestDistance = accepted, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+)
+
+func TestParseVolumeParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		strict   bool
+		expected *volumeParams
+		errMsgs  []string
+	}{
+		{
+			name:     "none",
+			expected: &volumeParams{},
+		},
+		{
+			name: "all",
+			params: map[string]string{
+				"type":                             "ssd",
+				"availability":                     "nova",
+				"fstype":                           "xfs",
+				"protected":                        "true",
+				"onDelete":                         "retain",
+				"csi.storage.k8s.io/pvc/name":      "pvc-1",
+				"csi.storage.k8s.io/pvc/namespace": "default",
+				"csi.storage.k8s.io/pv/name":       "pv-1",
+			},
+			strict: true,
+			expected: &volumeParams{
+				Type:         "ssd",
+				Availability: "nova",
+				FsType:       "xfs",
+				Protected:    true,
+				OnDelete:     "retain",
+				PVCName:      "pvc-1",
+				PVCNamespace: "default",
+				PVName:       "pv-1",
+			},
+		},
+		{
+			name:     "in-tree spelling",
+			params:   map[string]string{"Type": "ssd", "fsType": "ext4"},
+			strict:   true,
+			expected: &volumeParams{Type: "ssd", FsType: "ext4"},
+		},
+		{
+			name:     "other provisioner parameter",
+			params:   map[string]string{"csi.storage.k8s.io/fstype": "ext4"},
+			strict:   true,
+			expected: &volumeParams{},
+		},
+		{
+			name:     "unknown parameter ignored",
+			params:   map[string]string{"type": "ssd", "availabilty": "nova"},
+			expected: &volumeParams{Type: "ssd"},
+		},
+		{
+			name:    "typo",
+			params:  map[string]string{"type": "ssd", "availabilty": "nova"},
+			strict:  true,
+			errMsgs: []string{`"availabilty" (did you mean "availability"?)`, "the accepted parameters are availability, fstype, onDelete, protected, type"},
+		},
+		{
+			name:    "unknown parameter",
+			params:  map[string]string{"replication": "enabled"},
+			strict:  true,
+			errMsgs: []string{`unknown storage class parameters "replication", the accepted`},
+		},
+		{
+			name:    "bad fstype",
+			params:  map[string]string{"fstype": "ntfs"},
+			errMsgs: []string{`invalid fstype parameter: filesystem type "ntfs" is not supported, the supported types are ext2, ext3, ext4, xfs`},
+		},
+		{
+			name:    "bad protected",
+			params:  map[string]string{"protected": "yes"},
+			errMsgs: []string{`invalid protected parameter "yes", must be true or false`},
+		},
+		{
+			name:    "bad onDelete",
+			params:  map[string]string{"onDelete": "keep"},
+			errMsgs: []string{`invalid onDelete parameter "keep", must be retain or delete`},
+		},
+		{
+			name: "image metadata",
+			params: map[string]string{
+				"imageMetadata/hw_disk_bus":   "scsi",
+				"imageMetadata/hw_scsi_model": "virtio-scsi",
+			},
+			strict: true,
+			expected: &volumeParams{
+				ImageMetadata: map[string]string{"hw_disk_bus": "scsi", "hw_scsi_model": "virtio-scsi"},
+			},
+		},
+		{
+			name:    "image metadata not allowed",
+			params:  map[string]string{"imageMetadata/os_type": "windows"},
+			errMsgs: []string{`invalid imageMetadata/os_type parameter "windows", image metadata key "os_type" is not allowed, the keys allowed by --image-metadata-keys are hw_disk_bus, hw_scsi_model`},
+		},
+		{
+			name:    "empty image metadata",
+			params:  map[string]string{"imageMetadata/hw_disk_bus": ""},
+			errMsgs: []string{`invalid imageMetadata/hw_disk_bus parameter "", must not be empty`},
+		},
+		{
+			name:    "bad availability",
+			params:  map[string]string{"availability": "nova "},
+			errMsgs: []string{`invalid availability parameter "nova ", must not start or end with spaces`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+			d.SetStrictParameters(tt.strict)
+			params, err := parseVolumeParams(tt.params, d)
+			if len(tt.errMsgs) == 0 {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, params)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				for _, msg := range tt.errMsgs {
+					assert.Contains(t, err.Error(), msg)
+				}
+			}
+		})
+	}
+}
+
+// Test a strict driver refuses a storage class with a misspelled parameter
+// before creating anything
+func TestCreateVolumeStrictParameters(t *testing.T) {
+	cloudmock := new(openstack.OpenStackMock)
+
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	d.SetStrictParameters(true)
+	cs := NewControllerServer(d, cloudmock, nil)
+
+	_, err := cs.CreateVolume(FakeCtx, &csi.CreateVolumeRequest{
+		Name:       FakeVolName,
+		Parameters: map[string]string{"Availabilty": "nova"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), `did you mean "availability"?`)
+	cloudmock.AssertNotCalled(t, "CreateVolume")
+}
@@ -1,13 +1,17 @@
 package sanity
 
-import "k8s.io/cloud-provider-openstack/pkg/csi/cinder"
+import (
+	"context"
+
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder"
+)
 
 type fakemount struct {
 }
 
 // fake mount
 
-func (m *fakemount) ScanForAttach(devicePath string) error {
+func (m *fakemount) ScanForAttach(ctx context.Context, devicePath string) error {
 	return nil
 }
 
@@ -39,3 +43,15 @@ func (m *fakemount) GetInstanceID() (string, error) {
 func (m *fakemount) GetDevicePath(volumeID string) (string, error) {
 	return "", nil
 }
+
+func (m *fakemount) RescanDevice(devicePath string) error {
+	return nil
+}
+
+func (m *fakemount) ResizeFS(devicePath string, deviceMountPath string) error {
+	return nil
+}
+
+func (m *fakemount) NeedsResize(devicePath string, deviceMountPath string) (bool, error) {
+	return false, nil
+}
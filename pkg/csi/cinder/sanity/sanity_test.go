@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
 
 	"github.com/kubernetes-csi/csi-test/pkg/sanity"
 )
@@ -19,7 +20,8 @@ func TestDriver(t *testing.T) {
 	nodeID := "45678"
 
 	d := cinder.NewDriver(nodeID, endpoint, cluster)
-	c := &cloud{}
+	c := openstack.NewFakeOpenStack()
+	c.AddInstance(cinder.FakeInstanceID, cinder.FakeAvailability)
 	fakemnt := &fakemount{}
 	fakemet := &fakemetadata{}
 
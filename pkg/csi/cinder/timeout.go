@@ -0,0 +1,61 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const identityServicePrefix = "/csi.v1.Identity/"
+
+// SetOperationTimeout bounds the controller and node calls, and so every wait
+// for OpenStack or the node they do: attaches, detaches, creations, extends
+// and device discovery. The backoffs of the cloud config only shape the
+// polling within it. 0 leaves the calls bounded by their own deadline and the
+// backoffs only.
+func (d *CinderDriver) SetOperationTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("invalid --operation-timeout %v, must not be negative", timeout)
+	}
+	d.operationTimeout = timeout
+	return nil
+}
+
+// operationContext returns ctx bounded by timeout: its deadline is the earlier
+// of the one of ctx, i.e. of the RPC, and timeout from now
+func operationContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// boundOperation applies the operation timeout to the controller and node
+// calls. Identity calls only read state and are left alone.
+func (d *CinderDriver) boundOperation(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if d.operationTimeout <= 0 || strings.HasPrefix(info.FullMethod, identityServicePrefix) {
+		return handler(ctx, req)
+	}
+	ctx, cancel := operationContext(ctx, d.operationTimeout)
+	defer cancel()
+	return handler(ctx, req)
+}
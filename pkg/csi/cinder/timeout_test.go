@@ -0,0 +1,104 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// deadlineIn returns the time left until the deadline of ctx, 0 without one
+func deadlineIn(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	return time.Until(deadline)
+}
+
+func TestOperationContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		timeout  time.Duration
+		expected time.Duration
+	}{
+		{"timeout earlier", 80 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"deadline earlier", 10 * time.Second, 30 * time.Second, 10 * time.Second},
+		{"no deadline", 0, 30 * time.Second, 30 * time.Second},
+		{"no timeout", 80 * time.Second, 0, 80 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, cancelParent := context.WithCancel(context.Background())
+			if tt.deadline > 0 {
+				parent, cancelParent = context.WithTimeout(context.Background(), tt.deadline)
+			}
+			defer cancelParent()
+
+			ctx, cancel := operationContext(parent, tt.timeout)
+			defer cancel()
+			left := deadlineIn(ctx)
+			assert.True(t, left <= tt.expected && left > tt.expected-time.Second, "deadline in %v, expected %v", left, tt.expected)
+		})
+	}
+}
+
+// Test a 30s operation timeout caps a wait of 80s within the deadline of the
+// call, and the waits of OpenStack calls end with DeadlineExceeded once it
+// expires
+func TestBoundOperation(t *testing.T) {
+	d := NewDriver(FakeNodeID, FakeEndpoint, FakeCluster)
+	assert.Error(t, d.SetOperationTimeout(-time.Second))
+	assert.NoError(t, d.SetOperationTimeout(30*time.Second))
+
+	ctx, cancel := context.WithTimeout(FakeCtx, 80*time.Second)
+	defer cancel()
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	d.boundOperation(ctx, &csi.ControllerPublishVolumeRequest{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		left := deadlineIn(ctx)
+		assert.True(t, left <= 30*time.Second && left > 29*time.Second, "deadline in %v", left)
+		return nil, nil
+	})
+
+	// identity calls are not bounded
+	info = &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Identity/Probe"}
+	d.boundOperation(ctx, &csi.ProbeRequest{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		assert.True(t, deadlineIn(ctx) > 79*time.Second)
+		return nil, nil
+	})
+
+	// the same in milliseconds, with a wait outliving the timeout
+	assert.NoError(t, d.SetOperationTimeout(30*time.Millisecond))
+	info = &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	start := time.Now()
+	_, err := d.boundOperation(ctx, &csi.NodeStageVolumeRequest{}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			return nil, waitError(ctx.Err())
+		case <-time.After(80 * time.Millisecond):
+			return nil, nil
+		}
+	})
+	assert.Equal(t, waitError(context.DeadlineExceeded), err)
+	assert.True(t, time.Since(start) < 80*time.Millisecond, "waited %v", time.Since(start))
+}
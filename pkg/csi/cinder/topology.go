@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+)
+
+// TopologyOpts configures the topology segments reported by NodeGetInfo
+type TopologyOpts struct {
+	// Key of the availability zone segment, topology.<driver name>/zone if empty
+	ZoneKey string
+	// Key of the region segment, no region segment is reported if empty
+	RegionKey string
+	// Region reported in the region segment
+	Region string
+	// Additional segments, reported as is
+	Segments map[string]string
+}
+
+// SetTopologyOpts configures the topology segments of the driver. It must be
+// called after SetDriverName, as the default zone key depends on the name.
+func (d *CinderDriver) SetTopologyOpts(opts TopologyOpts) error {
+	keys := make(map[string]bool)
+	checkKey := func(key string) error {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid topology key %q: %s", key, strings.Join(errs, ", "))
+		}
+		if keys[key] {
+			return fmt.Errorf("topology key %q is used more than once", key)
+		}
+		keys[key] = true
+		return nil
+	}
+	checkValue := func(key, value string) error {
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q of topology key %q: %s", value, key, strings.Join(errs, ", "))
+		}
+		return nil
+	}
+
+	zoneKey := opts.ZoneKey
+	if zoneKey == "" {
+		zoneKey = zoneTopologyKeyFor(d.name)
+	}
+	if err := checkKey(zoneKey); err != nil {
+		return err
+	}
+	if opts.RegionKey != "" {
+		if err := checkKey(opts.RegionKey); err != nil {
+			return err
+		}
+		if opts.Region == "" {
+			return fmt.Errorf("no region to report under topology key %q", opts.RegionKey)
+		}
+		if err := checkValue(opts.RegionKey, opts.Region); err != nil {
+			return err
+		}
+	}
+	for k, v := range opts.Segments {
+		if err := checkKey(k); err != nil {
+			return err
+		}
+		if err := checkValue(k, v); err != nil {
+			return err
+		}
+	}
+
+	if zoneKey != zoneTopologyKeyFor(d.name) {
+		klog.Warningf("WARNING: using topology key %q for the availability zone instead of %q. "+
+			"Changing the key on an existing cluster makes the existing volumes unschedulable.", zoneKey, zoneTopologyKeyFor(d.name))
+	}
+
+	d.zoneTopologyKey = opts.ZoneKey
+	d.regionTopologyKey = opts.RegionKey
+	d.region = opts.Region
+	d.topologySegments = opts.Segments
+	return nil
+}
+
+// zoneTopologyKeyFor returns the default key of the availability zone segment
+func zoneTopologyKeyFor(driverName string) string {
+	return "topology." + driverName + "/zone"
+}
+
+// nodeTopology returns the topology segments of a node in the given zone
+func (d *CinderDriver) nodeTopology(zone string) map[string]string {
+	segments := make(map[string]string)
+	for k, v := range d.topologySegments {
+		segments[k] = v
+	}
+	if d.regionTopologyKey != "" {
+		segments[d.regionTopologyKey] = d.region
+	}
+	segments[d.topologyKey()] = zone
+	return segments
+}
+
+// ReadTopologySegments reads topology segments from a file holding one
+// key=value pair per line. Empty lines and lines starting with # are ignored.
+func ReadTopologySegments(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segments := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key=value, got %q", path, n, line)
+		}
+		segments[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cinder
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
+)
+
+func TestSetTopologyOpts(t *testing.T) {
+	assert := assert.New(t)
+
+	// Defaults only report the zone
+	d := NewFakeDriver()
+	assert.NoError(d.SetTopologyOpts(TopologyOpts{}))
+	assert.Equal(defaultTopologyKey, d.topologyKey())
+	assert.Equal(map[string]string{defaultTopologyKey: "zone-1"}, d.nodeTopology("zone-1"))
+
+	// Custom keys and segments
+	d = NewFakeDriver()
+	err := d.SetTopologyOpts(TopologyOpts{
+		ZoneKey:   "example.com/zone",
+		RegionKey: "topology.cinder.csi.openstack.org/region",
+		Region:    "region-1",
+		Segments:  map[string]string{"example.com/aggregate": "ssd"},
+	})
+	assert.NoError(err)
+	assert.Equal("example.com/zone", d.topologyKey())
+	assert.Equal(map[string]string{
+		"example.com/zone":                         "zone-1",
+		"topology.cinder.csi.openstack.org/region": "region-1",
+		"example.com/aggregate":                    "ssd",
+	}, d.nodeTopology("zone-1"))
+}
+
+func TestSetTopologyOptsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts TopologyOpts
+	}{
+		{
+			name: "invalid zone key",
+			opts: TopologyOpts{ZoneKey: "example.com/zone/invalid"},
+		},
+		{
+			name: "region key without region",
+			opts: TopologyOpts{RegionKey: "example.com/region"},
+		},
+		{
+			name: "duplicate key",
+			opts: TopologyOpts{Segments: map[string]string{defaultTopologyKey: "zone-1"}},
+		},
+		{
+			name: "invalid segment value",
+			opts: TopologyOpts{Segments: map[string]string{"example.com/aggregate": "not valid"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewFakeDriver()
+			assert.Error(t, d.SetTopologyOpts(tt.opts))
+			assert.Equal(t, defaultTopologyKey, d.topologyKey())
+		})
+	}
+}
+
+func TestReadTopologySegments(t *testing.T) {
+	f, err := ioutil.TempFile("", "segments")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`# host aggregates
+example.com/aggregate = ssd
+
+example.com/rack=r1
+`)
+	assert.NoError(t, err)
+	f.Close()
+
+	segments, err := ReadTopologySegments(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"example.com/aggregate": "ssd",
+		"example.com/rack":      "r1",
+	}, segments)
+
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte("no-value\n"), 0644))
+	_, err = ReadTopologySegments(f.Name())
+	assert.Error(t, err)
+}
+
+// Test CreateVolume reads the zone from the configured topology key
+func TestCreateVolumeCustomTopologyKey(t *testing.T) {
+	d := NewFakeDriver()
+	assert.NoError(t, d.SetTopologyOpts(TopologyOpts{ZoneKey: "example.com/zone"}))
+	cs := NewControllerServer(d, openstack.NewFakeOpenStack(), nil)
+
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: FakeVolName,
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Preferred: []*csi.Topology{
+				{Segments: map[string]string{"example.com/zone": "zone-2"}},
+			},
+		},
+	}
+
+	resp, err := cs.CreateVolume(FakeCtx, fakeReq)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com/zone": "zone-2"}, resp.GetVolume().GetAccessibleTopology()[0].GetSegments())
+}
@@ -3,10 +3,15 @@ package cinder
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/logging"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/mount"
 	"k8s.io/cloud-provider-openstack/pkg/csi/cinder/openstack"
 	"k8s.io/klog"
@@ -36,10 +41,13 @@ func NewVolumeCapabilityAccessMode(mode csi.VolumeCapability_AccessMode_Mode) *c
 	return &csi.VolumeCapability_AccessMode{Mode: mode}
 }
 
-func NewControllerServer(d *CinderDriver, cloud openstack.IOpenStack) *controllerServer {
+func NewControllerServer(d *CinderDriver, cloud openstack.IOpenStack, metadata openstack.IMetadata) *controllerServer {
 	return &controllerServer{
-		Driver: d,
-		Cloud:  cloud,
+		Driver:   d,
+		Cloud:    cloud,
+		Metadata: metadata,
+		inFlight: newInFlight(),
+		detached: newDetachedVolumes(),
 	}
 }
 
@@ -57,9 +65,9 @@ func NewNodeServer(d *CinderDriver, mount mount.IMount, metadata openstack.IMeta
 	}
 }
 
-func RunControllerandNodePublishServer(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+func RunControllerandNodePublishServer(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, interceptors ...grpc.UnaryServerInterceptor) {
 
-	s := NewNonBlockingGRPCServer()
+	s := NewNonBlockingGRPCServer(interceptors...)
 	s.Start(endpoint, ids, cs, ns)
 	s.Wait()
 }
@@ -74,14 +82,80 @@ func ParseEndpoint(ep string) (string, string, error) {
 	return "", "", fmt.Errorf("Invalid endpoint: %v", ep)
 }
 
+// chainUnaryInterceptors returns an interceptor calling the given ones in
+// order, the last one calling the handler
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// requestCounter numbers the gRPC requests served by this process
+var requestCounter uint64
+
+// RequestIDFromContext returns the ID logGRPC assigned to the request
+// handled with ctx, or an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	return logging.RequestIDFrom(ctx)
+}
+
+// logGRPC logs every gRPC call with a request ID, the fields identifying the
+// objects it acts on, its duration and the resulting status code, and records
+// the same in the operation metrics.
+// Requests are never dumped as a whole, as some of them carry secrets.
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
-	klog.V(5).Infof("GRPC request: %+v", req)
+	id := fmt.Sprintf("%d", atomic.AddUint64(&requestCounter, 1))
+	ctx = logging.WithRequestID(ctx, id)
+
+	method := methodName(info.FullMethod)
+	inFlight := operationsInFlight.WithLabelValues(method)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	klog.V(3).Infof("GRPC call [%s]: %s %s", id, info.FullMethod, requestFields(req))
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	duration := time.Since(start)
+	operationDuration.WithLabelValues(method, status.Code(err).String()).Observe(duration.Seconds())
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		klog.Errorf("GRPC error [%s]: %s returned %s after %v: %v", id, info.FullMethod, status.Code(err), duration, err)
 	} else {
-		klog.V(5).Infof("GRPC response: %+v", resp)
+		klog.V(3).Infof("GRPC done [%s]: %s returned %s after %v", id, info.FullMethod, codes.OK, duration)
+		klog.V(5).Infof("GRPC response [%s]: %+v", id, resp)
 	}
 	return resp, err
 }
+
+// requestFields returns the fields of a CSI request that are safe to log
+func requestFields(req interface{}) string {
+	var fields []string
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		fields = append(fields, "name="+r.GetName())
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		fields = append(fields, "volume_id="+r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetSourceVolumeId() string }); ok && r.GetSourceVolumeId() != "" {
+		fields = append(fields, "source_volume_id="+r.GetSourceVolumeId())
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		fields = append(fields, "snapshot_id="+r.GetSnapshotId())
+	}
+	if r, ok := req.(interface{ GetNodeId() string }); ok && r.GetNodeId() != "" {
+		fields = append(fields, "node_id="+r.GetNodeId())
+	}
+	if r, ok := req.(interface{ GetStagingTargetPath() string }); ok && r.GetStagingTargetPath() != "" {
+		fields = append(fields, "staging_target_path="+r.GetStagingTargetPath())
+	}
+	if r, ok := req.(interface{ GetTargetPath() string }); ok && r.GetTargetPath() != "" {
+		fields = append(fields, "target_path="+r.GetTargetPath())
+	}
+	return strings.Join(fields, " ")
+}
@@ -17,9 +17,16 @@ limitations under the License.
 package cinder
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestParseEndpoint(t *testing.T) {
@@ -74,3 +81,94 @@ func TestParseEndpoint(t *testing.T) {
 	_, _, err = ParseEndpoint("")
 	assert.NotNil(t, err)
 }
+
+func TestRequestFields(t *testing.T) {
+	assert := assert.New(t)
+
+	// Secrets are never part of the logged fields
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          FakeVolID,
+		StagingTargetPath: FakeStagingTargetPath,
+		Secrets:           map[string]string{"password": "fake-secret"},
+	}
+	fields := requestFields(req)
+	assert.Equal("volume_id="+FakeVolID+" staging_target_path="+FakeStagingTargetPath, fields)
+	assert.False(strings.Contains(fields, "fake-secret"))
+
+	pubReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId: FakeVolID,
+		NodeId:   FakeNodeID,
+		Secrets:  map[string]string{"password": "fake-secret"},
+	}
+	assert.Equal("volume_id="+FakeVolID+" node_id="+FakeNodeID, requestFields(pubReq))
+
+	snapReq := &csi.CreateSnapshotRequest{
+		Name:           FakeSnapshotName,
+		SourceVolumeId: FakeVolID,
+	}
+	assert.Equal("name="+FakeSnapshotName+" source_volume_id="+FakeVolID, requestFields(snapReq))
+
+	assert.Equal("", requestFields(&csi.GetPluginInfoRequest{}))
+}
+
+func TestLogGRPC(t *testing.T) {
+	assert := assert.New(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+
+	// Each request gets its own ID in the handler context
+	var ids []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		id := RequestIDFromContext(ctx)
+		assert.NotEmpty(id)
+		ids = append(ids, id)
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	for i := 0; i < 2; i++ {
+		_, err := logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, handler)
+		assert.NoError(err)
+	}
+	assert.Len(ids, 2)
+	assert.NotEqual(ids[0], ids[1])
+
+	// Errors are returned unchanged
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "fake error")
+	}
+	_, err := logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, failing)
+	assert.Equal(codes.NotFound, status.Code(err))
+
+	plain := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, errors.New("fake error")
+	}
+	_, err = logGRPC(FakeCtx, &csi.ControllerPublishVolumeRequest{VolumeId: FakeVolID}, info, plain)
+	assert.EqualError(err, "fake error")
+
+	// Outside of a request there is no ID
+	assert.Equal("", RequestIDFromContext(context.Background()))
+}
+
+func TestChainUnaryInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "response", nil
+	}
+
+	chain := chainUnaryInterceptors(interceptor("first"), interceptor("second"))
+	resp, err := chain(FakeCtx, nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "response", resp)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+
+	// Without interceptors the handler is called directly
+	calls = nil
+	_, err = chainUnaryInterceptors()(FakeCtx, nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"handler"}, calls)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockdevice
+
+import (
+	"path"
+	"strings"
+)
+
+// ByIDDir is where udev links the disks under names derived from their
+// serial ID, stable across reboots unlike the /dev/vdX names
+const ByIDDir = "/dev/disk/by-id"
+
+// serialIDLength is the length of the serial ID of a virtio disk, Nova sets
+// it to the volume ID, truncated
+const serialIDLength = 20
+
+// SerialIDPaths returns the paths under which udev links the disk of an
+// attached Cinder volume, depending on the hypervisor. Certain Nova drivers
+// set the serial ID of the disk to the volume ID.
+func SerialIDPaths(volumeID string) []string {
+	serial := volumeID
+	if len(serial) > serialIDLength {
+		serial = serial[:serialIDLength]
+	}
+	return []string{
+		// KVM
+		path.Join(ByIDDir, "virtio-"+serial),
+		// KVM virtio-scsi
+		path.Join(ByIDDir, "scsi-0QEMU_QEMU_HARDDISK_"+serial),
+		// ESXi
+		path.Join(ByIDDir, "wwn-0x"+strings.Replace(volumeID, "-", "", -1)),
+	}
+}
+
+// Disk buses of the hw_disk_bus image metadata changing the name of the disk
+const (
+	VirtioBus = "virtio"
+	SCSIBus   = "scsi"
+)
+
+// BusSerialIDPaths returns the paths of SerialIDPaths, those under which the
+// disk is linked on the bus first. The disk of a volume with the hw_disk_bus
+// image metadata is expected on that bus, the other paths are kept in case
+// Nova attached it elsewhere.
+func BusSerialIDPaths(volumeID, bus string) []string {
+	paths := SerialIDPaths(volumeID)
+	if bus != SCSIBus {
+		// virtio disks come first already
+		return paths
+	}
+	// KVM virtio-scsi, ESXi, then KVM
+	return []string{paths[1], paths[2], paths[0]}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockdevice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerialIDPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		volumeID string
+		expected []string
+	}{
+		{
+			name:     "volume ID",
+			volumeID: "261a8b81-3660-43e5-bab8-6470b65ee4e8",
+			expected: []string{
+				"/dev/disk/by-id/virtio-261a8b81-3660-43e5-b",
+				"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_261a8b81-3660-43e5-b",
+				"/dev/disk/by-id/wwn-0x261a8b81366043e5bab86470b65ee4e8",
+			},
+		},
+		{
+			name:     "short ID",
+			volumeID: "vol-1",
+			expected: []string{
+				"/dev/disk/by-id/virtio-vol-1",
+				"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_vol-1",
+				"/dev/disk/by-id/wwn-0xvol1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, SerialIDPaths(tt.volumeID))
+		})
+	}
+}
+
+func TestBusSerialIDPaths(t *testing.T) {
+	volumeID := "261a8b81-3660-43e5-bab8-6470b65ee4e8"
+	virtio := "/dev/disk/by-id/virtio-261a8b81-3660-43e5-b"
+	scsi := "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_261a8b81-3660-43e5-b"
+	wwn := "/dev/disk/by-id/wwn-0x261a8b81366043e5bab86470b65ee4e8"
+
+	assert.Equal(t, []string{scsi, wwn, virtio}, BusSerialIDPaths(volumeID, SCSIBus))
+	assert.Equal(t, []string{virtio, scsi, wwn}, BusSerialIDPaths(volumeID, VirtioBus))
+	assert.Equal(t, []string{virtio, scsi, wwn}, BusSerialIDPaths(volumeID, ""))
+	assert.Equal(t, []string{virtio, scsi, wwn}, BusSerialIDPaths(volumeID, "ide"))
+}
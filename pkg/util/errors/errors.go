@@ -35,3 +35,71 @@ func IsNotFound(err error) bool {
 
 	return false
 }
+
+func IsConflict(err error) bool {
+	if _, ok := err.(gophercloud.ErrDefault409); ok {
+		return true
+	}
+
+	if errCode, ok := err.(gophercloud.ErrUnexpectedResponseCode); ok {
+		if errCode.Actual == http.StatusConflict {
+			return true
+		}
+	}
+
+	return false
+}
+
+func IsBadRequest(err error) bool {
+	if _, ok := err.(gophercloud.ErrDefault400); ok {
+		return true
+	}
+
+	if errCode, ok := err.(gophercloud.ErrUnexpectedResponseCode); ok {
+		if errCode.Actual == http.StatusBadRequest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsForbidden returns whether err is the 403 returned when the policy of the
+// cloud doesn't allow the user the request
+func IsForbidden(err error) bool {
+	if _, ok := err.(gophercloud.ErrDefault403); ok {
+		return true
+	}
+
+	if errCode, ok := err.(gophercloud.ErrUnexpectedResponseCode); ok {
+		if errCode.Actual == http.StatusForbidden {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsOverQuota returns whether err is the 413 returned by Cinder when a quota
+// of the project would be exceeded
+func IsOverQuota(err error) bool {
+	if errCode, ok := err.(gophercloud.ErrUnexpectedResponseCode); ok {
+		if errCode.Actual == http.StatusRequestEntityTooLarge {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsNotAcceptable returns whether err is the 406 returned when the cloud
+// doesn't support the requested microversion
+func IsNotAcceptable(err error) bool {
+	if errCode, ok := err.(gophercloud.ErrUnexpectedResponseCode); ok {
+		if errCode.Actual == http.StatusNotAcceptable {
+			return true
+		}
+	}
+
+	return false
+}
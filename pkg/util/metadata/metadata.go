@@ -22,10 +22,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"k8s.io/klog"
 
@@ -54,6 +56,29 @@ const (
 	ConfigDriveID = "configDrive"
 )
 
+// metadataClient is shared by all the requests to the metadata service, so
+// that they reuse its connections instead of opening one per request
+var metadataClient = &http.Client{
+	// the whole request, a stalled metadata service must not block callers
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// the link-local metadata service is never reached through a proxy
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        2,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Client returns the HTTP client used for the requests to the metadata service
+func Client() *http.Client {
+	return metadataClient
+}
+
 // ErrBadMetadata is used to indicate a problem parsing data from metadata server
 var ErrBadMetadata = errors.New("invalid OpenStack metadata, got empty uuid")
 
@@ -63,9 +88,29 @@ type DeviceMetadata struct {
 	Bus     string `json:"bus,omitempty"`
 	Serial  string `json:"serial,omitempty"`
 	Address string `json:"address,omitempty"`
+	// Tags of the attachment, set by Nova 2.49 and later
+	Tags []string `json:"tags,omitempty"`
 	// .. and other fields.
 }
 
+// isVolume returns whether the device is the disk of the volume, by its
+// serial or, on hypervisors not setting it, by the volume ID tagging the
+// attachment
+func (d *DeviceMetadata) isVolume(volumeID string) bool {
+	if d.Type != "disk" {
+		return false
+	}
+	if d.Serial == volumeID {
+		return true
+	}
+	for _, tag := range d.Tags {
+		if tag == volumeID {
+			return true
+		}
+	}
+	return false
+}
+
 // Metadata has the information fetched from OpenStack metadata service or
 // config drives. Assumes the "2012-08-10" meta_data.json format.
 // See http://docs.openstack.org/user-guide/cli_config_drive.html
@@ -149,13 +194,18 @@ func GetFromConfigDrive(metadataVersion string) (*Metadata, error) {
 
 func GetFromMetadataService(metadataVersion string) (*Metadata, error) {
 	// Try to get JSON from metadata server.
-	metadataURL := getMetadataURL(metadataVersion)
+	return getFromURL(getMetadataURL(metadataVersion))
+}
+
+func getFromURL(metadataURL string) (*Metadata, error) {
 	klog.V(4).Infof("Attempting to fetch metadata from %s", metadataURL)
-	resp, err := http.Get(metadataURL)
+	resp, err := metadataClient.Get(metadataURL)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching %s: %v", metadataURL, err)
 	}
 	defer resp.Body.Close()
+	// the connection is only reused once the body is read to the end
+	defer io.Copy(ioutil.Discard, resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("unexpected status code when reading metadata from %s: %s", metadataURL, resp.Status)
@@ -178,15 +228,23 @@ func GetDevicePath(volumeID string) string {
 		klog.V(4).Infof("Could not retrieve instance metadata. Error: %v", err)
 		return ""
 	}
+	return instanceMetadata.DevicePath(volumeID)
+}
+
+// globDiskPaths lists the disks matching a pattern, replaced in tests
+var globDiskPaths = filepath.Glob
 
-	for _, device := range instanceMetadata.Devices {
-		if device.Type == "disk" && device.Serial == volumeID {
+// DevicePath returns the /dev/disk/by-path path of the volume found in the
+// device metadata, "" if not found
+func (m *Metadata) DevicePath(volumeID string) string {
+	for _, device := range m.Devices {
+		if device.isVolume(volumeID) {
 			klog.V(4).Infof(
 				"Found disk metadata for volumeID %q. Bus: %q, Address: %q",
 				volumeID, device.Bus, device.Address)
 
 			diskPattern := fmt.Sprintf("/dev/disk/by-path/*-%s-%s", device.Bus, device.Address)
-			diskPaths, err := filepath.Glob(diskPattern)
+			diskPaths, err := globDiskPaths(diskPattern)
 			if err != nil {
 				klog.Errorf(
 					"could not retrieve disk path for volumeID: %q. Error filepath.Glob(%q): %v",
@@ -17,7 +17,12 @@ limitations under the License.
 package metadata
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -105,3 +110,104 @@ func TestParseMetadata(t *testing.T) {
 		t.Errorf("incorrect device serial: %s", md.Devices[0].Serial)
 	}
 }
+
+// Test the device of a volume is found by its serial, or by the tag of its
+// attachment on hypervisors not setting the serial
+func TestDevicePath(t *testing.T) {
+	md, err := parseMetadata(strings.NewReader(`
+{
+    "uuid": "83679162-1378-4288-a2d4-70e13ec132aa",
+    "devices": [
+        {
+            "bus": "scsi",
+            "serial": "6df1888b-f373-41cf-b960-3786e60a28ef",
+            "type": "disk",
+            "address": "0:0:0:0"
+        },
+        {
+            "bus": "scsi",
+            "serial": "",
+            "tags": ["3f6e9b1a-7c1e-4b8e-9d0a-2f3e4d5c6b7a"],
+            "type": "disk",
+            "address": "0:0:0:1"
+        },
+        {
+            "bus": "pci",
+            "tags": ["8a1f2e3d-4c5b-6a7f-8e9d-0c1b2a3f4e5d"],
+            "type": "nic",
+            "address": "0000:00:03.0"
+        }
+    ]
+}
+`))
+	if err != nil {
+		t.Fatalf("Should succeed when provided with valid data: %s", err)
+	}
+
+	oldGlob := globDiskPaths
+	defer func() { globDiskPaths = oldGlob }()
+	globDiskPaths = func(pattern string) ([]string, error) {
+		switch pattern {
+		case "/dev/disk/by-path/*-scsi-0:0:0:0":
+			return []string{"/dev/disk/by-path/pci-0000:00:05.0-scsi-0:0:0:0"}, nil
+		case "/dev/disk/by-path/*-scsi-0:0:0:1":
+			return []string{"/dev/disk/by-path/pci-0000:00:05.0-scsi-0:0:0:1"}, nil
+		}
+		return nil, nil
+	}
+
+	tests := []struct {
+		volumeID string
+		expected string
+	}{
+		{"6df1888b-f373-41cf-b960-3786e60a28ef", "/dev/disk/by-path/pci-0000:00:05.0-scsi-0:0:0:0"},
+		{"3f6e9b1a-7c1e-4b8e-9d0a-2f3e4d5c6b7a", "/dev/disk/by-path/pci-0000:00:05.0-scsi-0:0:0:1"},
+		// not a disk
+		{"8a1f2e3d-4c5b-6a7f-8e9d-0c1b2a3f4e5d", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		if devicePath := md.DevicePath(tt.volumeID); devicePath != tt.expected {
+			t.Errorf("expected the device of %s to be %q, got %q", tt.volumeID, tt.expected, devicePath)
+		}
+	}
+}
+
+// Test the requests to the metadata service reuse the connections of the
+// shared client
+func TestGetFromURLReusesConnections(t *testing.T) {
+	var mux sync.Mutex
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"uuid": "%s", "availability_zone": "nova"}`, FakeMetadata.UUID)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mux.Lock()
+			connections++
+			mux.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	transport := Client().Transport
+	for i := 0; i < 3; i++ {
+		md, err := getFromURL(server.URL + "/openstack/latest/meta_data.json")
+		if err != nil {
+			t.Fatalf("failed to get metadata: %v", err)
+		}
+		if md.UUID != FakeMetadata.UUID {
+			t.Errorf("incorrect uuid: %s", md.UUID)
+		}
+	}
+
+	if Client().Transport != transport {
+		t.Errorf("the transport of the metadata client changed")
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if connections != 1 {
+		t.Errorf("expecting 1 connection for 3 requests, found %d", connections)
+	}
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version holds the build information of the binaries, set at
+// build time through ldflags, e.g.
+// -X k8s.io/cloud-provider-openstack/pkg/version.Version=v1.15.0
+package version
+
+import "fmt"
+
+var (
+	// Version is the version of the build
+	Version = "dev"
+	// GitCommit is the git commit the build was made from
+	GitCommit = "dev"
+	// BuildDate is the date of the build
+	BuildDate = "dev"
+)
+
+// String returns the full build information
+func String() string {
+	return fmt.Sprintf("%s (commit: %s, build date: %s)", Version, GitCommit, BuildDate)
+}